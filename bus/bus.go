@@ -0,0 +1,199 @@
+// Package bus implements a 16-bit address bus that decodes reads and writes
+// to the memory and devices mapped into it. A Bus satisfies the
+// MemoryAccess interfaces of both cpu6502 and z80.
+package bus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadFunc handles a read from a device. A read with peek set must not have
+// any side effects.
+type ReadFunc func(address uint16, peek bool) byte
+
+// WriteFunc handles a write to a device.
+type WriteFunc func(address uint16, value byte)
+
+// Region maps the addresses Start-End (inclusive) to a device.
+//
+// Mask, if non-zero, is ANDed with the offset from Start so a smaller device
+// is mirrored across the whole range (e.g. 2K of RAM in an 8K range has a
+// mask of $07FF). Read and Write are called with the address after
+// mirroring.
+//
+// Reads call Read if it's set and otherwise return the byte of Mem at the
+// offset. Writes call Write if it's set and otherwise store into Mem unless
+// ReadOnly is set. Reads with neither Read nor Mem return the open bus value
+// and writes with nowhere to go are ignored.
+type Region struct {
+	Name     string
+	Start    uint16
+	End      uint16
+	Mask     uint16
+	Mem      []byte
+	ReadOnly bool
+	Read     ReadFunc
+	Write    WriteFunc
+}
+
+func (r *Region) offset(address uint16) uint16 {
+	offset := address - r.Start
+	if r.Mask != 0 {
+		offset &= r.Mask
+	}
+	return offset
+}
+
+func (r *Region) String() string {
+	s := fmt.Sprintf("$%04X-$%04X  %s", r.Start, r.End, r.Name)
+	if r.Mask != 0 && r.Mask < r.End-r.Start {
+		s += fmt.Sprintf(" (mirrored every $%04X)", uint32(r.Mask)+1)
+	}
+	if r.Mem != nil && r.ReadOnly && r.Write == nil {
+		s += " read only"
+	}
+	return s
+}
+
+// Bus dispatches reads and writes to the regions mapped into it.
+type Bus struct {
+	// OpenBus is returned by reads of unmapped addresses
+	OpenBus byte
+
+	regions []*Region      // in address order
+	pages   [256][]*Region // regions overlapping each 256 byte page
+}
+
+// New returns an empty bus whose unmapped reads return openBus.
+func New(openBus byte) *Bus {
+	return &Bus{OpenBus: openBus}
+}
+
+// Map adds a region to the bus. It returns an error if the region overlaps
+// one that's already mapped or Mem is too short to back it.
+func (b *Bus) Map(r Region) (*Region, error) {
+	if r.End < r.Start {
+		return nil, fmt.Errorf("bus: %s range $%04X-$%04X is backwards", r.Name, r.Start, r.End)
+	}
+	if r.Mem != nil {
+		size := int(r.End-r.Start) + 1
+		if r.Mask != 0 && int(r.Mask)+1 < size {
+			size = int(r.Mask) + 1
+		}
+		if len(r.Mem) < size {
+			return nil, fmt.Errorf("bus: %s needs %d bytes of memory but has %d", r.Name, size, len(r.Mem))
+		}
+	}
+	i := 0
+	for ; i < len(b.regions); i++ {
+		o := b.regions[i]
+		if r.Start <= o.End && r.End >= o.Start {
+			return nil, fmt.Errorf("bus: %s $%04X-$%04X overlaps %s", r.Name, r.Start, r.End, o)
+		}
+		if o.Start > r.End {
+			break
+		}
+	}
+	region := &r
+	b.regions = append(b.regions, nil)
+	copy(b.regions[i+1:], b.regions[i:])
+	b.regions[i] = region
+	for p := int(r.Start >> 8); p <= int(r.End>>8); p++ {
+		b.pages[p] = append(b.pages[p], region)
+	}
+	return region, nil
+}
+
+// MapMemory maps mem (mirrored if it's shorter than the range) to
+// start-end. Writes are ignored unless writable is set.
+func (b *Bus) MapMemory(name string, start, end uint16, mem []byte, writable bool) (*Region, error) {
+	r := Region{Name: name, Start: start, End: end, Mem: mem, ReadOnly: !writable}
+	if len(mem) > 0 && len(mem) < int(end-start)+1 {
+		if len(mem)&(len(mem)-1) != 0 {
+			return nil, fmt.Errorf("bus: %s memory length %d can't be mirrored", name, len(mem))
+		}
+		r.Mask = uint16(len(mem) - 1)
+	}
+	return b.Map(r)
+}
+
+// MapDevice maps read and write handlers to start-end. mask is as for
+// Region.
+func (b *Bus) MapDevice(name string, start, end, mask uint16, read ReadFunc, write WriteFunc) (*Region, error) {
+	return b.Map(Region{Name: name, Start: start, End: end, Mask: mask, Read: read, Write: write})
+}
+
+// Region returns the region that address is mapped to or nil.
+func (b *Bus) Region(address uint16) *Region {
+	for _, r := range b.pages[address>>8] {
+		if address >= r.Start && address <= r.End {
+			return r
+		}
+	}
+	return nil
+}
+
+// Regions returns the mapped regions in address order.
+func (b *Bus) Regions() []*Region {
+	return b.regions
+}
+
+func (b *Bus) ReadByte(address uint16, peek bool) byte {
+	r := b.Region(address)
+	if r == nil {
+		return b.OpenBus
+	}
+	offset := r.offset(address)
+	if r.Read != nil {
+		return r.Read(r.Start+offset, peek)
+	}
+	if r.Mem != nil {
+		return r.Mem[offset]
+	}
+	return b.OpenBus
+}
+
+func (b *Bus) WriteByte(address uint16, value byte) {
+	r := b.Region(address)
+	if r == nil {
+		return
+	}
+	offset := r.offset(address)
+	if r.Write != nil {
+		r.Write(r.Start+offset, value)
+	} else if r.Mem != nil && !r.ReadOnly {
+		r.Mem[offset] = value
+	}
+}
+
+// WriteMemoryMap writes a line per region, including the unmapped gaps.
+func (b *Bus) WriteMemoryMap(w io.Writer) error {
+	next := 0
+	gap := func(end int) error {
+		if next >= end {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "$%04X-$%04X  unmapped (open bus $%02X)\n", next, end-1, b.OpenBus)
+		return err
+	}
+	for _, r := range b.regions {
+		if err := gap(int(r.Start)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, r); err != nil {
+			return err
+		}
+		next = int(r.End) + 1
+	}
+	return gap(0x10000)
+}
+
+// MemoryMap returns the memory map as written by WriteMemoryMap.
+func (b *Bus) MemoryMap() string {
+	var buf bytes.Buffer
+	b.WriteMemoryMap(&buf)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
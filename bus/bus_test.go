@@ -0,0 +1,75 @@
+package bus
+
+import (
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	b := New(0xaa)
+	ram := make([]byte, 0x800)
+	rom := make([]byte, 0x4000)
+	rom[0x0010] = 0x42
+	var regs [8]byte
+	var reads, writes []uint16
+	if _, err := b.MapMemory("RAM", 0x0000, 0x1fff, ram, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.MapDevice("REGS", 0x2000, 0x3fff, 0x0007,
+		func(address uint16, peek bool) byte {
+			if !peek {
+				reads = append(reads, address)
+			}
+			return regs[address-0x2000]
+		},
+		func(address uint16, value byte) {
+			writes = append(writes, address)
+			regs[address-0x2000] = value
+		}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.MapMemory("ROM", 0x8000, 0xffff, rom, false); err != nil {
+		t.Fatal(err)
+	}
+
+	b.WriteByte(0x0801, 0x12)
+	if ram[0x0001] != 0x12 || b.ReadByte(0x1801, false) != 0x12 {
+		t.Errorf("RAM isn't mirrored")
+	}
+	b.WriteByte(0x3ffb, 0x34)
+	if regs[3] != 0x34 || b.ReadByte(0x2003, false) != 0x34 {
+		t.Errorf("registers aren't mirrored")
+	}
+	if len(writes) != 1 || writes[0] != 0x2003 || len(reads) != 1 || reads[0] != 0x2003 {
+		t.Errorf("device saw reads %x and writes %x, expected 2003", reads, writes)
+	}
+	b.ReadByte(0x2003, true)
+	if len(reads) != 1 {
+		t.Errorf("peek wasn't passed to the device")
+	}
+	b.WriteByte(0xc010, 0x99)
+	if rom[0x0010] != 0x42 || b.ReadByte(0xc010, false) != 0x42 {
+		t.Errorf("ROM was written or isn't mirrored")
+	}
+	b.WriteByte(0x5000, 0x99)
+	if v := b.ReadByte(0x5000, false); v != 0xaa {
+		t.Errorf("unmapped read returned $%02X, expected the open bus $AA", v)
+	}
+
+	if _, err := b.MapMemory("overlap", 0x3f00, 0x40ff, make([]byte, 0x200), true); err == nil {
+		t.Errorf("overlapping region was mapped")
+	}
+	if _, err := b.MapMemory("short", 0x4000, 0x4fff, make([]byte, 0x300), true); err == nil {
+		t.Errorf("memory that can't be mirrored was mapped")
+	}
+	if _, err := b.Map(Region{Name: "short", Start: 0x4000, End: 0x40ff, Mem: make([]byte, 0x80)}); err == nil {
+		t.Errorf("memory too short for the region was mapped")
+	}
+
+	expected := `$0000-$1FFF  RAM (mirrored every $0800)
+$2000-$3FFF  REGS (mirrored every $0008)
+$4000-$7FFF  unmapped (open bus $AA)
+$8000-$FFFF  ROM (mirrored every $4000) read only`
+	if m := b.MemoryMap(); m != expected {
+		t.Errorf("memory map\n%s\nexpected\n%s", m, expected)
+	}
+}
@@ -2,7 +2,6 @@ package cpu6502
 
 import (
 	"fmt"
-	"os"
 )
 
 const (
@@ -44,18 +43,94 @@ type CPU6502 struct {
 
 	Cycles uint64
 
-	NMICounter int // steps till NMI
+	// ValidateCycles enables a self-check of the cycles used by each
+	// instruction against the opcode table. Step returns ErrCycleMismatch
+	// when they disagree.
+	ValidateCycles bool
+
+	// Magic constants ORed into A by the unstable XAA and ATX opcodes. The
+	// value varies between chips (and with temperature); 0xEE is the most
+	// commonly observed.
+	XAAMagic byte
+	ATXMagic byte
+
+	// Tick, if set, is called at the start of every bus cycle before the
+	// read or write happens. Every cycle of the 6502 accesses the bus so
+	// this lets the host system run its other chips in lock step with the
+	// CPU (cycle-stepped execution) rather than catching up after each
+	// instruction.
+	Tick func()
+
+	// Tracer, if set, is called before each instruction is executed.
+	Tracer Tracer
+
+	// AccessLogger, if set, is told which bytes are read as code and data.
+	AccessLogger AccessLogger
+
+	// Profiler, if set, records the cycles used at each address.
+	Profiler *Profiler
+
+	// Symbols, if set, names addresses in traces and breakpoint conditions.
+	Symbols Symbols
+
+	busCycles    int     // bus cycles used by the current instruction
+	jammed       bool    // KIL (or STP on the 65C02) was executed
+	indirectJump bool    // the next instruction was reached through JMP (ind)
+	calls        []Frame // shadow call stack (see CallStack)
+	waiting      bool    // WAI is waiting for an interrupt
+
+	irq uint32 // asserted IRQ sources (the line is the OR of all of them)
+	nmi bool   // level of the NMI line
+	interruptState
+
+	halt     int       // cycles to halt for before the next read (see Halt)
+	haltFunc func(int) // called for each halted cycle
+	halted   int       // cycles the current instruction was halted for
+
+	variant  Variant
+	port     *IOPort6510 // 6510 only
+	opcodes  *[256]OpcodeSpec
+	handlers *[256]instructionHandler // indexed by opcode
+	op       operand                  // operand of the current instruction
+
+	// Pages mapped with MapPages are read and written directly instead of
+	// through memory.
+	readPages  [256][]byte
+	writePages [256][]byte
+
+	breakpoints []*Breakpoint
+	nextBreakID int
+	breakKinds  BreakKind      // kinds of the enabled breakpoints
+	breakHit    *BreakpointHit // read or write breakpoint hit by this instruction
+	resuming    bool           // skip the execution breakpoint at resumePC
+	resumePC    uint16
 
 	memory MemoryAccess
 }
 
+// NewCPU6502 returns an NMOS 6502.
 func NewCPU6502(memory MemoryAccess) *CPU6502 {
+	return NewCPU6502Variant(memory, VariantNMOS)
+}
+
+// NewCPU6502Variant returns a CPU emulating the given member of the 6502
+// family. The 6510's I/O port is put in front of memory (see IOPort).
+func NewCPU6502Variant(memory MemoryAccess, variant Variant) *CPU6502 {
 	cpu := &CPU6502{
-		memory: memory,
-		SP:     0xFD,
+		variant:  variant,
+		opcodes:  variant.Opcodes(),
+		handlers: variant.handlers(),
+		memory:   memory,
+		SP:       0xFD,
+		XAAMagic: 0xEE,
+		ATXMagic: 0xEE,
 		// P: 0x34, 24?
 		InterruptsDisabledFlag: true}
 	// SoftwareInterruptFlag: true}
+	if variant == Variant6510 {
+		cpu.port = newIOPort6510(memory, cpu)
+		cpu.memory = cpu.port
+	}
 	return cpu
 }
 
@@ -153,18 +228,29 @@ func (cpu *CPU6502) ReadUI16(address uint16, peek bool) uint16 {
 		(uint16(cpu.memory.ReadByte((address+1)&0xff+(address&0xff00), peek)) << 8)
 }
 
+// Peek reads a byte without side effects
+func (cpu *CPU6502) Peek(address uint16) byte {
+	return cpu.memory.ReadByte(address, true)
+}
+
+// PeekRange reads n bytes starting at address without side effects
+func (cpu *CPU6502) PeekRange(address uint16, n int) []byte {
+	return PeekRange(cpu.memory, address, n)
+}
+
+// ReadOpcode decodes the instruction at PC without side effects
 func (cpu *CPU6502) ReadOpcode() (OpcodeSpec, uint16) {
-	return ReadOpcode(cpu.memory, cpu.PC)
+	return ReadOpcode(cpu.memory, cpu.variant, cpu.PC)
 }
 
 func (cpu *CPU6502) PushByte(value byte) {
-	cpu.memory.WriteByte(0x100+uint16(cpu.SP), value)
+	cpu.write(0x100+uint16(cpu.SP), value)
 	cpu.SP--
 }
 
 func (cpu *CPU6502) PopByte() byte {
 	cpu.SP++
-	return cpu.memory.ReadByte(0x100+uint16(cpu.SP), false)
+	return cpu.read(0x100 + uint16(cpu.SP))
 }
 
 func (cpu *CPU6502) PushAddress(addr uint16) {
@@ -176,517 +262,586 @@ func (cpu *CPU6502) PopAddress() uint16 {
 	return uint16(cpu.PopByte()) | (uint16(cpu.PopByte()) << 8)
 }
 
+// SetIRQ asserts or releases the IRQ line on behalf of a source. Sources are
+// bit masks chosen by the host system so that several devices can hold the
+// level-triggered line independently. The line is asserted while any source
+// holds it.
+func (cpu *CPU6502) SetIRQ(source uint32, asserted bool) {
+	if asserted {
+		cpu.irq |= source
+	} else {
+		cpu.irq &^= source
+	}
+}
+
+// IRQ returns true if any source is currently asserting the IRQ line.
+func (cpu *CPU6502) IRQ() bool {
+	return cpu.irq != 0
+}
+
+// SetNMI sets the level of the NMI line. NMI is edge triggered so asserting
+// the line requests a single interrupt, which is taken even if the line is
+// released again before the CPU polls it.
+func (cpu *CPU6502) SetNMI(asserted bool) {
+	if asserted && !cpu.nmi {
+		cpu.nmiEdge = true
+	}
+	cpu.nmi = asserted
+}
+
+// NMI returns true if the NMI line is asserted.
+func (cpu *CPU6502) NMI() bool {
+	return cpu.nmi
+}
+
+// interruptState is where the CPU is in noticing interrupts. The lines are
+// polled at the end of every bus cycle and an instruction is followed by an
+// interrupt if one was seen by the poll of its second-to-last cycle.
+type interruptState struct {
+	nmiEdge              bool // the NMI line was asserted since the last poll
+	needNMI, prevNeedNMI bool // an NMI was detected by the last and the previous poll
+	runIRQ, prevRunIRQ   bool // IRQ was asserted and unmasked at the last and the previous poll
+	pending              bool // the interrupt sequence runs before the next instruction
+}
+
+// poll samples the interrupt lines at the end of a bus cycle.
+func (cpu *CPU6502) poll() {
+	cpu.prevRunIRQ = cpu.runIRQ
+	cpu.runIRQ = cpu.irq != 0 && !cpu.InterruptsDisabledFlag
+	cpu.prevNeedNMI = cpu.needNMI
+	if cpu.nmiEdge {
+		cpu.needNMI = true
+		cpu.nmiEdge = false
+	}
+}
+
+// interruptVector returns the vector used by BRK and IRQ. An NMI detected
+// by the time they push P hijacks them to the NMI vector and is cleared.
+func (cpu *CPU6502) interruptVector() uint16 {
+	if cpu.needNMI {
+		cpu.needNMI = false
+		return IV_NMI
+	}
+	return IV_IRQ
+}
+
+// Halt stops the CPU for n cycles before its next read, as pulling RDY low
+// does, so another device (e.g. a DMA controller) can use the bus. fn is
+// called with the index of each of those cycles after Tick. Interrupts are
+// still polled and the cycles count towards the instruction or interrupt
+// sequence that was halted.
+func (cpu *CPU6502) Halt(n int, fn func(cycle int)) {
+	cpu.halt, cpu.haltFunc = n, fn
+}
+
+// BusCycle returns the number of the bus cycle in progress: Cycles plus the
+// cycles of the current instruction so far.
+func (cpu *CPU6502) BusCycle() uint64 {
+	return cpu.Cycles + uint64(cpu.busCycles)
+}
+
+// runHalt runs the cycles requested by Halt.
+func (cpu *CPU6502) runHalt() {
+	n, fn := cpu.halt, cpu.haltFunc
+	cpu.halt, cpu.haltFunc = 0, nil
+	for i := 0; i < n; i++ {
+		if cpu.Tick != nil {
+			cpu.Tick()
+		}
+		cpu.busCycles++
+		cpu.halted++
+		fn(i)
+		cpu.poll()
+	}
+}
+
+// read performs a single bus cycle reading from memory.
+func (cpu *CPU6502) read(address uint16) byte {
+	if cpu.halt != 0 {
+		cpu.runHalt()
+	}
+	if cpu.Tick != nil {
+		cpu.Tick()
+	}
+	cpu.busCycles++
+	var value byte
+	if page := cpu.readPages[address>>8]; page != nil {
+		value = page[address&0xff]
+	} else {
+		value = cpu.memory.ReadByte(address, false)
+	}
+	if cpu.breakKinds&BreakRead != 0 {
+		cpu.watch(BreakRead, address, value)
+	}
+	cpu.poll()
+	return value
+}
+
+// write performs a single bus cycle writing to memory.
+func (cpu *CPU6502) write(address uint16, value byte) {
+	if cpu.Tick != nil {
+		cpu.Tick()
+	}
+	cpu.busCycles++
+	if cpu.breakKinds&BreakWrite != 0 {
+		cpu.watch(BreakWrite, address, value)
+	}
+	if page := cpu.writePages[address>>8]; page != nil {
+		page[address&0xff] = value
+	} else {
+		cpu.memory.WriteByte(address, value)
+	}
+	cpu.poll()
+}
+
+// MapPages maps the 256 byte pages first through last to mem so that Step
+// reads them (and writes them if writable) directly rather than through the
+// MemoryAccess. This is a fast path for RAM and ROM; anything with side
+// effects (I/O registers, bank switching) must be left unmapped. mem must be
+// a multiple of 256 bytes long and is mirrored if it's shorter than the
+// range. The MemoryAccess must still see the same memory since peeks and the
+// rest of the system use it.
+func (cpu *CPU6502) MapPages(first, last byte, mem []byte, writable bool) {
+	if len(mem) == 0 || len(mem)%256 != 0 {
+		panic(fmt.Sprintf("cpu6502: MapPages memory length %d isn't a multiple of 256", len(mem)))
+	}
+	if first == 0 && cpu.port != nil {
+		panic("cpu6502: MapPages can't map page 0 in front of the 6510's I/O port")
+	}
+	for p := int(first); p <= int(last); p++ {
+		offset := ((p - int(first)) * 256) % len(mem)
+		page := mem[offset : offset+256 : offset+256]
+		cpu.readPages[p] = page
+		if writable {
+			cpu.writePages[p] = page
+		} else {
+			cpu.writePages[p] = nil
+		}
+	}
+}
+
+// UnmapPages returns the pages first through last to the MemoryAccess.
+func (cpu *CPU6502) UnmapPages(first, last byte) {
+	for p := int(first); p <= int(last); p++ {
+		cpu.readPages[p] = nil
+		cpu.writePages[p] = nil
+	}
+}
+
+// interrupt runs the interrupt sequence for a pending NMI or IRQ. It pushes
+// PC and P (with B clear) and jumps through the NMI vector if an NMI has
+// been detected by then, even if the sequence started for an IRQ, or else
+// the IRQ vector.
+func (cpu *CPU6502) interrupt() int {
+	pc := cpu.PC
+	cpu.busCycles = 0
+	cpu.pending = false
+	cpu.read(cpu.PC) // dummy reads while the opcode is replaced with BRK
+	cpu.read(cpu.PC)
+	cpu.PushAddress(cpu.PC)
+	vector := cpu.interruptVector()
+	cpu.PushByte(cpu.GetP() &^ FLAG_B)
+	cpu.InterruptsDisabledFlag = true
+	if cpu.variant.cmos() {
+		cpu.DecimalFlag = false
+	}
+	cpu.PC = cpu.readVector(vector)
+	cpu.Cycles += uint64(cpu.busCycles)
+	kind := CallIRQ
+	if vector == IV_NMI {
+		kind = CallNMI
+	}
+	cpu.pushCall(kind, pc, pc)
+	if cpu.Profiler != nil {
+		cpu.Profiler.interrupt(cpu, cpu.busCycles)
+	}
+	return cpu.busCycles
+}
+
+// PowerOn puts the CPU in its power on state (registers cleared) and runs the
+// reset sequence. It returns the number of cycles used.
+func (cpu *CPU6502) PowerOn() int {
+	cpu.A, cpu.X, cpu.Y = 0, 0, 0
+	cpu.SP = 0
+	cpu.SetP(0)
+	cpu.Cycles = 0
+	if cpu.port != nil {
+		cpu.port.latch = 0
+	}
+	return cpu.Reset()
+}
+
+// Reset runs the 7 cycle reset sequence. It's an interrupt with the stack
+// writes turned into reads so SP is decremented by 3 without changing
+// memory. I is set and PC is loaded from the reset vector. A, X, Y and the
+// other flags are unchanged. The 6510's I/O port bits become inputs. It
+// returns the number of cycles used.
+func (cpu *CPU6502) Reset() int {
+	if cpu.port != nil {
+		cpu.port.reset()
+	}
+	cpu.jammed = false
+	cpu.waiting = false
+	cpu.calls = cpu.calls[:0]
+	cpu.busCycles = 0
+	cpu.read(cpu.PC)
+	cpu.read(cpu.PC)
+	for i := 0; i < 3; i++ {
+		cpu.read(0x100 + uint16(cpu.SP))
+		cpu.SP--
+	}
+	cpu.InterruptsDisabledFlag = true
+	if cpu.variant.cmos() {
+		cpu.DecimalFlag = false
+	}
+	cpu.PC = cpu.readVector(IV_RESET)
+	cpu.interruptState = interruptState{}
+	cpu.Cycles += uint64(cpu.busCycles)
+	return cpu.busCycles
+}
+
+// illegalOpcode rewinds PC to the start of the instruction at pc and returns
+// an ErrIllegalOpcode error for it.
+func (cpu *CPU6502) illegalOpcode(pc uint16, opcode OpcodeSpec, detail string) error {
+	cpu.PC = pc
+	return &CPUError{
+		Err:    ErrIllegalOpcode,
+		PC:     pc,
+		Opcode: byte(opcode.Opcode),
+		State:  cpu.Registers(),
+		Detail: detail}
+}
+
+// Jammed returns true if the CPU has executed a KIL instruction (or STP on
+// the 65C02). A jammed CPU won't execute any more instructions until it's
+// reset.
+func (cpu *CPU6502) Jammed() bool {
+	return cpu.jammed
+}
+
+// Variant returns which member of the 6502 family the CPU emulates.
+func (cpu *CPU6502) Variant() Variant {
+	return cpu.variant
+}
+
+// decimal returns true if ADC and SBC should use BCD arithmetic.
+func (cpu *CPU6502) decimal() bool {
+	return cpu.DecimalFlag && cpu.variant != Variant2A03
+}
+
+// decimalFlags sets N and Z from the BCD result of a 65C02 ADC or SBC which
+// takes an extra cycle (rereading the operand) to do so. It returns the
+// number of extra cycles.
+func (cpu *CPU6502) decimalFlags(addr uint16) int {
+	cpu.read(addr)
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return 1
+}
+
+// storeHigh implements the store of the unstable SHA/SHX/SHY/TAS opcodes. The
+// value is ANDed with the high byte of the base address plus one, and when
+// indexing crosses a page that value also replaces the high byte of the
+// target address.
+func (cpu *CPU6502) storeHigh(addr uint16, index byte, value byte) {
+	base := addr - uint16(index)
+	value &= byte(base>>8) + 1
+	if base&0xff00 != addr&0xff00 {
+		addr = uint16(value)<<8 | addr&0x00ff
+	}
+	cpu.write(addr, value)
+}
+
+// Step executes one instruction (or takes a pending interrupt) and returns
+// the number of cycles used. A *BreakpointHit error is returned when a
+// breakpoint is hit.
 func (cpu *CPU6502) Step() (int, error) {
-	if cpu.NMICounter > 0 {
-		cpu.NMICounter--
-		if cpu.NMICounter == 0 {
-			cpu.PushAddress(cpu.PC)
-			cpu.SoftwareInterruptFlag = false
-			cpu.PushByte(cpu.GetP())
-			cpu.PC = cpu.ReadUI16(IV_NMI, false)
-			cpu.Cycles += uint64(5)
-			return 5, nil
+	cpu.breakHit = nil
+	cycles, err := cpu.step()
+	if hit := cpu.breakHit; hit != nil && err == nil {
+		hit.State = cpu.Registers()
+		err = hit
+	}
+	if e, ok := err.(*CPUError); ok {
+		e.Backtrace = cpu.Backtrace()
+		e.Backtrace.PC = e.PC
+		e.symbols = cpu.Symbols
+	}
+	return cycles, err
+}
+
+func (cpu *CPU6502) step() (int, error) {
+	if cpu.jammed {
+		return 0, &CPUError{
+			Err:    ErrCPUJammed,
+			PC:     cpu.PC - 1,
+			Opcode: cpu.memory.ReadByte(cpu.PC-1, true),
+			State:  cpu.Registers()}
+	}
+	if cpu.waiting {
+		// WAI resumes when the IRQ line is asserted even if interrupts
+		// are disabled (in which case execution simply continues), or on
+		// an NMI.
+		if cpu.irq == 0 && !cpu.needNMI && !cpu.nmiEdge {
+			cpu.busCycles = 0
+			cpu.read(cpu.PC)
+			cpu.Cycles++
+			if cpu.Profiler != nil {
+				cpu.Profiler.wait(cpu)
+			}
+			return 1, nil
 		}
+		cpu.waiting = false
+		cpu.pending = cpu.needNMI || cpu.nmiEdge || !cpu.InterruptsDisabledFlag
+	}
+	if cpu.pending {
+		return cpu.interrupt(), nil
 	}
 
-	opcode, opval := cpu.ReadOpcode()
-	cpu.PC += uint16(opcode.Size)
+	if cpu.breakKinds&BreakExec != 0 {
+		if cpu.resuming && cpu.resumePC == cpu.PC {
+			cpu.resuming = false
+		} else if hit := cpu.checkBreakpoints(BreakExec, cpu.PC, cpu.memory.ReadByte(cpu.PC, true)); hit != nil {
+			cpu.resuming, cpu.resumePC = true, cpu.PC
+			return 0, hit
+		}
+	}
 
-	var addr uint16
-	var value byte
-	var cycles int = opcode.Cycles
-	if cycles < 0 {
-		cycles = -cycles
+	if cpu.Tracer != nil {
+		cpu.Tracer.Trace(cpu)
 	}
-	cycles2 := opcode.Size
-	if cycles2 < 2 {
-		cycles2 = 2
+
+	pc := cpu.PC
+	cpu.busCycles = 0
+	cpu.halted = 0
+	opcode := cpu.opcodes[cpu.read(pc)]
+	cpu.PC++
+	if cpu.AccessLogger != nil {
+		cpu.logCode(pc, opcode)
+	}
+
+	var state Registers
+	if cpu.ValidateCycles {
+		state = cpu.Registers()
+		state.PC = pc
 	}
+
+	// Every cycle of the 6502 is a bus cycle, so the addressing modes below
+	// perform each of the reads (including the dummy ones) that the real
+	// CPU does in order. This lets the Tick hook observe every cycle.
+	var addr uint16
+	var value byte
+	var crossed bool // indexing crossed a page
+	inst := opcode.Instruction
+	cmos := cpu.variant.cmos()
 	switch opcode.AddressingMode {
 	default:
-		panic(fmt.Sprintf("Unhandled addresing mode %d", opcode.AddressingMode))
+		return 0, cpu.illegalOpcode(pc, opcode, fmt.Sprintf("unhandled addressing mode %d", opcode.AddressingMode))
 	case AMImplied:
-		// do nothing
+		if opcode.Cycles != 1 { // 65C02 single cycle NOPs
+			cpu.read(cpu.PC) // dummy read of the next byte
+		}
 	case AMAccumulator:
-		// do nothing
+		cpu.read(cpu.PC) // dummy read of the next byte
 		value = cpu.A
 	case AMImmediate:
-		// do nothing
-		value = byte(opval)
-	case AMAbsolute, AMZeroPage:
-		addr = opval
-		if opcode.Instruction.Read {
-			cycles2++
-			value = cpu.memory.ReadByte(addr, false)
-			if opcode.Instruction.Write {
-				// For read-modify-write instructions the value gets written twice
-				cpu.memory.WriteByte(addr, value)
-				cycles2 += 2
-			}
-		} else if opcode.Instruction.Write {
-			cycles2++
-		}
+		addr = cpu.PC
+		value = cpu.read(cpu.PC)
+		cpu.PC++
+	case AMZeroPage:
+		addr = uint16(cpu.read(cpu.PC))
+		cpu.PC++
 	case AMZeroPageX, AMZeroPageY:
-		cpu.memory.ReadByte(opval, false) // dummy read
+		base := cpu.read(cpu.PC)
+		cpu.PC++
+		cpu.read(uint16(base)) // dummy read while adding the index
 		if opcode.AddressingMode == AMZeroPageX {
-			addr = (opval + uint16(cpu.X)) & 0x00ff
+			addr = uint16(base + cpu.X)
 		} else {
-			addr = (opval + uint16(cpu.Y)) & 0x00ff
-		}
-		cycles2 += 2
-		if opcode.Instruction.Read {
-			value = cpu.memory.ReadByte(addr, false)
-			if opcode.Instruction.Write {
-				// For read-modify-write instructions the value gets written twice
-				cpu.memory.WriteByte(addr, value)
-				cycles2 += 2
-			}
-		}
+			addr = uint16(base + cpu.Y)
+		}
+	case AMAbsolute:
+		addr = uint16(cpu.read(cpu.PC))
+		cpu.PC++
+		if inst.Num == I_JSR.Num {
+			// JSR fetches the high byte of the address after pushing
+			// the return address so it's handled by the instruction.
+			break
+		}
+		addr |= uint16(cpu.read(cpu.PC)) << 8
+		cpu.PC++
 	case AMAbsoluteX, AMAbsoluteY, AMIndirectY:
-		addrt := opval
-		switch {
-		case opcode.AddressingMode == AMAbsoluteX:
-			addr = addrt + uint16(cpu.X)
-		case opcode.AddressingMode == AMAbsoluteY:
-			addr = addrt + uint16(cpu.Y)
-		default:
-			addrt = cpu.ReadUI16(opval, false)
-			addr = addrt + uint16(cpu.Y)
-			cycles2 += 2
+		var base uint16
+		if opcode.AddressingMode == AMIndirectY {
+			ptr := cpu.read(cpu.PC)
+			cpu.PC++
+			base = uint16(cpu.read(uint16(ptr)))
+			base |= uint16(cpu.read(uint16(ptr+1))) << 8
+		} else {
+			base = uint16(cpu.read(cpu.PC))
+			cpu.PC++
+			base |= uint16(cpu.read(cpu.PC)) << 8
+			cpu.PC++
 		}
-		value = cpu.memory.ReadByte(addrt&0xff00|addr&0x00ff, false)
-		cycles2++
-		if opcode.Instruction.Read {
-			if opcode.Instruction.Write {
-				// For read-modify-write instructions the value gets written twice
-				value = cpu.memory.ReadByte(addr, false)
-				cpu.memory.WriteByte(addr, value)
-				cycles2 += 3
-			} else if addr&0xff00 != addrt&0xff00 {
-				value = cpu.memory.ReadByte(addr, false)
-				cycles++
-				cycles2++
-			}
-		} else if opcode.Instruction.Write {
-			cycles2++
+		if opcode.AddressingMode == AMAbsoluteX {
+			addr = base + uint16(cpu.X)
+		} else {
+			addr = base + uint16(cpu.Y)
+		}
+		crossed = base&0xff00 != addr&0xff00
+		// The first read happens before the carry into the high byte is
+		// applied. Reads that didn't cross a page can use it directly,
+		// everything else has to read again from the fixed address.
+		// The 65C02 doesn't need the extra cycle for shifts and rotates
+		// that don't cross a page and rereads the last operand byte
+		// instead of the unfixed address.
+		fix := crossed || inst.Write || !inst.Read
+		if cmos && !crossed && opcode.Cycles < 0 {
+			fix = false
+		}
+		if fix && cmos && crossed {
+			cpu.read(cpu.PC - 1)
+		} else if fix {
+			cpu.read(base&0xff00 | addr&0x00ff)
 		}
 	case AMRelative:
-		addr = cpu.PC + uint16(int8(opval))
+		offset := cpu.read(cpu.PC)
+		cpu.PC++
+		addr = cpu.PC + uint16(int8(offset))
 	case AMIndirectX:
-		cpu.memory.ReadByte(opval, false) // dummy read
-		addr = uint16(byte(opval) + cpu.X)
-		addr = cpu.ReadUI16(addr, false)
-		cycles2 += 4
-		if opcode.Instruction.Read {
-			value = cpu.memory.ReadByte(addr, false)
-			if opcode.Instruction.Write {
-				// For read-modify-write instructions the value gets written twice
-				cpu.memory.WriteByte(addr, value)
-				cycles2 += 2
-			}
-		}
+		ptr := cpu.read(cpu.PC)
+		cpu.PC++
+		cpu.read(uint16(ptr)) // dummy read while adding X
+		ptr += cpu.X
+		addr = uint16(cpu.read(uint16(ptr)))
+		addr |= uint16(cpu.read(uint16(ptr+1))) << 8
 	case AMIndirect:
-		addr = cpu.ReadUI16(opval, false)
-		cycles2 += 2
+		ptr := uint16(cpu.read(cpu.PC))
+		cpu.PC++
+		ptr |= uint16(cpu.read(cpu.PC)) << 8
+		cpu.PC++
+		if cmos {
+			// The 65C02 fixed the page wrap bug at the cost of a cycle
+			cpu.read(cpu.PC - 1)
+			addr = uint16(cpu.read(ptr))
+			addr |= uint16(cpu.read(ptr+1)) << 8
+			break
+		}
+		// There's a bug in the 6502 where Indirect addressing doesn't advance pages
+		// 02ff -> bytes 02ff & 0200 rather than 02ff 0300
+		addr = uint16(cpu.read(ptr))
+		addr |= uint16(cpu.read(ptr&0xff00|(ptr+1)&0x00ff)) << 8
+	case AMZeroPageIndirect:
+		ptr := cpu.read(cpu.PC)
+		cpu.PC++
+		addr = uint16(cpu.read(uint16(ptr)))
+		addr |= uint16(cpu.read(uint16(ptr+1))) << 8
+	case AMAbsoluteIndirectX:
+		ptr := uint16(cpu.read(cpu.PC))
+		cpu.PC++
+		ptr |= uint16(cpu.read(cpu.PC)) << 8
+		cpu.read(cpu.PC) // dummy read while adding X
+		cpu.PC++
+		ptr += uint16(cpu.X)
+		addr = uint16(cpu.read(ptr))
+		addr |= uint16(cpu.read(ptr+1)) << 8
+	case AMZeroPageRelative:
+		zp := uint16(cpu.read(cpu.PC))
+		cpu.PC++
+		offset := cpu.read(cpu.PC)
+		cpu.PC++
+		value = cpu.read(zp)
+		cpu.read(zp) // dummy read while testing the bit
+		addr = cpu.PC + uint16(int8(offset))
 	}
 
-	jump := false // jump to 'addr' and account for clock
-
-	switch opcode.Instruction.Num {
-	default:
-		panic("Unhandled opcode " + opcode.Instruction.Name)
-	case I_AAX.Num: // undocumented
-		value = cpu.X & cpu.A
-		cpu.memory.WriteByte(addr, value)
-	case I_ADC.Num:
-		res := uint16(value) + uint16(cpu.A)
-		if cpu.CarryFlag {
-			res++
-		}
-		cpu.ZeroFlag = (res & 0xff) == 0
-		if cpu.DecimalFlag {
-			if (cpu.A^value^byte(res))&0x10 == 0x10 {
-				res += 6
-			}
-			if res&0xf0 > 0x90 {
-				res += 0x60
+	switch opcode.AddressingMode {
+	case AMZeroPage, AMZeroPageX, AMZeroPageY, AMAbsolute, AMAbsoluteX, AMAbsoluteY, AMIndirectX, AMIndirectY, AMZeroPageIndirect:
+		if inst.Read {
+			value = cpu.read(addr)
+			if inst.Write {
+				// For read-modify-write instructions the NMOS 6502 writes
+				// the value twice while the 65C02 reads it again.
+				if cmos {
+					cpu.read(addr)
+				} else {
+					cpu.write(addr, value)
+				}
 			}
 		}
-		cpu.SignFlag = res&0x80 != 0
-		cpu.OverflowFlag = !((cpu.A^value)&0x80 != 0) && ((uint16(cpu.A)^res)&0x80 != 0)
-		cpu.CarryFlag = res&0x100 != 0
-		cpu.A = byte(res & 0xff)
-	case I_AND.Num:
-		cpu.A &= value
-		cpu.SignFlag = cpu.A&0x80 > 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_ASL.Num:
-		cpu.CarryFlag = value&0x80 != 0
-		value = value << 1
-		cpu.SignFlag = value&0x80 != 0
-		cpu.ZeroFlag = value == 0
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-	case I_BCC.Num:
-		if !cpu.CarryFlag {
-			jump = true
-		}
-	case I_BCS.Num:
-		if cpu.CarryFlag {
-			jump = true
-		}
-	case I_BEQ.Num:
-		if cpu.ZeroFlag {
-			jump = true
-		}
-	case I_BIT.Num:
-		cpu.SignFlag = value&0x80 != 0
-		cpu.OverflowFlag = value&0x40 != 0
-		cpu.ZeroFlag = value&cpu.A == 0
-	case I_BMI.Num:
-		if cpu.SignFlag {
-			jump = true
-		}
-	case I_BPL.Num:
-		if !cpu.SignFlag {
-			jump = true
-		}
-	case I_BNE.Num:
-		if !cpu.ZeroFlag {
-			jump = true
-		}
-	case I_BRK.Num:
-		cpu.PushAddress(cpu.PC + 1)
-		cpu.SoftwareInterruptFlag = true
-		cpu.PushByte(cpu.GetP())
-		cpu.InterruptsDisabledFlag = true
-		cpu.PC = cpu.ReadUI16(IV_IRQ, false)
-		cycles2 += 5
-	case I_BVC.Num:
-		if !cpu.OverflowFlag {
-			jump = true
-		}
-	case I_BVS.Num:
-		if cpu.OverflowFlag {
-			jump = true
+	}
+	if cpu.AccessLogger != nil {
+		cpu.logData(pc, opcode, addr)
+	}
+
+	handler := cpu.handlers[opcode.Opcode]
+	if handler == nil {
+		return 0, cpu.illegalOpcode(pc, opcode, "unhandled instruction "+opcode.Instruction.Name)
+	}
+	cpu.op = operand{opcode: opcode, pc: pc, addr: addr, value: value}
+	if err := handler(cpu, &cpu.op); err != nil {
+		return 0, err
+	}
+	jump, extra := cpu.op.jump, cpu.op.extra
+
+	if jump {
+		// A taken branch doesn't poll on its last cycle unless it crosses a
+		// page, so an interrupt that arrived during the offset fetch is
+		// delayed until after the next instruction.
+		if cpu.runIRQ && !cpu.prevRunIRQ {
+			cpu.runIRQ = false
 		}
-	case I_CLC.Num:
-		cpu.CarryFlag = false
-	case I_CLD.Num:
-		cpu.DecimalFlag = false
-	case I_CLI.Num:
-		cpu.InterruptsDisabledFlag = false
-	case I_CLV.Num:
-		cpu.OverflowFlag = false
-	case I_CMP.Num:
-		res := cpu.A - value
-		cpu.CarryFlag = cpu.A >= value
-		cpu.SignFlag = res&0x80 != 0
-		cpu.ZeroFlag = res == 0
-	case I_CPX.Num:
-		res := cpu.X - value
-		cpu.CarryFlag = cpu.X >= value
-		cpu.SignFlag = res&0x80 != 0
-		cpu.ZeroFlag = res == 0
-	case I_CPY.Num:
-		res := cpu.Y - value
-		cpu.CarryFlag = cpu.Y >= value
-		cpu.SignFlag = res&0x80 != 0
-		cpu.ZeroFlag = res == 0
-	case I_DCP.Num: // undocumented - equivalent to DEC, CMP
-		value--
-		cpu.memory.WriteByte(addr, value)
-		res := cpu.A - value
-		cpu.CarryFlag = cpu.A >= value
-		cpu.SignFlag = res&0x80 != 0
-		cpu.ZeroFlag = res == 0
-	case I_DEC.Num:
-		value--
-		cpu.SignFlag = value&0x80 != 0
-		cpu.ZeroFlag = value == 0
-		cpu.memory.WriteByte(addr, value)
-	case I_DEX.Num:
-		cpu.X -= 1
-		cpu.SignFlag = cpu.X&0x80 != 0
-		cpu.ZeroFlag = cpu.X == 0
-	case I_DEY.Num:
-		cpu.Y -= 1
-		cpu.SignFlag = cpu.Y&0x80 != 0
-		cpu.ZeroFlag = cpu.Y == 0
-	case I_EOR.Num:
-		cpu.A ^= value
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_INC.Num:
-		value++
-		cpu.SignFlag = value&0x80 != 0
-		cpu.ZeroFlag = value == 0
-		cpu.memory.WriteByte(addr, value)
-	case I_INX.Num:
-		cpu.X += 1
-		cpu.SignFlag = cpu.X&0x80 != 0
-		cpu.ZeroFlag = cpu.X == 0
-	case I_INY.Num:
-		cpu.Y += 1
-		cpu.SignFlag = cpu.Y&0x80 != 0
-		cpu.ZeroFlag = cpu.Y == 0
-	case I_ISC.Num: // undocumented - equivalent to INC, SBC
-		value++
-		cpu.memory.WriteByte(addr, value)
-		temp := uint16(cpu.A) - uint16(value)
-		if !cpu.CarryFlag {
-			temp--
+		delayNMI := cpu.needNMI && !cpu.prevNeedNMI
+		cpu.read(cpu.PC) // dummy read while adding the offset
+		if delayNMI {
+			cpu.prevNeedNMI = false
 		}
-		cpu.SignFlag = temp&0x80 != 0
-		cpu.ZeroFlag = temp&0xff == 0
-		cpu.OverflowFlag = ((cpu.A^byte(temp))&0x80 != 0) && ((cpu.A^value)&0x80 != 0)
-		if cpu.DecimalFlag {
-			var carry byte = 1
-			if cpu.CarryFlag {
-				carry = 0
-			}
-			if ((cpu.A & 0x0f) - carry) < (value & 0x0f) {
-				/* EP */
-				temp -= 6
-			}
-			if temp > 0x99 {
-				temp -= 0x60
-			}
+		if cpu.PC&0xff00 != addr&0xff00 {
+			crossed = true
+			cpu.read(cpu.PC&0xff00 | addr&0x00ff) // dummy read before fixing PCH
 		}
-		cpu.CarryFlag = temp < 0x100
-		cpu.A = byte(temp & 0xff)
-	case I_JMP.Num:
 		cpu.PC = addr
-	case I_JSR.Num:
-		cpu.PushAddress(cpu.PC - 1)
-		cpu.PC = addr
-		cycles2 += 3
-	case I_LAX.Num: // undocumented
-		cpu.A = value
-		cpu.X = value
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_LDA.Num:
-		cpu.A = value
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_LDX.Num:
-		cpu.X = value
-		cpu.SignFlag = cpu.X&0x80 != 0
-		cpu.ZeroFlag = cpu.X == 0
-	case I_LDY.Num:
-		cpu.Y = value
-		cpu.SignFlag = cpu.Y&0x80 != 0
-		cpu.ZeroFlag = cpu.Y == 0
-	case I_LSR.Num:
-		cpu.CarryFlag = value&0x01 > 0
-		value >>= 1
-		cpu.SignFlag = value&0x80 != 0
-		cpu.ZeroFlag = value == 0
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-	case I_NOP.Num, I_DOP.Num, I_TOP.Num, I_NP2.Num:
-		// no-op
-	case I_ORA.Num:
-		cpu.A |= value
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_PHA.Num:
-		cpu.PushByte(cpu.A)
-		cycles2++
-	case I_PHP.Num:
-		cpu.PushByte(cpu.GetP() | FLAG_B) // B flag always pushed as 1
-		cycles2++
-	case I_PLA.Num:
-		cpu.A = cpu.PopByte()
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-		cycles2 += 2
-	case I_PLP.Num:
-		cpu.SetP(cpu.PopByte() & ^byte(FLAG_B)) // B flag discarded
-		cycles2 += 2
-	case I_RLA.Num: // undocumented - equivalent to ROL, AND
-		var carry byte = 0
-		if cpu.CarryFlag {
-			carry = 1
-		}
-		cpu.CarryFlag = value&0x80 > 0
-		value = (value << 1) | carry
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-		cpu.A &= value
-		cpu.SignFlag = cpu.A&0x80 > 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_RTI.Num:
-		cpu.SetP(cpu.PopByte())
-		cpu.PC = cpu.PopAddress()
-		cycles2 += 4
-	case I_ROL.Num:
-		var carry byte = 0
-		if cpu.CarryFlag {
-			carry = 1
-		}
-		cpu.CarryFlag = value&0x80 > 0
-		value = (value << 1) | carry
-		cpu.SignFlag = value&0x80 > 0
-		cpu.ZeroFlag = value == 0
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-	case I_ROR.Num:
-		var carry byte = 0
-		if cpu.CarryFlag {
-			carry = 0x80
-		}
-		cpu.CarryFlag = value&0x01 > 0
-		value = (value >> 1) | carry
-		cpu.SignFlag = value&0x80 > 0
-		cpu.ZeroFlag = value == 0
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-	case I_RRA.Num: // undocumented - equivalent to ROR, ADC
-		var carry byte = 0
-		if cpu.CarryFlag {
-			carry = 0x80
-		}
-		cpu.CarryFlag = value&0x01 > 0
-		value = (value >> 1) | carry
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-		res := uint16(value) + uint16(cpu.A)
-		if cpu.CarryFlag {
-			res++
-		}
-		cpu.ZeroFlag = (res & 0xff) == 0
-		if cpu.DecimalFlag {
-			if (cpu.A^value^byte(res))&0x10 == 0x10 {
-				res += 6
-			}
-			if res&0xf0 > 0x90 {
-				res += 0x60
-			}
-		}
-		cpu.SignFlag = res&0x80 != 0
-		cpu.OverflowFlag = !((cpu.A^value)&0x80 != 0) && ((uint16(cpu.A)^res)&0x80 != 0)
-		cpu.CarryFlag = res&0x100 != 0
-		cpu.A = byte(res & 0xff)
-	case I_RTS.Num:
-		cpu.PC = cpu.PopAddress() + 1
-		cycles2 += 4
-	case I_SBC.Num:
-		temp := uint16(cpu.A) - uint16(value)
-		if !cpu.CarryFlag {
-			temp--
-		}
-		cpu.SignFlag = temp&0x80 != 0
-		cpu.ZeroFlag = temp&0xff == 0
-		cpu.OverflowFlag = ((cpu.A^byte(temp))&0x80 != 0) && ((cpu.A^value)&0x80 != 0)
-		if cpu.DecimalFlag {
-			var carry byte = 1
-			if cpu.CarryFlag {
-				carry = 0
-			}
-			if ((cpu.A & 0x0f) - carry) < (value & 0x0f) {
-				/* EP */
-				temp -= 6
+	}
+
+	cycles := cpu.busCycles
+	var err error
+	if cpu.ValidateCycles {
+		expected := opcode.Cycles
+		if expected < 0 {
+			expected = -expected
+			if jump {
+				expected++
 			}
-			if temp > 0x99 {
-				temp -= 0x60
+			if crossed {
+				expected++
 			}
 		}
-		cpu.CarryFlag = temp < 0x100
-		cpu.A = byte(temp & 0xff)
-	case I_SEC.Num:
-		cpu.CarryFlag = true
-	case I_SED.Num:
-		cpu.DecimalFlag = true
-	case I_SEI.Num:
-		cpu.InterruptsDisabledFlag = true
-	case I_SLO.Num: // undocumented - equivalent to ASL, ORA
-		cpu.CarryFlag = value&0x80 != 0
-		value = value << 1
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
-		}
-
-		cpu.A |= value
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_SRE.Num: // undocumented - equivalent to LSR, EOR
-		cpu.CarryFlag = value&0x01 > 0
-		value >>= 1
-		if opcode.AddressingMode == AMAccumulator {
-			cpu.A = value
-		} else {
-			cpu.memory.WriteByte(addr, value)
+		expected += extra + cpu.halted
+		if cycles != expected {
+			err = &CPUError{
+				Err:    ErrCycleMismatch,
+				PC:     pc,
+				Opcode: byte(opcode.Opcode),
+				State:  state,
+				Detail: fmt.Sprintf("%s am:%d expected:%d was:%d", opcode.Instruction.Name, opcode.AddressingMode, expected, cycles)}
 		}
-		cpu.A ^= value
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_STA.Num:
-		cpu.memory.WriteByte(addr, cpu.A)
-	case I_STX.Num:
-		cpu.memory.WriteByte(addr, cpu.X)
-	case I_STY.Num:
-		cpu.memory.WriteByte(addr, cpu.Y)
-	case I_TAX.Num:
-		cpu.X = cpu.A
-		cpu.SignFlag = cpu.X&0x80 != 0
-		cpu.ZeroFlag = cpu.X == 0
-	case I_TAY.Num:
-		cpu.Y = cpu.A
-		cpu.SignFlag = cpu.Y&0x80 != 0
-		cpu.ZeroFlag = cpu.Y == 0
-	case I_TSX.Num:
-		cpu.X = cpu.SP
-		cpu.SignFlag = cpu.X&0x80 != 0
-		cpu.ZeroFlag = cpu.X == 0
-	case I_TXA.Num:
-		cpu.A = cpu.X
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	case I_TXS.Num:
-		cpu.SP = cpu.X
-	case I_TYA.Num:
-		cpu.A = cpu.Y
-		cpu.SignFlag = cpu.A&0x80 != 0
-		cpu.ZeroFlag = cpu.A == 0
-	}
-
-	if cycles2 != cycles {
-		fmt.Printf("%s am:%d expected:%d was:%d\n", opcode.Instruction.Name, opcode.AddressingMode, cycles, cycles2)
-		os.Exit(1)
 	}
 
-	if jump {
-		if cpu.PC&0xff00 != addr&0xff00 {
-			cycles += 2
-		} else {
-			cycles += 1
-		}
-		cpu.PC = addr
-	}
+	// CLI, SEI and PLP change the I flag after the last poll so their
+	// effect on IRQ is delayed by one instruction.
+	cpu.pending = cpu.prevRunIRQ || cpu.prevNeedNMI
 
 	cpu.Cycles += uint64(cycles)
+	if cpu.Profiler != nil {
+		cpu.Profiler.instruction(cpu, pc, cycles)
+	}
+	cpu.unwindCalls()
+	switch opcode.Instruction.Num {
+	case I_JSR.Num:
+		cpu.pushCall(CallJSR, pc, pc+3)
+	case I_BRK.Num:
+		cpu.pushCall(CallBRK, pc, pc+2)
+	}
 
-	return cycles, nil
+	return cycles, err
 }
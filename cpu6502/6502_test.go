@@ -1,6 +1,11 @@
 package cpu6502
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -12,13 +17,28 @@ type InstructionTest struct {
 //     {0x29, 0xf0}
 // }
 
+// TestMemory is a flat 64K memory that logs every (non-peek) bus access
 type TestMemory struct {
-	bytes []byte
+	bytes  []byte
+	cycles []busCycle
+}
+
+type busCycle struct {
+	addr  uint16
+	value byte
+	write bool
+}
+
+func (c busCycle) String() string {
+	if c.write {
+		return fmt.Sprintf("write $%04X=$%02X", c.addr, c.value)
+	}
+	return fmt.Sprintf("read $%04X=$%02X", c.addr, c.value)
 }
 
 func NewTestMemory(bytes []byte) *TestMemory {
 	mem := TestMemory{}
-	mem.bytes = make([]byte, 0x200, 0x200)
+	mem.bytes = make([]byte, 0x10000, 0x10000)
 	for i := 0; i < len(bytes); i++ {
 		mem.bytes[i] = bytes[i]
 	}
@@ -26,13 +46,28 @@ func NewTestMemory(bytes []byte) *TestMemory {
 }
 
 func (m *TestMemory) ReadByte(addr uint16, peek bool) byte {
+	if !peek {
+		m.cycles = append(m.cycles, busCycle{addr, m.bytes[addr], false})
+	}
 	return m.bytes[addr]
 }
 
 func (m *TestMemory) WriteByte(addr uint16, value byte) {
+	m.cycles = append(m.cycles, busCycle{addr, value, true})
 	m.bytes[addr] = value
 }
 
+// assemble returns a TestMemory with the program loaded
+func assemble(t *testing.T, source string) *TestMemory {
+	prog, err := Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := NewTestMemory(nil)
+	prog.Load(memory)
+	return memory
+}
+
 func TestStack(t *testing.T) {
 	memory := NewTestMemory([]byte{0})
 	cpu := NewCPU6502(memory)
@@ -66,9 +101,9 @@ func TestStack(t *testing.T) {
 }
 
 func TestAND(t *testing.T) {
-	memory := NewTestMemory([]byte{
-		0x29, 0xf0, // AND #$f0
-		0x29, 0x0f}) // AND #$0f
+	memory := assemble(t, `
+		AND #$f0
+		AND #$0f`)
 	cpu := NewCPU6502(memory)
 	cpu.A = 0xff
 	cpu.Step()
@@ -92,3 +127,1219 @@ func TestAND(t *testing.T) {
 		t.Errorf("AND/Immediate set sign flag when it shouldn't have")
 	}
 }
+
+func TestIRQ(t *testing.T) {
+	memory := assemble(t, `
+		CLI
+		NOP
+		SEI
+		NOP
+		NOP
+		.org $FFFE
+		.word $8000`)
+	cpu := NewCPU6502(memory)
+	cpu.SetIRQ(1, true)
+	cpu.SetIRQ(2, true)
+	cpu.SetIRQ(1, false)
+	if !cpu.IRQ() {
+		t.Fatalf("Releasing one IRQ source released the line")
+	}
+
+	cpu.Step() // CLI
+	cpu.Step() // NOP (IRQ is delayed by one instruction after CLI)
+	if cpu.PC != 0x0002 {
+		t.Fatalf("IRQ taken immediately after CLI (PC=%04x)", cpu.PC)
+	}
+	cycles, _ := cpu.Step()
+	if cpu.PC != 0x8000 || cycles != 7 {
+		t.Fatalf("IRQ not taken after CLI latency (PC=%04x cycles=%d)", cpu.PC, cycles)
+	}
+	if !cpu.InterruptsDisabledFlag {
+		t.Errorf("IRQ didn't set the interrupt disable flag")
+	}
+	p := cpu.PopByte()
+	if p&FLAG_B != 0 || p&FLAG_I != 0 {
+		t.Errorf("IRQ pushed wrong flags %02x", p)
+	}
+	if addr := cpu.PopAddress(); addr != 0x0002 {
+		t.Errorf("IRQ pushed wrong return address %04x", addr)
+	}
+
+	// SEI still lets a pending IRQ through once
+	cpu.PC = 0x0002
+	cpu.InterruptsDisabledFlag = false
+	cpu.Step() // SEI
+	cpu.Step()
+	if cpu.PC != 0x8000 {
+		t.Errorf("IRQ not taken after SEI (PC=%04x)", cpu.PC)
+	}
+
+	// Masked
+	cpu.PC = 0x0003
+	cpu.Step()
+	cpu.Step()
+	if cpu.PC != 0x0005 {
+		t.Errorf("IRQ taken while interrupts disabled (PC=%04x)", cpu.PC)
+	}
+
+	cpu.SetIRQ(2, false)
+	cpu.InterruptsDisabledFlag = false
+	cpu.PC = 0x0003
+	cpu.Step()
+	cpu.Step()
+	if cpu.PC != 0x0005 {
+		t.Errorf("IRQ taken after line released (PC=%04x)", cpu.PC)
+	}
+}
+
+// interruptAt calls fn at the start of the nth bus cycle from now.
+func interruptAt(cpu *CPU6502, n int, fn func()) {
+	cycle := 0
+	cpu.Tick = func() {
+		if cycle++; cycle == n {
+			fn()
+		}
+	}
+}
+
+func TestNMIHijack(t *testing.T) {
+	memory := assemble(t, `
+		.org $0200
+		BRK
+		NOP
+		NOP
+		.org $8000
+		NOP
+		.org $9000
+		NOP
+		.org $FFFA
+		.word $9000
+		.word $0200
+		.word $8000`)
+	for _, tc := range []struct {
+		name string
+		pc   uint16
+		b    byte // B in the pushed P
+	}{
+		{"BRK", 0x0200, FLAG_B},
+		{"IRQ", 0x0202, 0},
+	} {
+		for cycle := 1; cycle <= 7; cycle++ {
+			cpu := NewCPU6502(memory)
+			cpu.PC = tc.pc
+			if tc.name == "IRQ" {
+				cpu.InterruptsDisabledFlag = false
+				cpu.SetIRQ(1, true)
+				cpu.Step() // NOP
+			}
+			interruptAt(cpu, cycle, func() { cpu.SetNMI(true) })
+			cpu.Step()
+			cpu.Tick = nil
+			if p := memory.bytes[0x100+uint16(cpu.SP)+1]; p&FLAG_B != tc.b {
+				t.Errorf("%s with NMI at cycle %d pushed P=%02x", tc.name, cycle, p)
+			}
+			if cpu.SoftwareInterruptFlag {
+				t.Errorf("%s left B set", tc.name)
+			}
+			// An NMI in the first four cycles changes the vector
+			if cycle <= 4 {
+				if cpu.PC != 0x9000 {
+					t.Errorf("NMI at cycle %d didn't hijack %s (PC=%04x)", cycle, tc.name, cpu.PC)
+				}
+				continue
+			}
+			if cpu.PC != 0x8000 {
+				t.Errorf("NMI at cycle %d hijacked %s (PC=%04x)", cycle, tc.name, cpu.PC)
+			}
+			// Otherwise it's taken after the handler's first instruction
+			cpu.Step()
+			cpu.Step()
+			if cpu.PC != 0x9000 || cpu.PopByte()&FLAG_B != 0 || cpu.PopAddress() != 0x8001 {
+				t.Errorf("NMI at cycle %d of %s wasn't taken after it (PC=%04x)", cycle, tc.name, cpu.PC)
+			}
+		}
+	}
+}
+
+func TestBranchDelaysIRQ(t *testing.T) {
+	memory := assemble(t, `
+		.org $0200
+		BCC near	; taken without crossing a page
+	near:	NOP
+		NOP
+		.org $02FC
+		BCC far		; taken across a page
+		NOP
+		.org $0300
+	far:	NOP
+		NOP
+		.org $FFFE
+		.word $8000`)
+	for _, tc := range []struct {
+		pc    uint16
+		cycle int    // of the branch when IRQ is asserted
+		ret   uint16 // pushed by the IRQ
+	}{
+		{0x0200, 1, 0x0202},
+		{0x0200, 2, 0x0203}, // not polled on the last cycle
+		{0x0200, 3, 0x0203},
+		{0x02FC, 2, 0x0300},
+		{0x02FC, 3, 0x0300},
+		{0x02FC, 4, 0x0301},
+	} {
+		cpu := NewCPU6502(memory)
+		cpu.PC = tc.pc
+		cpu.InterruptsDisabledFlag = false
+		interruptAt(cpu, tc.cycle, func() { cpu.SetIRQ(1, true) })
+		cpu.Step()
+		cpu.Tick = nil
+		for i := 0; i < 3 && cpu.PC != 0x8000; i++ {
+			cpu.Step()
+		}
+		cpu.PopByte()
+		if ret := cpu.PopAddress(); cpu.PC != 0x8000 || ret != tc.ret {
+			t.Errorf("IRQ at cycle %d of the branch at $%04X returned to $%04X instead of $%04X", tc.cycle, tc.pc, ret, tc.ret)
+		}
+	}
+}
+
+func TestBranchDelaysNMI(t *testing.T) {
+	memory := assemble(t, `
+		.org $0200
+		BCC near	; taken without crossing a page
+	near:	NOP
+		NOP
+		.org $02FC
+		BCC far		; taken across a page
+		NOP
+		.org $0300
+	far:	NOP
+		NOP
+		.org $FFFA
+		.word $9000`)
+	for _, tc := range []struct {
+		pc    uint16
+		cycle int    // of the branch when NMI is asserted
+		ret   uint16 // pushed by the NMI
+	}{
+		{0x0200, 1, 0x0202},
+		{0x0200, 2, 0x0203}, // not polled on the last cycle
+		{0x0200, 3, 0x0203},
+		{0x02FC, 2, 0x0300},
+		{0x02FC, 3, 0x0300},
+		{0x02FC, 4, 0x0301},
+	} {
+		cpu := NewCPU6502(memory)
+		cpu.PC = tc.pc
+		interruptAt(cpu, tc.cycle, func() { cpu.SetNMI(true) })
+		cpu.Step()
+		cpu.Tick = nil
+		for i := 0; i < 3 && cpu.PC != 0x9000; i++ {
+			cpu.Step()
+		}
+		cpu.PopByte()
+		if ret := cpu.PopAddress(); cpu.PC != 0x9000 || ret != tc.ret {
+			t.Errorf("NMI at cycle %d of the branch at $%04X returned to $%04X instead of $%04X", tc.cycle, tc.pc, ret, tc.ret)
+		}
+	}
+}
+
+func TestKIL(t *testing.T) {
+	memory := assemble(t, `
+		NOP
+		KIL`)
+	cpu := NewCPU6502(memory)
+	cpu.Step()
+	_, err := cpu.Step()
+	if !errors.Is(err, ErrCPUJammed) {
+		t.Fatalf("Expected ErrCPUJammed, got %v", err)
+	}
+	cpuErr, ok := err.(*CPUError)
+	if !ok {
+		t.Fatalf("Expected *CPUError, got %T", err)
+	}
+	if cpuErr.PC != 0x0001 || cpuErr.Opcode != 0x02 {
+		t.Errorf("Wrong error details %+v", cpuErr)
+	}
+	if !cpu.Jammed() {
+		t.Errorf("KIL didn't jam the CPU")
+	}
+	if _, err := cpu.Step(); !errors.Is(err, ErrCPUJammed) {
+		t.Errorf("Jammed CPU kept executing")
+	}
+}
+
+func TestValidateCycles(t *testing.T) {
+	for _, variant := range []Variant{VariantNMOS, Variant65C02} {
+		for op := 0; op < 256; op++ {
+			if variant.Opcodes()[op].Instruction.Num == I_KIL.Num {
+				continue
+			}
+			for _, index := range []byte{0x00, 0xff} {
+				memory := NewTestMemory([]byte{byte(op), 0x80, 0x01})
+				memory.bytes[0x80] = 0xf0
+				memory.bytes[0x81] = 0x01
+				cpu := NewCPU6502Variant(memory, variant)
+				cpu.ValidateCycles = true
+				cpu.X = index
+				cpu.Y = index
+				cpu.DecimalFlag = index != 0
+				if _, err := cpu.Step(); err != nil {
+					t.Errorf("%s %02x: %v", variant, op, err)
+				}
+			}
+		}
+	}
+}
+
+func TestTick(t *testing.T) {
+	for _, variant := range []Variant{VariantNMOS, Variant65C02} {
+		for op := 0; op < 256; op++ {
+			if variant.Opcodes()[op].Instruction.Num == I_KIL.Num {
+				continue
+			}
+			for _, index := range []byte{0x00, 0xff} {
+				memory := NewTestMemory([]byte{byte(op), 0x80, 0x01})
+				memory.bytes[0x80] = 0xf0
+				memory.bytes[0x81] = 0x01
+				cpu := NewCPU6502Variant(memory, variant)
+				ticks := 0
+				cpu.Tick = func() { ticks++ }
+				cpu.X = index
+				cpu.Y = index
+				cpu.DecimalFlag = index != 0
+				cycles, _ := cpu.Step()
+				if cycles != ticks {
+					t.Errorf("%s %02x: %d cycles but %d bus cycles", variant, op, cycles, ticks)
+				}
+			}
+		}
+	}
+}
+
+func TestUnstableOpcodes(t *testing.T) {
+	memory := assemble(t, `
+		SXA $12F0,Y
+		SYA $3000,X
+		XAA #$0F
+		ATX #$F0
+		AXS #$05
+		ARR #$C0
+		LAR $0200,Y`)
+	cpu := NewCPU6502(memory)
+
+	cpu.X = 0x0f
+	cpu.Y = 0x20
+	cpu.Step()
+	// Page crossed so the high byte of the address is replaced by X & ($12+1)
+	if memory.bytes[0x1310] != 0 || memory.bytes[0x0310] != 0x03 {
+		t.Errorf("SXA didn't store to the corrupted address")
+	}
+
+	cpu.X = 0x01
+	cpu.Y = 0xff
+	cpu.Step()
+	if memory.bytes[0x3001] != 0x31 {
+		t.Errorf("SYA stored %02x instead of %02x", memory.bytes[0x3001], 0x31)
+	}
+
+	cpu.A = 0x00
+	cpu.X = 0x3c
+	cpu.Step()
+	if cpu.A != (0xee&0x3c&0x0f) || cpu.ZeroFlag {
+		t.Errorf("XAA produced %02x", cpu.A)
+	}
+
+	cpu.A = 0x01
+	cpu.Step()
+	if cpu.A != 0xe0 || cpu.X != 0xe0 || !cpu.SignFlag {
+		t.Errorf("ATX produced A=%02x X=%02x", cpu.A, cpu.X)
+	}
+
+	cpu.A = 0x0f
+	cpu.X = 0x03
+	cpu.Step()
+	if cpu.X != 0xfe || cpu.CarryFlag || !cpu.SignFlag {
+		t.Errorf("AXS produced X=%02x C=%v", cpu.X, cpu.CarryFlag)
+	}
+
+	cpu.A = 0xff
+	cpu.CarryFlag = true
+	cpu.Step()
+	if cpu.A != 0xe0 || !cpu.CarryFlag || cpu.OverflowFlag || !cpu.SignFlag {
+		t.Errorf("ARR produced A=%02x %s", cpu.A, cpu.FlagString())
+	}
+
+	memory.bytes[0x0210] = 0xf3
+	cpu.SP = 0x3f
+	cpu.Y = 0x10
+	cpu.Step()
+	if cpu.A != 0x33 || cpu.X != 0x33 || cpu.SP != 0x33 {
+		t.Errorf("LAR produced A=%02x X=%02x SP=%02x", cpu.A, cpu.X, cpu.SP)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	memory := NewTestMemory(nil)
+	copy(memory.bytes[0x8000:], []byte{
+		0xa2, 0x00, // 8000 LDX #$00
+		0xbd, 0x10, 0x80, // 8002 LDA $8010,X
+		0xf0, 0x06, // 8005 BEQ $800D
+		0x20, 0x0e, 0x80, // 8007 JSR $800E
+		0xe8,       // 800A INX
+		0xd0, 0xf5, // 800B BNE $8002
+		0x40,             // 800D RTI
+		0x60,             // 800E RTS
+		0xff,             // 800F
+		0x48, 0x49, 0x00, // 8010 "HI\0"
+	})
+	memory.bytes[IV_RESET] = 0x00
+	memory.bytes[IV_RESET+1] = 0x80
+	memory.bytes[IV_NMI] = 0x0d
+	memory.bytes[IV_NMI+1] = 0x80
+
+	ins := DisassembleOne(memory, VariantNMOS, 0x8002)
+	if ins.String() != "LDA $8010,X" || len(ins.Bytes) != 3 {
+		t.Errorf("DisassembleOne returned %s %v", ins, ins.Bytes)
+	}
+	if n := len(DisassembleRange(memory, VariantNMOS, 0x8000, 0x800e)); n != 8 {
+		t.Errorf("DisassembleRange returned %d instructions instead of 8", n)
+	}
+
+	d := Disassemble(memory, VariantNMOS, 0x8000, 0x8012)
+	for addr := uint16(0x8000); addr <= 0x8012; addr++ {
+		if d.IsCode(addr) != (addr < 0x800f) {
+			t.Errorf("IsCode($%04X) = %v", addr, d.IsCode(addr))
+		}
+	}
+	for addr, label := range map[uint16]string{0x8000: "reset", 0x800d: "nmi", 0x8002: "L8002", 0x800e: "L800E", 0x8010: "L8010"} {
+		if l, ok := d.Label(addr); !ok || l != label {
+			t.Errorf("Label($%04X) = %q instead of %q", addr, l, label)
+		}
+	}
+}
+
+func TestDisassemble65C02(t *testing.T) {
+	memory := NewTestMemory(nil)
+	code := []byte{
+		0x80, 0x02, // 8000 BRA $8004
+		0xea, 0xea, // 8002
+		0x64, 0x10, // 8004 STZ $10
+		0xda,             // 8006 PHX
+		0x1c, 0x00, 0x02, // 8007 TRB $0200
+		0xb2, 0x20, // 800A LDA ($20)
+		0x0f, 0x10, 0x02, // 800C BBR0 $10,$8011
+		0xdb,             // 800F STP
+		0xea,             // 8010
+		0x7c, 0x00, 0x90, // 8011 JMP ($9000,X)
+	}
+	copy(memory.bytes[0x8000:], code)
+
+	var got []string
+	for _, ins := range DisassembleRange(memory, Variant65C02, 0x8004, 0x8011) {
+		got = append(got, fmt.Sprintf("%04X %s", ins.Address, ins))
+	}
+	want := []string{"8004 STZ $10", "8006 PHX", "8007 TRB $0200", "800A LDA ($20)",
+		"800C BBR0 $10,$8011", "800F STP", "8010 NOP", "8011 JMP ($9000,X)"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("65C02 disassembly is\n%s\ninstead of\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// $DA is an undocumented NOP on the NMOS 6502
+	if ins := DisassembleOne(memory, VariantNMOS, 0x8006); ins.Opcode.Instruction.Name == "PHX" {
+		t.Errorf("NMOS disassembly used the 65C02 table: %s", ins)
+	}
+
+	cpu := NewCPU6502Variant(memory, Variant65C02)
+	cpu.PC = 0x800a
+	if op, value := cpu.ReadOpcode(); op.AddressingMode != AMZeroPageIndirect || op.Size != 2 || value != 0x20 {
+		t.Errorf("ReadOpcode returned %s $%04X", op, value)
+	}
+
+	d := Disassemble(memory, Variant65C02, 0x8000, 0x8013, 0x8000)
+	for addr := uint16(0x8000); addr <= 0x8013; addr++ {
+		// BRA and STP don't fall through
+		if code := addr < 0x8002 || addr >= 0x8004 && addr < 0x8010 || addr >= 0x8011; d.IsCode(addr) != code {
+			t.Errorf("IsCode($%04X) = %v", addr, d.IsCode(addr))
+		}
+	}
+	for _, addr := range []uint16{0x8004, 0x8011} {
+		if _, ok := d.Label(addr); !ok {
+			t.Errorf("No label for branch target $%04X", addr)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	prog, err := Assemble(`
+		; comment
+		ptr = $10
+		.org $8000
+start:	LDX #<(data+1)
+		lda ptr,x
+		LDA (ptr),Y
+		STA (ptr,X)
+		STA a:ptr
+		LDA $1234,Y
+		ASL A
+		JMP (vector)
+		BNE start
+		BEQ done
+		SAX z:ptr
+		ANE #$FF
+		SB2 #1
+done:	RTS
+vector:	.word start, done
+data:	.byte 1, -1, 'A', "hi", >$1234`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0xa2, 0x22, // LDX #<(data+1)
+		0xb5, 0x10, // LDA $10,X
+		0xb1, 0x10, // LDA ($10),Y
+		0x81, 0x10, // STA ($10,X)
+		0x8d, 0x10, 0x00, // STA a:$10
+		0xb9, 0x34, 0x12, // LDA $1234,Y
+		0x0a,             // ASL A
+		0x6c, 0x1d, 0x80, // JMP ($801D)
+		0xd0, 0xec, // BNE $8000
+		0xf0, 0x06, // BEQ $801C
+		0x87, 0x10, // SAX $10
+		0x8b, 0xff, // ANE #$FF
+		0xeb, 0x01, // SB2 #$01
+		0x60,                   // RTS
+		0x00, 0x80, 0x1c, 0x80, // .word
+		0x01, 0xff, 0x41, 0x68, 0x69, 0x12, // .byte
+	}
+	if prog.Origin != 0x8000 || !bytes.Equal(prog.Code, expected) {
+		t.Errorf("Assemble produced $%04X % x", prog.Origin, prog.Code)
+	}
+	if prog.Labels["data"] != 0x8021 || prog.Labels["ptr"] != 0x10 {
+		t.Errorf("Wrong labels %v", prog.Labels)
+	}
+
+	for _, src := range []string{
+		"JMP ($10),Y",
+		"BNE *+200",
+		"FOO #1",
+		"LDA undefined",
+		".org $10\n.org $0",
+		"x: NOP\nx: NOP",
+	} {
+		if _, err := Assemble(src); err == nil {
+			t.Errorf("Expected an error assembling %q", src)
+		}
+	}
+}
+
+func TestAssembleDisassembly(t *testing.T) {
+	// Disassembled random bytes (so every opcode, code and data mixed)
+	// should reassemble to the same bytes.
+	rnd := rand.New(rand.NewSource(1))
+	memory := NewTestMemory(nil)
+	for i := 0x8000; i < 0x10000; i++ {
+		memory.bytes[i] = byte(rnd.Intn(256))
+	}
+	buf := &bytes.Buffer{}
+	if _, err := Disassemble(memory, VariantNMOS, 0x8000, 0xffff).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := Assemble(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Origin != 0x8000 || !bytes.Equal(prog.Code, memory.bytes[0x8000:]) {
+		t.Errorf("Reassembled disassembly doesn't match")
+	}
+}
+
+func TestVariants(t *testing.T) {
+	// The 2A03 ignores the D flag
+	for _, variant := range []Variant{VariantNMOS, Variant2A03} {
+		memory := assemble(t, `
+			SED
+			LDA #$08
+			CLC
+			ADC #$08`)
+		cpu := NewCPU6502Variant(memory, variant)
+		for i := 0; i < 4; i++ {
+			cpu.Step()
+		}
+		if expected := map[Variant]byte{VariantNMOS: 0x16, Variant2A03: 0x10}[variant]; cpu.A != expected {
+			t.Errorf("%s: $08+$08 = $%02X in decimal mode", variant, cpu.A)
+		}
+	}
+
+	memory := NewTestMemory([]byte{
+		0x64, 0x40, // STZ $40
+		0x80, 0x01, // BRA +1
+		0xea,       // NOP
+		0xda,       // PHX
+		0x7a,       // PLY
+		0x04, 0x41, // TSB $41
+		0x1a,       // INC A
+		0xb2, 0x42, // LDA ($42)
+		0xd7, 0x44, // SMB5 $44
+		0x5f, 0x44, 0x02, // BBR5 $44,+2
+		0xdf, 0x44, 0x01, // BBS5 $44,+1
+		0xea,             // NOP
+		0x6c, 0xff, 0x02, // JMP ($02FF)
+	})
+	memory.bytes[0x40] = 0xff
+	memory.bytes[0x41] = 0x81
+	memory.bytes[0x42] = 0x00
+	memory.bytes[0x43] = 0x03
+	memory.bytes[0x02ff] = 0x00
+	memory.bytes[0x0200] = 0x12
+	memory.bytes[0x0300] = 0x80 // also the target of JMP ($02FF), NMOS would use $0200
+	cpu := NewCPU6502Variant(memory, Variant65C02)
+	cpu.ValidateCycles = true
+	cpu.X = 0x0e
+	cpu.A = 0x06
+	step := func() {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	step()
+	if memory.bytes[0x40] != 0 {
+		t.Errorf("STZ didn't store zero")
+	}
+	step()
+	if cpu.PC != 0x0005 {
+		t.Errorf("BRA didn't branch (PC=%04x)", cpu.PC)
+	}
+	step()
+	step()
+	if cpu.Y != 0x0e {
+		t.Errorf("PHX/PLY moved %02x", cpu.Y)
+	}
+	step()
+	if memory.bytes[0x41] != 0x87 || !cpu.ZeroFlag {
+		t.Errorf("TSB stored %02x Z=%v", memory.bytes[0x41], cpu.ZeroFlag)
+	}
+	step()
+	if cpu.A != 0x07 {
+		t.Errorf("INC A produced %02x", cpu.A)
+	}
+	step()
+	if cpu.A != 0x80 {
+		t.Errorf("LDA (zp) loaded %02x", cpu.A)
+	}
+	step()
+	if memory.bytes[0x44] != 0x20 {
+		t.Errorf("SMB5 stored %02x", memory.bytes[0x44])
+	}
+	step()
+	if cpu.PC != 0x0011 {
+		t.Errorf("BBR5 branched with the bit set (PC=%04x)", cpu.PC)
+	}
+	step()
+	if cpu.PC != 0x0015 {
+		t.Errorf("BBS5 didn't branch (PC=%04x)", cpu.PC)
+	}
+	step()
+	if cpu.PC != 0x8000 {
+		t.Errorf("JMP ($02FF) went to %04x", cpu.PC)
+	}
+}
+
+func TestWAI(t *testing.T) {
+	memory := NewTestMemory([]byte{
+		0xcb, // WAI
+		0xea, // NOP
+	})
+	cpu := NewCPU6502Variant(memory, Variant65C02)
+	cpu.Step()
+	for i := 0; i < 3; i++ {
+		if cycles, _ := cpu.Step(); cycles != 1 || cpu.PC != 0x0001 {
+			t.Fatalf("WAI didn't wait (PC=%04x cycles=%d)", cpu.PC, cycles)
+		}
+	}
+	// Interrupts are disabled so execution continues after WAI
+	cpu.SetIRQ(1, true)
+	cpu.Step()
+	if cpu.PC != 0x0002 {
+		t.Errorf("WAI didn't resume on IRQ (PC=%04x)", cpu.PC)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	memory := assemble(t, `
+		.org $0400
+	start:	LDX #0
+	loop:	INX
+		STX $10
+		LDA $20,X
+		CPX #5
+		BNE loop
+	done:	JMP done`)
+	cpu := NewCPU6502(memory)
+	run := func() *BreakpointHit {
+		for i := 0; i < 100; i++ {
+			if _, err := cpu.Step(); err != nil {
+				var hit *BreakpointHit
+				if !errors.As(err, &hit) || !errors.Is(err, ErrBreakpoint) {
+					t.Fatal(err)
+				}
+				return hit
+			}
+		}
+		return nil
+	}
+
+	cpu.PC = 0x0400
+	bp, err := cpu.AddBreakpoint(BreakExec, 0x0402, 0x0402, "x == 3 && a != 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit := run(); hit == nil || hit.Breakpoint != bp || cpu.PC != 0x0402 || cpu.X != 3 {
+		t.Fatalf("exec breakpoint: %v", hit)
+	}
+	// Resuming executes the instruction at the breakpoint
+	if _, err := cpu.Step(); err != nil || cpu.PC != 0x0403 || cpu.X != 4 {
+		t.Fatalf("exec breakpoint didn't resume: %v", err)
+	}
+	if !cpu.EnableBreakpoint(bp.ID, false) {
+		t.Fatal("EnableBreakpoint failed")
+	}
+
+	cpu.PC = 0x0400
+	wp, err := cpu.AddBreakpoint(BreakWrite, 0x10, 0x10, "VALUE >= 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit := run(); hit == nil || hit.Breakpoint != wp || hit.Kind != BreakWrite || hit.Value != 2 || hit.State.PC != 0x0405 {
+		t.Fatalf("write breakpoint: %v", hit)
+	}
+	cpu.RemoveBreakpoint(wp.ID)
+
+	cpu.PC = 0x0400
+	rp, err := cpu.AddBreakpoint(BreakRead, 0x24, 0x25, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit := run(); hit == nil || hit.Breakpoint != rp || hit.Address != 0x24 || cpu.X != 4 {
+		t.Fatalf("read breakpoint: %v", hit)
+	}
+
+	cpu.ClearBreakpoints()
+	if hit := run(); hit != nil || cpu.PC != 0x040B {
+		t.Fatalf("breakpoint hit after ClearBreakpoints: %v", hit)
+	}
+
+	for _, cond := range []string{"Q == 1", "A ==", "X <"} {
+		if _, err := cpu.AddBreakpoint(BreakExec, 0, 0xffff, cond); err == nil {
+			t.Errorf("AddBreakpoint accepted condition %q", cond)
+		}
+	}
+	if _, err := cpu.AddBreakpoint(BreakExec, 2, 1, ""); err == nil {
+		t.Errorf("AddBreakpoint accepted a backwards range")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	memory := assemble(t, `
+		.org $C000
+		JMP $C5F5
+		LDA ($80,X)
+		LDA ($89),Y
+		JMP ($0200)
+		.byte $04, $A9 ; NOP $A9
+		LDA $0300,X
+		STX $00`)
+	memory.bytes[0x80] = 0x00
+	memory.bytes[0x81] = 0x02
+	memory.bytes[0x89] = 0x00
+	memory.bytes[0x8a] = 0x03
+	memory.bytes[0x0200] = 0x5A
+	memory.bytes[0x0201] = 0xDB
+	memory.bytes[0x0300] = 0x89
+	memory.bytes[0x0302] = 0x7E
+	memory.cycles = nil
+	cpu := NewCPU6502(memory)
+	cpu.Cycles = 7
+
+	cases := []struct {
+		pc     uint16
+		format TraceFormat
+		line   string
+	}{
+		{0xC000, TraceNestest, "C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC003, TraceNestest, "C003  A1 80     LDA ($80,X) @ 80 = 0200 = 5A    A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC005, TraceNestest, "C005  B1 89     LDA ($89),Y = 0300 @ 0300 = 89  A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC007, TraceNestest, "C007  6C 00 02  JMP ($0200) = DB5A              A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC00A, TraceNestest, "C00A  04 A9    *NOP $A9 = 00                    A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC00C, TraceNestest, "C00C  BD 00 03  LDA $0300,X @ 0300 = 89         A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC00F, TraceNestest, "C00F  86 00     STX $00 = 00                    A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"},
+		{0xC000, TraceFCEUX, "A:00 X:00 Y:00 S:FD P:nvUbdIzc  $C000:4C F5 C5  JMP $C5F5"},
+		{0xC00C, TraceFCEUX, "A:00 X:00 Y:00 S:FD P:nvUbdIzc  $C00C:BD 00 03  LDA $0300,X @ $0300 = #$89"},
+		{0xC00F, TraceFCEUX, "A:00 X:00 Y:00 S:FD P:nvUbdIzc  $C00F:86 00     STX $00 = #$00"},
+		{0xC000, TraceMesen, "C000  $4C $F5 $C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:21  SL:0   CPU Cycle:7"},
+		{0xC00C, TraceMesen, "C00C  $BD $00 $03  LDA $0300,X [$0300] = $89       A:00 X:00 Y:00 P:24 SP:FD CYC:21  SL:0   CPU Cycle:7"},
+	}
+	for _, c := range cases {
+		cpu.PC = c.pc
+		if line := FormatTrace(cpu, c.format, 0, 21); line != c.line {
+			t.Errorf("%s at $%04X:\n%q\nexpected\n%q", c.format, c.pc, line, c.line)
+		}
+	}
+	if len(memory.cycles) != 0 {
+		t.Errorf("tracing accessed the bus: %v", memory.cycles)
+	}
+
+	var buf bytes.Buffer
+	cpu.PC = 0xC000
+	cpu.Tracer = NewLogTracer(&buf, TraceNestest, func() (int, int) { return 0, 21 })
+	cpu.Step()
+	cpu.Tracer = nil
+	cpu.Step()
+	if buf.String() != cases[0].line+"\n" {
+		t.Errorf("LogTracer wrote %q", buf.String())
+	}
+
+	if f, err := ParseTraceFormat("FCEUX"); err != nil || f != TraceFCEUX {
+		t.Errorf("ParseTraceFormat returned %s, %v", f, err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	memory := NewTestMemory([]byte{0xad, 0x34, 0x12}) // LDA $1234
+	cpu := NewCPU6502(memory)
+	if op, value := cpu.ReadOpcode(); op.Instruction.Num != I_LDA.Num || value != 0x1234 {
+		t.Errorf("ReadOpcode returned %s $%04X", op, value)
+	}
+	if b := cpu.PeekRange(0xffff, 4); !bytes.Equal(b, []byte{0, 0xad, 0x34, 0x12}) {
+		t.Errorf("PeekRange returned % x", b)
+	}
+	if cpu.Peek(2) != 0x12 {
+		t.Errorf("Peek failed")
+	}
+	if len(memory.cycles) != 0 {
+		t.Errorf("peeking accessed the bus: %v", memory.cycles)
+	}
+}
+
+func TestReset(t *testing.T) {
+	memory := NewTestMemory(nil)
+	memory.bytes[IV_RESET] = 0x00
+	memory.bytes[IV_RESET+1] = 0x80
+	cpu := NewCPU6502(memory)
+	cpu.PC = 0x1234
+	if cycles := cpu.PowerOn(); cycles != 7 || cpu.Cycles != 7 {
+		t.Errorf("power on took %d cycles (%d)", cycles, cpu.Cycles)
+	}
+	if cpu.PC != 0x8000 || cpu.SP != 0xFD || cpu.GetP() != 0x24 {
+		t.Errorf("wrong power on state %s", cpu)
+	}
+	expected := "[read $1234=$00 read $1234=$00 read $0100=$00 read $01FF=$00 read $01FE=$00 read $FFFC=$00 read $FFFD=$80]"
+	if s := fmt.Sprint(memory.cycles); s != expected {
+		t.Errorf("power on bus cycles %s, expected %s", s, expected)
+	}
+
+	memory.cycles = nil
+	cpu.A = 0x55
+	cpu.SP = 0x10
+	cpu.CarryFlag = true
+	cpu.InterruptsDisabledFlag = false
+	cpu.PC = 0x9000
+	cpu.Reset()
+	if cpu.PC != 0x8000 || cpu.SP != 0x0D || cpu.A != 0x55 || !cpu.CarryFlag || !cpu.InterruptsDisabledFlag || cpu.Cycles != 14 {
+		t.Errorf("wrong state after reset %s", cpu)
+	}
+	for _, c := range memory.cycles {
+		if c.write {
+			t.Errorf("reset wrote to memory: %s", c)
+		}
+	}
+}
+
+func TestMapPages(t *testing.T) {
+	memory := assemble(t, `
+		.org $8000
+		LDA $0810
+		STA $0011
+		STA $9000
+		BRK`)
+	ram := make([]byte, 0x200)
+	ram[0x10] = 0x42
+	rom := memory.bytes[0x8000 : 0x8000+0x1000]
+	cpu := NewCPU6502(memory)
+	cpu.PC = 0x8000
+	cpu.MapPages(0x00, 0x0f, ram, true) // mirrored every $200
+	cpu.MapPages(0x80, 0x8f, rom, false)
+	memory.cycles = nil
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.A != 0x42 || ram[0x11] != 0x42 || memory.bytes[0x0011] != 0 {
+		t.Errorf("mapped RAM wasn't used (A=$%02X, RAM $11=$%02X)", cpu.A, ram[0x11])
+	}
+	// Only the write to the read only page should reach the memory
+	if len(memory.cycles) != 1 || memory.cycles[0] != (busCycle{0x9000, 0x42, true}) {
+		t.Errorf("unexpected bus accesses %v", memory.cycles)
+	}
+	if cpu.Cycles != 11 {
+		t.Errorf("mapped accesses took %d cycles, expected 11", cpu.Cycles)
+	}
+
+	cpu.UnmapPages(0x00, 0xff)
+	cpu.PC = 0x8000
+	memory.cycles = nil
+	if _, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.A != 0 || len(memory.cycles) != 4 {
+		t.Errorf("unmapped pages still used %v", memory.cycles)
+	}
+}
+
+type accessLog map[uint16]AccessKind
+
+func (l accessLog) LogAccess(address uint16, kind AccessKind) {
+	l[address] |= kind
+}
+
+func TestAccessLogger(t *testing.T) {
+	memory := assemble(t, `
+		.org $8000
+		LDA $9000
+		LDY #0
+		LDA ($10),Y
+		STA $0200
+		JMP ($9010)
+		.org $8100
+		BRK`)
+	memory.bytes[0x10], memory.bytes[0x11] = 0x20, 0x90
+	memory.bytes[0x9010], memory.bytes[0x9011] = 0x00, 0x81
+	memory.bytes[IV_IRQ], memory.bytes[IV_IRQ+1] = 0x00, 0x80
+	log := accessLog{}
+	cpu := NewCPU6502(memory)
+	cpu.PC = 0x8000
+	cpu.AccessLogger = log
+	for i := 0; i < 6; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := accessLog{
+		0x8000: AccessOpcode, 0x8001: AccessOperand, 0x8002: AccessOperand,
+		0x8003: AccessOpcode, 0x8004: AccessOperand,
+		0x8005: AccessOpcode, 0x8006: AccessOperand,
+		0x8007: AccessOpcode, 0x8008: AccessOperand, 0x8009: AccessOperand,
+		0x800a: AccessOpcode, 0x800b: AccessOperand, 0x800c: AccessOperand,
+		0x8100: AccessOpcode | AccessIndirect,
+		0x9000: AccessData,
+		0x0010: AccessData, 0x0011: AccessData,
+		0x9020: AccessData | AccessIndirect,
+		0x9010: AccessData, 0x9011: AccessData,
+		IV_IRQ: AccessData, IV_IRQ + 1: AccessData,
+	}
+	for addr, kind := range expected {
+		if log[addr] != kind {
+			t.Errorf("$%04X logged as %d, expected %d", addr, log[addr], kind)
+		}
+	}
+	for addr, kind := range log {
+		if _, ok := expected[addr]; !ok {
+			t.Errorf("$%04X unexpectedly logged as %d", addr, kind)
+		}
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	memory := assemble(t, `
+		.org $8000
+main:	JSR fast
+		JSR slow
+		JMP main
+fast:	LDX #2
+f1:		DEX
+		BNE f1
+		RTS
+slow:	PLA		; discard the return address
+		PLA
+		JMP main`)
+	names := map[uint16]string{0x8000: "main", 0x8009: "fast", 0x800f: "slow"}
+	cpu := NewCPU6502(memory)
+	cpu.PC = 0x8000
+	cpu.Profiler = NewProfiler()
+	cpu.Profiler.Symbol = func(address uint16, bank int) string { return names[address] }
+	for i := 0; i < 1000; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.Profiler.Cycles() != cpu.Cycles {
+		t.Errorf("profiled %d cycles of %d", cpu.Profiler.Cycles(), cpu.Cycles)
+	}
+	cum := map[string]int64{}
+	depth := 0
+	for _, s := range cpu.Profiler.Profile().Sample {
+		if len(s.Location) > depth {
+			depth = len(s.Location)
+		}
+		seen := map[string]bool{}
+		for _, l := range s.Location {
+			if !seen[l.Function.Name] {
+				cum[l.Function.Name] += s.Value[1]
+				seen[l.Function.Name] = true
+			}
+		}
+	}
+	if depth != 2 {
+		t.Errorf("deepest stack is %d, expected 2 (slow drops its return address)", depth)
+	}
+	if cum["main"] != int64(cpu.Cycles) || cum["fast"] == 0 || cum["slow"] == 0 {
+		t.Errorf("cumulative cycles %v of %d", cum, cpu.Cycles)
+	}
+}
+
+type testSymbols map[uint16]string
+
+func (s testSymbols) Name(address uint16) string {
+	return s[address]
+}
+
+func (s testSymbols) Address(name string) (uint16, bool) {
+	for a, n := range s {
+		if n == name {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+func TestSymbols(t *testing.T) {
+	memory := assemble(t, `
+		.org $C000
+		LDX #$10
+	loop:
+		JSR $C00C
+		DEX
+		BNE loop
+		STA $2000
+		BRK
+		LDA $10
+		STA $0200,X
+		RTS`)
+	memory.bytes[IV_RESET] = 0x00
+	memory.bytes[IV_RESET+1] = 0xc0
+	syms := testSymbols{0xc002: "main_loop", 0xc00c: "update_player", 0x10: "player_x", 0x2000: "PPUCTRL", 0x0200: "oam"}
+
+	for _, tc := range []struct {
+		addr uint16
+		want string
+	}{
+		{0xc000, "#$10"},
+		{0xc002, "update_player"},
+		{0xc006, "main_loop"},
+		{0xc008, "PPUCTRL"},
+		{0xc00c, "player_x"},
+		{0xc00e, "oam,X"},
+	} {
+		op, value := memory.bytes[tc.addr], uint16(memory.bytes[tc.addr+1])|uint16(memory.bytes[tc.addr+2])<<8
+		spec := opcodes[op]
+		if spec.Size == 2 {
+			value &= 0xff
+		}
+		if s := spec.FormatArgumentsSymbolic(value, tc.addr+uint16(spec.Size), syms); s != tc.want {
+			t.Errorf("$%04X: got %q instead of %q", tc.addr, s, tc.want)
+		}
+	}
+
+	cpu := NewCPU6502(memory)
+	cpu.Symbols = syms
+	cpu.PC = 0xc002
+	if s := FormatTrace(cpu, TraceFCEUX, 0, 0); !strings.HasSuffix(s, "JSR update_player") {
+		t.Errorf("Trace doesn't use symbols: %s", s)
+	}
+	if _, err := cpu.AddBreakpoint(BreakExec, 0, 0xffff, "PC == player_x"); err != nil {
+		t.Fatal(err)
+	}
+	cpu.ClearBreakpoints()
+	if _, err := cpu.AddBreakpoint(BreakExec, 0, 0xffff, "PC == update_plyer"); err == nil {
+		t.Error("Expected a misspelled symbol to be rejected")
+	}
+	if _, err := cpu.AddBreakpoint(BreakWrite, 0, 0xffff, "ADDR == PPUCTRL"); err != nil {
+		t.Fatal(err)
+	}
+	cpu.PC = 0xc000
+	for i := 0; i < 100; i++ {
+		if _, err := cpu.Step(); err != nil {
+			var hit *BreakpointHit
+			if !errors.As(err, &hit) || hit.Address != 0x2000 || cpu.PC != 0xc00b {
+				t.Fatalf("Expected to stop after STA PPUCTRL: %s", err)
+			}
+			break
+		}
+	}
+
+	d := Disassemble(memory, VariantNMOS, 0xc000, 0xc011)
+	d.UseSymbols(syms)
+	if l, _ := d.Label(0xc00c); l != "update_player" {
+		t.Errorf("Label($C00C) = %q", l)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := d.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"PPUCTRL = $2000\n", "player_x = $10\n", "main_loop:\n", "JSR update_player", "STA oam,x"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Disassembly doesn't contain %q:\n%s", s, buf)
+		}
+	}
+	prog, err := Assemble(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(prog.Code, memory.bytes[0xc000:0xc012]) {
+		t.Errorf("Reassembled disassembly doesn't match")
+	}
+}
+
+func TestCallStack(t *testing.T) {
+	memory := assemble(t, `
+		.org $8000
+		LDX #$FF
+		TXS
+		JSR $8010
+		JMP $8006
+		.org $8010
+		JSR $8020
+		RTS
+		.org $8020
+		JSR $8030
+		BRK
+		.org $8030
+		PLA        ; discard the return address
+		PLA
+		JMP $8040
+		.org $8040
+		.byte $02  ; KIL
+		.org $8050
+		RTI
+		.org $FFFA
+		.word $8050`)
+	cpu := NewCPU6502(memory)
+	cpu.Symbols = testSymbols{0x8010: "outer", 0x8020: "inner"}
+	cpu.PC = 0x8000
+	for i := 0; i < 10 && cpu.PC != 0x8020; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []Frame{
+		{Kind: CallJSR, Entry: 0x8010, Caller: 0x8003, Return: 0x8006, SP: 0xfd},
+		{Kind: CallJSR, Entry: 0x8020, Caller: 0x8010, Return: 0x8013, SP: 0xfb},
+	}
+	if fmt.Sprint(cpu.CallStack()) != fmt.Sprint(want) {
+		t.Fatalf("Call stack is %v instead of %v", cpu.CallStack(), want)
+	}
+
+	// The NMI is taken after the JSR it arrives during
+	cpu.SetNMI(true)
+	cpu.Step()
+	cpu.Step()
+	if s := cpu.CallStack(); len(s) != 4 || s[3].Kind != CallNMI || s[3].Entry != 0x8050 || s[3].Caller != 0x8030 {
+		t.Fatalf("NMI not on the call stack: %v", s)
+	}
+	cpu.Step() // RTI
+	if len(cpu.CallStack()) != 3 {
+		t.Fatalf("RTI didn't pop the NMI: %v", cpu.CallStack())
+	}
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = cpu.Step()
+	}
+	var e *CPUError
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected a CPUError, got %v", err)
+	}
+	// The routine at $8030 discarded its return address so it's gone
+	backtrace := "#0 $8040 in inner+32\n#1 $8010 in outer (JSR)\n#2 $8003 in ? (JSR)"
+	if s := e.Backtrace.Format(cpu.Symbols); s != backtrace {
+		t.Errorf("Backtrace is\n%s\ninstead of\n%s", s, backtrace)
+	}
+	if !strings.HasSuffix(err.Error(), "\n"+backtrace) {
+		t.Errorf("Error doesn't include the backtrace: %s", err)
+	}
+
+	cpu.Reset()
+	if len(cpu.CallStack()) != 0 {
+		t.Errorf("Reset didn't clear the call stack")
+	}
+}
+
+func TestIOPort6510(t *testing.T) {
+	memory := assemble(t, `
+		.org $8000
+		lda #$ef
+		sta $00      ; P4 (cassette sense) is the only input
+		lda #$c5
+		sta $01      ; LORAM, CHAREN and bits 6 and 7 high
+		lda $01
+		sta $10
+		lda #$2f
+		sta $00      ; bits 6 and 7 become inputs
+		lda $01
+		sta $11
+		.org $fffc
+		.word $8000
+	`)
+	memory.bytes[0x0000] = 0x55
+	cpu := NewCPU6502Variant(memory, Variant6510)
+	cpu.PC = 0x8000
+	port := cpu.IOPort()
+	var changes []byte
+	port.Changed = func(pins byte) {
+		changes = append(changes, pins)
+	}
+	port.Input = func() byte {
+		return 0x2f // P4 low
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if memory.bytes[0x10] != 0xc5 || memory.bytes[0x11] != 0xc5 {
+		t.Errorf("Read $%02X and $%02X from $0001 instead of $C5", memory.bytes[0x10], memory.bytes[0x11])
+	}
+	if string(changes) != "\x00\xc5" {
+		t.Errorf("Changed was called with % X", changes)
+	}
+	if memory.bytes[0x0000] != 0x55 || cpu.Peek(0x0000) != 0x2f || port.Latch() != 0xc5 {
+		t.Errorf("Port writes reached memory or weren't latched")
+	}
+	s := cpu.Snapshot()
+	cpu.Cycles += PORT6510_FADE_CYCLES
+	if pins := port.Pins(); pins != 0x05 {
+		t.Errorf("Bits 6 and 7 didn't fade: pins are $%02X", pins)
+	}
+
+	cpu.Reset()
+	if port.DDR() != 0 || len(changes) != 3 || changes[2] != 0x2f {
+		t.Errorf("Reset left DDR $%02X and called Changed with % X", port.DDR(), changes)
+	}
+	cpu.Restore(s)
+	if port.DDR() != 0x2f || port.Pins() != 0xc5 {
+		t.Errorf("Restore left DDR $%02X and pins $%02X", port.DDR(), port.Pins())
+	}
+	if NewCPU6502(memory).IOPort() != nil {
+		t.Errorf("NMOS 6502 has an I/O port")
+	}
+
+	// Mapping page 0 would bypass the port
+	cpu.MapPages(0x01, 0x01, make([]byte, 256), true)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MapPages mapped page 0 on a 6510")
+		}
+	}()
+	cpu.MapPages(0x00, 0x01, make([]byte, 512), true)
+}
@@ -0,0 +1,87 @@
+package cpu6502
+
+// AccessKind says how an instruction used a byte of memory.
+type AccessKind int
+
+const (
+	AccessOpcode  AccessKind = 1 << iota // fetched as the first byte of an instruction
+	AccessOperand                        // fetched as an operand byte of an instruction
+	AccessData                           // read as data (including pointers and vectors)
+	// AccessIndirect is ORed into the above for code reached through an
+	// indirect jump and data read through a pointer
+	AccessIndirect
+)
+
+// AccessLogger, if set on the CPU, is told about each byte read as code or
+// data, e.g. to build a code/data log. Code is logged when the instruction
+// is fetched and data as it's read, so both are logged before the
+// instruction has any effect (such as switching banks). Dummy reads, stack
+// accesses and writes aren't logged.
+type AccessLogger interface {
+	LogAccess(address uint16, kind AccessKind)
+}
+
+// logCode logs the bytes of the instruction at pc
+func (cpu *CPU6502) logCode(pc uint16, opcode OpcodeSpec) {
+	indirect := AccessKind(0)
+	if cpu.indirectJump {
+		indirect = AccessIndirect
+		cpu.indirectJump = false
+	}
+	cpu.AccessLogger.LogAccess(pc, AccessOpcode|indirect)
+	for i := 1; i < opcode.Size; i++ {
+		cpu.AccessLogger.LogAccess(pc+uint16(i), AccessOperand|indirect)
+	}
+}
+
+// logData logs the data read by an instruction once its addressing mode
+// has been performed
+func (cpu *CPU6502) logData(pc uint16, opcode OpcodeSpec, addr uint16) {
+	switch opcode.AddressingMode {
+	case AMIndirect, AMAbsoluteIndirectX:
+		// The pointer is read as data and the target is indirect code
+		ptr := uint16(cpu.memory.ReadByte(pc+1, true)) | uint16(cpu.memory.ReadByte(pc+2, true))<<8
+		if opcode.AddressingMode == AMAbsoluteIndirectX {
+			ptr += uint16(cpu.X)
+		}
+		hi := ptr + 1
+		if opcode.AddressingMode == AMIndirect && !cpu.variant.cmos() {
+			hi = ptr&0xff00 | (ptr+1)&0x00ff
+		}
+		cpu.AccessLogger.LogAccess(ptr, AccessData)
+		cpu.AccessLogger.LogAccess(hi, AccessData)
+		cpu.indirectJump = true
+		return
+	case AMZeroPageRelative:
+		cpu.AccessLogger.LogAccess(uint16(cpu.memory.ReadByte(pc+1, true)), AccessData)
+		return
+	case AMIndirectX, AMIndirectY, AMZeroPageIndirect:
+		// Zero page pointer
+		ptr := cpu.memory.ReadByte(pc+1, true)
+		if opcode.AddressingMode == AMIndirectX {
+			ptr += cpu.X
+		}
+		cpu.AccessLogger.LogAccess(uint16(ptr), AccessData)
+		cpu.AccessLogger.LogAccess(uint16(ptr+1), AccessData)
+	}
+	if !opcode.Instruction.Read {
+		return
+	}
+	switch opcode.AddressingMode {
+	case AMZeroPage, AMZeroPageX, AMZeroPageY, AMAbsolute, AMAbsoluteX, AMAbsoluteY:
+		cpu.AccessLogger.LogAccess(addr, AccessData)
+	case AMIndirectX, AMIndirectY, AMZeroPageIndirect:
+		cpu.AccessLogger.LogAccess(addr, AccessData|AccessIndirect)
+	}
+}
+
+// readVector reads the address in an interrupt vector
+func (cpu *CPU6502) readVector(vector uint16) uint16 {
+	addr := uint16(cpu.read(vector)) | uint16(cpu.read(vector+1))<<8
+	cpu.indirectJump = false
+	if cpu.AccessLogger != nil {
+		cpu.AccessLogger.LogAccess(vector, AccessData)
+		cpu.AccessLogger.LogAccess(vector+1, AccessData)
+	}
+	return addr
+}
@@ -0,0 +1,405 @@
+package cpu6502
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Program is the output of the assembler
+type Program struct {
+	Origin uint16
+	Code   []byte
+	Labels map[string]uint16
+}
+
+// Load copies the program into memory at its origin
+func (p *Program) Load(memory MemoryAccess) {
+	for i, b := range p.Code {
+		memory.WriteByte(p.Origin+uint16(i), b)
+	}
+}
+
+type asmLine struct {
+	num     int
+	label   string
+	name    string // mnemonic or directive (upper case)
+	operand string
+
+	mode int // addressing mode chosen in the first pass
+}
+
+type assembler struct {
+	lines   []*asmLine
+	symbols map[string]int
+	pc      int
+	origin  int
+	code    []byte
+	pass    int
+}
+
+var (
+	// asmOpcodes maps mnemonics (both the opcode table's and ca65's names)
+	// and addressing modes to opcodes
+	asmOpcodes  = map[ca65Key]int{}
+	asmMnemonic = map[string]bool{}
+)
+
+func init() {
+	// Same priority as ca65Opcodes (documented opcodes first)
+	for pass := 0; pass < 2; pass++ {
+		for _, op := range opcodes {
+			documented := op.Instruction.Num < I_KIL.Num && op.Instruction.Name != I_SB2.Name
+			if documented != (pass == 0) {
+				continue
+			}
+			for _, name := range []string{op.Instruction.Name, ca65Name(op.Instruction.Name)} {
+				key := ca65Key{name, op.AddressingMode}
+				if _, ok := asmOpcodes[key]; !ok {
+					asmOpcodes[key] = op.Opcode
+				}
+				asmMnemonic[name] = true
+			}
+		}
+	}
+}
+
+// Assemble is a small two-pass 6502 assembler. Source lines look like
+//
+//	label:  MNEMONIC operand   ; comment
+//	name = expression
+//	        .org $8000
+//	        .byte 1, 2, "text"
+//	        .word label, $1234
+//
+// Mnemonics are the names used in the opcode table plus the ca65 6502X names
+// for the undocumented opcodes (SAX, ANC, ALR, JAM, ...). Operands use the
+// usual syntax (#imm, zp, zp,X, abs,Y, (ind), (zp,X), (zp),Y, A) and
+// expressions (see expr.go). Zero page addressing is used when the operand is
+// known to fit in the first pass; the ca65 a: and z: prefixes force absolute
+// or zero page addressing.
+func Assemble(source string) (*Program, error) {
+	a := &assembler{symbols: make(map[string]int), origin: -1}
+	for i, text := range strings.Split(source, "\n") {
+		line, err := parseAsmLine(i+1, text)
+		if err != nil {
+			return nil, err
+		}
+		if line != nil {
+			a.lines = append(a.lines, line)
+		}
+	}
+
+	for a.pass = 1; a.pass <= 2; a.pass++ {
+		a.pc = 0
+		a.code = a.code[:0]
+		for _, line := range a.lines {
+			if err := a.assembleLine(line); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.num, err)
+			}
+		}
+	}
+
+	prog := &Program{Code: a.code, Labels: make(map[string]uint16)}
+	if a.origin >= 0 {
+		prog.Origin = uint16(a.origin)
+	}
+	for name, v := range a.symbols {
+		prog.Labels[name] = uint16(v)
+	}
+	return prog, nil
+}
+
+// parseAsmLine splits a line into label, mnemonic/directive and operand
+func parseAsmLine(num int, text string) (*asmLine, error) {
+	// Strip comments (ignoring ; inside quotes)
+	inQuote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if inQuote != 0 {
+			if c == inQuote {
+				inQuote = 0
+			}
+		} else if c == '"' || (c == '\'' && i+2 < len(text) && text[i+2] == '\'') {
+			inQuote = c
+		} else if c == ';' {
+			text = text[:i]
+			break
+		}
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+
+	line := &asmLine{num: num}
+	if i := strings.Index(text, ":"); i > 0 && isSymbol(text[:i]) {
+		line.label = text[:i]
+		text = strings.TrimSpace(text[i+1:])
+	} else if i := strings.Index(text, "="); i > 0 && isSymbol(strings.TrimSpace(text[:i])) {
+		line.label = strings.TrimSpace(text[:i])
+		line.name = "="
+		line.operand = strings.TrimSpace(text[i+1:])
+		return line, nil
+	}
+
+	line.name = text
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		line.name, line.operand = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	line.name = strings.ToUpper(line.name)
+	return line, nil
+}
+
+func isSymbol(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !isSymbolChar(c, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) resolve(name string) (int, bool) {
+	if name == "*" {
+		return a.pc, true
+	}
+	v, ok := a.symbols[name]
+	return v, ok
+}
+
+// eval evaluates an expression. In the first pass undefined symbols are
+// allowed (they're forward references) and reported through the bool.
+func (a *assembler) eval(s string) (int, bool, error) {
+	e, err := parseExpr(s)
+	if err != nil {
+		return 0, false, err
+	}
+	v, err := e.eval(a.resolve)
+	if errors.Is(err, errUndefined) && a.pass == 1 {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+func (a *assembler) emit(b ...byte) {
+	if a.origin < 0 {
+		a.origin = a.pc
+	}
+	if off := a.pc - a.origin; off > len(a.code) {
+		a.code = append(a.code, make([]byte, off-len(a.code))...)
+	}
+	a.code = append(a.code, b...)
+	a.pc += len(b)
+}
+
+func (a *assembler) define(name string, value int) error {
+	if v, ok := a.symbols[name]; ok && a.pass == 1 && v != value {
+		return fmt.Errorf("symbol %s redefined", name)
+	}
+	a.symbols[name] = value
+	return nil
+}
+
+func (a *assembler) assembleLine(line *asmLine) error {
+	if line.name == "=" {
+		v, ok, err := a.eval(line.operand)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s must be defined before use", line.operand)
+		}
+		return a.define(line.label, v)
+	}
+	if line.label != "" {
+		if err := a.define(line.label, a.pc); err != nil {
+			return err
+		}
+	}
+	if line.name == "" {
+		return nil
+	}
+
+	if line.name[0] == '.' {
+		return a.directive(line)
+	}
+	return a.instruction(line)
+}
+
+func (a *assembler) directive(line *asmLine) error {
+	switch line.name {
+	case ".ORG":
+		v, ok, err := a.eval(line.operand)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New(".org must be defined before use")
+		}
+		if v < a.pc {
+			return fmt.Errorf(".org $%04X moves backwards", v)
+		}
+		a.pc = v
+	case ".BYTE", ".DB":
+		for _, arg := range splitArgs(line.operand) {
+			if len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"' {
+				a.emit([]byte(arg[1 : len(arg)-1])...)
+				continue
+			}
+			v, _, err := a.eval(arg)
+			if err != nil {
+				return err
+			}
+			if v < -128 || v > 255 {
+				return fmt.Errorf("byte value %d out of range", v)
+			}
+			a.emit(byte(v))
+		}
+	case ".WORD", ".DW":
+		for _, arg := range splitArgs(line.operand) {
+			v, _, err := a.eval(arg)
+			if err != nil {
+				return err
+			}
+			a.emit(byte(v), byte(v>>8))
+		}
+	case ".SETCPU":
+		// Only the NMOS 6502 (with undocumented opcodes) is supported
+	default:
+		return fmt.Errorf("unknown directive %s", line.name)
+	}
+	return nil
+}
+
+// splitArgs splits a comma separated list ignoring commas in quotes
+func splitArgs(s string) []string {
+	var args []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuote = !inQuote
+		case ',':
+			if !inQuote {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+func (a *assembler) instruction(line *asmLine) error {
+	name := line.name
+	has := func(mode int) bool {
+		_, ok := asmOpcodes[ca65Key{name, mode}]
+		return ok
+	}
+	if !asmMnemonic[name] {
+		return fmt.Errorf("unknown instruction %s", name)
+	}
+
+	operand := line.operand
+	upper := strings.ToUpper(operand)
+	var mode int
+	var arg string
+	switch {
+	case operand == "" && has(AMImplied):
+		mode = AMImplied
+	case (operand == "" || upper == "A") && has(AMAccumulator):
+		mode = AMAccumulator
+	case strings.HasPrefix(operand, "#"):
+		mode, arg = AMImmediate, operand[1:]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(strings.Replace(upper, " ", "", -1), ",X)"):
+		mode, arg = AMIndirectX, operand[1:strings.LastIndex(operand, ",")]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(strings.Replace(upper, " ", "", -1), "),Y"):
+		mode, arg = AMIndirectY, operand[1:strings.LastIndex(operand, ")")]
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")") && has(AMIndirect):
+		mode, arg = AMIndirect, operand[1:len(operand)-1]
+	default:
+		arg = operand
+		index := ""
+		if i := strings.LastIndex(arg, ","); i > 0 {
+			index = strings.TrimSpace(upper[i+1:])
+			arg = arg[:i]
+		}
+		arg = strings.TrimSpace(arg)
+		force := ""
+		if len(arg) > 2 && (arg[:2] == "a:" || arg[:2] == "A:" || arg[:2] == "z:" || arg[:2] == "Z:") {
+			force = strings.ToLower(arg[:1])
+			arg = arg[2:]
+		}
+		abs, zp := AMAbsolute, AMZeroPage
+		switch index {
+		case "":
+			if has(AMRelative) {
+				abs, zp = AMRelative, AMRelative
+			}
+		case "X":
+			abs, zp = AMAbsoluteX, AMZeroPageX
+		case "Y":
+			abs, zp = AMAbsoluteY, AMZeroPageY
+		default:
+			return fmt.Errorf("bad index register %s", index)
+		}
+		if a.pass == 1 {
+			v, known, err := a.eval(arg)
+			if err != nil {
+				return err
+			}
+			useZP := has(zp) && (force == "z" || (force == "" && known && v >= 0 && v < 0x100))
+			if !has(abs) || useZP {
+				mode = zp
+			} else {
+				mode = abs
+			}
+		} else {
+			mode = line.mode
+		}
+	}
+	if a.pass == 1 {
+		line.mode = mode
+	}
+
+	op, ok := asmOpcodes[ca65Key{name, mode}]
+	if !ok {
+		return fmt.Errorf("%s doesn't support that addressing mode", name)
+	}
+	size := opcodes[op].Size
+	if mode == AMImplied || mode == AMAccumulator {
+		a.emit(byte(op))
+		return nil
+	}
+
+	v, _, err := a.eval(arg)
+	if err != nil {
+		return err
+	}
+	if mode == AMRelative {
+		if a.pass == 2 {
+			v -= a.pc + 2
+			if v < -128 || v > 127 {
+				return fmt.Errorf("branch out of range (%d)", v)
+			}
+		}
+		a.emit(byte(op), byte(v))
+		return nil
+	}
+	if size == 2 {
+		if a.pass == 2 && (v < -128 || v > 255) {
+			return fmt.Errorf("operand $%X doesn't fit in a byte", v)
+		}
+		a.emit(byte(op), byte(v))
+	} else {
+		a.emit(byte(op), byte(v), byte(v>>8))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package cpu6502
+
+import (
+	"testing"
+)
+
+// benchmarkProgram is a mix of loads, stores, arithmetic, read-modify-write,
+// branches and subroutine calls
+const benchmarkProgram = `
+		.org $8000
+start:	LDX #0
+loop:	LDA $0200,X
+		CLC
+		ADC #1
+		STA $0200,X
+		INC $10
+		LDY $10
+		EOR ($20),Y
+		DEX
+		BNE loop
+		JSR sub
+		JMP start
+sub:	PHA
+		PLA
+		RTS`
+
+func benchmarkStep(b *testing.B, setup func(cpu *CPU6502, memory *flatMemory)) {
+	prog, err := Assemble(benchmarkProgram)
+	if err != nil {
+		b.Fatal(err)
+	}
+	memory := &flatMemory{}
+	copy(memory[prog.Origin:], prog.Code)
+	cpu := NewCPU6502(memory)
+	cpu.PC = prog.Origin
+	if setup != nil {
+		setup(cpu, memory)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cpu.Step(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instr/s")
+}
+
+func BenchmarkStep(b *testing.B) {
+	benchmarkStep(b, nil)
+}
+
+func BenchmarkStepMappedPages(b *testing.B) {
+	benchmarkStep(b, func(cpu *CPU6502, memory *flatMemory) {
+		cpu.MapPages(0x00, 0xff, memory[:], true)
+	})
+}
@@ -0,0 +1,244 @@
+package cpu6502
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrBreakpoint = errors.New("breakpoint")
+
+// BreakKind says what a breakpoint watches.
+type BreakKind int
+
+const (
+	BreakExec  BreakKind = 1 << iota // an instruction is fetched from the range
+	BreakRead                        // the range is read (including dummy reads)
+	BreakWrite                       // the range is written
+)
+
+func (k BreakKind) String() string {
+	var kinds []string
+	for _, n := range []struct {
+		kind BreakKind
+		name string
+	}{{BreakExec, "exec"}, {BreakRead, "read"}, {BreakWrite, "write"}} {
+		if k&n.kind != 0 {
+			kinds = append(kinds, n.name)
+		}
+	}
+	if len(kinds) == 0 {
+		return fmt.Sprintf("BreakKind(%d)", int(k))
+	}
+	return strings.Join(kinds, "|")
+}
+
+// Breakpoint stops execution when an address in Start-End (inclusive) is
+// executed, read or written and Condition (if any) is true. The condition is
+// an expression (see expr.go) that can use the registers A, X, Y, SP, P and PC,
+// the flags C, Z, I, D, V and N, and for reads and writes ADDR and VALUE.
+// These names are case insensitive. Any other name is looked up in the CPU's
+// Symbols (e.g. "ADDR == player_x").
+type Breakpoint struct {
+	ID        int
+	Kind      BreakKind
+	Start     uint16
+	End       uint16
+	Condition string
+	Disabled  bool
+
+	cond expr
+}
+
+func (b *Breakpoint) String() string {
+	s := fmt.Sprintf("#%d %s $%04X", b.ID, b.Kind, b.Start)
+	if b.End != b.Start {
+		s += fmt.Sprintf("-$%04X", b.End)
+	}
+	if b.Condition != "" {
+		s += " if " + b.Condition
+	}
+	return s
+}
+
+// BreakpointHit is the error returned by Step when a breakpoint is hit. An
+// execution breakpoint stops before the instruction runs (Step returns 0
+// cycles) and calling Step again executes it. A read or write breakpoint
+// stops after the instruction that made the access has completed. State is
+// the CPU state when Step returned.
+type BreakpointHit struct {
+	Breakpoint *Breakpoint
+	Kind       BreakKind // kind of access that triggered the breakpoint
+	Address    uint16
+	Value      byte // value read or written
+	State      Registers
+}
+
+func (h *BreakpointHit) Error() string {
+	return fmt.Sprintf("cpu6502: %s at $%04X (%s) %s", ErrBreakpoint, h.Address, h.Breakpoint, h.State)
+}
+
+func (h *BreakpointHit) Unwrap() error {
+	return ErrBreakpoint
+}
+
+// AddBreakpoint adds a breakpoint for kind (which may be several kinds ORed
+// together) on start-end with an optional condition and returns it.
+func (cpu *CPU6502) AddBreakpoint(kind BreakKind, start, end uint16, condition string) (*Breakpoint, error) {
+	if end < start {
+		return nil, fmt.Errorf("breakpoint range $%04X-$%04X is backwards", start, end)
+	}
+	b := &Breakpoint{Kind: kind, Start: start, End: end, Condition: condition}
+	if strings.TrimSpace(condition) != "" {
+		e, err := parseExpr(condition)
+		if err != nil {
+			return nil, err
+		}
+		// Catch misspelled names now rather than silently never breaking
+		if _, err := e.eval(cpu.breakResolver(0, 0)); errors.Is(err, errUndefined) {
+			return nil, err
+		}
+		b.cond = e
+	}
+	cpu.nextBreakID++
+	b.ID = cpu.nextBreakID
+	cpu.breakpoints = append(cpu.breakpoints, b)
+	cpu.updateBreakKinds()
+	return b, nil
+}
+
+// RemoveBreakpoint removes the breakpoint with the given ID. It returns false
+// if there's no such breakpoint.
+func (cpu *CPU6502) RemoveBreakpoint(id int) bool {
+	for i, b := range cpu.breakpoints {
+		if b.ID == id {
+			cpu.breakpoints = append(cpu.breakpoints[:i], cpu.breakpoints[i+1:]...)
+			cpu.updateBreakKinds()
+			return true
+		}
+	}
+	return false
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (cpu *CPU6502) ClearBreakpoints() {
+	cpu.breakpoints = nil
+	cpu.updateBreakKinds()
+}
+
+// Breakpoints returns the current breakpoints. Use EnableBreakpoint rather
+// than setting Disabled directly.
+func (cpu *CPU6502) Breakpoints() []*Breakpoint {
+	return cpu.breakpoints
+}
+
+// EnableBreakpoint enables or disables the breakpoint with the given ID. It
+// returns false if there's no such breakpoint.
+func (cpu *CPU6502) EnableBreakpoint(id int, enabled bool) bool {
+	for _, b := range cpu.breakpoints {
+		if b.ID == id {
+			b.Disabled = !enabled
+			cpu.updateBreakKinds()
+			return true
+		}
+	}
+	return false
+}
+
+// updateBreakKinds recomputes the kinds of enabled breakpoints so the checks
+// cost a single test when there are none.
+func (cpu *CPU6502) updateBreakKinds() {
+	cpu.breakKinds = 0
+	for _, b := range cpu.breakpoints {
+		if !b.Disabled {
+			cpu.breakKinds |= b.Kind
+		}
+	}
+}
+
+// Evaluate evaluates an expression using the names breakpoint conditions
+// can use (registers, flags and symbols) with the current CPU state. ADDR
+// and VALUE are 0.
+func (cpu *CPU6502) Evaluate(expression string) (int, error) {
+	return Eval(expression, cpu.breakResolver(0, 0))
+}
+
+// breakResolver resolves register and symbol names in breakpoint conditions
+func (cpu *CPU6502) breakResolver(addr uint16, value byte) func(string) (int, bool) {
+	return func(name string) (int, bool) {
+		if v, ok := cpu.resolveRegister(name, addr, value); ok {
+			return v, true
+		}
+		if cpu.Symbols != nil {
+			if a, ok := cpu.Symbols.Address(name); ok {
+				return int(a), true
+			}
+		}
+		return 0, false
+	}
+}
+
+// resolveRegister resolves the register names of breakpoint conditions
+func (cpu *CPU6502) resolveRegister(name string, addr uint16, value byte) (int, bool) {
+	switch strings.ToUpper(name) {
+	case "A":
+		return int(cpu.A), true
+	case "X":
+		return int(cpu.X), true
+	case "Y":
+		return int(cpu.Y), true
+	case "SP", "S":
+		return int(cpu.SP), true
+	case "P":
+		return int(cpu.GetP()), true
+	case "PC":
+		return int(cpu.PC), true
+	case "C":
+		return boolInt(cpu.CarryFlag), true
+	case "Z":
+		return boolInt(cpu.ZeroFlag), true
+	case "I":
+		return boolInt(cpu.InterruptsDisabledFlag), true
+	case "D":
+		return boolInt(cpu.DecimalFlag), true
+	case "V":
+		return boolInt(cpu.OverflowFlag), true
+	case "N":
+		return boolInt(cpu.SignFlag), true
+	case "ADDR":
+		return int(addr), true
+	case "VALUE":
+		return int(value), true
+	}
+	return 0, false
+}
+
+// checkBreakpoints returns the first enabled breakpoint of the given kind
+// that covers addr and whose condition is true. Conditions that fail to
+// evaluate (e.g. division by zero) are treated as false.
+func (cpu *CPU6502) checkBreakpoints(kind BreakKind, addr uint16, value byte) *BreakpointHit {
+	for _, b := range cpu.breakpoints {
+		if b.Disabled || b.Kind&kind == 0 || addr < b.Start || addr > b.End {
+			continue
+		}
+		if b.cond != nil {
+			if v, err := b.cond.eval(cpu.breakResolver(addr, value)); err != nil || v == 0 {
+				continue
+			}
+		}
+		return &BreakpointHit{
+			Breakpoint: b,
+			Kind:       kind,
+			Address:    addr,
+			Value:      value,
+			State:      cpu.Registers()}
+	}
+	return nil
+}
+
+// watch records the first read or write breakpoint hit by an instruction
+func (cpu *CPU6502) watch(kind BreakKind, addr uint16, value byte) {
+	if cpu.breakHit == nil {
+		cpu.breakHit = cpu.checkBreakpoints(kind, addr, value)
+	}
+}
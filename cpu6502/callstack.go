@@ -0,0 +1,127 @@
+package cpu6502
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CallKind says how a routine in the call stack was entered.
+type CallKind int
+
+const (
+	CallJSR CallKind = iota
+	CallBRK
+	CallIRQ
+	CallNMI
+)
+
+func (k CallKind) String() string {
+	switch k {
+	case CallJSR:
+		return "JSR"
+	case CallBRK:
+		return "BRK"
+	case CallIRQ:
+		return "IRQ"
+	case CallNMI:
+		return "NMI"
+	}
+	return fmt.Sprintf("CallKind(%d)", int(k))
+}
+
+// Frame is a routine on the CPU's shadow call stack.
+type Frame struct {
+	Kind   CallKind
+	Entry  uint16 // start of the routine
+	Caller uint16 // the JSR or BRK, or the instruction that was interrupted
+	Return uint16 // address the routine should return to
+	SP     byte   // stack pointer once the return address (and P) were pushed
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%s $%04X from $%04X", f.Kind, f.Entry, f.Caller)
+}
+
+// maxCallDepth limits the shadow call stack. The 6502's stack can't hold
+// more than 128 return addresses so anything deeper has been overwritten.
+const maxCallDepth = 128
+
+// pushCall adds a frame for a routine just entered
+func (cpu *CPU6502) pushCall(kind CallKind, caller, ret uint16) {
+	if len(cpu.calls) == maxCallDepth {
+		copy(cpu.calls, cpu.calls[1:])
+		cpu.calls = cpu.calls[:maxCallDepth-1]
+	}
+	cpu.calls = append(cpu.calls, Frame{Kind: kind, Entry: cpu.PC, Caller: caller, Return: ret, SP: cpu.SP})
+}
+
+// unwindCalls pops the frames whose return address has been pulled off the
+// stack
+func (cpu *CPU6502) unwindCalls() {
+	for n := len(cpu.calls); n > 0 && cpu.SP > cpu.calls[n-1].SP; n-- {
+		cpu.calls = cpu.calls[:n-1]
+	}
+}
+
+// CallStack returns the frames of the shadow call stack, outermost first.
+// The slice is only valid until the next Step.
+//
+// The CPU tracks the routines entered by JSR, BRK and interrupts. A frame is
+// popped once the stack pointer moves above the return address it pushed,
+// so RTS, RTI and routines that discard their return address (PLA PLA, TXS)
+// are all handled without trusting the return address on the stack.
+func (cpu *CPU6502) CallStack() []Frame {
+	return cpu.calls
+}
+
+// Backtrace is the call stack at a point in execution.
+type Backtrace struct {
+	PC     uint16
+	Frames []Frame // innermost first
+}
+
+// Backtrace returns the current call stack.
+func (cpu *CPU6502) Backtrace() Backtrace {
+	b := Backtrace{PC: cpu.PC, Frames: make([]Frame, len(cpu.calls))}
+	for i, f := range cpu.calls {
+		b.Frames[len(cpu.calls)-1-i] = f
+	}
+	return b
+}
+
+// Format returns a line for each level of the backtrace, innermost first,
+// giving the address executing at that level, the routine it's in (by name
+// if symbols has one) and how the level above was entered:
+//
+//	#0 $C105 in update_player+5
+//	#1 $C002 in main_loop (JSR)
+//	#2 $C010 in ? (NMI)
+//
+// The outermost routine's start is unknown so it's shown as "?".
+func (b Backtrace) Format(symbols Symbols) string {
+	var lines []string
+	pc := b.PC
+	for i := 0; i <= len(b.Frames); i++ {
+		routine := "?"
+		if i < len(b.Frames) {
+			entry := b.Frames[i].Entry
+			routine = symbolOr(symbols, entry, "$%04X")
+			if pc > entry {
+				routine += fmt.Sprintf("+%d", pc-entry)
+			}
+		}
+		line := fmt.Sprintf("#%d $%04X in %s", i, pc, routine)
+		if i > 0 {
+			line += fmt.Sprintf(" (%s)", b.Frames[i-1].Kind)
+		}
+		lines = append(lines, line)
+		if i < len(b.Frames) {
+			pc = b.Frames[i].Caller
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (b Backtrace) String() string {
+	return b.Format(nil)
+}
@@ -0,0 +1,206 @@
+package cpu6502
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Result of an ADC or SBC
+type arith struct {
+	a          byte
+	n, v, z, c bool
+}
+
+func (r arith) String() string {
+	return fmt.Sprintf("A=$%02X N=%d V=%d Z=%d C=%d", r.a, boolInt(r.n), boolInt(r.v), boolInt(r.z), boolInt(r.c))
+}
+
+// The reference models are written the way VICE does them rather than
+// following Bruce Clark's description like the CPU does.
+
+func binaryADC(a, b byte, c int) arith {
+	sum := uint(a) + uint(b) + uint(c)
+	return arith{a: byte(sum), n: sum&0x80 != 0, z: sum&0xff == 0, c: sum > 0xff,
+		v: (a^b)&0x80 == 0 && (uint(a)^sum)&0x80 != 0}
+}
+
+func binarySBC(a, b byte, c int) arith {
+	diff := uint(a) - uint(b) - uint(1-c)
+	return arith{a: byte(diff), n: diff&0x80 != 0, z: diff&0xff == 0, c: diff < 0x100,
+		v: (a^b)&0x80 != 0 && (uint(a)^diff)&0x80 != 0}
+}
+
+func nmosADC(a, b byte, c int) arith {
+	tmp := uint(a&0x0f) + uint(b&0x0f) + uint(c)
+	if tmp > 9 {
+		tmp += 6
+	}
+	if tmp <= 0x0f {
+		tmp = tmp&0x0f + uint(a&0xf0) + uint(b&0xf0)
+	} else {
+		tmp = tmp&0x0f + uint(a&0xf0) + uint(b&0xf0) + 0x10
+	}
+	r := arith{
+		z: (uint(a)+uint(b)+uint(c))&0xff == 0,
+		n: tmp&0x80 != 0,
+		v: (uint(a)^tmp)&0x80 != 0 && (a^b)&0x80 == 0}
+	if tmp&0x1f0 > 0x90 {
+		tmp += 0x60
+	}
+	r.c = tmp&0xff0 > 0xf0
+	r.a = byte(tmp)
+	return r
+}
+
+func nmosSBC(a, b byte, c int) arith {
+	r := binarySBC(a, b, c)
+	tmp := uint(a&0x0f) - uint(b&0x0f) - uint(1-c)
+	if tmp&0x10 != 0 {
+		tmp = (tmp-6)&0x0f | (uint(a&0xf0) - uint(b&0xf0) - 0x10)
+	} else {
+		tmp = tmp&0x0f | (uint(a&0xf0) - uint(b&0xf0))
+	}
+	if tmp&0x100 != 0 {
+		tmp -= 0x60
+	}
+	r.a = byte(tmp)
+	return r
+}
+
+// The 65C02 gets the same result and V as the NMOS 6502 for ADC, and C and
+// V from the binary subtraction for SBC, but N and Z are from the result
+func cmosADC(a, b byte, c int) arith {
+	r := nmosADC(a, b, c)
+	r.n, r.z = r.a&0x80 != 0, r.a == 0
+	return r
+}
+
+func cmosSBC(a, b byte, c int) arith {
+	r := binarySBC(a, b, c)
+	tmp := uint(a) - uint(b) - uint(1-c)
+	if tmp&0x8000 != 0 { // borrow out of the high digit
+		tmp -= 0x60
+	}
+	if (uint(a&0x0f)-uint(b&0x0f)-uint(1-c))&0x8000 != 0 {
+		tmp -= 0x06
+	}
+	r.a = byte(tmp)
+	r.n, r.z = r.a&0x80 != 0, r.a == 0
+	return r
+}
+
+// rraNMOS and iscNMOS are the undocumented read-modify-write versions
+func rraNMOS(a, b byte, c int) arith {
+	return nmosADC(a, b>>1|byte(c)<<7, int(b&1))
+}
+
+func iscNMOS(a, b byte, c int) arith {
+	return nmosSBC(a, b+1, c)
+}
+
+// runArith runs "opcode $10" with A, the carry and the byte at $10 set and
+// returns the result
+func runArith(cpu *CPU6502, memory *TestMemory, opcode, a, b byte, c int) arith {
+	memory.bytes[0x200], memory.bytes[0x201], memory.bytes[0x10] = opcode, 0x10, b
+	memory.cycles = memory.cycles[:0]
+	cpu.PC, cpu.A, cpu.CarryFlag = 0x200, a, c != 0
+	cpu.Step()
+	return arith{a: cpu.A, n: cpu.SignFlag, v: cpu.OverflowFlag, z: cpu.ZeroFlag, c: cpu.CarryFlag}
+}
+
+func TestDecimalMode(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		variant Variant
+		opcode  byte // zero page
+		decimal bool
+		ref     func(a, b byte, c int) arith
+	}{
+		{"6502 ADC", VariantNMOS, 0x65, false, binaryADC},
+		{"6502 SBC", VariantNMOS, 0xe5, false, binarySBC},
+		{"6502 decimal ADC", VariantNMOS, 0x65, true, nmosADC},
+		{"6502 decimal SBC", VariantNMOS, 0xe5, true, nmosSBC},
+		{"6502 decimal RRA", VariantNMOS, 0x67, true, rraNMOS},
+		{"6502 decimal ISC", VariantNMOS, 0xe7, true, iscNMOS},
+		{"2A03 decimal ADC", Variant2A03, 0x65, true, binaryADC},
+		{"2A03 decimal SBC", Variant2A03, 0xe5, true, binarySBC},
+		{"65C02 ADC", Variant65C02, 0x65, false, binaryADC},
+		{"65C02 SBC", Variant65C02, 0xe5, false, binarySBC},
+		{"65C02 decimal ADC", Variant65C02, 0x65, true, cmosADC},
+		{"65C02 decimal SBC", Variant65C02, 0xe5, true, cmosSBC},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			memory := NewTestMemory(nil)
+			cpu := NewCPU6502Variant(memory, tc.variant)
+			cpu.DecimalFlag = tc.decimal
+			failures := 0
+			for i := 0; i < 0x20000; i++ {
+				a, b, c := byte(i>>9), byte(i>>1), i&1
+				want := tc.ref(a, b, c)
+				if got := runArith(cpu, memory, tc.opcode, a, b, c); got != want {
+					t.Errorf("$%02X, $%02X, C=%d gave %s instead of %s", a, b, c, got, want)
+					if failures++; failures == 10 {
+						t.FailNow()
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDecimalModeBCD checks the results are right for valid BCD on the
+// variants that have decimal mode, whatever their flags do.
+func TestDecimalModeBCD(t *testing.T) {
+	bcd := func(n int) byte { return byte(n/10<<4 | n%10) }
+	for _, variant := range []Variant{VariantNMOS, Variant65C02} {
+		memory := NewTestMemory(nil)
+		cpu := NewCPU6502Variant(memory, variant)
+		cpu.DecimalFlag = true
+		for x := 0; x < 100; x++ {
+			for y := 0; y < 100; y++ {
+				for c := 0; c < 2; c++ {
+					sum := x + y + c
+					if r := runArith(cpu, memory, 0x65, bcd(x), bcd(y), c); r.a != bcd(sum%100) || r.c != (sum > 99) {
+						t.Fatalf("%s: %d + %d + %d gave %s", variant, x, y, c, r)
+					}
+					diff := x - y - (1 - c)
+					if r := runArith(cpu, memory, 0xe5, bcd(x), bcd(y), c); r.a != bcd((diff+100)%100) || r.c != (diff >= 0) {
+						t.Fatalf("%s: %d - %d - %d gave %s", variant, x, y, 1-c, r)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecimalModeFlags(t *testing.T) {
+	// Worked examples, mostly where the NMOS 6502 and 65C02 differ
+	for _, tc := range []struct {
+		variant Variant
+		opcode  byte
+		a, b    byte
+		c       int
+		want    arith
+	}{
+		// The binary sum $9A isn't zero but the result is, and N comes
+		// from $A0 before the high digit is adjusted
+		{VariantNMOS, 0x65, 0x99, 0x01, 0, arith{a: 0x00, n: true, c: true}},
+		{Variant65C02, 0x65, 0x99, 0x01, 0, arith{a: 0x00, z: true, c: true}},
+		// 79 + 1 = 80 overflows a signed byte
+		{VariantNMOS, 0x65, 0x79, 0x00, 1, arith{a: 0x80, n: true, v: true}},
+		{Variant65C02, 0x65, 0x79, 0x00, 1, arith{a: 0x80, n: true, v: true}},
+		// SBC's Z comes from the binary difference, $06
+		{VariantNMOS, 0xe5, 0x10, 0x0a, 1, arith{a: 0x00, c: true}},
+		{Variant65C02, 0xe5, 0x10, 0x0a, 1, arith{a: 0x00, z: true, c: true}},
+		// Invalid BCD: the two adjust SBC's digits differently
+		{VariantNMOS, 0xe5, 0x00, 0x0f, 1, arith{a: 0x9b, n: true}},
+		{Variant65C02, 0xe5, 0x00, 0x0f, 1, arith{a: 0x8b, n: true}},
+	} {
+		memory := NewTestMemory(nil)
+		cpu := NewCPU6502Variant(memory, tc.variant)
+		cpu.DecimalFlag = true
+		if got := runArith(cpu, memory, tc.opcode, tc.a, tc.b, tc.c); got != tc.want {
+			t.Errorf("%s opcode $%02X $%02X, $%02X, C=%d gave %s instead of %s", tc.variant, tc.opcode, tc.a, tc.b, tc.c, got, tc.want)
+		}
+	}
+}
@@ -1,14 +1,506 @@
 package cpu6502
 
-// import (
-//     "fmt"
-//     "os"
-// )
-//
-// func DisassembleOne(memory MemoryAccess, address uint16) (OpcodeSpec, string, os.Error) {
-//     opcode, value, err := ReadOpcode(memory, address)
-//     if err != nil {
-//         return opcode, "", err
-//     }
-//     return opcode, opcode.FormatArguments(value), nil
-// }
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Instruction is a single decoded instruction
+type Instruction struct {
+	Address uint16
+	Opcode  OpcodeSpec
+	Value   uint16 // operand (not sign extended for relative branches)
+	Bytes   []byte
+}
+
+func (ins Instruction) String() string {
+	args := ins.Opcode.FormatArguments(ins.Value, ins.Address+uint16(ins.Opcode.Size))
+	if args == "" {
+		return ins.Opcode.Instruction.Name
+	}
+	return ins.Opcode.Instruction.Name + " " + args
+}
+
+// Target returns the address referenced by the instruction's operand if it
+// has one (branch target, jump target, or absolute/zero page address).
+func (ins Instruction) Target() (uint16, bool) {
+	switch ins.Opcode.AddressingMode {
+	case AMRelative:
+		return ins.Address + uint16(ins.Opcode.Size) + uint16(int8(ins.Value)), true
+	case AMZeroPageRelative:
+		return ins.Address + uint16(ins.Opcode.Size) + uint16(int8(ins.Value>>8)), true
+	case AMZeroPage, AMZeroPageX, AMZeroPageY, AMAbsolute, AMAbsoluteX, AMAbsoluteY, AMIndirect, AMIndirectX, AMIndirectY,
+		AMZeroPageIndirect, AMAbsoluteIndirectX:
+		return ins.Value, true
+	}
+	return 0, false
+}
+
+// DisassembleOne decodes the variant's instruction at the given address
+func DisassembleOne(memory MemoryAccess, variant Variant, address uint16) Instruction {
+	opcode, value := ReadOpcode(memory, variant, address)
+	ins := Instruction{
+		Address: address,
+		Opcode:  opcode,
+		Value:   value,
+		Bytes:   make([]byte, opcode.Size)}
+	for i := range ins.Bytes {
+		ins.Bytes[i] = memory.ReadByte(address+uint16(i), true)
+	}
+	return ins
+}
+
+// DisassembleRange linearly decodes instructions from start up to and
+// including end.
+func DisassembleRange(memory MemoryAccess, variant Variant, start, end uint16) []Instruction {
+	var out []Instruction
+	for addr := int(start); addr <= int(end); {
+		ins := DisassembleOne(memory, variant, uint16(addr))
+		out = append(out, ins)
+		addr += len(ins.Bytes)
+	}
+	return out
+}
+
+// Disassembly is the result of a recursive-descent disassembly that follows
+// the flow of execution from a set of entry points to separate code from
+// data.
+type Disassembly struct {
+	Start, End uint16 // inclusive range of disassembled memory
+
+	memory MemoryAccess
+	code   map[uint16]Instruction // instructions by start address
+	owner  map[uint16]uint16      // start address of the instruction covering a byte
+	labels map[uint16]string
+	equ    map[uint16]string // names for addresses outside Start-End
+}
+
+// Disassemble performs a recursive-descent disassembly of the variant's
+// code in memory between start and end (inclusive). If no entry points are
+// given then the NMI, RESET and IRQ vectors are used.
+func Disassemble(memory MemoryAccess, variant Variant, start, end uint16, entries ...uint16) *Disassembly {
+	d := &Disassembly{
+		Start:  start,
+		End:    end,
+		memory: memory,
+		code:   make(map[uint16]Instruction),
+		owner:  make(map[uint16]uint16),
+		labels: make(map[uint16]string)}
+
+	var queue []uint16
+	if len(entries) == 0 {
+		for _, v := range []struct {
+			vector uint16
+			name   string
+		}{{IV_RESET, "reset"}, {IV_NMI, "nmi"}, {IV_IRQ, "irq"}} {
+			addr := d.readWord(v.vector)
+			if d.contains(addr) {
+				if _, ok := d.labels[addr]; !ok {
+					d.labels[addr] = v.name
+				}
+				queue = append(queue, addr)
+			}
+		}
+	} else {
+		queue = append(queue, entries...)
+	}
+
+	for len(queue) > 0 {
+		addr := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for d.contains(addr) {
+			if _, ok := d.code[addr]; ok {
+				break
+			}
+			ins := DisassembleOne(memory, variant, addr)
+			if !d.fits(ins) {
+				break
+			}
+			d.code[addr] = ins
+			for i := range ins.Bytes {
+				d.owner[addr+uint16(i)] = addr
+			}
+
+			target, hasTarget := ins.Target()
+			stop := false
+			switch ins.Opcode.Instruction.Num {
+			case I_JMP.Num:
+				if ins.Opcode.AddressingMode == AMAbsolute {
+					queue = append(queue, target)
+				}
+				stop = true
+			case I_JSR.Num:
+				queue = append(queue, target)
+			case I_BRA.Num:
+				queue = append(queue, target)
+				stop = true
+			case I_RTS.Num, I_RTI.Num, I_BRK.Num, I_KIL.Num, I_STP.Num:
+				stop = true
+			default:
+				if mode := ins.Opcode.AddressingMode; mode == AMRelative || mode == AMZeroPageRelative {
+					queue = append(queue, target)
+				}
+			}
+			if hasTarget && d.contains(target) && ins.Opcode.AddressingMode != AMZeroPage &&
+				ins.Opcode.AddressingMode != AMZeroPageX && ins.Opcode.AddressingMode != AMZeroPageY &&
+				ins.Opcode.AddressingMode != AMIndirectX && ins.Opcode.AddressingMode != AMIndirectY &&
+				ins.Opcode.AddressingMode != AMZeroPageIndirect {
+				d.addLabel(target)
+			}
+			if stop {
+				break
+			}
+			next := uint32(addr) + uint32(len(ins.Bytes))
+			if next > 0xffff {
+				break
+			}
+			addr = uint16(next)
+		}
+	}
+
+	// Labels that point inside an instruction are referenced relative to
+	// the instruction's label instead.
+	for addr := range d.labels {
+		if start, ok := d.owner[addr]; ok && start != addr {
+			delete(d.labels, addr)
+			d.addLabel(start)
+		}
+	}
+
+	return d
+}
+
+func (d *Disassembly) contains(addr uint16) bool {
+	return addr >= d.Start && addr <= d.End
+}
+
+// fits returns true if the instruction lies within the range and doesn't
+// overlap any already decoded instruction.
+func (d *Disassembly) fits(ins Instruction) bool {
+	last := uint32(ins.Address) + uint32(len(ins.Bytes)) - 1
+	if last > uint32(d.End) {
+		return false
+	}
+	for a := uint32(ins.Address); a <= last; a++ {
+		if _, ok := d.owner[uint16(a)]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Disassembly) readWord(addr uint16) uint16 {
+	return uint16(d.memory.ReadByte(addr, true)) | uint16(d.memory.ReadByte(addr+1, true))<<8
+}
+
+func (d *Disassembly) addLabel(addr uint16) {
+	if _, ok := d.labels[addr]; !ok {
+		d.labels[addr] = fmt.Sprintf("L%04X", addr)
+	}
+}
+
+// IsCode returns true if the byte at the address was reached as part of an
+// instruction.
+func (d *Disassembly) IsCode(address uint16) bool {
+	_, ok := d.owner[address]
+	return ok
+}
+
+// Instruction returns the instruction starting at the address if there is one.
+func (d *Disassembly) Instruction(address uint16) (Instruction, bool) {
+	ins, ok := d.code[address]
+	return ins, ok
+}
+
+// Label returns the label for an address if it has one.
+func (d *Disassembly) Label(address uint16) (string, bool) {
+	l, ok := d.labels[address]
+	return l, ok
+}
+
+// Instructions returns all code in address order.
+func (d *Disassembly) Instructions() []Instruction {
+	out := make([]Instruction, 0, len(d.code))
+	for _, ins := range d.code {
+		out = append(out, ins)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// UseSymbols names labels and the addresses used outside the disassembled
+// range from symbols rather than generating names. Names that ca65 can't
+// use as identifiers, or that are already taken, are ignored.
+func (d *Disassembly) UseSymbols(symbols Symbols) {
+	used := map[string]bool{}
+	for _, l := range d.labels {
+		used[l] = true
+	}
+	name := func(addr uint16) string {
+		n := symbols.Name(addr)
+		if !isCa65Identifier(n) || used[n] {
+			return ""
+		}
+		used[n] = true
+		return n
+	}
+	addrs := make([]uint16, 0, len(d.labels))
+	for addr := range d.labels {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for _, addr := range addrs {
+		if n := name(addr); n != "" {
+			delete(used, d.labels[addr])
+			d.labels[addr] = n
+		}
+	}
+	d.equ = map[uint16]string{}
+	for _, ins := range d.Instructions() {
+		if ins.Opcode.AddressingMode == AMImmediate {
+			continue
+		}
+		if target, ok := ins.Target(); ok && !d.contains(target) {
+			if _, ok := d.equ[target]; !ok {
+				if n := name(target); n != "" {
+					d.equ[target] = n
+				}
+			}
+		}
+	}
+}
+
+// isCa65Identifier returns true if s can be used as a label by ca65
+func isCa65Identifier(s string) bool {
+	if s == "" || len(s) == 1 && strings.ContainsAny(s, "aAxXyY") {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// symbol returns an expression for an address using labels where possible.
+func (d *Disassembly) symbol(addr uint16) (string, bool) {
+	if l, ok := d.labels[addr]; ok {
+		return l, true
+	}
+	if l, ok := d.equ[addr]; ok {
+		return l, true
+	}
+	if start, ok := d.owner[addr]; ok {
+		if l, ok := d.labels[start]; ok {
+			return fmt.Sprintf("%s+%d", l, addr-start), true
+		}
+	}
+	return "", false
+}
+
+// WriteTo writes the disassembly as ca65 source that reassembles to the
+// same bytes. Undocumented opcodes use the ca65 6502X mnemonics, and
+// opcodes that have no unique mnemonic (duplicate NOPs, KILs, SBC $EB) are
+// written as .byte.
+func (d *Disassembly) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	fmt.Fprintf(bw, ".setcpu \"6502X\"\n\n")
+	if len(d.equ) != 0 {
+		addrs := make([]uint16, 0, len(d.equ))
+		for addr := range d.equ {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+		for _, addr := range addrs {
+			if addr < 0x100 {
+				fmt.Fprintf(bw, "%s = $%02X\n", d.equ[addr], addr)
+			} else {
+				fmt.Fprintf(bw, "%s = $%04X\n", d.equ[addr], addr)
+			}
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	fmt.Fprintf(bw, ".org $%04X\n\n", d.Start)
+
+	var data []byte
+	var dataAddr uint16
+	flush := func() {
+		if len(data) == 0 {
+			return
+		}
+		vals := make([]string, len(data))
+		for i, b := range data {
+			vals[i] = fmt.Sprintf("$%02X", b)
+		}
+		fmt.Fprintf(bw, "\t.byte %-32s ; %04X\n", strings.Join(vals, ","), dataAddr)
+		data = data[:0]
+	}
+
+	for addr := uint32(d.Start); addr <= uint32(d.End); {
+		a := uint16(addr)
+		if l, ok := d.labels[a]; ok {
+			flush()
+			fmt.Fprintf(bw, "%s:\n", l)
+		}
+		if ins, ok := d.code[a]; ok {
+			flush()
+			src, ok := d.source(ins)
+			if !ok {
+				vals := make([]string, len(ins.Bytes))
+				for i, b := range ins.Bytes {
+					vals[i] = fmt.Sprintf("$%02X", b)
+				}
+				src = ".byte " + strings.Join(vals, ",")
+			}
+			fmt.Fprintf(bw, "\t%-38s ; %04X  %s\n", src, a, ins)
+			addr += uint32(len(ins.Bytes))
+			continue
+		}
+		if len(data) == 0 {
+			dataAddr = a
+		}
+		data = append(data, d.memory.ReadByte(a, true))
+		if len(data) == 8 {
+			flush()
+		}
+		addr++
+	}
+	flush()
+
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// source returns the ca65 source for an instruction or false if ca65
+// wouldn't assemble it to the same opcode.
+func (d *Disassembly) source(ins Instruction) (string, bool) {
+	name, ok := ca65Mnemonic(ins.Opcode)
+	if !ok {
+		return "", false
+	}
+
+	mode := ins.Opcode.AddressingMode
+	arg := ""
+	if target, ok := ins.Target(); ok {
+		if sym, ok := d.symbol(target); ok {
+			arg = sym
+		} else if mode == AMZeroPage || mode == AMZeroPageX || mode == AMZeroPageY || mode == AMIndirectX || mode == AMIndirectY {
+			arg = fmt.Sprintf("$%02X", target)
+		} else {
+			arg = fmt.Sprintf("$%04X", target)
+		}
+	}
+
+	// Force absolute addressing when ca65 would otherwise pick zero page
+	prefix := ""
+	if zp, ok := zeroPageMode[mode]; ok && ins.Value < 0x100 {
+		if _, ok := ca65Opcodes[ca65Key{name, zp}]; ok {
+			prefix = "a:"
+		}
+	}
+
+	switch mode {
+	case AMImplied:
+		return name, true
+	case AMAccumulator:
+		return name + " a", true
+	case AMImmediate:
+		return fmt.Sprintf("%s #$%02X", name, ins.Value), true
+	case AMZeroPageX, AMAbsoluteX:
+		return fmt.Sprintf("%s %s%s,x", name, prefix, arg), true
+	case AMZeroPageY, AMAbsoluteY:
+		return fmt.Sprintf("%s %s%s,y", name, prefix, arg), true
+	case AMIndirect:
+		return fmt.Sprintf("%s (%s)", name, arg), true
+	case AMIndirectX:
+		return fmt.Sprintf("%s (%s,x)", name, arg), true
+	case AMIndirectY:
+		return fmt.Sprintf("%s (%s),y", name, arg), true
+	}
+	return fmt.Sprintf("%s %s%s", name, prefix, arg), true
+}
+
+type ca65Key struct {
+	name string
+	mode int
+}
+
+var (
+	// ca65 (6502X) names for the undocumented instructions
+	ca65Names = map[string]string{
+		"AAC": "ANC",
+		"AAX": "SAX",
+		"ASR": "ALR",
+		"ATX": "LAX",
+		"AXA": "SHA",
+		"DOP": "NOP",
+		"KIL": "JAM",
+		"LAR": "LAS",
+		"NP2": "NOP",
+		"SB2": "SBC",
+		"SXA": "SHX",
+		"SYA": "SHY",
+		"TOP": "NOP",
+		"XAA": "ANE",
+		"XAS": "TAS",
+	}
+
+	zeroPageMode = map[int]int{
+		AMAbsolute:  AMZeroPage,
+		AMAbsoluteX: AMZeroPageX,
+		AMAbsoluteY: AMZeroPageY,
+	}
+
+	// opcode ca65 emits for each mnemonic and addressing mode
+	ca65Opcodes = map[ca65Key]int{}
+)
+
+func init() {
+	// Documented opcodes take priority, otherwise the first in the table
+	// wins which matches what ca65 picks for the undocumented ones.
+	for pass := 0; pass < 2; pass++ {
+		for _, op := range opcodes {
+			documented := op.Instruction.Num < I_KIL.Num && op.Instruction.Name != I_SB2.Name
+			if documented != (pass == 0) {
+				continue
+			}
+			key := ca65Key{ca65Name(op.Instruction.Name), op.AddressingMode}
+			if _, ok := ca65Opcodes[key]; !ok {
+				ca65Opcodes[key] = op.Opcode
+			}
+		}
+	}
+}
+
+func ca65Name(name string) string {
+	if n, ok := ca65Names[name]; ok {
+		return n
+	}
+	return name
+}
+
+// ca65Mnemonic returns the ca65 mnemonic for an opcode and true if ca65
+// assembles that mnemonic and addressing mode back to the same opcode.
+func ca65Mnemonic(op OpcodeSpec) (string, bool) {
+	name := ca65Name(op.Instruction.Name)
+	return name, ca65Opcodes[ca65Key{name, op.AddressingMode}] == op.Opcode
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
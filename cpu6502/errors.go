@@ -0,0 +1,71 @@
+package cpu6502
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrIllegalOpcode = errors.New("illegal opcode")
+	ErrCPUJammed     = errors.New("cpu jammed")
+	ErrCycleMismatch = errors.New("cycle count mismatch")
+)
+
+// Registers is a snapshot of the CPU's programmer visible state.
+type Registers struct {
+	A, X, Y byte
+	P       byte
+	SP      byte
+	PC      uint16
+	Cycles  uint64
+}
+
+func (r Registers) String() string {
+	return fmt.Sprintf("{PC:%04x SP:%02x A:%02x X:%02x Y:%02x P:%02x CYC:%d}",
+		r.PC, r.SP, r.A, r.X, r.Y, r.P, r.Cycles)
+}
+
+// CPUError is returned by Step when an instruction can't be executed. Err is
+// one of the Err* values above so callers can test for it with errors.Is.
+// PC and Opcode identify the failing instruction and State is the CPU state
+// before it executed. Backtrace is the call stack when Step returned, which
+// the message includes when there was a call in progress.
+type CPUError struct {
+	Err       error
+	PC        uint16
+	Opcode    byte
+	State     Registers
+	Detail    string
+	Backtrace Backtrace
+
+	symbols Symbols // for formatting Backtrace
+}
+
+func (e *CPUError) Error() string {
+	msg := fmt.Sprintf("cpu6502: %s $%02X at $%04X", e.Err, e.Opcode, e.PC)
+	if e.Detail != "" {
+		msg += " (" + e.Detail + ")"
+	}
+	msg += " " + e.State.String()
+	if len(e.Backtrace.Frames) != 0 {
+		msg += "\n" + e.Backtrace.Format(e.symbols)
+	}
+	return msg
+}
+
+func (e *CPUError) Unwrap() error {
+	return e.Err
+}
+
+// Registers returns a snapshot of the current register state.
+func (cpu *CPU6502) Registers() Registers {
+	return Registers{
+		A:      cpu.A,
+		X:      cpu.X,
+		Y:      cpu.Y,
+		P:      cpu.GetP(),
+		SP:     cpu.SP,
+		PC:     cpu.PC,
+		Cycles: cpu.Cycles,
+	}
+}
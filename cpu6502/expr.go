@@ -0,0 +1,317 @@
+package cpu6502
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are shared by the assembler (operands and directives) and
+// anything else that needs to evaluate numbers with symbols in them.
+//
+// Numbers can be decimal, $hex, %binary or 'c' characters. Operators in
+// order of decreasing precedence:
+//
+//	unary - ~ ! < (low byte) > (high byte)
+//	* / %
+//	+ -
+//	<< >>
+//	< <= > >=
+//	== !=
+//	&
+//	^
+//	|
+//	&&
+//	||
+//
+// and parentheses for grouping. Comparisons and the logical operators give
+// 1 for true and 0 for false. A '*' in place of a value is the current
+// program counter.
+
+var errUndefined = errors.New("undefined symbol")
+
+type expr interface {
+	eval(resolve func(name string) (int, bool)) (int, error)
+}
+
+type exprNum int
+
+type exprSym string
+
+type exprUnary struct {
+	op string
+	x  expr
+}
+
+type exprBinary struct {
+	op   string
+	x, y expr
+}
+
+func (e exprNum) eval(resolve func(string) (int, bool)) (int, error) {
+	return int(e), nil
+}
+
+func (e exprSym) eval(resolve func(string) (int, bool)) (int, error) {
+	if resolve != nil {
+		if v, ok := resolve(string(e)); ok {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %s", errUndefined, string(e))
+}
+
+func (e exprUnary) eval(resolve func(string) (int, bool)) (int, error) {
+	x, err := e.x.eval(resolve)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case "-":
+		return -x, nil
+	case "~":
+		return ^x, nil
+	case "!":
+		return boolInt(x == 0), nil
+	case "<":
+		return x & 0xff, nil
+	case ">":
+		return (x >> 8) & 0xff, nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", e.op)
+}
+
+func (e exprBinary) eval(resolve func(string) (int, bool)) (int, error) {
+	x, err := e.x.eval(resolve)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.y.eval(resolve)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if e.op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "<<":
+		return x << uint(y), nil
+	case ">>":
+		return x >> uint(y), nil
+	case "&":
+		return x & y, nil
+	case "^":
+		return x ^ y, nil
+	case "|":
+		return x | y, nil
+	case "==":
+		return boolInt(x == y), nil
+	case "!=":
+		return boolInt(x != y), nil
+	case "<":
+		return boolInt(x < y), nil
+	case "<=":
+		return boolInt(x <= y), nil
+	case ">":
+		return boolInt(x > y), nil
+	case ">=":
+		return boolInt(x >= y), nil
+	case "&&":
+		return boolInt(x != 0 && y != 0), nil
+	case "||":
+		return boolInt(x != 0 || y != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", e.op)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binary operators by precedence level (lowest first)
+var binaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// Eval evaluates an expression. resolve returns the value of a name (nil
+// if there are none).
+func Eval(expression string, resolve func(name string) (int, bool)) (int, error) {
+	e, err := parseExpr(expression)
+	if err != nil {
+		return 0, err
+	}
+	return e.eval(resolve)
+}
+
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.s[p.pos:], s)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peekOp returns the operator from the list at the current position
+func (p *exprParser) peekOp(ops []string) string {
+	p.skipSpace()
+	for _, op := range ops {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			// Don't mistake the first character of a longer operator
+			// (e.g. '<' of '<<' or '<=') for a shorter one.
+			if len(op) == 1 && p.pos+1 < len(p.s) && (p.s[p.pos+1] == op[0] || p.s[p.pos+1] == '=') {
+				continue
+			}
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) parseBinary(level int) (expr, error) {
+	if level == len(binaryOps) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peekOp(binaryOps[level])
+		if op == "" {
+			return x, nil
+		}
+		p.pos += len(op)
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = exprBinary{op, x, y}
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("missing value in expression %q", p.s)
+	}
+	switch c := p.s[p.pos]; c {
+	case '-', '~', '!', '<', '>':
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{string(c), x}, nil
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	case '(':
+		p.pos++
+		x, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+			return nil, fmt.Errorf("missing ) in expression %q", p.s)
+		}
+		p.pos++
+		return x, nil
+	case '*':
+		p.pos++
+		return exprSym("*"), nil
+	case '\'':
+		if p.pos+2 < len(p.s) && p.s[p.pos+2] == '\'' {
+			v := p.s[p.pos+1]
+			p.pos += 3
+			return exprNum(v), nil
+		}
+		return nil, fmt.Errorf("bad character constant in expression %q", p.s)
+	case '$', '%':
+		base := 16
+		if c == '%' {
+			base = 2
+		}
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.s) && isHexDigit(p.s[p.pos]) {
+			p.pos++
+		}
+		v, err := strconv.ParseInt(p.s[start:p.pos], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", p.s[start-1:p.pos])
+		}
+		return exprNum(v), nil
+	}
+
+	start := p.pos
+	if c := p.s[p.pos]; c >= '0' && c <= '9' {
+		for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+			p.pos++
+		}
+		v, err := strconv.ParseInt(p.s[start:p.pos], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", p.s[start:p.pos])
+		}
+		return exprNum(v), nil
+	}
+	for p.pos < len(p.s) && isSymbolChar(rune(p.s[p.pos]), p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.s[p.pos:], p.s)
+	}
+	return exprSym(p.s[start:p.pos]), nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isSymbolChar(c rune, first bool) bool {
+	if c == '_' || c == '.' || c == '@' || unicode.IsLetter(c) {
+		return true
+	}
+	return !first && unicode.IsDigit(c)
+}
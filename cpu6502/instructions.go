@@ -0,0 +1,936 @@
+package cpu6502
+
+// operand is what an instruction handler works on: the address and value
+// fetched by the addressing mode. Handlers report a taken branch and any
+// cycles not in the opcode table back to step through it.
+type operand struct {
+	opcode OpcodeSpec
+	pc     uint16 // address of the opcode
+	addr   uint16
+	value  byte
+	jump   bool // jump to addr and account for the clock
+	extra  int  // cycles not in the opcode table (65C02 decimal mode)
+}
+
+// instructionHandler executes an instruction after its addressing mode has
+// been performed. Only errors that stop the CPU are returned.
+type instructionHandler func(cpu *CPU6502, op *operand) error
+
+// instructionHandlers maps Instruction.Num to its handler. Per variant
+// dispatch tables indexed by opcode are built from it (see buildHandlers).
+var instructionHandlers = map[int]instructionHandler{
+	I_AAC.Num: (*CPU6502).opAAC,
+	I_AAX.Num: (*CPU6502).opAAX,
+	I_ARR.Num: (*CPU6502).opARR,
+	I_ASR.Num: (*CPU6502).opASR,
+	I_ATX.Num: (*CPU6502).opATX,
+	I_AXA.Num: (*CPU6502).opAXA,
+	I_AXS.Num: (*CPU6502).opAXS,
+	I_ADC.Num: (*CPU6502).opADC,
+	I_AND.Num: (*CPU6502).opAND,
+	I_ASL.Num: (*CPU6502).opASL,
+	I_BCC.Num: (*CPU6502).opBCC,
+	I_BCS.Num: (*CPU6502).opBCS,
+	I_BEQ.Num: (*CPU6502).opBEQ,
+	I_BIT.Num: (*CPU6502).opBIT,
+	I_BMI.Num: (*CPU6502).opBMI,
+	I_BPL.Num: (*CPU6502).opBPL,
+	I_BNE.Num: (*CPU6502).opBNE,
+	I_BRK.Num: (*CPU6502).opBRK,
+	I_BVC.Num: (*CPU6502).opBVC,
+	I_BVS.Num: (*CPU6502).opBVS,
+	I_BRA.Num: (*CPU6502).opBRA,
+	I_BBR.Num: (*CPU6502).opBBR,
+	I_BBS.Num: (*CPU6502).opBBS,
+	I_CLC.Num: (*CPU6502).opCLC,
+	I_CLD.Num: (*CPU6502).opCLD,
+	I_CLI.Num: (*CPU6502).opCLI,
+	I_CLV.Num: (*CPU6502).opCLV,
+	I_CMP.Num: (*CPU6502).opCMP,
+	I_CPX.Num: (*CPU6502).opCPX,
+	I_CPY.Num: (*CPU6502).opCPY,
+	I_DCP.Num: (*CPU6502).opDCP,
+	I_DEC.Num: (*CPU6502).opDEC,
+	I_DEX.Num: (*CPU6502).opDEX,
+	I_DEY.Num: (*CPU6502).opDEY,
+	I_EOR.Num: (*CPU6502).opEOR,
+	I_INC.Num: (*CPU6502).opINC,
+	I_INX.Num: (*CPU6502).opINX,
+	I_INY.Num: (*CPU6502).opINY,
+	I_ISC.Num: (*CPU6502).opISC,
+	I_JMP.Num: (*CPU6502).opJMP,
+	I_KIL.Num: (*CPU6502).opKIL,
+	I_LAR.Num: (*CPU6502).opLAR,
+	I_JSR.Num: (*CPU6502).opJSR,
+	I_LAX.Num: (*CPU6502).opLAX,
+	I_LDA.Num: (*CPU6502).opLDA,
+	I_LDX.Num: (*CPU6502).opLDX,
+	I_LDY.Num: (*CPU6502).opLDY,
+	I_LSR.Num: (*CPU6502).opLSR,
+	I_NOP.Num: (*CPU6502).opNOP,
+	I_DOP.Num: (*CPU6502).opNOP,
+	I_TOP.Num: (*CPU6502).opNOP,
+	I_NP2.Num: (*CPU6502).opNOP,
+	I_NPC.Num: (*CPU6502).opNPC,
+	I_ORA.Num: (*CPU6502).opORA,
+	I_PHA.Num: (*CPU6502).opPHA,
+	I_PHX.Num: (*CPU6502).opPHX,
+	I_PHY.Num: (*CPU6502).opPHY,
+	I_PLX.Num: (*CPU6502).opPLX,
+	I_PLY.Num: (*CPU6502).opPLY,
+	I_PHP.Num: (*CPU6502).opPHP,
+	I_PLA.Num: (*CPU6502).opPLA,
+	I_PLP.Num: (*CPU6502).opPLP,
+	I_RMB.Num: (*CPU6502).opRMB,
+	I_RLA.Num: (*CPU6502).opRLA,
+	I_RTI.Num: (*CPU6502).opRTI,
+	I_ROL.Num: (*CPU6502).opROL,
+	I_ROR.Num: (*CPU6502).opROR,
+	I_RRA.Num: (*CPU6502).opRRA,
+	I_RTS.Num: (*CPU6502).opRTS,
+	I_SBC.Num: (*CPU6502).opSBC,
+	I_SEC.Num: (*CPU6502).opSEC,
+	I_SED.Num: (*CPU6502).opSED,
+	I_SEI.Num: (*CPU6502).opSEI,
+	I_SMB.Num: (*CPU6502).opSMB,
+	I_SLO.Num: (*CPU6502).opSLO,
+	I_SRE.Num: (*CPU6502).opSRE,
+	I_STA.Num: (*CPU6502).opSTA,
+	I_STX.Num: (*CPU6502).opSTX,
+	I_STY.Num: (*CPU6502).opSTY,
+	I_STP.Num: (*CPU6502).opSTP,
+	I_STZ.Num: (*CPU6502).opSTZ,
+	I_SXA.Num: (*CPU6502).opSXA,
+	I_SYA.Num: (*CPU6502).opSYA,
+	I_TRB.Num: (*CPU6502).opTRB,
+	I_TSB.Num: (*CPU6502).opTSB,
+	I_TAX.Num: (*CPU6502).opTAX,
+	I_TAY.Num: (*CPU6502).opTAY,
+	I_TSX.Num: (*CPU6502).opTSX,
+	I_TXA.Num: (*CPU6502).opTXA,
+	I_TXS.Num: (*CPU6502).opTXS,
+	I_WAI.Num: (*CPU6502).opWAI,
+	I_TYA.Num: (*CPU6502).opTYA,
+	I_XAA.Num: (*CPU6502).opXAA,
+	I_XAS.Num: (*CPU6502).opXAS}
+
+// buildHandlers fills in the handler of each opcode in an opcode table.
+// Opcodes without a handler are left nil and are reported as illegal by
+// Step.
+func buildHandlers(handlers *[256]instructionHandler, opcodes *[256]OpcodeSpec) {
+	for i, op := range opcodes {
+		handlers[i] = instructionHandlers[op.Instruction.Num]
+	}
+}
+
+// AAC: undocumented - AND, then copy N to C
+func (cpu *CPU6502) opAAC(op *operand) error {
+	cpu.A &= op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	cpu.CarryFlag = cpu.SignFlag
+	return nil
+}
+
+// AAX: undocumented
+func (cpu *CPU6502) opAAX(op *operand) error {
+	op.value = cpu.X & cpu.A
+	cpu.write(op.addr, op.value)
+	return nil
+}
+
+// ARR: undocumented - AND, then ROR A with odd flags
+func (cpu *CPU6502) opARR(op *operand) error {
+	var carry byte = 0
+	if cpu.CarryFlag {
+		carry = 0x80
+	}
+	t := cpu.A & op.value
+	cpu.A = (t >> 1) | carry
+	cpu.ZeroFlag = cpu.A == 0
+	if cpu.decimal() {
+		cpu.SignFlag = carry != 0
+		cpu.OverflowFlag = (t^cpu.A)&0x40 != 0
+		if (t&0x0f)+(t&0x01) > 5 {
+			cpu.A = cpu.A&0xf0 | (cpu.A+6)&0x0f
+		}
+		cpu.CarryFlag = uint16(t&0xf0)+uint16(t&0x10) > 0x50
+		if cpu.CarryFlag {
+			cpu.A += 0x60
+		}
+	} else {
+		cpu.SignFlag = cpu.A&0x80 != 0
+		cpu.CarryFlag = cpu.A&0x40 != 0
+		cpu.OverflowFlag = (cpu.A>>6)&1 != (cpu.A>>5)&1
+	}
+	return nil
+}
+
+// ASR: undocumented - AND, then LSR A
+func (cpu *CPU6502) opASR(op *operand) error {
+	cpu.A &= op.value
+	cpu.CarryFlag = cpu.A&0x01 != 0
+	cpu.A >>= 1
+	cpu.SignFlag = false
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+// ATX: undocumented (unstable) - (A | magic) AND byte, then TAX
+func (cpu *CPU6502) opATX(op *operand) error {
+	cpu.A = (cpu.A | cpu.ATXMagic) & op.value
+	cpu.X = cpu.A
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+// AXA: undocumented (unstable)
+func (cpu *CPU6502) opAXA(op *operand) error {
+	cpu.storeHigh(op.addr, cpu.Y, cpu.A&cpu.X)
+	return nil
+}
+
+// AXS: undocumented - X = (A AND X) - byte without borrow
+func (cpu *CPU6502) opAXS(op *operand) error {
+	t := cpu.A & cpu.X
+	cpu.X = t - op.value
+	cpu.CarryFlag = t >= op.value
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+func (cpu *CPU6502) opADC(op *operand) error {
+	cpu.adc(op.value)
+	if cpu.variant.cmos() && cpu.decimal() {
+		op.extra += cpu.decimalFlags(op.addr)
+	}
+	return nil
+}
+
+// adc adds value and the carry to A. In decimal mode the NMOS 6502 sets Z
+// from the binary sum and N and V from the sum after only the low digit has
+// been adjusted, as described in Bruce Clark's "Decimal Mode" tutorial
+// (http://www.6502.org/tutorials/decimal_mode.html). The 65C02 sets N and Z
+// from the BCD result afterwards (see decimalFlags).
+func (cpu *CPU6502) adc(value byte) {
+	a, b, c := int(cpu.A), int(value), boolInt(cpu.CarryFlag)
+	binary := a + b + c
+	cpu.ZeroFlag = binary&0xff == 0
+	if !cpu.decimal() {
+		cpu.SignFlag = binary&0x80 != 0
+		cpu.OverflowFlag = (a^binary)&(b^binary)&0x80 != 0
+		cpu.CarryFlag = binary > 0xff
+		cpu.A = byte(binary)
+		return
+	}
+	low := a&0x0f + b&0x0f + c
+	if low >= 0x0a {
+		low = (low+0x06)&0x0f + 0x10
+	}
+	sum := a&0xf0 + b&0xf0 + low
+	signed := int(int8(a&0xf0)) + int(int8(b&0xf0)) + low
+	cpu.SignFlag = sum&0x80 != 0
+	cpu.OverflowFlag = signed < -128 || signed > 127
+	if sum >= 0xa0 {
+		sum += 0x60
+	}
+	cpu.CarryFlag = sum > 0xff
+	cpu.A = byte(sum)
+}
+
+// sbc subtracts value and the borrow (inverted carry) from A. The flags are
+// those of the binary subtraction, in decimal mode too, except that the
+// 65C02 sets N and Z from the BCD result (see decimalFlags). The two adjust
+// the digits differently so they disagree for invalid BCD.
+func (cpu *CPU6502) sbc(value byte) {
+	a, b, borrow := int(cpu.A), int(value), 1-boolInt(cpu.CarryFlag)
+	binary := a - b - borrow
+	cpu.SignFlag = binary&0x80 != 0
+	cpu.ZeroFlag = binary&0xff == 0
+	cpu.OverflowFlag = (a^b)&(a^binary)&0x80 != 0
+	cpu.CarryFlag = binary >= 0
+	if !cpu.decimal() {
+		cpu.A = byte(binary)
+		return
+	}
+	low := a&0x0f - b&0x0f - borrow
+	if cpu.variant.cmos() {
+		diff := binary
+		if diff < 0 {
+			diff -= 0x60
+		}
+		if low < 0 {
+			diff -= 0x06
+		}
+		cpu.A = byte(diff)
+		return
+	}
+	if low < 0 {
+		low = (low-0x06)&0x0f - 0x10
+	}
+	diff := a&0xf0 - b&0xf0 + low
+	if diff < 0 {
+		diff -= 0x60
+	}
+	cpu.A = byte(diff)
+}
+
+func (cpu *CPU6502) opAND(op *operand) error {
+	cpu.A &= op.value
+	cpu.SignFlag = cpu.A&0x80 > 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opASL(op *operand) error {
+	cpu.CarryFlag = op.value&0x80 != 0
+	op.value = op.value << 1
+	cpu.SignFlag = op.value&0x80 != 0
+	cpu.ZeroFlag = op.value == 0
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBCC(op *operand) error {
+	if !cpu.CarryFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBCS(op *operand) error {
+	if cpu.CarryFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBEQ(op *operand) error {
+	if cpu.ZeroFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBIT(op *operand) error {
+	if op.opcode.AddressingMode != AMImmediate { // 65C02 BIT # only sets Z
+		cpu.SignFlag = op.value&0x80 != 0
+		cpu.OverflowFlag = op.value&0x40 != 0
+	}
+	cpu.ZeroFlag = op.value&cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opBMI(op *operand) error {
+	if cpu.SignFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBPL(op *operand) error {
+	if !cpu.SignFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBNE(op *operand) error {
+	if !cpu.ZeroFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBRK(op *operand) error {
+	cpu.PushAddress(cpu.PC + 1)
+	vector := cpu.interruptVector()
+	cpu.PushByte(cpu.GetP() | FLAG_B) // B is only set in the pushed copy
+	cpu.InterruptsDisabledFlag = true
+	if cpu.variant.cmos() {
+		cpu.DecimalFlag = false
+	}
+	cpu.PC = cpu.readVector(vector)
+	// Like the interrupt sequence the handler's first instruction always
+	// runs, so an NMI that arrived too late to hijack BRK waits for it.
+	cpu.prevNeedNMI = false
+	return nil
+}
+
+func (cpu *CPU6502) opBVC(op *operand) error {
+	if !cpu.OverflowFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opBVS(op *operand) error {
+	if cpu.OverflowFlag {
+		op.jump = true
+	}
+	return nil
+}
+
+// BRA: 65C02
+func (cpu *CPU6502) opBRA(op *operand) error {
+	op.jump = true
+	return nil
+}
+
+// BBR: 65C02
+func (cpu *CPU6502) opBBR(op *operand) error {
+	op.jump = op.value&(1<<uint((op.opcode.Opcode>>4)&7)) == 0
+	return nil
+}
+
+// BBS: 65C02
+func (cpu *CPU6502) opBBS(op *operand) error {
+	op.jump = op.value&(1<<uint((op.opcode.Opcode>>4)&7)) != 0
+	return nil
+}
+
+func (cpu *CPU6502) opCLC(op *operand) error {
+	cpu.CarryFlag = false
+	return nil
+}
+
+func (cpu *CPU6502) opCLD(op *operand) error {
+	cpu.DecimalFlag = false
+	return nil
+}
+
+func (cpu *CPU6502) opCLI(op *operand) error {
+	cpu.InterruptsDisabledFlag = false
+	return nil
+}
+
+func (cpu *CPU6502) opCLV(op *operand) error {
+	cpu.OverflowFlag = false
+	return nil
+}
+
+func (cpu *CPU6502) opCMP(op *operand) error {
+	res := cpu.A - op.value
+	cpu.CarryFlag = cpu.A >= op.value
+	cpu.SignFlag = res&0x80 != 0
+	cpu.ZeroFlag = res == 0
+	return nil
+}
+
+func (cpu *CPU6502) opCPX(op *operand) error {
+	res := cpu.X - op.value
+	cpu.CarryFlag = cpu.X >= op.value
+	cpu.SignFlag = res&0x80 != 0
+	cpu.ZeroFlag = res == 0
+	return nil
+}
+
+func (cpu *CPU6502) opCPY(op *operand) error {
+	res := cpu.Y - op.value
+	cpu.CarryFlag = cpu.Y >= op.value
+	cpu.SignFlag = res&0x80 != 0
+	cpu.ZeroFlag = res == 0
+	return nil
+}
+
+// DCP: undocumented - equivalent to DEC, CMP
+func (cpu *CPU6502) opDCP(op *operand) error {
+	op.value--
+	cpu.write(op.addr, op.value)
+	res := cpu.A - op.value
+	cpu.CarryFlag = cpu.A >= op.value
+	cpu.SignFlag = res&0x80 != 0
+	cpu.ZeroFlag = res == 0
+	return nil
+}
+
+func (cpu *CPU6502) opDEC(op *operand) error {
+	op.value--
+	cpu.SignFlag = op.value&0x80 != 0
+	cpu.ZeroFlag = op.value == 0
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opDEX(op *operand) error {
+	cpu.X -= 1
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+func (cpu *CPU6502) opDEY(op *operand) error {
+	cpu.Y -= 1
+	cpu.SignFlag = cpu.Y&0x80 != 0
+	cpu.ZeroFlag = cpu.Y == 0
+	return nil
+}
+
+func (cpu *CPU6502) opEOR(op *operand) error {
+	cpu.A ^= op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opINC(op *operand) error {
+	op.value++
+	cpu.SignFlag = op.value&0x80 != 0
+	cpu.ZeroFlag = op.value == 0
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opINX(op *operand) error {
+	cpu.X += 1
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+func (cpu *CPU6502) opINY(op *operand) error {
+	cpu.Y += 1
+	cpu.SignFlag = cpu.Y&0x80 != 0
+	cpu.ZeroFlag = cpu.Y == 0
+	return nil
+}
+
+// ISC: undocumented - equivalent to INC, SBC
+func (cpu *CPU6502) opISC(op *operand) error {
+	op.value++
+	cpu.write(op.addr, op.value)
+	cpu.sbc(op.value)
+	return nil
+}
+
+func (cpu *CPU6502) opJMP(op *operand) error {
+	cpu.PC = op.addr
+	return nil
+}
+
+// KIL: undocumented - locks up the processor
+func (cpu *CPU6502) opKIL(op *operand) error {
+	cpu.jammed = true
+	return &CPUError{
+		Err:    ErrCPUJammed,
+		PC:     op.pc,
+		Opcode: byte(op.opcode.Opcode),
+		State:  cpu.Registers()}
+}
+
+// LAR: undocumented
+func (cpu *CPU6502) opLAR(op *operand) error {
+	op.value &= cpu.SP
+	cpu.A = op.value
+	cpu.X = op.value
+	cpu.SP = op.value
+	cpu.SignFlag = op.value&0x80 != 0
+	cpu.ZeroFlag = op.value == 0
+	return nil
+}
+
+func (cpu *CPU6502) opJSR(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP)) // dummy read of the stack
+	cpu.PushAddress(cpu.PC)
+	op.addr |= uint16(cpu.read(cpu.PC)) << 8
+	cpu.PC = op.addr
+	return nil
+}
+
+// LAX: undocumented
+func (cpu *CPU6502) opLAX(op *operand) error {
+	cpu.A = op.value
+	cpu.X = op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opLDA(op *operand) error {
+	cpu.A = op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opLDX(op *operand) error {
+	cpu.X = op.value
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+func (cpu *CPU6502) opLDY(op *operand) error {
+	cpu.Y = op.value
+	cpu.SignFlag = cpu.Y&0x80 != 0
+	cpu.ZeroFlag = cpu.Y == 0
+	return nil
+}
+
+func (cpu *CPU6502) opLSR(op *operand) error {
+	cpu.CarryFlag = op.value&0x01 > 0
+	op.value >>= 1
+	cpu.SignFlag = op.value&0x80 != 0
+	cpu.ZeroFlag = op.value == 0
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opNOP(op *operand) error {
+	// no-op
+	return nil
+}
+
+// NPC: 65C02 undefined opcodes
+func (cpu *CPU6502) opNPC(op *operand) error {
+	for cpu.busCycles < op.opcode.Cycles {
+		cpu.read(op.addr)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opORA(op *operand) error {
+	cpu.A |= op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opPHA(op *operand) error {
+	cpu.PushByte(cpu.A)
+	return nil
+}
+
+// PHX: 65C02
+func (cpu *CPU6502) opPHX(op *operand) error {
+	cpu.PushByte(cpu.X)
+	return nil
+}
+
+// PHY: 65C02
+func (cpu *CPU6502) opPHY(op *operand) error {
+	cpu.PushByte(cpu.Y)
+	return nil
+}
+
+// PLX: 65C02
+func (cpu *CPU6502) opPLX(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP)) // dummy read of the stack
+	cpu.X = cpu.PopByte()
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+// PLY: 65C02
+func (cpu *CPU6502) opPLY(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP)) // dummy read of the stack
+	cpu.Y = cpu.PopByte()
+	cpu.SignFlag = cpu.Y&0x80 != 0
+	cpu.ZeroFlag = cpu.Y == 0
+	return nil
+}
+
+func (cpu *CPU6502) opPHP(op *operand) error {
+	cpu.PushByte(cpu.GetP() | FLAG_B) // B flag always pushed as 1
+	return nil
+}
+
+func (cpu *CPU6502) opPLA(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP)) // dummy read of the stack
+	cpu.A = cpu.PopByte()
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opPLP(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP))        // dummy read of the stack
+	cpu.SetP(cpu.PopByte() & ^byte(FLAG_B)) // B flag discarded
+	return nil
+}
+
+// RMB: 65C02
+func (cpu *CPU6502) opRMB(op *operand) error {
+	cpu.write(op.addr, op.value&^(1<<uint((op.opcode.Opcode>>4)&7)))
+	return nil
+}
+
+// RLA: undocumented - equivalent to ROL, AND
+func (cpu *CPU6502) opRLA(op *operand) error {
+	var carry byte = 0
+	if cpu.CarryFlag {
+		carry = 1
+	}
+	cpu.CarryFlag = op.value&0x80 > 0
+	op.value = (op.value << 1) | carry
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	cpu.A &= op.value
+	cpu.SignFlag = cpu.A&0x80 > 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opRTI(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP))        // dummy read of the stack
+	cpu.SetP(cpu.PopByte() & ^byte(FLAG_B)) // B flag discarded
+	cpu.PC = cpu.PopAddress()
+	return nil
+}
+
+func (cpu *CPU6502) opROL(op *operand) error {
+	var carry byte = 0
+	if cpu.CarryFlag {
+		carry = 1
+	}
+	cpu.CarryFlag = op.value&0x80 > 0
+	op.value = (op.value << 1) | carry
+	cpu.SignFlag = op.value&0x80 > 0
+	cpu.ZeroFlag = op.value == 0
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opROR(op *operand) error {
+	var carry byte = 0
+	if cpu.CarryFlag {
+		carry = 0x80
+	}
+	cpu.CarryFlag = op.value&0x01 > 0
+	op.value = (op.value >> 1) | carry
+	cpu.SignFlag = op.value&0x80 > 0
+	cpu.ZeroFlag = op.value == 0
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	return nil
+}
+
+// RRA: undocumented - equivalent to ROR, ADC
+func (cpu *CPU6502) opRRA(op *operand) error {
+	var carry byte = 0
+	if cpu.CarryFlag {
+		carry = 0x80
+	}
+	cpu.CarryFlag = op.value&0x01 > 0
+	op.value = (op.value >> 1) | carry
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	cpu.adc(op.value)
+	return nil
+}
+
+func (cpu *CPU6502) opRTS(op *operand) error {
+	cpu.read(0x100 + uint16(cpu.SP)) // dummy read of the stack
+	cpu.PC = cpu.PopAddress()
+	cpu.read(cpu.PC) // dummy read while incrementing PC
+	cpu.PC++
+	return nil
+}
+
+func (cpu *CPU6502) opSBC(op *operand) error {
+	cpu.sbc(op.value)
+	if cpu.variant.cmos() && cpu.decimal() {
+		op.extra += cpu.decimalFlags(op.addr)
+	}
+	return nil
+}
+
+func (cpu *CPU6502) opSEC(op *operand) error {
+	cpu.CarryFlag = true
+	return nil
+}
+
+func (cpu *CPU6502) opSED(op *operand) error {
+	cpu.DecimalFlag = true
+	return nil
+}
+
+func (cpu *CPU6502) opSEI(op *operand) error {
+	cpu.InterruptsDisabledFlag = true
+	return nil
+}
+
+// SMB: 65C02
+func (cpu *CPU6502) opSMB(op *operand) error {
+	cpu.write(op.addr, op.value|1<<uint((op.opcode.Opcode>>4)&7))
+	return nil
+}
+
+// SLO: undocumented - equivalent to ASL, ORA
+func (cpu *CPU6502) opSLO(op *operand) error {
+	cpu.CarryFlag = op.value&0x80 != 0
+	op.value = op.value << 1
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+
+	cpu.A |= op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+// SRE: undocumented - equivalent to LSR, EOR
+func (cpu *CPU6502) opSRE(op *operand) error {
+	cpu.CarryFlag = op.value&0x01 > 0
+	op.value >>= 1
+	if op.opcode.AddressingMode == AMAccumulator {
+		cpu.A = op.value
+	} else {
+		cpu.write(op.addr, op.value)
+	}
+	cpu.A ^= op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opSTA(op *operand) error {
+	cpu.write(op.addr, cpu.A)
+	return nil
+}
+
+func (cpu *CPU6502) opSTX(op *operand) error {
+	cpu.write(op.addr, cpu.X)
+	return nil
+}
+
+func (cpu *CPU6502) opSTY(op *operand) error {
+	cpu.write(op.addr, cpu.Y)
+	return nil
+}
+
+// STP: 65C02 - stops the clock until reset
+func (cpu *CPU6502) opSTP(op *operand) error {
+	cpu.read(cpu.PC) // dummy read
+	cpu.jammed = true
+	return nil
+}
+
+// STZ: 65C02
+func (cpu *CPU6502) opSTZ(op *operand) error {
+	cpu.write(op.addr, 0)
+	return nil
+}
+
+// SXA: undocumented (unstable)
+func (cpu *CPU6502) opSXA(op *operand) error {
+	cpu.storeHigh(op.addr, cpu.Y, cpu.X)
+	return nil
+}
+
+// SYA: undocumented (unstable)
+func (cpu *CPU6502) opSYA(op *operand) error {
+	cpu.storeHigh(op.addr, cpu.X, cpu.Y)
+	return nil
+}
+
+// TRB: 65C02
+func (cpu *CPU6502) opTRB(op *operand) error {
+	cpu.ZeroFlag = op.value&cpu.A == 0
+	cpu.write(op.addr, op.value&^cpu.A)
+	return nil
+}
+
+// TSB: 65C02
+func (cpu *CPU6502) opTSB(op *operand) error {
+	cpu.ZeroFlag = op.value&cpu.A == 0
+	cpu.write(op.addr, op.value|cpu.A)
+	return nil
+}
+
+func (cpu *CPU6502) opTAX(op *operand) error {
+	cpu.X = cpu.A
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+func (cpu *CPU6502) opTAY(op *operand) error {
+	cpu.Y = cpu.A
+	cpu.SignFlag = cpu.Y&0x80 != 0
+	cpu.ZeroFlag = cpu.Y == 0
+	return nil
+}
+
+func (cpu *CPU6502) opTSX(op *operand) error {
+	cpu.X = cpu.SP
+	cpu.SignFlag = cpu.X&0x80 != 0
+	cpu.ZeroFlag = cpu.X == 0
+	return nil
+}
+
+func (cpu *CPU6502) opTXA(op *operand) error {
+	cpu.A = cpu.X
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+func (cpu *CPU6502) opTXS(op *operand) error {
+	cpu.SP = cpu.X
+	return nil
+}
+
+// WAI: 65C02 - wait for an interrupt
+func (cpu *CPU6502) opWAI(op *operand) error {
+	cpu.read(cpu.PC) // dummy read
+	cpu.waiting = true
+	return nil
+}
+
+func (cpu *CPU6502) opTYA(op *operand) error {
+	cpu.A = cpu.Y
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+// XAA: undocumented (unstable) - TXA, then (A | magic) AND byte
+func (cpu *CPU6502) opXAA(op *operand) error {
+	cpu.A = (cpu.A | cpu.XAAMagic) & cpu.X & op.value
+	cpu.SignFlag = cpu.A&0x80 != 0
+	cpu.ZeroFlag = cpu.A == 0
+	return nil
+}
+
+// XAS: undocumented (unstable)
+func (cpu *CPU6502) opXAS(op *operand) error {
+	cpu.SP = cpu.A & cpu.X
+	cpu.storeHigh(op.addr, cpu.Y, cpu.SP)
+	return nil
+}
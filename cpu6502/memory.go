@@ -1,6 +1,25 @@
 package cpu6502
 
+// MemoryAccess is the CPU's view of the bus. A read with peek set must return
+// what a real read would without any side effects (clearing flags, latching
+// registers, acknowledging interrupts) so debuggers and tracers can look at
+// memory without disturbing the emulation.
 type MemoryAccess interface {
 	ReadByte(address uint16, peek bool) byte
 	WriteByte(address uint16, value byte)
 }
+
+// Peek reads a byte without side effects
+func Peek(memory MemoryAccess, address uint16) byte {
+	return memory.ReadByte(address, true)
+}
+
+// PeekRange reads n bytes starting at address (wrapping at $FFFF) without
+// side effects
+func PeekRange(memory MemoryAccess, address uint16, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = memory.ReadByte(address+uint16(i), true)
+	}
+	return b
+}
@@ -19,6 +19,10 @@ const (
 	AMAccumulator
 	AMRelative
 	AMImplied
+	// 65C02 only
+	AMZeroPageIndirect  // (zp)
+	AMAbsoluteIndirectX // (abs,X) - JMP only
+	AMZeroPageRelative  // zp,rel - BBR/BBS only
 )
 
 type InstructionSpec struct {
@@ -96,10 +100,10 @@ var (
 	I_TYA = InstructionSpec{56, "TYA", false, false}
 	// Undocumented/invalid opcodes
 	I_KIL = InstructionSpec{57, "KIL", false, false} // Stop program counter (processor lock up)
-	I_DOP = InstructionSpec{58, "DOP", false, false} // double NOP
+	I_DOP = InstructionSpec{58, "DOP", true, false}  // double NOP
 	I_SLO = InstructionSpec{59, "SLO", true, true}   // Shift left one bit in memory, then OR accumulator with memory. Status flags: N, Z, C
 	I_AAC = InstructionSpec{60, "AAC", false, false} // (ANC) AND byte with accumulator. If result is negative then carry is set. Status flags: N, Z, C
-	I_TOP = InstructionSpec{61, "TOP", false, false} // triple NOP
+	I_TOP = InstructionSpec{61, "TOP", true, false}  // triple NOP
 	I_NP2 = InstructionSpec{62, "NP2", false, false} // NOP - undocumented
 	I_RLA = InstructionSpec{63, "RLA", true, true}   // rotate one bit left in memory, then AND accumulator with memory. Status flags: N, Z, C
 	I_SRE = InstructionSpec{64, "SRE", true, true}   // Shift right one bit in memory, then EOR accumulator with memory. Status flags: N,Z,C
@@ -114,7 +118,7 @@ var (
 	I_AAX = InstructionSpec{68, "AAX", false, true}  // (SAX) [AXS] AND X register with accumulator and store result in memory. Status flags: N,Z
 	I_XAA = InstructionSpec{69, "XAA", false, false} // (ANE) Exact operation unknown. Read the referenced documents for more information and observations.
 	I_AXA = InstructionSpec{70, "AXA", false, true}  // (SHA) AND X register with accumulator then AND result with 7 and store in memory. Status flags: -
-	I_XAS = InstructionSpec{71, "XAS", true, false}  // (SHS) [TAS] AND X register with accumulator and store result in stack
+	I_XAS = InstructionSpec{71, "XAS", false, true}  // (SHS) [TAS] AND X register with accumulator and store result in stack
 	// pointer, then AND stack pointer with the high byte of the
 	// target address of the argument + 1. Store result in memory.
 	// S = X AND A, M = S AND HIGH(arg) + 1
@@ -132,6 +136,22 @@ var (
 	I_AXS = InstructionSpec{78, "AXS", false, false}       // (SBX) [SAX] AND X register with accumulator and store result in X register, then subtract byte from X register (without borrow). Status flags: N,Z,C
 	I_ISC = InstructionSpec{79, "ISC", true, true}         // (ISB) [INS] Increase memory by one, then subtract memory from accumulator (with borrow). Status flags: N,V,Z,C
 	I_SB2 = InstructionSpec{I_SBC.Num, "SB2", true, false} // Same as legal opcode $E9 (SBC #byte)
+	// 65C02
+	I_BRA = InstructionSpec{80, "BRA", false, false} // Branch always
+	I_STZ = InstructionSpec{81, "STZ", false, true}  // Store zero
+	I_PHX = InstructionSpec{82, "PHX", false, false}
+	I_PHY = InstructionSpec{83, "PHY", false, false}
+	I_PLX = InstructionSpec{84, "PLX", false, false}
+	I_PLY = InstructionSpec{85, "PLY", false, false}
+	I_TRB = InstructionSpec{86, "TRB", true, true}   // Test and reset bits (M &= ^A, Z = A & M == 0)
+	I_TSB = InstructionSpec{87, "TSB", true, true}   // Test and set bits (M |= A, Z = A & M == 0)
+	I_RMB = InstructionSpec{88, "RMB", true, true}   // Reset memory bit (bit number is opcode bits 4-6)
+	I_SMB = InstructionSpec{89, "SMB", true, true}   // Set memory bit
+	I_BBR = InstructionSpec{90, "BBR", true, false}  // Branch on bit reset
+	I_BBS = InstructionSpec{91, "BBS", true, false}  // Branch on bit set
+	I_WAI = InstructionSpec{92, "WAI", false, false} // Wait for interrupt
+	I_STP = InstructionSpec{93, "STP", false, false} // Stop the clock (until reset)
+	I_NPC = InstructionSpec{94, "NOP", true, false}  // Undefined 65C02 opcodes (NOPs that may read their operand)
 )
 
 var (
@@ -144,7 +164,7 @@ var (
 		{0x0a, I_ASL, 1, AMAccumulator, 2}, {0x0b, I_AAC, 2, AMImmediate, 2},
 		{0x0c, I_TOP, 3, AMAbsolute, 4}, {0x0d, I_ORA, 3, AMAbsolute, 4},
 		{0x0e, I_ASL, 3, AMAbsolute, 6}, {0x0f, I_SLO, 3, AMAbsolute, 6},
-		{0x10, I_BPL, 2, AMRelative, -2}, {0x11, I_ORA, 2, AMIndirectY, 5},
+		{0x10, I_BPL, 2, AMRelative, -2}, {0x11, I_ORA, 2, AMIndirectY, -5},
 		{0x12, I_KIL, 1, AMImplied, 0}, {0x13, I_SLO, 2, AMIndirectY, 8},
 		{0x14, I_DOP, 2, AMZeroPageX, 4}, {0x15, I_ORA, 2, AMZeroPageX, 4},
 		{0x16, I_ASL, 2, AMZeroPageX, 6}, {0x17, I_SLO, 2, AMZeroPageX, 6},
@@ -160,7 +180,7 @@ var (
 		{0x2a, I_ROL, 1, AMAccumulator, 2}, {0x2b, I_AAC, 2, AMImmediate, 2},
 		{0x2c, I_BIT, 3, AMAbsolute, 4}, {0x2d, I_AND, 3, AMAbsolute, 4},
 		{0x2e, I_ROL, 3, AMAbsolute, 6}, {0x2f, I_RLA, 3, AMAbsolute, 6},
-		{0x30, I_BMI, 2, AMRelative, -2}, {0x31, I_AND, 2, AMIndirectY, 5},
+		{0x30, I_BMI, 2, AMRelative, -2}, {0x31, I_AND, 2, AMIndirectY, -5},
 		{0x32, I_KIL, 1, AMImplied, 0}, {0x33, I_RLA, 2, AMIndirectY, 8},
 		{0x34, I_DOP, 2, AMZeroPageX, 4}, {0x35, I_AND, 2, AMZeroPageX, 4},
 		{0x36, I_ROL, 2, AMZeroPageX, 6}, {0x37, I_RLA, 2, AMZeroPageX, 6},
@@ -266,14 +286,16 @@ var (
 		{0xfe, I_INC, 3, AMAbsoluteX, 7}, {0xff, I_ISC, 3, AMAbsoluteX, 7}}
 )
 
-func ReadOpcode(memory MemoryAccess, address uint16) (OpcodeSpec, uint16) {
-	op := opcodes[memory.ReadByte(address, false)]
+// ReadOpcode decodes the variant's instruction at address without side
+// effects and returns it with its operand.
+func ReadOpcode(memory MemoryAccess, variant Variant, address uint16) (OpcodeSpec, uint16) {
+	op := variant.Opcodes()[memory.ReadByte(address, true)]
 
 	var value uint16 = 0
 	if op.Size == 2 {
-		value = uint16(memory.ReadByte(address+1, false))
+		value = uint16(memory.ReadByte(address+1, true))
 	} else if op.Size == 3 {
-		value = uint16(memory.ReadByte(address+1, false)) | (uint16(memory.ReadByte(address+2, false)) << 8)
+		value = uint16(memory.ReadByte(address+1, true)) | (uint16(memory.ReadByte(address+2, true)) << 8)
 	}
 	// switch op.AddressingMode {
 	// case AMRelative:
@@ -283,6 +305,19 @@ func ReadOpcode(memory MemoryAccess, address uint16) (OpcodeSpec, uint16) {
 }
 
 func (op OpcodeSpec) FormatArguments(value uint16, address uint16) string {
+	return op.FormatArgumentsSymbolic(value, address, nil)
+}
+
+// FormatArgumentsSymbolic formats the arguments like FormatArguments but
+// with the addresses that symbols has names for printed as names. Immediate
+// values are always printed as numbers.
+func (op OpcodeSpec) FormatArgumentsSymbolic(value uint16, address uint16, symbols Symbols) string {
+	zp := func(a uint16) string {
+		return symbolOr(symbols, a, "$%02X")
+	}
+	abs := func(a uint16) string {
+		return symbolOr(symbols, a, "$%04X")
+	}
 	var arguments string = ""
 	switch op.AddressingMode {
 	case AMAccumulator:
@@ -290,25 +325,31 @@ func (op OpcodeSpec) FormatArguments(value uint16, address uint16) string {
 	case AMImmediate:
 		arguments = fmt.Sprintf("#$%02X", value)
 	case AMIndirect:
-		arguments = fmt.Sprintf("($%04X)", value)
+		arguments = "(" + abs(value) + ")"
 	case AMIndirectX:
-		arguments = fmt.Sprintf("($%02X,X)", value)
+		arguments = "(" + zp(value) + ",X)"
 	case AMIndirectY:
-		arguments = fmt.Sprintf("($%02X),Y", value)
+		arguments = "(" + zp(value) + "),Y"
 	case AMRelative:
-		arguments = fmt.Sprintf("$%02X", address+uint16(int8(value)))
+		arguments = zp(address + uint16(int8(value)))
 	case AMZeroPage:
-		arguments = fmt.Sprintf("$%02X", value)
+		arguments = zp(value)
 	case AMZeroPageX:
-		arguments = fmt.Sprintf("$%02X,X", value)
+		arguments = zp(value) + ",X"
 	case AMZeroPageY:
-		arguments = fmt.Sprintf("$%02X,Y", value)
+		arguments = zp(value) + ",Y"
 	case AMAbsolute:
-		arguments = fmt.Sprintf("$%04X", value)
+		arguments = abs(value)
 	case AMAbsoluteX:
-		arguments = fmt.Sprintf("$%04X,X", value)
+		arguments = abs(value) + ",X"
 	case AMAbsoluteY:
-		arguments = fmt.Sprintf("$%04X,Y", value)
+		arguments = abs(value) + ",Y"
+	case AMZeroPageIndirect:
+		arguments = "(" + zp(value) + ")"
+	case AMAbsoluteIndirectX:
+		arguments = "(" + abs(value) + ",X)"
+	case AMZeroPageRelative:
+		arguments = zp(value&0xff) + "," + zp(address+uint16(int8(value>>8)))
 	}
 	return arguments
 }
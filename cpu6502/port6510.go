@@ -0,0 +1,124 @@
+package cpu6502
+
+const (
+	PORT6510_PINS     = 0x3f // P0-P5, bits 6 and 7 aren't connected
+	PORT6510_FLOATING = 0xc0
+
+	// Cycles an unconnected bit keeps the value last written to it after
+	// being switched to an input (VICE's figure for the C64's 6510)
+	PORT6510_FADE_CYCLES = 350000
+)
+
+// IOPort6510 is the 6510's processor port: a data direction register at
+// $0000 (1 bits are outputs) and an output latch at $0001. Reading $0001
+// gives the latch for the outputs and the pin levels for the inputs. The
+// port sits in front of the CPU's memory, so reads and writes of $0000 and
+// $0001 don't reach it (MapPages refuses to map page 0 for the 6510).
+//
+// Bits 6 and 7 have no pins. Switched to inputs they read back the value
+// they last had as outputs until it fades away after FadeCycles.
+type IOPort6510 struct {
+	// Input, if set, returns the levels of P0-P5 driven from outside.
+	// Only the bits of inputs are used. Without it inputs read as 1
+	// (pulled up).
+	Input func() byte
+	// Changed, if set, is called with the new pin levels (as $0001 reads)
+	// when a write to the port or a reset changes them, e.g. so the C64
+	// can remap memory when the LORAM, HIRAM and CHAREN bits change.
+	Changed    func(pins byte)
+	FadeCycles uint64
+
+	memory MemoryAccess
+	cpu    *CPU6502
+	ioPortState
+}
+
+type ioPortState struct {
+	ddr, latch byte
+	pins       byte      // levels last passed to Changed
+	floating   byte      // values of the unconnected bits when they became inputs
+	fadeAt     [8]uint64 // cycle when each unconnected bit fades to 0
+}
+
+func newIOPort6510(memory MemoryAccess, cpu *CPU6502) *IOPort6510 {
+	p := &IOPort6510{memory: memory, cpu: cpu, FadeCycles: PORT6510_FADE_CYCLES}
+	p.pins = p.Pins()
+	return p
+}
+
+// IOPort returns the 6510's I/O port or nil for other variants.
+func (cpu *CPU6502) IOPort() *IOPort6510 {
+	return cpu.port
+}
+
+// DDR returns the data direction register.
+func (p *IOPort6510) DDR() byte {
+	return p.ddr
+}
+
+// Latch returns the output latch.
+func (p *IOPort6510) Latch() byte {
+	return p.latch
+}
+
+// Pins returns the levels of the port's bits: what reading $0001 gives.
+func (p *IOPort6510) Pins() byte {
+	in := byte(PORT6510_PINS)
+	if p.Input != nil {
+		in = p.Input()
+	}
+	pins := p.latch&p.ddr | in&^p.ddr&PORT6510_PINS
+	for bit := uint(6); bit < 8; bit++ {
+		m := byte(1) << bit
+		if p.ddr&m == 0 && p.floating&m != 0 && p.cpu.Cycles < p.fadeAt[bit] {
+			pins |= m
+		}
+	}
+	return pins
+}
+
+func (p *IOPort6510) ReadByte(address uint16, peek bool) byte {
+	switch address {
+	case 0x0000:
+		return p.ddr
+	case 0x0001:
+		return p.Pins()
+	}
+	return p.memory.ReadByte(address, peek)
+}
+
+func (p *IOPort6510) WriteByte(address uint16, value byte) {
+	switch address {
+	case 0x0000:
+		// Unconnected bits switched to inputs hold their level for a while
+		for bit := uint(6); bit < 8; bit++ {
+			m := byte(1) << bit
+			if p.ddr&m != 0 && value&m == 0 {
+				p.floating = p.floating&^m | p.latch&m
+				p.fadeAt[bit] = p.cpu.Cycles + p.FadeCycles
+			}
+		}
+		p.ddr = value
+	case 0x0001:
+		p.latch = value
+	default:
+		p.memory.WriteByte(address, value)
+		return
+	}
+	p.update()
+}
+
+// reset makes every bit an input as the RES line does
+func (p *IOPort6510) reset() {
+	p.WriteByte(0x0000, 0)
+}
+
+// update calls Changed if the levels of P0-P5 have changed
+func (p *IOPort6510) update() {
+	if pins := p.Pins(); (pins^p.pins)&PORT6510_PINS != 0 {
+		p.pins = pins
+		if p.Changed != nil {
+			p.Changed(pins)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package cpu6502
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/samuel/go-emu/pprof"
+)
+
+// Profiler attributes the cycles used by each instruction to its address
+// and call stack so the emulated program can be examined with
+// `go tool pprof`. Set it as the CPU's Profiler.
+//
+// Call stacks come from the CPU's shadow call stack (see CallStack). Code
+// running outside any frame is attributed to whatever routine was running
+// when profiling started.
+type Profiler struct {
+	// Symbol, if set, returns the name of the routine at an address in a
+	// bank (-1 if not banked), e.g. symbols.Table.Lookup. An empty name
+	// falls back to the address.
+	Symbol func(address uint16, bank int) string
+	// Bank, if set, returns the bank mapped at an address or -1 if it
+	// isn't banked, so code at the same address in different banks is
+	// kept apart.
+	Bank func(address uint16) int
+
+	root    profileAddress // where profiling started
+	rooted  bool
+	frames  []profileFrame // banks of the CPU's call stack
+	samples map[string]*profileSample
+	cycles  uint64
+	key     []byte
+}
+
+// profileFrame is a frame of the CPU's call stack with the banks mapped
+// when it was entered
+type profileFrame struct {
+	Frame
+	entry  profileAddress
+	caller profileAddress
+}
+
+type profileAddress struct {
+	pc   uint16
+	bank int
+}
+
+// append appends a to a sample key
+func (a profileAddress) append(key []byte) []byte {
+	return append(key, byte(a.pc), byte(a.pc>>8), byte(a.bank), byte(a.bank>>8), byte(a.bank>>16))
+}
+
+type profileSample struct {
+	stack        []profileAddress // leaf first, then the call site in each caller
+	routines     []profileAddress // entry of the routine containing each of stack
+	instructions int64
+	cycles       int64
+}
+
+// NewProfiler returns an empty profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{samples: map[string]*profileSample{}}
+}
+
+// Cycles returns the total number of cycles profiled.
+func (p *Profiler) Cycles() uint64 {
+	return p.cycles
+}
+
+func (p *Profiler) address(pc uint16) profileAddress {
+	a := profileAddress{pc: pc, bank: -1}
+	if p.Bank != nil {
+		a.bank = p.Bank(pc)
+	}
+	return a
+}
+
+// record adds cycles (and an instruction unless it's an interrupt
+// sequence) at pc with the CPU's call stack
+func (p *Profiler) record(cpu *CPU6502, pc uint16, cycles int, instruction bool) {
+	leaf := p.address(pc)
+	if !p.rooted {
+		p.root, p.rooted = leaf, true
+	}
+	p.sync(cpu.CallStack())
+	p.key = leaf.append(p.key[:0])
+	for i := len(p.frames) - 1; i >= 0; i-- {
+		p.key = p.frames[i].entry.append(p.key)
+		p.key = p.frames[i].caller.append(p.key)
+	}
+	s := p.samples[string(p.key)]
+	if s == nil {
+		s = &profileSample{stack: []profileAddress{leaf}}
+		for i := len(p.frames) - 1; i >= 0; i-- {
+			s.routines = append(s.routines, p.frames[i].entry)
+			s.stack = append(s.stack, p.frames[i].caller)
+		}
+		s.routines = append(s.routines, p.root)
+		p.samples[string(p.key)] = s
+	}
+	s.cycles += int64(cycles)
+	if instruction {
+		s.instructions++
+	}
+	p.cycles += uint64(cycles)
+}
+
+// sync matches frames to the CPU's call stack, looking up the banks of
+// frames entered since the last record
+func (p *Profiler) sync(calls []Frame) {
+	n := 0
+	for n < len(p.frames) && n < len(calls) && p.frames[n].Frame == calls[n] {
+		n++
+	}
+	p.frames = p.frames[:n]
+	for _, f := range calls[n:] {
+		p.frames = append(p.frames, profileFrame{Frame: f, entry: p.address(f.Entry), caller: p.address(f.Caller)})
+	}
+}
+
+// instruction records an executed instruction. It's called before the call
+// stack is updated so JSR and RTS count in the caller and callee.
+func (p *Profiler) instruction(cpu *CPU6502, pc uint16, cycles int) {
+	p.record(cpu, pc, cycles, true)
+}
+
+// interrupt records an interrupt sequence once its frame has been pushed
+func (p *Profiler) interrupt(cpu *CPU6502, cycles int) {
+	p.record(cpu, cpu.PC, cycles, false)
+}
+
+// wait records a cycle spent waiting for an interrupt (WAI)
+func (p *Profiler) wait(cpu *CPU6502) {
+	p.record(cpu, cpu.PC, 1, false)
+}
+
+// Reset discards everything profiled so far.
+func (p *Profiler) Reset() {
+	p.rooted = false
+	p.frames = nil
+	p.samples = map[string]*profileSample{}
+	p.cycles = 0
+}
+
+// name returns the name of the routine starting at a
+func (p *Profiler) name(a profileAddress) string {
+	if p.Symbol != nil {
+		if name := p.Symbol(a.pc, a.bank); name != "" {
+			if a.bank >= 0 {
+				return fmt.Sprintf("%s (bank %d)", name, a.bank)
+			}
+			return name
+		}
+	}
+	if a.bank >= 0 {
+		return fmt.Sprintf("$%02X:%04X", a.bank, a.pc)
+	}
+	return fmt.Sprintf("$%04X", a.pc)
+}
+
+// Profile returns the profile with "instructions" and "cycles" sample types.
+func (p *Profiler) Profile() *pprof.Profile {
+	prof := &pprof.Profile{
+		SampleType: []pprof.ValueType{
+			{Type: "instructions", Unit: "count"},
+			{Type: "cycles", Unit: "count"},
+		},
+		PeriodType:        pprof.ValueType{Type: "cycles", Unit: "count"},
+		Period:            1,
+		DefaultSampleType: "cycles",
+	}
+	functions := map[profileAddress]*pprof.Function{}
+	locations := map[[2]profileAddress]*pprof.Location{}
+	location := func(pc, routine profileAddress) *pprof.Location {
+		if l := locations[[2]profileAddress{pc, routine}]; l != nil {
+			return l
+		}
+		f := functions[routine]
+		if f == nil {
+			f = &pprof.Function{Name: p.name(routine), SystemName: p.name(routine)}
+			functions[routine] = f
+		}
+		address := uint64(pc.pc)
+		if pc.bank >= 0 {
+			address |= uint64(pc.bank+1) << 16
+		}
+		// The line number is the address so pprof keeps instructions apart
+		l := &pprof.Location{Address: address, Function: f, Line: int64(pc.pc)}
+		locations[[2]profileAddress{pc, routine}] = l
+		return l
+	}
+
+	// Sort the samples so the output is deterministic
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := p.samples[k]
+		sample := &pprof.Sample{Value: []int64{s.instructions, s.cycles}}
+		for i, pc := range s.stack {
+			sample.Location = append(sample.Location, location(pc, s.routines[i]))
+		}
+		prof.Sample = append(prof.Sample, sample)
+	}
+	return prof
+}
+
+// WriteProfile writes the profile in pprof's gzipped protobuf format.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	return p.Profile().Write(w)
+}
@@ -0,0 +1,120 @@
+package cpu6502
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Harness for the 6502 test ROMs:
+//
+//	6502_functional_test.bin - Klaus Dormann's functional test assembled
+//	    with the default configuration (load at $0000, start at $0400)
+//	6502_decimal_test.bin - Bruce Clark's decimal mode test as distributed
+//	    with Klaus Dormann's tests (load and start at $0200) assembled with
+//	    end_of_test as "jmp *" since the NMOS 6502 has no STP
+//
+// Put the binaries in testdata (or CPU6502_TESTROM_DIR). Tests for missing
+// ROMs are skipped.
+
+// maxTrapInstructions is how long a test ROM may run before giving up. The
+// functional test needs about 30 million instructions.
+const maxTrapInstructions = 100000000
+
+type flatMemory [0x10000]byte
+
+func (m *flatMemory) ReadByte(addr uint16, peek bool) byte {
+	return m[addr]
+}
+
+func (m *flatMemory) WriteByte(addr uint16, value byte) {
+	m[addr] = value
+}
+
+// runUntilTrap runs until the program loops on a single instruction (JMP *
+// or a branch to itself) and returns the trap address.
+func runUntilTrap(cpu *CPU6502, limit int) (uint16, error) {
+	for i := 0; i < limit; i++ {
+		pc := cpu.PC
+		if _, err := cpu.Step(); err != nil {
+			return pc, err
+		}
+		if cpu.PC == pc {
+			return pc, nil
+		}
+	}
+	return cpu.PC, fmt.Errorf("no trap after %d instructions %s", limit, cpu.Registers())
+}
+
+func loadTestROM(t *testing.T, name string, addr uint16) *flatMemory {
+	dir := os.Getenv("CPU6502_TESTROM_DIR")
+	if dir == "" {
+		dir = "testdata"
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		t.Skipf("%s not found in %s", name, dir)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	memory := &flatMemory{}
+	copy(memory[addr:], data)
+	return memory
+}
+
+func TestFunctionalROM(t *testing.T) {
+	const success = 0x3469
+	memory := loadTestROM(t, "6502_functional_test.bin", 0x0000)
+	cpu := NewCPU6502(memory)
+	cpu.PC = 0x0400
+	trap, err := runUntilTrap(cpu, maxTrapInstructions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trap != success {
+		// The test number is kept in $0200
+		t.Fatalf("trapped at $%04X in test $%02X %s", trap, memory[0x0200], cpu.Registers())
+	}
+}
+
+func TestDecimalROM(t *testing.T) {
+	memory := loadTestROM(t, "6502_decimal_test.bin", 0x0200)
+	cpu := NewCPU6502(memory)
+	cpu.PC = 0x0200
+	trap, err := runUntilTrap(cpu, maxTrapInstructions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ERROR ($000B) is 0 on success. N1/N2 ($0000/$0001) are the operands,
+	// DA/DNVZC ($0004/$0005) the actual result and flags and AR ($0006) the
+	// expected result of the failing case.
+	if memory[0x0b] != 0 {
+		t.Fatalf("failed at $%04X: N1=$%02X N2=$%02X A=$%02X P=$%02X expected A=$%02X %s",
+			trap, memory[0x00], memory[0x01], memory[0x04], memory[0x05], memory[0x06], cpu.Registers())
+	}
+}
+
+func TestRunUntilTrap(t *testing.T) {
+	prog, err := Assemble(`
+		.org $0400
+		LDX #10
+loop:	DEX
+		BNE loop
+done:	JMP done`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := &flatMemory{}
+	copy(memory[prog.Origin:], prog.Code)
+	cpu := NewCPU6502(memory)
+	cpu.PC = prog.Origin
+	if trap, err := runUntilTrap(cpu, 100); err != nil || trap != prog.Labels["done"] {
+		t.Errorf("runUntilTrap returned $%04X, %v", trap, err)
+	}
+
+	cpu.PC = prog.Origin
+	if _, err := runUntilTrap(cpu, 5); err == nil {
+		t.Errorf("runUntilTrap didn't give up")
+	}
+}
@@ -0,0 +1,190 @@
+package cpu6502
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Runner for the SingleStepTests (https://github.com/SingleStepTests/65x02)
+// 6502 test vectors. Each file XX.json holds 10,000 cases for opcode $XX.
+// They're too big to check in, so fetch them with
+//
+//	git clone --depth 1 https://github.com/SingleStepTests/65x02
+//
+// and copy (or link) the files from 65x02/6502/v1 into testdata/singlestep
+// or point CPU6502_SINGLESTEP_DIR at that directory, as the singlestep CI
+// job does. TestSingleStep is skipped without them unless
+// CPU6502_SINGLESTEP_DIR is set, and logs how many cases passed.
+
+type singleStepState struct {
+	PC  uint16   `json:"pc"`
+	S   byte     `json:"s"`
+	A   byte     `json:"a"`
+	X   byte     `json:"x"`
+	Y   byte     `json:"y"`
+	P   byte     `json:"p"`
+	RAM [][2]int `json:"ram"`
+}
+
+type singleStepTest struct {
+	Name    string           `json:"name"`
+	Initial singleStepState  `json:"initial"`
+	Final   singleStepState  `json:"final"`
+	Cycles  [][3]interface{} `json:"cycles"`
+}
+
+// B and the unused bit don't exist in the status register
+const singleStepPMask = ^byte(FLAG_B | 0x20)
+
+// singleStepFailures is how many failing cases to show per opcode
+const singleStepFailures = 5
+
+func TestSingleStep(t *testing.T) {
+	dir := os.Getenv("CPU6502_SINGLESTEP_DIR")
+	required := dir != ""
+	if !required {
+		dir = filepath.Join("testdata", "singlestep")
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		if required {
+			t.Fatalf("no test vectors in %s", dir)
+		}
+		t.Skipf("no test vectors in %s (see singlestep_test.go for where to get them)", dir)
+	}
+	var passed, total int
+	for _, path := range files {
+		op, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".json"), 16, 8)
+		if err != nil {
+			continue
+		}
+		if opcodes[op].Instruction.Num == I_KIL.Num {
+			continue
+		}
+		path := path
+		t.Run(fmt.Sprintf("%02x", op), func(t *testing.T) {
+			p, n := runSingleStepFile(t, path)
+			passed += p
+			total += n
+		})
+	}
+	t.Logf("%d of %d cases passed, %d failed", passed, total, total-passed)
+}
+
+// TestSingleStepRunner checks the runner itself on a case in the vectors'
+// format (STA ($FF),Y with the pointer wrapping around page 0) and a copy
+// of it with the wrong value written.
+func TestSingleStepRunner(t *testing.T) {
+	const vector = `{"name": "91 ff",
+		"initial": {"pc": 4096, "s": 253, "a": 66, "x": 0, "y": 1, "p": 36,
+			"ram": [[4096, 145], [4097, 255], [255, 0], [0, 3]]},
+		"final": {"pc": 4098, "s": 253, "a": 66, "x": 0, "y": 1, "p": 36,
+			"ram": [[4096, 145], [4097, 255], [255, 0], [0, 3], [769, 66]]},
+		"cycles": [[4096, 145, "read"], [4097, 255, "read"], [255, 0, "read"], [0, 3, "read"],
+			[769, 0, "read"], [769, 66, "write"]]}`
+	var test singleStepTest
+	if err := json.Unmarshal([]byte(vector), &test); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSingleStep(&test); err != nil {
+		t.Errorf("%s: %s", test.Name, err)
+	}
+	test.Final.RAM[4][1] = 67
+	if err := runSingleStep(&test); err == nil || !strings.Contains(err.Error(), "ram $0301=$42, expected $43") {
+		t.Errorf("runner didn't report the wrong write: %v", err)
+	}
+}
+
+// runSingleStepFile runs the cases in a file and returns how many passed
+// out of how many.
+func runSingleStepFile(t *testing.T, path string) (int, int) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests []singleStepTest
+	if err := json.Unmarshal(data, &tests); err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	failures := 0
+	for _, test := range tests {
+		if err := runSingleStep(&test); err != nil {
+			if failures++; failures <= singleStepFailures {
+				t.Errorf("%s: %s", test.Name, err)
+			}
+		}
+	}
+	if failures > 0 {
+		t.Logf("%d of %d cases failed", failures, len(tests))
+	}
+	return len(tests) - failures, len(tests)
+}
+
+func runSingleStep(test *singleStepTest) error {
+	memory := NewTestMemory(nil)
+	for _, m := range test.Initial.RAM {
+		memory.bytes[m[0]] = byte(m[1])
+	}
+	cpu := NewCPU6502(memory)
+	cpu.PC = test.Initial.PC
+	cpu.SP = test.Initial.S
+	cpu.A = test.Initial.A
+	cpu.X = test.Initial.X
+	cpu.Y = test.Initial.Y
+	cpu.SetP(test.Initial.P)
+
+	cycles, err := cpu.Step()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	final := test.Final
+	if cpu.PC != final.PC || cpu.SP != final.S || cpu.A != final.A || cpu.X != final.X || cpu.Y != final.Y ||
+		cpu.GetP()&singleStepPMask != final.P&singleStepPMask {
+		errs = append(errs, fmt.Sprintf("registers PC:%04x SP:%02x A:%02x X:%02x Y:%02x P:%02x, expected PC:%04x SP:%02x A:%02x X:%02x Y:%02x P:%02x",
+			cpu.PC, cpu.SP, cpu.A, cpu.X, cpu.Y, cpu.GetP(), final.PC, final.S, final.A, final.X, final.Y, final.P))
+	}
+	for _, m := range final.RAM {
+		if v := memory.bytes[m[0]]; v != byte(m[1]) {
+			errs = append(errs, fmt.Sprintf("ram $%04X=$%02X, expected $%02X", m[0], v, m[1]))
+		}
+	}
+
+	expected := make([]busCycle, len(test.Cycles))
+	for i, c := range test.Cycles {
+		addr, _ := c[0].(float64)
+		value, _ := c[1].(float64)
+		kind, _ := c[2].(string)
+		expected[i] = busCycle{uint16(addr), byte(value), kind == "write"}
+	}
+	if cycles != len(expected) {
+		errs = append(errs, fmt.Sprintf("%d cycles, expected %d", cycles, len(expected)))
+	}
+	for i := 0; i < len(expected) || i < len(memory.cycles); i++ {
+		var got, exp string
+		if i < len(memory.cycles) {
+			got = memory.cycles[i].String()
+		}
+		if i < len(expected) {
+			exp = expected[i].String()
+		}
+		if got != exp {
+			errs = append(errs, fmt.Sprintf("cycle %d: %q, expected %q", i, got, exp))
+			break
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
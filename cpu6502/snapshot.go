@@ -0,0 +1,61 @@
+package cpu6502
+
+// Snapshot is a copy of the CPU's execution state taken between
+// instructions. It doesn't include the configuration (variant, hooks,
+// breakpoints, mapped pages) or memory, which belongs to the host system,
+// apart from the 6510's I/O port.
+type Snapshot struct {
+	Registers
+	IRQ     uint32 // asserted IRQ sources
+	NMI     bool   // level of the NMI line
+	Jammed  bool
+	Waiting bool
+
+	interrupts   interruptState
+	halt         int
+	haltFunc     func(int)
+	indirectJump bool
+	calls        []Frame
+	port         ioPortState
+}
+
+// Snapshot returns a copy of the CPU's state.
+func (cpu *CPU6502) Snapshot() Snapshot {
+	s := Snapshot{
+		Registers:    cpu.Registers(),
+		IRQ:          cpu.irq,
+		NMI:          cpu.nmi,
+		interrupts:   cpu.interruptState,
+		halt:         cpu.halt,
+		haltFunc:     cpu.haltFunc,
+		Jammed:       cpu.jammed,
+		Waiting:      cpu.waiting,
+		indirectJump: cpu.indirectJump,
+		calls:        append([]Frame(nil), cpu.calls...),
+	}
+	if cpu.port != nil {
+		s.port = cpu.port.ioPortState
+	}
+	return s
+}
+
+// Restore puts the CPU back in the state s was taken in.
+func (cpu *CPU6502) Restore(s Snapshot) {
+	cpu.A, cpu.X, cpu.Y = s.A, s.X, s.Y
+	cpu.SetP(s.P)
+	cpu.SP = s.SP
+	cpu.PC = s.PC
+	cpu.Cycles = s.Cycles
+	cpu.irq = s.IRQ
+	cpu.nmi = s.NMI
+	cpu.interruptState = s.interrupts
+	cpu.halt, cpu.haltFunc = s.halt, s.haltFunc
+	cpu.jammed = s.Jammed
+	cpu.waiting = s.Waiting
+	cpu.indirectJump = s.indirectJump
+	cpu.calls = append(cpu.calls[:0], s.calls...)
+	cpu.resuming = false
+	if cpu.port != nil {
+		cpu.port.ioPortState = s.port
+	}
+}
@@ -0,0 +1,21 @@
+package cpu6502
+
+import "fmt"
+
+// Symbols names addresses, e.g. from the labels in a program's debug info
+// (see the symbols package). Name should take the bank mapped at the
+// address into account and return "" if it has no name.
+type Symbols interface {
+	Name(address uint16) string
+	Address(name string) (uint16, bool)
+}
+
+// symbolOr returns the name of addr or addr formatted with format
+func symbolOr(symbols Symbols, addr uint16, format string) string {
+	if symbols != nil {
+		if name := symbols.Name(addr); name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf(format, addr)
+}
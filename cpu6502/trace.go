@@ -0,0 +1,239 @@
+package cpu6502
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tracer is called by Step before each instruction is executed (after any
+// pending interrupt has been taken) with PC pointing at the opcode.
+type Tracer interface {
+	Trace(cpu *CPU6502)
+}
+
+// TraceFormat selects the layout of the lines written by a LogTracer.
+type TraceFormat int
+
+const (
+	// TraceNestest matches nestest.log:
+	//	C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+	TraceNestest TraceFormat = iota
+	// TraceFCEUX matches FCEUX's trace logger with its default options:
+	//	A:00 X:00 Y:00 S:FD P:nvUbdIzc  $C000:4C F5 C5  JMP $C5F5
+	TraceFCEUX
+	// TraceMesen matches Mesen's trace logger with its default format:
+	//	C000  $4C $F5 $C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:21  SL:0   CPU Cycle:7
+	TraceMesen
+)
+
+func (f TraceFormat) String() string {
+	switch f {
+	case TraceNestest:
+		return "nestest"
+	case TraceFCEUX:
+		return "fceux"
+	case TraceMesen:
+		return "mesen"
+	}
+	return fmt.Sprintf("TraceFormat(%d)", int(f))
+}
+
+// ParseTraceFormat returns the format with the given name (see String).
+func ParseTraceFormat(name string) (TraceFormat, error) {
+	for f := TraceNestest; f <= TraceMesen; f++ {
+		if strings.EqualFold(name, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown trace format %q", name)
+}
+
+// LogTracer writes a line per instruction to W. PPU, if set, returns the
+// PPU scanline and dot shown by the nestest and Mesen formats. The first
+// write error is kept in Err and stops further output.
+type LogTracer struct {
+	W      io.Writer
+	Format TraceFormat
+	PPU    func() (scanline, dot int)
+	Err    error
+}
+
+func NewLogTracer(w io.Writer, format TraceFormat, ppu func() (scanline, dot int)) *LogTracer {
+	return &LogTracer{W: w, Format: format, PPU: ppu}
+}
+
+func (t *LogTracer) Trace(cpu *CPU6502) {
+	if t.Err != nil {
+		return
+	}
+	var scanline, dot int
+	if t.PPU != nil {
+		scanline, dot = t.PPU()
+	}
+	_, t.Err = io.WriteString(t.W, FormatTrace(cpu, t.Format, scanline, dot)+"\n")
+}
+
+// traceOperand is the effective address and value of an instruction's
+// operand as shown by the trace formats. Memory is only peeked.
+type traceOperand struct {
+	pointer uint16 // zero page address or pointer used by indirect modes
+	addr    uint16 // effective address
+	value   byte   // value at addr
+}
+
+func (cpu *CPU6502) traceOperand(op OpcodeSpec, value uint16) traceOperand {
+	peek := func(addr uint16) byte {
+		return cpu.memory.ReadByte(addr, true)
+	}
+	// zero page pointers wrap within the zero page
+	peekZPWord := func(zp byte) uint16 {
+		return uint16(peek(uint16(zp))) | uint16(peek(uint16(zp+1)))<<8
+	}
+	var o traceOperand
+	switch op.AddressingMode {
+	case AMZeroPage, AMAbsolute:
+		o.addr = value
+	case AMZeroPageX:
+		o.addr = uint16(byte(value) + cpu.X)
+	case AMZeroPageY:
+		o.addr = uint16(byte(value) + cpu.Y)
+	case AMAbsoluteX:
+		o.addr = value + uint16(cpu.X)
+	case AMAbsoluteY:
+		o.addr = value + uint16(cpu.Y)
+	case AMIndirectX:
+		o.pointer = uint16(byte(value) + cpu.X)
+		o.addr = peekZPWord(byte(o.pointer))
+	case AMIndirectY:
+		o.pointer = peekZPWord(byte(value))
+		o.addr = o.pointer + uint16(cpu.Y)
+	case AMZeroPageIndirect:
+		o.addr = peekZPWord(byte(value))
+	case AMIndirect:
+		// The target of JMP (ind) including the NMOS page wrap bug
+		hi := value + 1
+		if !cpu.variant.cmos() {
+			hi = value&0xff00 | uint16(byte(value)+1)
+		}
+		o.addr = uint16(peek(value)) | uint16(peek(hi))<<8
+		return o
+	}
+	o.value = peek(o.addr)
+	return o
+}
+
+// traceShowsValue returns false for instructions whose operand is only an
+// address (jumps) rather than a memory access.
+func traceShowsValue(op OpcodeSpec) bool {
+	switch op.Instruction.Num {
+	case I_JMP.Num, I_JSR.Num:
+		return false
+	}
+	return true
+}
+
+// traceUndocumented returns true for the opcodes nestest marks with a *
+func traceUndocumented(op OpcodeSpec) bool {
+	return op.Instruction.Num >= I_KIL.Num && op.Instruction.Num < I_BRA.Num || op.Instruction.Name == I_SB2.Name
+}
+
+// FormatTrace formats the instruction at PC and the current registers as a
+// line (without newline) of the given trace format. Operands are printed by
+// name if the CPU has Symbols.
+func FormatTrace(cpu *CPU6502, format TraceFormat, scanline, dot int) string {
+	pc := cpu.PC
+	op := cpu.opcodes[cpu.memory.ReadByte(pc, true)]
+	var value uint16
+	bytes := make([]byte, op.Size)
+	for i := range bytes {
+		bytes[i] = cpu.memory.ReadByte(pc+uint16(i), true)
+		if i > 0 {
+			value |= uint16(bytes[i]) << uint(8*(i-1))
+		}
+	}
+	name := ca65Name(op.Instruction.Name)
+	args := op.FormatArgumentsSymbolic(value, pc+uint16(op.Size), cpu.Symbols)
+	o := cpu.traceOperand(op, value)
+	p := cpu.GetP()
+
+	switch format {
+	case TraceFCEUX:
+		var b []string
+		for _, v := range bytes {
+			b = append(b, fmt.Sprintf("%02X", v))
+		}
+		ins := strings.TrimSpace(name + " " + args)
+		switch op.AddressingMode {
+		case AMZeroPage, AMAbsolute:
+			if traceShowsValue(op) {
+				ins += fmt.Sprintf(" = #$%02X", o.value)
+			}
+		case AMZeroPageX, AMZeroPageY, AMAbsoluteX, AMAbsoluteY, AMIndirectX, AMIndirectY, AMZeroPageIndirect:
+			ins += fmt.Sprintf(" @ $%04X = #$%02X", o.addr, o.value)
+		case AMIndirect:
+			ins += fmt.Sprintf(" = $%04X", o.addr)
+		}
+		flags := []byte("nvubdizc")
+		for i := range flags {
+			if p&(0x80>>uint(i)) != 0 {
+				flags[i] -= 'a' - 'A'
+			}
+		}
+		return fmt.Sprintf("A:%02X X:%02X Y:%02X S:%02X P:%s  $%04X:%-10s%s",
+			cpu.A, cpu.X, cpu.Y, cpu.SP, flags, pc, strings.Join(b, " "), ins)
+
+	case TraceMesen:
+		var b []string
+		for _, v := range bytes {
+			b = append(b, fmt.Sprintf("$%02X", v))
+		}
+		ins := strings.TrimSpace(name + " " + args)
+		switch op.AddressingMode {
+		case AMZeroPage, AMAbsolute:
+			if traceShowsValue(op) {
+				ins += fmt.Sprintf(" = $%02X", o.value)
+			}
+		case AMZeroPageX, AMZeroPageY, AMAbsoluteX, AMAbsoluteY, AMIndirectX, AMIndirectY, AMZeroPageIndirect:
+			ins += fmt.Sprintf(" [$%04X] = $%02X", o.addr, o.value)
+		case AMIndirect:
+			ins += fmt.Sprintf(" [$%04X]", o.addr)
+		}
+		return fmt.Sprintf("%04X  %-11s  %-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X CYC:%-3d SL:%-3d CPU Cycle:%d",
+			pc, strings.Join(b, " "), ins, cpu.A, cpu.X, cpu.Y, p, cpu.SP, dot, scanline, cpu.Cycles)
+	}
+
+	// nestest
+	var b []string
+	for _, v := range bytes {
+		b = append(b, fmt.Sprintf("%02X", v))
+	}
+	if name == "ISC" {
+		name = "ISB"
+	}
+	mark := " "
+	if traceUndocumented(op) {
+		mark = "*"
+	}
+	ins := strings.TrimSpace(name + " " + args)
+	switch op.AddressingMode {
+	case AMZeroPage, AMAbsolute:
+		if traceShowsValue(op) {
+			ins += fmt.Sprintf(" = %02X", o.value)
+		}
+	case AMZeroPageX, AMZeroPageY:
+		ins += fmt.Sprintf(" @ %02X = %02X", o.addr, o.value)
+	case AMAbsoluteX, AMAbsoluteY:
+		ins += fmt.Sprintf(" @ %04X = %02X", o.addr, o.value)
+	case AMIndirectX:
+		ins += fmt.Sprintf(" @ %02X = %04X = %02X", o.pointer, o.addr, o.value)
+	case AMIndirectY:
+		ins += fmt.Sprintf(" = %04X @ %04X = %02X", o.pointer, o.addr, o.value)
+	case AMZeroPageIndirect:
+		ins += fmt.Sprintf(" = %04X = %02X", o.addr, o.value)
+	case AMIndirect:
+		ins += fmt.Sprintf(" = %04X", o.addr)
+	}
+	return fmt.Sprintf("%04X  %-8s %s%-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		pc, strings.Join(b, " "), mark, ins, cpu.A, cpu.X, cpu.Y, p, cpu.SP, scanline, dot, cpu.Cycles)
+}
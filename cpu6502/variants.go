@@ -0,0 +1,125 @@
+package cpu6502
+
+import (
+	"fmt"
+)
+
+// Variant selects which member of the 6502 family the CPU emulates.
+type Variant int
+
+const (
+	// VariantNMOS is the original NMOS 6502 including the undocumented
+	// opcodes and binary coded decimal arithmetic.
+	VariantNMOS Variant = iota
+	// Variant2A03 is the Ricoh 2A03/2A07 used in the NES. It's an NMOS
+	// 6502 with the decimal mode circuitry disconnected so the D flag can
+	// be set and cleared but has no effect on ADC and SBC.
+	Variant2A03
+	// Variant65C02 is the WDC 65C02 with the Rockwell/WDC bit instructions
+	// (RMB, SMB, BBR, BBS) and WAI/STP. Undefined opcodes are NOPs.
+	Variant65C02
+	// Variant6510 is the MOS 6510 used in the Commodore 64: an NMOS 6502
+	// with an I/O port at $0000 and $0001 (see IOPort6510).
+	Variant6510
+)
+
+func (v Variant) String() string {
+	switch v {
+	case VariantNMOS:
+		return "6502"
+	case Variant2A03:
+		return "2A03"
+	case Variant65C02:
+		return "65C02"
+	case Variant6510:
+		return "6510"
+	}
+	return fmt.Sprintf("Variant(%d)", int(v))
+}
+
+// cmos returns true for the CMOS variants
+func (v Variant) cmos() bool {
+	return v == Variant65C02
+}
+
+// Opcodes returns the opcode table for the variant
+func (v Variant) Opcodes() *[256]OpcodeSpec {
+	if v.cmos() {
+		return &opcodes65C02
+	}
+	return &opcodes
+}
+
+// handlers returns the dispatch table for the variant's opcodes
+func (v Variant) handlers() *[256]instructionHandler {
+	if v.cmos() {
+		return &handlers65C02
+	}
+	return &handlersNMOS
+}
+
+var (
+	opcodes65C02 [256]OpcodeSpec
+
+	handlersNMOS  [256]instructionHandler
+	handlers65C02 [256]instructionHandler
+
+	// 65C02 opcodes that differ from the NMOS table. Every other undocumented
+	// NMOS opcode becomes a 1 byte, 1 cycle NOP.
+	opcodes65C02Changes = []OpcodeSpec{
+		{0x02, I_NPC, 2, AMImmediate, 2}, {0x22, I_NPC, 2, AMImmediate, 2},
+		{0x42, I_NPC, 2, AMImmediate, 2}, {0x62, I_NPC, 2, AMImmediate, 2},
+		{0x82, I_NPC, 2, AMImmediate, 2}, {0xc2, I_NPC, 2, AMImmediate, 2},
+		{0xe2, I_NPC, 2, AMImmediate, 2}, {0x44, I_NPC, 2, AMZeroPage, 3},
+		{0x54, I_NPC, 2, AMZeroPageX, 4}, {0xd4, I_NPC, 2, AMZeroPageX, 4},
+		{0xf4, I_NPC, 2, AMZeroPageX, 4}, {0x5c, I_NPC, 3, AMAbsolute, 8},
+		{0xdc, I_NPC, 3, AMAbsolute, 4}, {0xfc, I_NPC, 3, AMAbsolute, 4},
+
+		{0x04, I_TSB, 2, AMZeroPage, 5}, {0x0c, I_TSB, 3, AMAbsolute, 6},
+		{0x14, I_TRB, 2, AMZeroPage, 5}, {0x1c, I_TRB, 3, AMAbsolute, 6},
+		{0x12, I_ORA, 2, AMZeroPageIndirect, 5}, {0x32, I_AND, 2, AMZeroPageIndirect, 5},
+		{0x52, I_EOR, 2, AMZeroPageIndirect, 5}, {0x72, I_ADC, 2, AMZeroPageIndirect, 5},
+		{0x92, I_STA, 2, AMZeroPageIndirect, 5}, {0xb2, I_LDA, 2, AMZeroPageIndirect, 5},
+		{0xd2, I_CMP, 2, AMZeroPageIndirect, 5}, {0xf2, I_SBC, 2, AMZeroPageIndirect, 5},
+		{0x1a, I_INC, 1, AMAccumulator, 2}, {0x3a, I_DEC, 1, AMAccumulator, 2},
+		{0x34, I_BIT, 2, AMZeroPageX, 4}, {0x3c, I_BIT, 3, AMAbsoluteX, -4},
+		{0x89, I_BIT, 2, AMImmediate, 2},
+		{0x5a, I_PHY, 1, AMImplied, 3}, {0x7a, I_PLY, 1, AMImplied, 4},
+		{0xda, I_PHX, 1, AMImplied, 3}, {0xfa, I_PLX, 1, AMImplied, 4},
+		{0x64, I_STZ, 2, AMZeroPage, 3}, {0x74, I_STZ, 2, AMZeroPageX, 4},
+		{0x9c, I_STZ, 3, AMAbsolute, 4}, {0x9e, I_STZ, 3, AMAbsoluteX, 5},
+		{0x6c, I_JMP, 3, AMIndirect, 6}, {0x7c, I_JMP, 3, AMAbsoluteIndirectX, 6},
+		{0x80, I_BRA, 2, AMRelative, -2},
+		{0xcb, I_WAI, 1, AMImplied, 3}, {0xdb, I_STP, 1, AMImplied, 3},
+		// Shifts and rotates with abs,X only take the extra cycle on a page
+		// cross (INC and DEC always take it)
+		{0x1e, I_ASL, 3, AMAbsoluteX, -6}, {0x3e, I_ROL, 3, AMAbsoluteX, -6},
+		{0x5e, I_LSR, 3, AMAbsoluteX, -6}, {0x7e, I_ROR, 3, AMAbsoluteX, -6},
+	}
+)
+
+func init() {
+	for i, op := range opcodes {
+		if op.Instruction.Num >= I_KIL.Num || op.Instruction.Name == I_SB2.Name {
+			op = OpcodeSpec{i, I_NPC, 1, AMImplied, 1}
+		}
+		opcodes65C02[i] = op
+	}
+	for _, op := range opcodes65C02Changes {
+		opcodes65C02[op.Opcode] = op
+	}
+	for bit := 0; bit < 8; bit++ {
+		opcodes65C02[bit<<4|0x07] = OpcodeSpec{bit<<4 | 0x07, bitInstruction(I_RMB, bit), 2, AMZeroPage, 5}
+		opcodes65C02[bit<<4|0x87] = OpcodeSpec{bit<<4 | 0x87, bitInstruction(I_SMB, bit), 2, AMZeroPage, 5}
+		opcodes65C02[bit<<4|0x0f] = OpcodeSpec{bit<<4 | 0x0f, bitInstruction(I_BBR, bit), 3, AMZeroPageRelative, -5}
+		opcodes65C02[bit<<4|0x8f] = OpcodeSpec{bit<<4 | 0x8f, bitInstruction(I_BBS, bit), 3, AMZeroPageRelative, -5}
+	}
+	buildHandlers(&handlersNMOS, &opcodes)
+	buildHandlers(&handlers65C02, &opcodes65C02)
+}
+
+// bitInstruction names one of the 65C02 bit instructions (e.g. RMB3)
+func bitInstruction(spec InstructionSpec, bit int) InstructionSpec {
+	spec.Name += string(rune('0' + bit))
+	return spec
+}
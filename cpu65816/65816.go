@@ -0,0 +1,905 @@
+package cpu65816
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/samuel/go-emu/cpu6502"
+)
+
+const (
+	// Emulation mode vectors (same as the 6502)
+	IV_COP   = 0xFFF4
+	IV_ABORT = 0xFFF8
+	IV_NMI   = 0xFFFA
+	IV_RESET = 0xFFFC
+	IV_IRQ   = 0xFFFE
+
+	// Native mode vectors
+	IV_NATIVE_COP   = 0xFFE4
+	IV_NATIVE_BRK   = 0xFFE6
+	IV_NATIVE_ABORT = 0xFFE8
+	IV_NATIVE_NMI   = 0xFFEA
+	IV_NATIVE_IRQ   = 0xFFEE
+
+	FLAG_C = cpu6502.FLAG_C
+	FLAG_Z = cpu6502.FLAG_Z
+	FLAG_I = cpu6502.FLAG_I
+	FLAG_D = cpu6502.FLAG_D
+	FLAG_X = 0x10 // native mode: 8-bit index registers
+	FLAG_B = 0x10 // emulation mode: BRK
+	FLAG_M = 0x20 // native mode: 8-bit accumulator and memory
+	FLAG_V = cpu6502.FLAG_V
+	FLAG_S = cpu6502.FLAG_S
+)
+
+var ErrStopped = errors.New("cpu stopped")
+
+type CPU65816 struct {
+	A    uint16 // C (B is the high byte and A the low byte)
+	X, Y uint16
+	SP   uint16
+	D    uint16 // direct page
+	DBR  byte   // data bank
+	PBR  byte   // program bank
+	PC   uint16
+
+	CarryFlag              bool
+	ZeroFlag               bool
+	InterruptsDisabledFlag bool
+	DecimalFlag            bool
+	IndexFlag              bool // X - 8-bit index registers
+	MemoryFlag             bool // M - 8-bit accumulator and memory
+	OverflowFlag           bool
+	SignFlag               bool
+	EmulationFlag          bool // E - 6502 emulation mode
+
+	Cycles uint64
+
+	stopped bool // STP was executed
+	waiting bool // WAI is waiting for an interrupt
+
+	irq uint32 // asserted IRQ sources
+	nmi bool   // NMI edge latched
+
+	memory MemoryAccess
+}
+
+// NewCPU65816 returns a CPU in the power on state (emulation mode). Call
+// Reset to load PC from the reset vector.
+func NewCPU65816(memory MemoryAccess) *CPU65816 {
+	return &CPU65816{
+		memory:                 memory,
+		SP:                     0x01FF,
+		EmulationFlag:          true,
+		MemoryFlag:             true,
+		IndexFlag:              true,
+		InterruptsDisabledFlag: true,
+	}
+}
+
+// Reset switches to emulation mode and jumps through the reset vector.
+func (cpu *CPU65816) Reset() {
+	cpu.EmulationFlag = true
+	cpu.D = 0
+	cpu.DBR = 0
+	cpu.PBR = 0
+	cpu.SP = 0x0100 | cpu.SP&0xff
+	cpu.InterruptsDisabledFlag = true
+	cpu.DecimalFlag = false
+	cpu.SetP(cpu.GetP())
+	cpu.stopped = false
+	cpu.waiting = false
+	cpu.PC = cpu.readWord(IV_RESET, true)
+	cpu.Cycles += 7
+}
+
+func (cpu *CPU65816) GetP() byte {
+	var flags byte
+	if cpu.CarryFlag {
+		flags |= FLAG_C
+	}
+	if cpu.ZeroFlag {
+		flags |= FLAG_Z
+	}
+	if cpu.InterruptsDisabledFlag {
+		flags |= FLAG_I
+	}
+	if cpu.DecimalFlag {
+		flags |= FLAG_D
+	}
+	if cpu.IndexFlag {
+		flags |= FLAG_X
+	}
+	if cpu.MemoryFlag {
+		flags |= FLAG_M
+	}
+	if cpu.OverflowFlag {
+		flags |= FLAG_V
+	}
+	if cpu.SignFlag {
+		flags |= FLAG_S
+	}
+	return flags
+}
+
+// SetP sets the status register. In emulation mode M and X are always set
+// and when X is set the high bytes of the index registers are cleared.
+func (cpu *CPU65816) SetP(flags byte) {
+	cpu.CarryFlag = flags&FLAG_C != 0
+	cpu.ZeroFlag = flags&FLAG_Z != 0
+	cpu.InterruptsDisabledFlag = flags&FLAG_I != 0
+	cpu.DecimalFlag = flags&FLAG_D != 0
+	cpu.IndexFlag = flags&FLAG_X != 0 || cpu.EmulationFlag
+	cpu.MemoryFlag = flags&FLAG_M != 0 || cpu.EmulationFlag
+	cpu.OverflowFlag = flags&FLAG_V != 0
+	cpu.SignFlag = flags&FLAG_S != 0
+	if cpu.IndexFlag {
+		cpu.X &= 0xff
+		cpu.Y &= 0xff
+	}
+}
+
+func (cpu *CPU65816) String() string {
+	e := "N"
+	if cpu.EmulationFlag {
+		e = "E"
+	}
+	return fmt.Sprintf("{PC:%02x:%04x SP:%04x A:%04x X:%04x Y:%04x D:%04x DB:%02x P:%02x %s}",
+		cpu.PBR, cpu.PC, cpu.SP, cpu.A, cpu.X, cpu.Y, cpu.D, cpu.DBR, cpu.GetP(), e)
+}
+
+// SetIRQ asserts or releases the level-triggered IRQ line on behalf of a
+// source (see cpu6502.CPU6502.SetIRQ).
+func (cpu *CPU65816) SetIRQ(source uint32, asserted bool) {
+	if asserted {
+		cpu.irq |= source
+	} else {
+		cpu.irq &^= source
+	}
+}
+
+// NMI signals a falling edge on the NMI line. The interrupt is taken before
+// the next instruction.
+func (cpu *CPU65816) NMI() {
+	cpu.nmi = true
+}
+
+// Stopped returns true if STP has been executed.
+func (cpu *CPU65816) Stopped() bool {
+	return cpu.stopped
+}
+
+func bank(address uint32) uint32 {
+	return address & 0xff0000
+}
+
+func (cpu *CPU65816) read(address uint32) byte {
+	return cpu.memory.ReadByte(address&0xffffff, false)
+}
+
+func (cpu *CPU65816) write(address uint32, value byte) {
+	cpu.memory.WriteByte(address&0xffffff, value)
+}
+
+// readWord reads a little endian 16-bit value. When wrap is set the high
+// byte comes from the same bank (direct page, stack and vectors), otherwise
+// the address simply carries into the next bank.
+func (cpu *CPU65816) readWord(address uint32, wrap bool) uint16 {
+	next := address + 1
+	if wrap {
+		next = bank(address) | uint32(uint16(address)+1)
+	}
+	return uint16(cpu.read(address)) | uint16(cpu.read(next))<<8
+}
+
+// readData reads an 8 or 16-bit value
+func (cpu *CPU65816) readData(address uint32, wrap bool, wide bool) uint16 {
+	if wide {
+		return cpu.readWord(address, wrap)
+	}
+	return uint16(cpu.read(address))
+}
+
+func (cpu *CPU65816) writeData(address uint32, wrap bool, wide bool, value uint16) {
+	cpu.write(address, byte(value))
+	if wide {
+		next := address + 1
+		if wrap {
+			next = bank(address) | uint32(uint16(address)+1)
+		}
+		cpu.write(next, byte(value>>8))
+	}
+}
+
+func (cpu *CPU65816) fetch() byte {
+	v := cpu.read(uint32(cpu.PBR)<<16 | uint32(cpu.PC))
+	cpu.PC++
+	return v
+}
+
+func (cpu *CPU65816) PushByte(value byte) {
+	cpu.write(uint32(cpu.SP), value)
+	cpu.SP--
+	if cpu.EmulationFlag {
+		cpu.SP = 0x0100 | cpu.SP&0xff
+	}
+}
+
+func (cpu *CPU65816) PopByte() byte {
+	cpu.SP++
+	if cpu.EmulationFlag {
+		cpu.SP = 0x0100 | cpu.SP&0xff
+	}
+	return cpu.read(uint32(cpu.SP))
+}
+
+func (cpu *CPU65816) PushWord(value uint16) {
+	cpu.PushByte(byte(value >> 8))
+	cpu.PushByte(byte(value))
+}
+
+func (cpu *CPU65816) PopWord() uint16 {
+	return uint16(cpu.PopByte()) | uint16(cpu.PopByte())<<8
+}
+
+func (cpu *CPU65816) push(value uint16, wide bool) {
+	if wide {
+		cpu.PushWord(value)
+	} else {
+		cpu.PushByte(byte(value))
+	}
+}
+
+func (cpu *CPU65816) pop(wide bool) uint16 {
+	if wide {
+		return cpu.PopWord()
+	}
+	return uint16(cpu.PopByte())
+}
+
+// setNZ sets the sign and zero flags from an 8 or 16-bit result
+func (cpu *CPU65816) setNZ(value uint16, wide bool) {
+	if wide {
+		cpu.SignFlag = value&0x8000 != 0
+		cpu.ZeroFlag = value == 0
+	} else {
+		cpu.SignFlag = value&0x80 != 0
+		cpu.ZeroFlag = value&0xff == 0
+	}
+}
+
+// setReg sets the low byte only of an 8-bit register (the accumulator keeps
+// its hidden high byte B) or all of a 16-bit one.
+func setReg(reg *uint16, value uint16, wide bool) {
+	if wide {
+		*reg = value
+	} else {
+		*reg = *reg&0xff00 | value&0xff
+	}
+}
+
+// interrupt pushes the return state and jumps through a vector
+func (cpu *CPU65816) interrupt(vector uint16, pc uint16, brk bool) {
+	if cpu.EmulationFlag {
+		cpu.PushWord(pc)
+		p := cpu.GetP() &^ FLAG_B
+		if brk {
+			p |= FLAG_B
+		}
+		cpu.PushByte(p | 0x20)
+	} else {
+		cpu.PushByte(cpu.PBR)
+		cpu.PushWord(pc)
+		cpu.PushByte(cpu.GetP())
+	}
+	cpu.InterruptsDisabledFlag = true
+	cpu.DecimalFlag = false
+	cpu.PBR = 0
+	cpu.PC = cpu.readWord(uint32(vector), true)
+}
+
+func (cpu *CPU65816) vector(emulation, native uint16) uint16 {
+	if cpu.EmulationFlag {
+		return emulation
+	}
+	return native
+}
+
+// xInstruction returns true for instructions where the operand width comes
+// from the X flag rather than M.
+func xInstruction(inst InstructionSpec) bool {
+	switch inst.Num {
+	case I_CPX.Num, I_CPY.Num, I_LDX.Num, I_LDY.Num, I_STX.Num, I_STY.Num,
+		I_PHX.Num, I_PHY.Num, I_PLX.Num, I_PLY.Num:
+		return true
+	}
+	return false
+}
+
+// mInstruction returns true for instructions that take an extra cycle for
+// each extra byte when the accumulator is 16-bit.
+func mInstruction(inst InstructionSpec) bool {
+	switch inst.Num {
+	case I_ADC.Num, I_AND.Num, I_BIT.Num, I_CMP.Num, I_EOR.Num, I_LDA.Num, I_ORA.Num,
+		I_SBC.Num, I_STA.Num, I_STZ.Num, I_TRB.Num, I_TSB.Num, I_ASL.Num, I_LSR.Num,
+		I_ROL.Num, I_ROR.Num, I_INC.Num, I_DEC.Num, I_PHA.Num, I_PLA.Num:
+		return true
+	}
+	return false
+}
+
+// Step executes one instruction (or takes a pending interrupt) and returns
+// the number of cycles used.
+func (cpu *CPU65816) Step() (int, error) {
+	if cpu.stopped {
+		return 0, ErrStopped
+	}
+	if cpu.waiting {
+		if !cpu.nmi && cpu.irq == 0 {
+			cpu.Cycles++
+			return 1, nil
+		}
+		cpu.waiting = false
+	}
+	if cpu.nmi {
+		cpu.nmi = false
+		cpu.interrupt(cpu.vector(IV_NMI, IV_NATIVE_NMI), cpu.PC, false)
+		return cpu.interruptCycles(), nil
+	}
+	if cpu.irq != 0 && !cpu.InterruptsDisabledFlag {
+		cpu.interrupt(cpu.vector(IV_IRQ, IV_NATIVE_IRQ), cpu.PC, false)
+		return cpu.interruptCycles(), nil
+	}
+
+	pc := cpu.PC
+	opcode := opcodes[cpu.fetch()]
+	inst := opcode.Instruction
+	m8, x8 := cpu.MemoryFlag, cpu.IndexFlag
+	wide := !m8
+	if xInstruction(inst) {
+		wide = !x8
+	}
+
+	var operand uint32
+	for i, n := 0, opcode.Length(m8, x8)-1; i < n; i++ {
+		operand |= uint32(cpu.fetch()) << uint(8*i)
+	}
+
+	cycles := opcode.Cycles
+	if mInstruction(inst) && !m8 {
+		cycles++
+		if inst.Read && inst.Write && opcode.AddressingMode != AMAccumulator {
+			cycles++ // read-modify-write has two extra bytes to handle
+		}
+	}
+	if xInstruction(inst) && !x8 {
+		cycles++
+	}
+
+	// Effective address
+	dbr := uint32(cpu.DBR) << 16
+	pbr := uint32(cpu.PBR) << 16
+	var addr uint32
+	wrap := false // address is in bank 0 and wraps within it
+	direct := func(offset uint16) uint32 {
+		// In emulation mode with the direct page aligned indexing wraps
+		// within the page like on the 6502.
+		if cpu.EmulationFlag && cpu.D&0xff == 0 {
+			return uint32(cpu.D | (uint16(operand)+offset)&0xff)
+		}
+		return uint32(cpu.D + uint16(operand) + offset)
+	}
+	indexCross := func(base uint32) {
+		// Indexed reads take a cycle to fix the address when it crosses a
+		// page or the index registers are 16-bit.
+		if inst.Read && !inst.Write && (!x8 || base&0xff00 != addr&0xff00) {
+			cycles++
+		}
+	}
+	switch opcode.AddressingMode {
+	case AMDirect, AMDirectX, AMDirectY, AMDirectIndirect, AMDirectIndirectLong,
+		AMDirectIndirectX, AMDirectIndirectY, AMDirectIndirectLongY:
+		if cpu.D&0xff != 0 {
+			cycles++
+		}
+	}
+	switch opcode.AddressingMode {
+	case AMImmediateM, AMImmediateX, AMImmediate8:
+	case AMDirect:
+		addr, wrap = direct(0), true
+	case AMDirectX:
+		addr, wrap = direct(cpu.X), true
+	case AMDirectY:
+		addr, wrap = direct(cpu.Y), true
+	case AMDirectIndirect:
+		addr = dbr | uint32(cpu.readWord(direct(0), true))
+	case AMDirectIndirectX:
+		addr = dbr | uint32(cpu.readWord(direct(cpu.X), true))
+	case AMDirectIndirectY:
+		base := dbr | uint32(cpu.readWord(direct(0), true))
+		addr = (base + uint32(cpu.Y)) & 0xffffff
+		indexCross(base)
+	case AMDirectIndirectLong, AMDirectIndirectLongY:
+		ptr := direct(0)
+		addr = uint32(cpu.readWord(ptr, true)) | uint32(cpu.read(uint32(uint16(ptr)+2)))<<16
+		if opcode.AddressingMode == AMDirectIndirectLongY {
+			addr = (addr + uint32(cpu.Y)) & 0xffffff
+		}
+	case AMAbsolute:
+		addr = dbr | operand
+	case AMAbsoluteX, AMAbsoluteY:
+		base := dbr | operand
+		if opcode.AddressingMode == AMAbsoluteX {
+			addr = (base + uint32(cpu.X)) & 0xffffff
+		} else {
+			addr = (base + uint32(cpu.Y)) & 0xffffff
+		}
+		indexCross(base)
+	case AMAbsoluteLong:
+		addr = operand
+	case AMAbsoluteLongX:
+		addr = (operand + uint32(cpu.X)) & 0xffffff
+	case AMAbsoluteIndirect, AMAbsoluteIndirectLong, AMAbsoluteIndirectX:
+		// handled by JMP, JML and JSR
+	case AMStackRelative:
+		addr, wrap = uint32(cpu.SP+uint16(operand)), true
+	case AMStackRelativeIndirectY:
+		base := dbr | uint32(cpu.readWord(uint32(cpu.SP+uint16(operand)), true))
+		addr = (base + uint32(cpu.Y)) & 0xffffff
+	case AMRelative:
+		addr = uint32(cpu.PC + uint16(int8(operand)))
+	case AMRelativeLong:
+		addr = uint32(cpu.PC + uint16(operand))
+	case AMBlockMove, AMAccumulator, AMImplied:
+	default:
+		return 0, fmt.Errorf("cpu65816: unhandled addressing mode %d at $%02X:%04X", opcode.AddressingMode, cpu.PBR, pc)
+	}
+
+	var value uint16
+	switch opcode.AddressingMode {
+	case AMImmediateM, AMImmediateX, AMImmediate8:
+		value = uint16(operand)
+	case AMAccumulator:
+		value = cpu.A
+	case AMImplied, AMRelative, AMRelativeLong, AMBlockMove,
+		AMAbsoluteIndirect, AMAbsoluteIndirectLong, AMAbsoluteIndirectX:
+	default:
+		if inst.Read {
+			value = cpu.readData(addr, wrap, wide)
+		}
+	}
+	mask, sign := uint16(0xff), uint16(0x80)
+	if wide {
+		mask, sign = 0xffff, 0x8000
+	}
+	value &= mask
+
+	// store writes the result of read-modify-write instructions
+	store := func(v uint16) {
+		if opcode.AddressingMode == AMAccumulator {
+			setReg(&cpu.A, v, wide)
+		} else {
+			cpu.writeData(addr, wrap, wide, v)
+		}
+	}
+	compare := func(reg uint16) {
+		reg &= mask
+		cpu.CarryFlag = reg >= value
+		cpu.setNZ(reg-value, wide)
+	}
+
+	jump := false
+	switch inst.Num {
+	default:
+		return 0, fmt.Errorf("cpu65816: unhandled instruction %s at $%02X:%04X", inst.Name, cpu.PBR, pc)
+	case I_ADC.Num:
+		cpu.adc(value, wide)
+	case I_SBC.Num:
+		cpu.sbc(value, wide)
+	case I_AND.Num:
+		setReg(&cpu.A, cpu.A&value, wide)
+		cpu.setNZ(cpu.A, wide)
+	case I_EOR.Num:
+		setReg(&cpu.A, cpu.A^value, wide)
+		cpu.setNZ(cpu.A, wide)
+	case I_ORA.Num:
+		setReg(&cpu.A, cpu.A|value, wide)
+		cpu.setNZ(cpu.A, wide)
+	case I_BIT.Num:
+		if opcode.AddressingMode != AMImmediateM {
+			cpu.SignFlag = value&sign != 0
+			cpu.OverflowFlag = value&(sign>>1) != 0
+		}
+		cpu.ZeroFlag = cpu.A&value&mask == 0
+	case I_CMP.Num:
+		compare(cpu.A)
+	case I_CPX.Num:
+		compare(cpu.X)
+	case I_CPY.Num:
+		compare(cpu.Y)
+	case I_ASL.Num:
+		cpu.CarryFlag = value&sign != 0
+		value = (value << 1) & mask
+		cpu.setNZ(value, wide)
+		store(value)
+	case I_LSR.Num:
+		cpu.CarryFlag = value&1 != 0
+		value >>= 1
+		cpu.setNZ(value, wide)
+		store(value)
+	case I_ROL.Num:
+		carry := uint16(0)
+		if cpu.CarryFlag {
+			carry = 1
+		}
+		cpu.CarryFlag = value&sign != 0
+		value = (value<<1 | carry) & mask
+		cpu.setNZ(value, wide)
+		store(value)
+	case I_ROR.Num:
+		carry := uint16(0)
+		if cpu.CarryFlag {
+			carry = sign
+		}
+		cpu.CarryFlag = value&1 != 0
+		value = value>>1 | carry
+		cpu.setNZ(value, wide)
+		store(value)
+	case I_INC.Num:
+		value = (value + 1) & mask
+		cpu.setNZ(value, wide)
+		store(value)
+	case I_DEC.Num:
+		value = (value - 1) & mask
+		cpu.setNZ(value, wide)
+		store(value)
+	case I_TSB.Num:
+		cpu.ZeroFlag = cpu.A&value&mask == 0
+		store(value | cpu.A&mask)
+	case I_TRB.Num:
+		cpu.ZeroFlag = cpu.A&value&mask == 0
+		store(value &^ cpu.A)
+	case I_INX.Num:
+		cpu.X = (cpu.X + 1) & cpu.indexMask()
+		cpu.setNZ(cpu.X, !x8)
+	case I_INY.Num:
+		cpu.Y = (cpu.Y + 1) & cpu.indexMask()
+		cpu.setNZ(cpu.Y, !x8)
+	case I_DEX.Num:
+		cpu.X = (cpu.X - 1) & cpu.indexMask()
+		cpu.setNZ(cpu.X, !x8)
+	case I_DEY.Num:
+		cpu.Y = (cpu.Y - 1) & cpu.indexMask()
+		cpu.setNZ(cpu.Y, !x8)
+	case I_LDA.Num:
+		setReg(&cpu.A, value, wide)
+		cpu.setNZ(value, wide)
+	case I_LDX.Num:
+		cpu.X = value
+		cpu.setNZ(value, wide)
+	case I_LDY.Num:
+		cpu.Y = value
+		cpu.setNZ(value, wide)
+	case I_STA.Num:
+		cpu.writeData(addr, wrap, wide, cpu.A)
+	case I_STX.Num:
+		cpu.writeData(addr, wrap, wide, cpu.X)
+	case I_STY.Num:
+		cpu.writeData(addr, wrap, wide, cpu.Y)
+	case I_STZ.Num:
+		cpu.writeData(addr, wrap, wide, 0)
+
+	case I_BCC.Num:
+		jump = !cpu.CarryFlag
+	case I_BCS.Num:
+		jump = cpu.CarryFlag
+	case I_BEQ.Num:
+		jump = cpu.ZeroFlag
+	case I_BNE.Num:
+		jump = !cpu.ZeroFlag
+	case I_BMI.Num:
+		jump = cpu.SignFlag
+	case I_BPL.Num:
+		jump = !cpu.SignFlag
+	case I_BVC.Num:
+		jump = !cpu.OverflowFlag
+	case I_BVS.Num:
+		jump = cpu.OverflowFlag
+	case I_BRA.Num:
+		jump = true
+		cycles-- // the table includes the taken cycle
+	case I_BRL.Num:
+		cpu.PC = uint16(addr)
+
+	case I_JMP.Num:
+		switch opcode.AddressingMode {
+		case AMAbsolute:
+			cpu.PC = uint16(operand)
+		case AMAbsoluteIndirect:
+			cpu.PC = cpu.readWord(operand, true)
+		case AMAbsoluteIndirectX:
+			cpu.PC = cpu.readWord(pbr|uint32(uint16(operand)+cpu.X), true)
+		}
+	case I_JML.Num:
+		if opcode.AddressingMode == AMAbsoluteIndirectLong {
+			operand = uint32(cpu.readWord(operand, true)) | uint32(cpu.read(uint32(uint16(operand)+2)))<<16
+		}
+		cpu.PBR = byte(operand >> 16)
+		cpu.PC = uint16(operand)
+	case I_JSR.Num:
+		cpu.PushWord(cpu.PC - 1)
+		if opcode.AddressingMode == AMAbsoluteIndirectX {
+			cpu.PC = cpu.readWord(pbr|uint32(uint16(operand)+cpu.X), true)
+		} else {
+			cpu.PC = uint16(operand)
+		}
+	case I_JSL.Num:
+		cpu.PushByte(cpu.PBR)
+		cpu.PushWord(cpu.PC - 1)
+		cpu.PBR = byte(operand >> 16)
+		cpu.PC = uint16(operand)
+	case I_RTS.Num:
+		cpu.PC = cpu.PopWord() + 1
+	case I_RTL.Num:
+		cpu.PC = cpu.PopWord() + 1
+		cpu.PBR = cpu.PopByte()
+	case I_RTI.Num:
+		cpu.SetP(cpu.PopByte())
+		cpu.PC = cpu.PopWord()
+		if !cpu.EmulationFlag {
+			cpu.PBR = cpu.PopByte()
+			cycles++
+		}
+	case I_BRK.Num:
+		if !cpu.EmulationFlag {
+			cycles++
+		}
+		cpu.interrupt(cpu.vector(IV_IRQ, IV_NATIVE_BRK), cpu.PC, true)
+	case I_COP.Num:
+		if !cpu.EmulationFlag {
+			cycles++
+		}
+		cpu.interrupt(cpu.vector(IV_COP, IV_NATIVE_COP), cpu.PC, true)
+
+	case I_CLC.Num:
+		cpu.CarryFlag = false
+	case I_CLD.Num:
+		cpu.DecimalFlag = false
+	case I_CLI.Num:
+		cpu.InterruptsDisabledFlag = false
+	case I_CLV.Num:
+		cpu.OverflowFlag = false
+	case I_SEC.Num:
+		cpu.CarryFlag = true
+	case I_SED.Num:
+		cpu.DecimalFlag = true
+	case I_SEI.Num:
+		cpu.InterruptsDisabledFlag = true
+	case I_REP.Num:
+		cpu.SetP(cpu.GetP() &^ byte(operand))
+	case I_SEP.Num:
+		cpu.SetP(cpu.GetP() | byte(operand))
+	case I_XCE.Num:
+		cpu.CarryFlag, cpu.EmulationFlag = cpu.EmulationFlag, cpu.CarryFlag
+		if cpu.EmulationFlag {
+			cpu.SP = 0x0100 | cpu.SP&0xff
+		}
+		cpu.SetP(cpu.GetP())
+
+	case I_PHA.Num:
+		cpu.push(cpu.A, wide)
+	case I_PHX.Num:
+		cpu.push(cpu.X, wide)
+	case I_PHY.Num:
+		cpu.push(cpu.Y, wide)
+	case I_PLA.Num:
+		setReg(&cpu.A, cpu.pop(wide), wide)
+		cpu.setNZ(cpu.A, wide)
+	case I_PLX.Num:
+		cpu.X = cpu.pop(wide)
+		cpu.setNZ(cpu.X, wide)
+	case I_PLY.Num:
+		cpu.Y = cpu.pop(wide)
+		cpu.setNZ(cpu.Y, wide)
+	case I_PHP.Num:
+		p := cpu.GetP()
+		if cpu.EmulationFlag {
+			p |= FLAG_B | 0x20
+		}
+		cpu.PushByte(p)
+	case I_PLP.Num:
+		cpu.SetP(cpu.PopByte())
+	case I_PHB.Num:
+		cpu.PushByte(cpu.DBR)
+	case I_PLB.Num:
+		cpu.DBR = cpu.PopByte()
+		cpu.setNZ(uint16(cpu.DBR), false)
+	case I_PHD.Num:
+		cpu.PushWord(cpu.D)
+	case I_PLD.Num:
+		cpu.D = cpu.PopWord()
+		cpu.setNZ(cpu.D, true)
+	case I_PHK.Num:
+		cpu.PushByte(cpu.PBR)
+	case I_PEA.Num:
+		cpu.PushWord(uint16(operand))
+	case I_PEI.Num:
+		cpu.PushWord(uint16(addr))
+	case I_PER.Num:
+		cpu.PushWord(uint16(addr))
+
+	case I_TAX.Num:
+		cpu.X = cpu.A & cpu.indexMask()
+		cpu.setNZ(cpu.X, !x8)
+	case I_TAY.Num:
+		cpu.Y = cpu.A & cpu.indexMask()
+		cpu.setNZ(cpu.Y, !x8)
+	case I_TXA.Num:
+		setReg(&cpu.A, cpu.X, !m8)
+		cpu.setNZ(cpu.A, !m8)
+	case I_TYA.Num:
+		setReg(&cpu.A, cpu.Y, !m8)
+		cpu.setNZ(cpu.A, !m8)
+	case I_TXY.Num:
+		cpu.Y = cpu.X
+		cpu.setNZ(cpu.Y, !x8)
+	case I_TYX.Num:
+		cpu.X = cpu.Y
+		cpu.setNZ(cpu.X, !x8)
+	case I_TSX.Num:
+		cpu.X = cpu.SP & cpu.indexMask()
+		cpu.setNZ(cpu.X, !x8)
+	case I_TXS.Num:
+		cpu.SP = cpu.X
+		if cpu.EmulationFlag {
+			cpu.SP = 0x0100 | cpu.X&0xff
+		}
+	case I_TCD.Num:
+		cpu.D = cpu.A
+		cpu.setNZ(cpu.D, true)
+	case I_TDC.Num:
+		cpu.A = cpu.D
+		cpu.setNZ(cpu.A, true)
+	case I_TCS.Num:
+		cpu.SP = cpu.A
+		if cpu.EmulationFlag {
+			cpu.SP = 0x0100 | cpu.A&0xff
+		}
+	case I_TSC.Num:
+		cpu.A = cpu.SP
+		cpu.setNZ(cpu.A, true)
+	case I_XBA.Num:
+		cpu.A = cpu.A<<8 | cpu.A>>8
+		cpu.setNZ(cpu.A, false)
+
+	case I_MVN.Num, I_MVP.Num:
+		// One byte is moved per step. The instruction repeats until C
+		// underflows.
+		dst, src := byte(operand), byte(operand>>8)
+		cpu.DBR = dst
+		cpu.write(uint32(dst)<<16|uint32(cpu.Y), cpu.read(uint32(src)<<16|uint32(cpu.X)))
+		if inst.Num == I_MVN.Num {
+			cpu.X = (cpu.X + 1) & cpu.indexMask()
+			cpu.Y = (cpu.Y + 1) & cpu.indexMask()
+		} else {
+			cpu.X = (cpu.X - 1) & cpu.indexMask()
+			cpu.Y = (cpu.Y - 1) & cpu.indexMask()
+		}
+		cpu.A--
+		if cpu.A != 0xffff {
+			cpu.PC = pc
+		}
+
+	case I_NOP.Num, I_WDM.Num:
+	case I_WAI.Num:
+		cpu.waiting = true
+	case I_STP.Num:
+		cpu.stopped = true
+	}
+
+	if jump {
+		cycles++
+		if cpu.EmulationFlag && cpu.PC&0xff00 != uint16(addr)&0xff00 {
+			cycles++
+		}
+		cpu.PC = uint16(addr)
+	}
+
+	cpu.Cycles += uint64(cycles)
+	return cycles, nil
+}
+
+func (cpu *CPU65816) indexMask() uint16 {
+	if cpu.IndexFlag {
+		return 0xff
+	}
+	return 0xffff
+}
+
+func (cpu *CPU65816) interruptCycles() int {
+	cycles := 7
+	if !cpu.EmulationFlag {
+		cycles++
+	}
+	cpu.Cycles += uint64(cycles)
+	return cycles
+}
+
+// adc adds with carry in binary or BCD.
+func (cpu *CPU65816) adc(value uint16, wide bool) {
+	digits, mask, sign := 2, uint32(0xff), uint32(0x80)
+	if wide {
+		digits, mask, sign = 4, 0xffff, 0x8000
+	}
+	a, v := uint32(cpu.A)&mask, uint32(value)
+	carry := uint32(0)
+	if cpu.CarryFlag {
+		carry = 1
+	}
+	var res uint32
+	if cpu.DecimalFlag {
+		for i := 0; i < digits; i++ {
+			shift := uint(4 * i)
+			d := (a>>shift)&0xf + (v>>shift)&0xf + carry
+			carry = 0
+			if d > 9 {
+				d += 6
+				carry = 1
+			}
+			res |= (d & 0xf) << shift
+		}
+		res |= carry << uint(4*digits)
+	} else {
+		res = a + v + carry
+	}
+	cpu.OverflowFlag = ^(a^v)&(a^res)&sign != 0
+	cpu.CarryFlag = res > mask
+	setReg(&cpu.A, uint16(res), wide)
+	cpu.setNZ(uint16(res), wide)
+}
+
+// sbc subtracts with borrow in binary or BCD.
+func (cpu *CPU65816) sbc(value uint16, wide bool) {
+	digits, mask, sign := 2, uint32(0xff), uint32(0x80)
+	if wide {
+		digits, mask, sign = 4, 0xffff, 0x8000
+	}
+	a, v := uint32(cpu.A)&mask, uint32(value)
+	borrow := uint32(1)
+	if cpu.CarryFlag {
+		borrow = 0
+	}
+	var res uint32
+	if cpu.DecimalFlag {
+		for i := 0; i < digits; i++ {
+			shift := uint(4 * i)
+			d := int32((a>>shift)&0xf) - int32((v>>shift)&0xf) - int32(borrow)
+			borrow = 0
+			if d < 0 {
+				d += 10
+				borrow = 1
+			}
+			res |= uint32(d&0xf) << shift
+		}
+	} else {
+		res = (a - v - borrow) & (mask<<1 | 1)
+		if a < v+borrow {
+			borrow = 1
+		} else {
+			borrow = 0
+		}
+	}
+	bin := (a - v - uint32(btoi(!cpu.CarryFlag))) & mask
+	cpu.OverflowFlag = (a^v)&(a^bin)&sign != 0
+	cpu.CarryFlag = borrow == 0
+	setReg(&cpu.A, uint16(res), wide)
+	cpu.setNZ(uint16(res&mask), wide)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,218 @@
+package cpu65816
+
+import (
+	"testing"
+)
+
+// TestMemory is a sparse 16M memory
+type TestMemory map[uint32]byte
+
+func (m TestMemory) ReadByte(address uint32, peek bool) byte {
+	return m[address]
+}
+
+func (m TestMemory) WriteByte(address uint32, value byte) {
+	m[address] = value
+}
+
+func (m TestMemory) load(address uint32, bytes ...byte) {
+	for i, b := range bytes {
+		m[address+uint32(i)] = b
+	}
+}
+
+// newTestCPU returns a CPU reset into a program at $00:8000
+func newTestCPU(program ...byte) (*CPU65816, TestMemory) {
+	memory := TestMemory{}
+	memory.load(IV_RESET, 0x00, 0x80)
+	memory.load(0x8000, program...)
+	cpu := NewCPU65816(memory)
+	cpu.Reset()
+	return cpu, memory
+}
+
+// run steps until STP
+func run(t *testing.T, cpu *CPU65816) {
+	for i := 0; i < 1000; i++ {
+		if _, err := cpu.Step(); err == ErrStopped {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatalf("program didn't stop %s", cpu)
+}
+
+func TestModes(t *testing.T) {
+	cpu, _ := newTestCPU(
+		0x18,       // CLC
+		0xfb,       // XCE
+		0xc2, 0x30, // REP #$30
+		0xa9, 0x34, 0x12, // LDA #$1234
+		0xa2, 0x78, 0x56, // LDX #$5678
+		0x9b,       // TXY
+		0xe2, 0x10, // SEP #$10
+		0x38, // SEC
+		0xfb, // XCE
+		0xdb, // STP
+	)
+	for i := 0; i < 6; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.EmulationFlag || cpu.MemoryFlag || cpu.IndexFlag || !cpu.CarryFlag {
+		t.Fatalf("expected native mode with 16-bit registers %s", cpu)
+	}
+	if cpu.A != 0x1234 || cpu.X != 0x5678 || cpu.Y != 0x5678 {
+		t.Fatalf("wrong 16-bit registers %s", cpu)
+	}
+	if _, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if !cpu.IndexFlag || cpu.X != 0x78 || cpu.Y != 0x78 {
+		t.Fatalf("SEP #$10 didn't clear the index high bytes %s", cpu)
+	}
+	run(t, cpu)
+	if !cpu.EmulationFlag || !cpu.MemoryFlag || cpu.CarryFlag || cpu.SP>>8 != 0x01 {
+		t.Fatalf("expected emulation mode %s", cpu)
+	}
+	if cpu.A != 0x1234 {
+		t.Fatalf("B wasn't preserved %s", cpu)
+	}
+}
+
+func TestWideArithmetic(t *testing.T) {
+	cpu, memory := newTestCPU(
+		0x18, 0xfb, 0xc2, 0x30, // CLC, XCE, REP #$30
+		0xa9, 0xff, 0x7f, // LDA #$7FFF
+		0x18,             // CLC
+		0x69, 0x01, 0x00, // ADC #$0001
+		0x8f, 0x56, 0x34, 0x12, // STA $123456
+		0x08,             // PHP
+		0xf8,             // SED
+		0xa9, 0x99, 0x19, // LDA #$1999
+		0x18,             // CLC
+		0x69, 0x01, 0x00, // ADC #$0001
+		0xd8,       // CLD
+		0x85, 0x10, // STA $10
+		0xe2, 0x20, // SEP #$20
+		0xa9, 0x12, // LDA #$12
+		0xeb, // XBA
+		0xdb, // STP
+	)
+	run(t, cpu)
+	if memory[0x123456] != 0x00 || memory[0x123457] != 0x80 {
+		t.Errorf("$7FFF+1 stored $%02X%02X", memory[0x123457], memory[0x123456])
+	}
+	if p := memory[0x01ff]; p&(FLAG_V|FLAG_S) != FLAG_V|FLAG_S || p&FLAG_C != 0 {
+		t.Errorf("$7FFF+1 set P=$%02X", p)
+	}
+	if memory[0x10] != 0x00 || memory[0x11] != 0x20 {
+		t.Errorf("BCD $1999+1 gave $%02X%02X", memory[0x11], memory[0x10])
+	}
+	if cpu.A != 0x1220 || cpu.SignFlag || cpu.ZeroFlag {
+		t.Errorf("XBA gave %s", cpu)
+	}
+}
+
+func TestLongAndBlockMove(t *testing.T) {
+	cpu, memory := newTestCPU(
+		0x18, 0xfb, 0xc2, 0x30, // CLC, XCE, REP #$30
+		0x22, 0x00, 0x00, 0x01, // JSL $010000
+		0xdb, // STP
+	)
+	memory.load(0x010000,
+		0xa9, 0x03, 0x00, // LDA #$0003
+		0xa2, 0x00, 0x10, // LDX #$1000
+		0xa0, 0x00, 0x20, // LDY #$2000
+		0x54, 0x03, 0x02, // MVN $02,$03
+		0xa0, 0x02, 0x00, // LDY #$0002
+		0xb7, 0x20, // LDA [$20],Y
+		0x6b, // RTL
+	)
+	memory.load(0x021000, 1, 2, 3, 4)
+	memory.load(0x20, 0x00, 0x20, 0x03)
+	run(t, cpu)
+	for i := uint32(0); i < 4; i++ {
+		if v := memory[0x032000+i]; v != byte(i+1) {
+			t.Errorf("$03:%04X = %d, expected %d", 0x2000+i, v, i+1)
+		}
+	}
+	if cpu.X != 0x1004 || cpu.DBR != 0x03 || cpu.PBR != 0x00 || cpu.PC != 0x8009 || cpu.SP != 0x01ff {
+		t.Errorf("wrong state after MVN and RTL %s", cpu)
+	}
+	if cpu.A != 0x0403 {
+		t.Errorf("LDA [$20],Y loaded $%04X", cpu.A)
+	}
+	if memory[0x01ff] != 0x00 || memory[0x01fe] != 0x80 || memory[0x01fd] != 0x07 {
+		t.Errorf("JSL pushed $%02X %02X%02X", memory[0x01ff], memory[0x01fe], memory[0x01fd])
+	}
+}
+
+func TestNativeInterrupts(t *testing.T) {
+	cpu, memory := newTestCPU(
+		0x18, 0xfb, // CLC, XCE
+		0x5c, 0x00, 0x80, 0x01, // JML $018000
+	)
+	memory.load(IV_NATIVE_BRK, 0x00, 0x90)
+	memory.load(0x9000, 0x40) // RTI
+	memory.load(0x018000,
+		0x00, 0xea, // BRK #$EA
+		0xdb, // STP
+	)
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cycles, err := cpu.Step(); err != nil {
+		t.Fatal(err)
+	} else if cycles != 8 {
+		t.Errorf("native BRK took %d cycles, expected 8", cycles)
+	}
+	if cpu.PBR != 0 || cpu.PC != 0x9000 || memory[0x01ff] != 0x01 {
+		t.Fatalf("BRK didn't use the native vector %s", cpu)
+	}
+	run(t, cpu)
+	if cpu.PBR != 0x01 || cpu.PC != 0x8003 {
+		t.Fatalf("RTI didn't restore the program bank %s", cpu)
+	}
+
+	cpu.Reset()
+	if !cpu.EmulationFlag || cpu.PC != 0x8000 || cpu.Stopped() {
+		t.Fatalf("reset failed %s", cpu)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		bytes  []byte
+		m8, x8 bool
+		text   string
+	}{
+		{[]byte{0xa9, 0x34, 0x12}, false, true, "LDA #$1234"},
+		{[]byte{0xa9, 0x34}, true, false, "LDA #$34"},
+		{[]byte{0xa2, 0x34, 0x12}, true, false, "LDX #$1234"},
+		{[]byte{0xaf, 0x56, 0x34, 0x12}, true, true, "LDA $123456"},
+		{[]byte{0xb7, 0x10}, true, true, "LDA [$10],Y"},
+		{[]byte{0xa3, 0x05}, true, true, "LDA $05,S"},
+		{[]byte{0x54, 0x03, 0x02}, true, true, "MVN $02,$03"},
+		{[]byte{0x82, 0xfd, 0xff}, true, true, "BRL $8000"},
+		{[]byte{0x5c, 0x00, 0x80, 0x01}, true, true, "JML $018000"},
+		{[]byte{0xdc, 0x00, 0x02}, true, true, "JML [$0200]"},
+		{[]byte{0xfc, 0x00, 0x02}, true, true, "JSR ($0200,X)"},
+	}
+	for _, c := range cases {
+		memory := TestMemory{}
+		memory.load(0x8000, c.bytes...)
+		op, value := ReadOpcode(memory, 0x8000, c.m8, c.x8)
+		length := op.Length(c.m8, c.x8)
+		if length != len(c.bytes) {
+			t.Errorf("% x: length %d", c.bytes, length)
+		}
+		if text := op.Instruction.Name + " " + op.FormatArguments(value, length, 0x8000+uint16(length)); text != c.text {
+			t.Errorf("% x: %q, expected %q", c.bytes, text, c.text)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package cpu65816
+
+// MemoryAccess is the 65816's 24-bit bus. Addresses are bank<<16 | offset
+// and are always below $1000000.
+type MemoryAccess interface {
+	ReadByte(address uint32, peek bool) byte
+	WriteByte(address uint32, value byte)
+}
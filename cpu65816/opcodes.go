@@ -0,0 +1,366 @@
+package cpu65816
+
+import (
+	"fmt"
+
+	"github.com/samuel/go-emu/cpu6502"
+)
+
+const (
+	// Addressing Modes
+	AMImmediateM int = iota // size depends on the M flag
+	AMImmediateX            // size depends on the X flag
+	AMImmediate8            // always 8-bit (REP, SEP, BRK, COP, WDM)
+	AMDirect
+	AMDirectX
+	AMDirectY
+	AMDirectIndirect      // (dp)
+	AMDirectIndirectLong  // [dp]
+	AMDirectIndirectX     // (dp,X)
+	AMDirectIndirectY     // (dp),Y
+	AMDirectIndirectLongY // [dp],Y
+	AMAbsolute
+	AMAbsoluteX
+	AMAbsoluteY
+	AMAbsoluteLong
+	AMAbsoluteLongX
+	AMAbsoluteIndirect     // (abs)
+	AMAbsoluteIndirectLong // [abs]
+	AMAbsoluteIndirectX    // (abs,X)
+	AMStackRelative        // sr,S
+	AMStackRelativeIndirectY
+	AMRelative
+	AMRelativeLong
+	AMBlockMove
+	AMAccumulator
+	AMImplied
+)
+
+// InstructionSpec is shared with the 6502 so instructions common to both
+// have the same number and name.
+type InstructionSpec = cpu6502.InstructionSpec
+
+// OpcodeSpec describes an opcode. Size is the length with an 8-bit
+// accumulator and index registers (see Length).
+type OpcodeSpec struct {
+	Opcode         int
+	Instruction    InstructionSpec
+	Size           int
+	AddressingMode int
+	Cycles         int
+}
+
+var (
+	// Instructions
+	I_ADC = cpu6502.I_ADC
+	I_AND = cpu6502.I_AND
+	I_ASL = cpu6502.I_ASL
+	I_BCC = cpu6502.I_BCC
+	I_BCS = cpu6502.I_BCS
+	I_BEQ = cpu6502.I_BEQ
+	I_BIT = cpu6502.I_BIT
+	I_BMI = cpu6502.I_BMI
+	I_BNE = cpu6502.I_BNE
+	I_BPL = cpu6502.I_BPL
+	I_BRA = cpu6502.I_BRA
+	I_BRK = cpu6502.I_BRK
+	I_BVC = cpu6502.I_BVC
+	I_BVS = cpu6502.I_BVS
+	I_CLC = cpu6502.I_CLC
+	I_CLD = cpu6502.I_CLD
+	I_CLI = cpu6502.I_CLI
+	I_CLV = cpu6502.I_CLV
+	I_CMP = cpu6502.I_CMP
+	I_CPX = cpu6502.I_CPX
+	I_CPY = cpu6502.I_CPY
+	I_DEC = cpu6502.I_DEC
+	I_DEX = cpu6502.I_DEX
+	I_DEY = cpu6502.I_DEY
+	I_EOR = cpu6502.I_EOR
+	I_INC = cpu6502.I_INC
+	I_INX = cpu6502.I_INX
+	I_INY = cpu6502.I_INY
+	I_JMP = cpu6502.I_JMP
+	I_JSR = cpu6502.I_JSR
+	I_LDA = cpu6502.I_LDA
+	I_LDX = cpu6502.I_LDX
+	I_LDY = cpu6502.I_LDY
+	I_LSR = cpu6502.I_LSR
+	I_NOP = cpu6502.I_NOP
+	I_ORA = cpu6502.I_ORA
+	I_PHA = cpu6502.I_PHA
+	I_PHP = cpu6502.I_PHP
+	I_PHX = cpu6502.I_PHX
+	I_PHY = cpu6502.I_PHY
+	I_PLA = cpu6502.I_PLA
+	I_PLP = cpu6502.I_PLP
+	I_PLX = cpu6502.I_PLX
+	I_PLY = cpu6502.I_PLY
+	I_ROL = cpu6502.I_ROL
+	I_ROR = cpu6502.I_ROR
+	I_RTI = cpu6502.I_RTI
+	I_RTS = cpu6502.I_RTS
+	I_SBC = cpu6502.I_SBC
+	I_SEC = cpu6502.I_SEC
+	I_SED = cpu6502.I_SED
+	I_SEI = cpu6502.I_SEI
+	I_STA = cpu6502.I_STA
+	I_STP = cpu6502.I_STP
+	I_STX = cpu6502.I_STX
+	I_STY = cpu6502.I_STY
+	I_STZ = cpu6502.I_STZ
+	I_TAX = cpu6502.I_TAX
+	I_TAY = cpu6502.I_TAY
+	I_TRB = cpu6502.I_TRB
+	I_TSB = cpu6502.I_TSB
+	I_TSX = cpu6502.I_TSX
+	I_TXA = cpu6502.I_TXA
+	I_TXS = cpu6502.I_TXS
+	I_TYA = cpu6502.I_TYA
+	I_WAI = cpu6502.I_WAI
+	// 65816 only
+	I_BRL = InstructionSpec{Num: 100, Name: "BRL"} // Branch always long
+	I_COP = InstructionSpec{Num: 101, Name: "COP"} // Co-processor enable (software interrupt)
+	I_JML = InstructionSpec{Num: 102, Name: "JML"} // Jump long
+	I_JSL = InstructionSpec{Num: 103, Name: "JSL"} // Jump to subroutine long
+	I_MVN = InstructionSpec{Num: 104, Name: "MVN"} // Block move next (incrementing)
+	I_MVP = InstructionSpec{Num: 105, Name: "MVP"} // Block move previous (decrementing)
+	I_PEA = InstructionSpec{Num: 106, Name: "PEA"} // Push effective absolute address
+	I_PEI = InstructionSpec{Num: 107, Name: "PEI"} // Push effective indirect address
+	I_PER = InstructionSpec{Num: 108, Name: "PER"} // Push effective PC relative address
+	I_PHB = InstructionSpec{Num: 109, Name: "PHB"} // Push data bank
+	I_PHD = InstructionSpec{Num: 110, Name: "PHD"} // Push direct page
+	I_PHK = InstructionSpec{Num: 111, Name: "PHK"} // Push program bank
+	I_PLB = InstructionSpec{Num: 112, Name: "PLB"} // Pull data bank
+	I_PLD = InstructionSpec{Num: 113, Name: "PLD"} // Pull direct page
+	I_REP = InstructionSpec{Num: 114, Name: "REP"} // Reset status bits
+	I_RTL = InstructionSpec{Num: 115, Name: "RTL"} // Return from subroutine long
+	I_SEP = InstructionSpec{Num: 116, Name: "SEP"} // Set status bits
+	I_TCD = InstructionSpec{Num: 117, Name: "TCD"} // Transfer C to direct page
+	I_TCS = InstructionSpec{Num: 118, Name: "TCS"} // Transfer C to stack pointer
+	I_TDC = InstructionSpec{Num: 119, Name: "TDC"} // Transfer direct page to C
+	I_TSC = InstructionSpec{Num: 120, Name: "TSC"} // Transfer stack pointer to C
+	I_TXY = InstructionSpec{Num: 121, Name: "TXY"}
+	I_TYX = InstructionSpec{Num: 122, Name: "TYX"}
+	I_WDM = InstructionSpec{Num: 123, Name: "WDM"} // Reserved (2 byte NOP)
+	I_XBA = InstructionSpec{Num: 124, Name: "XBA"} // Exchange B and A
+	I_XCE = InstructionSpec{Num: 125, Name: "XCE"} // Exchange carry and emulation flags
+)
+
+var (
+	opcodes = [256]OpcodeSpec{
+		{0x00, I_BRK, 2, AMImmediate8, 7}, {0x01, I_ORA, 2, AMDirectIndirectX, 6},
+		{0x02, I_COP, 2, AMImmediate8, 7}, {0x03, I_ORA, 2, AMStackRelative, 4},
+		{0x04, I_TSB, 2, AMDirect, 5}, {0x05, I_ORA, 2, AMDirect, 3},
+		{0x06, I_ASL, 2, AMDirect, 5}, {0x07, I_ORA, 2, AMDirectIndirectLong, 6},
+		{0x08, I_PHP, 1, AMImplied, 3}, {0x09, I_ORA, 2, AMImmediateM, 2},
+		{0x0a, I_ASL, 1, AMAccumulator, 2}, {0x0b, I_PHD, 1, AMImplied, 4},
+		{0x0c, I_TSB, 3, AMAbsolute, 6}, {0x0d, I_ORA, 3, AMAbsolute, 4},
+		{0x0e, I_ASL, 3, AMAbsolute, 6}, {0x0f, I_ORA, 4, AMAbsoluteLong, 5},
+		{0x10, I_BPL, 2, AMRelative, 2}, {0x11, I_ORA, 2, AMDirectIndirectY, 5},
+		{0x12, I_ORA, 2, AMDirectIndirect, 5}, {0x13, I_ORA, 2, AMStackRelativeIndirectY, 7},
+		{0x14, I_TRB, 2, AMDirect, 5}, {0x15, I_ORA, 2, AMDirectX, 4},
+		{0x16, I_ASL, 2, AMDirectX, 6}, {0x17, I_ORA, 2, AMDirectIndirectLongY, 6},
+		{0x18, I_CLC, 1, AMImplied, 2}, {0x19, I_ORA, 3, AMAbsoluteY, 4},
+		{0x1a, I_INC, 1, AMAccumulator, 2}, {0x1b, I_TCS, 1, AMImplied, 2},
+		{0x1c, I_TRB, 3, AMAbsolute, 6}, {0x1d, I_ORA, 3, AMAbsoluteX, 4},
+		{0x1e, I_ASL, 3, AMAbsoluteX, 7}, {0x1f, I_ORA, 4, AMAbsoluteLongX, 5},
+		{0x20, I_JSR, 3, AMAbsolute, 6}, {0x21, I_AND, 2, AMDirectIndirectX, 6},
+		{0x22, I_JSL, 4, AMAbsoluteLong, 8}, {0x23, I_AND, 2, AMStackRelative, 4},
+		{0x24, I_BIT, 2, AMDirect, 3}, {0x25, I_AND, 2, AMDirect, 3},
+		{0x26, I_ROL, 2, AMDirect, 5}, {0x27, I_AND, 2, AMDirectIndirectLong, 6},
+		{0x28, I_PLP, 1, AMImplied, 4}, {0x29, I_AND, 2, AMImmediateM, 2},
+		{0x2a, I_ROL, 1, AMAccumulator, 2}, {0x2b, I_PLD, 1, AMImplied, 5},
+		{0x2c, I_BIT, 3, AMAbsolute, 4}, {0x2d, I_AND, 3, AMAbsolute, 4},
+		{0x2e, I_ROL, 3, AMAbsolute, 6}, {0x2f, I_AND, 4, AMAbsoluteLong, 5},
+		{0x30, I_BMI, 2, AMRelative, 2}, {0x31, I_AND, 2, AMDirectIndirectY, 5},
+		{0x32, I_AND, 2, AMDirectIndirect, 5}, {0x33, I_AND, 2, AMStackRelativeIndirectY, 7},
+		{0x34, I_BIT, 2, AMDirectX, 4}, {0x35, I_AND, 2, AMDirectX, 4},
+		{0x36, I_ROL, 2, AMDirectX, 6}, {0x37, I_AND, 2, AMDirectIndirectLongY, 6},
+		{0x38, I_SEC, 1, AMImplied, 2}, {0x39, I_AND, 3, AMAbsoluteY, 4},
+		{0x3a, I_DEC, 1, AMAccumulator, 2}, {0x3b, I_TSC, 1, AMImplied, 2},
+		{0x3c, I_BIT, 3, AMAbsoluteX, 4}, {0x3d, I_AND, 3, AMAbsoluteX, 4},
+		{0x3e, I_ROL, 3, AMAbsoluteX, 7}, {0x3f, I_AND, 4, AMAbsoluteLongX, 5},
+		{0x40, I_RTI, 1, AMImplied, 6}, {0x41, I_EOR, 2, AMDirectIndirectX, 6},
+		{0x42, I_WDM, 2, AMImmediate8, 2}, {0x43, I_EOR, 2, AMStackRelative, 4},
+		{0x44, I_MVP, 3, AMBlockMove, 7}, {0x45, I_EOR, 2, AMDirect, 3},
+		{0x46, I_LSR, 2, AMDirect, 5}, {0x47, I_EOR, 2, AMDirectIndirectLong, 6},
+		{0x48, I_PHA, 1, AMImplied, 3}, {0x49, I_EOR, 2, AMImmediateM, 2},
+		{0x4a, I_LSR, 1, AMAccumulator, 2}, {0x4b, I_PHK, 1, AMImplied, 3},
+		{0x4c, I_JMP, 3, AMAbsolute, 3}, {0x4d, I_EOR, 3, AMAbsolute, 4},
+		{0x4e, I_LSR, 3, AMAbsolute, 6}, {0x4f, I_EOR, 4, AMAbsoluteLong, 5},
+		{0x50, I_BVC, 2, AMRelative, 2}, {0x51, I_EOR, 2, AMDirectIndirectY, 5},
+		{0x52, I_EOR, 2, AMDirectIndirect, 5}, {0x53, I_EOR, 2, AMStackRelativeIndirectY, 7},
+		{0x54, I_MVN, 3, AMBlockMove, 7}, {0x55, I_EOR, 2, AMDirectX, 4},
+		{0x56, I_LSR, 2, AMDirectX, 6}, {0x57, I_EOR, 2, AMDirectIndirectLongY, 6},
+		{0x58, I_CLI, 1, AMImplied, 2}, {0x59, I_EOR, 3, AMAbsoluteY, 4},
+		{0x5a, I_PHY, 1, AMImplied, 3}, {0x5b, I_TCD, 1, AMImplied, 2},
+		{0x5c, I_JML, 4, AMAbsoluteLong, 4}, {0x5d, I_EOR, 3, AMAbsoluteX, 4},
+		{0x5e, I_LSR, 3, AMAbsoluteX, 7}, {0x5f, I_EOR, 4, AMAbsoluteLongX, 5},
+		{0x60, I_RTS, 1, AMImplied, 6}, {0x61, I_ADC, 2, AMDirectIndirectX, 6},
+		{0x62, I_PER, 3, AMRelativeLong, 6}, {0x63, I_ADC, 2, AMStackRelative, 4},
+		{0x64, I_STZ, 2, AMDirect, 3}, {0x65, I_ADC, 2, AMDirect, 3},
+		{0x66, I_ROR, 2, AMDirect, 5}, {0x67, I_ADC, 2, AMDirectIndirectLong, 6},
+		{0x68, I_PLA, 1, AMImplied, 4}, {0x69, I_ADC, 2, AMImmediateM, 2},
+		{0x6a, I_ROR, 1, AMAccumulator, 2}, {0x6b, I_RTL, 1, AMImplied, 6},
+		{0x6c, I_JMP, 3, AMAbsoluteIndirect, 5}, {0x6d, I_ADC, 3, AMAbsolute, 4},
+		{0x6e, I_ROR, 3, AMAbsolute, 6}, {0x6f, I_ADC, 4, AMAbsoluteLong, 5},
+		{0x70, I_BVS, 2, AMRelative, 2}, {0x71, I_ADC, 2, AMDirectIndirectY, 5},
+		{0x72, I_ADC, 2, AMDirectIndirect, 5}, {0x73, I_ADC, 2, AMStackRelativeIndirectY, 7},
+		{0x74, I_STZ, 2, AMDirectX, 4}, {0x75, I_ADC, 2, AMDirectX, 4},
+		{0x76, I_ROR, 2, AMDirectX, 6}, {0x77, I_ADC, 2, AMDirectIndirectLongY, 6},
+		{0x78, I_SEI, 1, AMImplied, 2}, {0x79, I_ADC, 3, AMAbsoluteY, 4},
+		{0x7a, I_PLY, 1, AMImplied, 4}, {0x7b, I_TDC, 1, AMImplied, 2},
+		{0x7c, I_JMP, 3, AMAbsoluteIndirectX, 6}, {0x7d, I_ADC, 3, AMAbsoluteX, 4},
+		{0x7e, I_ROR, 3, AMAbsoluteX, 7}, {0x7f, I_ADC, 4, AMAbsoluteLongX, 5},
+		{0x80, I_BRA, 2, AMRelative, 3}, {0x81, I_STA, 2, AMDirectIndirectX, 6},
+		{0x82, I_BRL, 3, AMRelativeLong, 4}, {0x83, I_STA, 2, AMStackRelative, 4},
+		{0x84, I_STY, 2, AMDirect, 3}, {0x85, I_STA, 2, AMDirect, 3},
+		{0x86, I_STX, 2, AMDirect, 3}, {0x87, I_STA, 2, AMDirectIndirectLong, 6},
+		{0x88, I_DEY, 1, AMImplied, 2}, {0x89, I_BIT, 2, AMImmediateM, 2},
+		{0x8a, I_TXA, 1, AMImplied, 2}, {0x8b, I_PHB, 1, AMImplied, 3},
+		{0x8c, I_STY, 3, AMAbsolute, 4}, {0x8d, I_STA, 3, AMAbsolute, 4},
+		{0x8e, I_STX, 3, AMAbsolute, 4}, {0x8f, I_STA, 4, AMAbsoluteLong, 5},
+		{0x90, I_BCC, 2, AMRelative, 2}, {0x91, I_STA, 2, AMDirectIndirectY, 6},
+		{0x92, I_STA, 2, AMDirectIndirect, 5}, {0x93, I_STA, 2, AMStackRelativeIndirectY, 7},
+		{0x94, I_STY, 2, AMDirectX, 4}, {0x95, I_STA, 2, AMDirectX, 4},
+		{0x96, I_STX, 2, AMDirectY, 4}, {0x97, I_STA, 2, AMDirectIndirectLongY, 6},
+		{0x98, I_TYA, 1, AMImplied, 2}, {0x99, I_STA, 3, AMAbsoluteY, 5},
+		{0x9a, I_TXS, 1, AMImplied, 2}, {0x9b, I_TXY, 1, AMImplied, 2},
+		{0x9c, I_STZ, 3, AMAbsolute, 4}, {0x9d, I_STA, 3, AMAbsoluteX, 5},
+		{0x9e, I_STZ, 3, AMAbsoluteX, 5}, {0x9f, I_STA, 4, AMAbsoluteLongX, 5},
+		{0xa0, I_LDY, 2, AMImmediateX, 2}, {0xa1, I_LDA, 2, AMDirectIndirectX, 6},
+		{0xa2, I_LDX, 2, AMImmediateX, 2}, {0xa3, I_LDA, 2, AMStackRelative, 4},
+		{0xa4, I_LDY, 2, AMDirect, 3}, {0xa5, I_LDA, 2, AMDirect, 3},
+		{0xa6, I_LDX, 2, AMDirect, 3}, {0xa7, I_LDA, 2, AMDirectIndirectLong, 6},
+		{0xa8, I_TAY, 1, AMImplied, 2}, {0xa9, I_LDA, 2, AMImmediateM, 2},
+		{0xaa, I_TAX, 1, AMImplied, 2}, {0xab, I_PLB, 1, AMImplied, 4},
+		{0xac, I_LDY, 3, AMAbsolute, 4}, {0xad, I_LDA, 3, AMAbsolute, 4},
+		{0xae, I_LDX, 3, AMAbsolute, 4}, {0xaf, I_LDA, 4, AMAbsoluteLong, 5},
+		{0xb0, I_BCS, 2, AMRelative, 2}, {0xb1, I_LDA, 2, AMDirectIndirectY, 5},
+		{0xb2, I_LDA, 2, AMDirectIndirect, 5}, {0xb3, I_LDA, 2, AMStackRelativeIndirectY, 7},
+		{0xb4, I_LDY, 2, AMDirectX, 4}, {0xb5, I_LDA, 2, AMDirectX, 4},
+		{0xb6, I_LDX, 2, AMDirectY, 4}, {0xb7, I_LDA, 2, AMDirectIndirectLongY, 6},
+		{0xb8, I_CLV, 1, AMImplied, 2}, {0xb9, I_LDA, 3, AMAbsoluteY, 4},
+		{0xba, I_TSX, 1, AMImplied, 2}, {0xbb, I_TYX, 1, AMImplied, 2},
+		{0xbc, I_LDY, 3, AMAbsoluteX, 4}, {0xbd, I_LDA, 3, AMAbsoluteX, 4},
+		{0xbe, I_LDX, 3, AMAbsoluteY, 4}, {0xbf, I_LDA, 4, AMAbsoluteLongX, 5},
+		{0xc0, I_CPY, 2, AMImmediateX, 2}, {0xc1, I_CMP, 2, AMDirectIndirectX, 6},
+		{0xc2, I_REP, 2, AMImmediate8, 3}, {0xc3, I_CMP, 2, AMStackRelative, 4},
+		{0xc4, I_CPY, 2, AMDirect, 3}, {0xc5, I_CMP, 2, AMDirect, 3},
+		{0xc6, I_DEC, 2, AMDirect, 5}, {0xc7, I_CMP, 2, AMDirectIndirectLong, 6},
+		{0xc8, I_INY, 1, AMImplied, 2}, {0xc9, I_CMP, 2, AMImmediateM, 2},
+		{0xca, I_DEX, 1, AMImplied, 2}, {0xcb, I_WAI, 1, AMImplied, 3},
+		{0xcc, I_CPY, 3, AMAbsolute, 4}, {0xcd, I_CMP, 3, AMAbsolute, 4},
+		{0xce, I_DEC, 3, AMAbsolute, 6}, {0xcf, I_CMP, 4, AMAbsoluteLong, 5},
+		{0xd0, I_BNE, 2, AMRelative, 2}, {0xd1, I_CMP, 2, AMDirectIndirectY, 5},
+		{0xd2, I_CMP, 2, AMDirectIndirect, 5}, {0xd3, I_CMP, 2, AMStackRelativeIndirectY, 7},
+		{0xd4, I_PEI, 2, AMDirectIndirect, 6}, {0xd5, I_CMP, 2, AMDirectX, 4},
+		{0xd6, I_DEC, 2, AMDirectX, 6}, {0xd7, I_CMP, 2, AMDirectIndirectLongY, 6},
+		{0xd8, I_CLD, 1, AMImplied, 2}, {0xd9, I_CMP, 3, AMAbsoluteY, 4},
+		{0xda, I_PHX, 1, AMImplied, 3}, {0xdb, I_STP, 1, AMImplied, 3},
+		{0xdc, I_JML, 3, AMAbsoluteIndirectLong, 6}, {0xdd, I_CMP, 3, AMAbsoluteX, 4},
+		{0xde, I_DEC, 3, AMAbsoluteX, 7}, {0xdf, I_CMP, 4, AMAbsoluteLongX, 5},
+		{0xe0, I_CPX, 2, AMImmediateX, 2}, {0xe1, I_SBC, 2, AMDirectIndirectX, 6},
+		{0xe2, I_SEP, 2, AMImmediate8, 3}, {0xe3, I_SBC, 2, AMStackRelative, 4},
+		{0xe4, I_CPX, 2, AMDirect, 3}, {0xe5, I_SBC, 2, AMDirect, 3},
+		{0xe6, I_INC, 2, AMDirect, 5}, {0xe7, I_SBC, 2, AMDirectIndirectLong, 6},
+		{0xe8, I_INX, 1, AMImplied, 2}, {0xe9, I_SBC, 2, AMImmediateM, 2},
+		{0xea, I_NOP, 1, AMImplied, 2}, {0xeb, I_XBA, 1, AMImplied, 3},
+		{0xec, I_CPX, 3, AMAbsolute, 4}, {0xed, I_SBC, 3, AMAbsolute, 4},
+		{0xee, I_INC, 3, AMAbsolute, 6}, {0xef, I_SBC, 4, AMAbsoluteLong, 5},
+		{0xf0, I_BEQ, 2, AMRelative, 2}, {0xf1, I_SBC, 2, AMDirectIndirectY, 5},
+		{0xf2, I_SBC, 2, AMDirectIndirect, 5}, {0xf3, I_SBC, 2, AMStackRelativeIndirectY, 7},
+		{0xf4, I_PEA, 3, AMAbsolute, 5}, {0xf5, I_SBC, 2, AMDirectX, 4},
+		{0xf6, I_INC, 2, AMDirectX, 6}, {0xf7, I_SBC, 2, AMDirectIndirectLongY, 6},
+		{0xf8, I_SED, 1, AMImplied, 2}, {0xf9, I_SBC, 3, AMAbsoluteY, 4},
+		{0xfa, I_PLX, 1, AMImplied, 4}, {0xfb, I_XCE, 1, AMImplied, 2},
+		{0xfc, I_JSR, 3, AMAbsoluteIndirectX, 8}, {0xfd, I_SBC, 3, AMAbsoluteX, 4},
+		{0xfe, I_INC, 3, AMAbsoluteX, 7}, {0xff, I_SBC, 4, AMAbsoluteLongX, 5}}
+)
+
+// Length returns the size of the instruction in bytes given the width of the
+// accumulator (m8) and index registers (x8).
+func (op OpcodeSpec) Length(m8, x8 bool) int {
+	switch {
+	case op.AddressingMode == AMImmediateM && !m8:
+		return op.Size + 1
+	case op.AddressingMode == AMImmediateX && !x8:
+		return op.Size + 1
+	}
+	return op.Size
+}
+
+// ReadOpcode returns the opcode at address and its operand.
+func ReadOpcode(memory MemoryAccess, address uint32, m8, x8 bool) (OpcodeSpec, uint32) {
+	op := opcodes[memory.ReadByte(address&0xffffff, true)]
+	var value uint32
+	for i := op.Length(m8, x8) - 1; i > 0; i-- {
+		value = value<<8 | uint32(memory.ReadByte(bank(address)|uint32(uint16(address)+uint16(i)), true))
+	}
+	return op, value
+}
+
+// FormatArguments formats the operand of an instruction of the given length
+// (see Length). Address is that of the next instruction.
+func (op OpcodeSpec) FormatArguments(value uint32, length int, address uint16) string {
+	var arguments string = ""
+	switch op.AddressingMode {
+	case AMAccumulator:
+		arguments = "A"
+	case AMImmediateM, AMImmediateX, AMImmediate8:
+		if length == 3 {
+			arguments = fmt.Sprintf("#$%04X", value)
+		} else {
+			arguments = fmt.Sprintf("#$%02X", value)
+		}
+	case AMDirect:
+		arguments = fmt.Sprintf("$%02X", value)
+	case AMDirectX:
+		arguments = fmt.Sprintf("$%02X,X", value)
+	case AMDirectY:
+		arguments = fmt.Sprintf("$%02X,Y", value)
+	case AMDirectIndirect:
+		arguments = fmt.Sprintf("($%02X)", value)
+	case AMDirectIndirectLong:
+		arguments = fmt.Sprintf("[$%02X]", value)
+	case AMDirectIndirectX:
+		arguments = fmt.Sprintf("($%02X,X)", value)
+	case AMDirectIndirectY:
+		arguments = fmt.Sprintf("($%02X),Y", value)
+	case AMDirectIndirectLongY:
+		arguments = fmt.Sprintf("[$%02X],Y", value)
+	case AMAbsolute:
+		arguments = fmt.Sprintf("$%04X", value)
+	case AMAbsoluteX:
+		arguments = fmt.Sprintf("$%04X,X", value)
+	case AMAbsoluteY:
+		arguments = fmt.Sprintf("$%04X,Y", value)
+	case AMAbsoluteLong:
+		arguments = fmt.Sprintf("$%06X", value)
+	case AMAbsoluteLongX:
+		arguments = fmt.Sprintf("$%06X,X", value)
+	case AMAbsoluteIndirect:
+		arguments = fmt.Sprintf("($%04X)", value)
+	case AMAbsoluteIndirectLong:
+		arguments = fmt.Sprintf("[$%04X]", value)
+	case AMAbsoluteIndirectX:
+		arguments = fmt.Sprintf("($%04X,X)", value)
+	case AMStackRelative:
+		arguments = fmt.Sprintf("$%02X,S", value)
+	case AMStackRelativeIndirectY:
+		arguments = fmt.Sprintf("($%02X,S),Y", value)
+	case AMRelative:
+		arguments = fmt.Sprintf("$%04X", address+uint16(int8(value)))
+	case AMRelativeLong:
+		arguments = fmt.Sprintf("$%04X", address+uint16(value))
+	case AMBlockMove:
+		// Encoded as destination then source bank but written source first
+		arguments = fmt.Sprintf("$%02X,$%02X", value>>8, value&0xff)
+	}
+	return arguments
+}
+
+func (op OpcodeSpec) String() string {
+	return fmt.Sprintf("%s %d", op.Instruction.Name, op.AddressingMode)
+}
@@ -0,0 +1,492 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-emu/cpu6502"
+	"github.com/samuel/go-emu/nes"
+	"github.com/samuel/go-emu/symbols"
+	"github.com/samuel/go-emu/z80"
+)
+
+var testSource = []string{
+	"        .org $8000",
+	"start:  ldx #0",
+	"loop:   jsr inc_count",
+	"        inx",
+	"        cpx #3",
+	"        bne loop",
+	"done:   jmp done",
+	"inc_count:",
+	"        inc $10",
+	"        rts",
+}
+
+// Lines of testSource that assemble to code
+var testLines = []symbols.Line{
+	{Line: 2, Address: 0x8000, Size: 2},
+	{Line: 3, Address: 0x8002, Size: 3},
+	{Line: 4, Address: 0x8005, Size: 1},
+	{Line: 5, Address: 0x8006, Size: 2},
+	{Line: 6, Address: 0x8008, Size: 2},
+	{Line: 7, Address: 0x800a, Size: 3},
+	{Line: 9, Address: 0x800d, Size: 2},
+	{Line: 10, Address: 0x800f, Size: 1},
+}
+
+type ram [0x10000]byte
+
+func (m *ram) ReadByte(address uint16, peek bool) byte {
+	return m[address]
+}
+
+func (m *ram) WriteByte(address uint16, value byte) {
+	m[address] = value
+}
+
+type message struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client is a scripted DAP client
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	seq    int
+	events []message
+	done   chan error
+}
+
+// start6502 starts a server for the test program with the debug info loaded
+func start6502(t *testing.T) (*client, *cpu6502.CPU6502, *ram) {
+	prog, err := cpu6502.Assemble(strings.Join(testSource, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := &ram{}
+	prog.Load(memory)
+	table := symbols.New()
+	for name, addr := range prog.Labels {
+		table.Add(name, addr, -1)
+	}
+	for _, l := range testLines {
+		l.File, l.Bank = "src/game.s", -1
+		table.AddLine(l)
+	}
+	view := table.View(nil)
+	cpu := cpu6502.NewCPU6502(memory)
+	cpu.PC = 0x8000
+	cpu.Symbols = view
+	target := New6502Target(cpu, memory, func() error {
+		_, err := cpu.Step()
+		return err
+	})
+	return startServer(t, NewServer(target, view)), cpu, memory
+}
+
+func startServer(t *testing.T, s *Server) *client {
+	serverConn, clientConn := net.Pipe()
+	c := &client{t: t, conn: clientConn, r: bufio.NewReader(clientConn), done: make(chan error, 1)}
+	go func() {
+		c.done <- s.Serve(serverConn)
+		serverConn.Close()
+	}()
+	t.Cleanup(func() { clientConn.Close() })
+	return c
+}
+
+func (c *client) read() message {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	body, err := readMessage(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var m message
+	if err := json.Unmarshal(body, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// call sends a request and decodes the response's body into out (if not
+// nil). Events that arrive first are kept for wait.
+func (c *client) call(command string, args interface{}, out interface{}) message {
+	c.t.Helper()
+	c.seq++
+	if err := writeMessage(c.conn, map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args}); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		m := c.read()
+		if m.Type == "event" {
+			c.events = append(c.events, m)
+			continue
+		}
+		if m.RequestSeq != c.seq || m.Command != command {
+			c.t.Fatalf("Got response %+v to %s", m, command)
+		}
+		if out != nil && m.Success {
+			if err := json.Unmarshal(m.Body, out); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return m
+	}
+}
+
+// mustCall is call for requests that should succeed
+func (c *client) mustCall(command string, args interface{}, out interface{}) {
+	c.t.Helper()
+	if m := c.call(command, args, out); !m.Success {
+		c.t.Fatalf("%s failed: %s", command, m.Message)
+	}
+}
+
+// wait returns the body of the next event with the given name
+func (c *client) wait(name string) json.RawMessage {
+	c.t.Helper()
+	for {
+		var m message
+		if len(c.events) > 0 {
+			m, c.events = c.events[0], c.events[1:]
+		} else {
+			m = c.read()
+		}
+		if m.Type == "event" && m.Event == name {
+			return m.Body
+		}
+	}
+}
+
+// stopped waits for the target to stop and checks why and where
+func (c *client) stopped(reason string, pc uint16) {
+	c.t.Helper()
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(c.wait("stopped"), &body)
+	if body.Reason != reason {
+		c.t.Errorf("Stopped for %q instead of %q", body.Reason, reason)
+	}
+	if frames := c.stackTrace(); frames[0].InstructionPointerReference != memoryReference(pc) {
+		c.t.Fatalf("Stopped at %s instead of $%04X", frames[0].InstructionPointerReference, pc)
+	}
+}
+
+func (c *client) stackTrace() []stackFrame {
+	c.t.Helper()
+	var body struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	c.mustCall("stackTrace", map[string]int{"threadId": 1}, &body)
+	return body.StackFrames
+}
+
+func (c *client) variables() map[string]string {
+	c.t.Helper()
+	var body struct {
+		Variables []variable `json:"variables"`
+	}
+	c.mustCall("variables", map[string]int{"variablesReference": registersReference}, &body)
+	vars := map[string]string{}
+	for _, v := range body.Variables {
+		vars[v.Name] = v.Value
+	}
+	return vars
+}
+
+func (c *client) disconnect() {
+	c.t.Helper()
+	c.mustCall("disconnect", nil, nil)
+	if err := <-c.done; err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestServer6502(t *testing.T) {
+	c, cpu, memory := start6502(t)
+
+	var caps capabilities
+	c.mustCall("initialize", map[string]string{"adapterID": "go-emu"}, &caps)
+	if !caps.SupportsDisassembleRequest || !caps.SupportsInstructionBreakpoints {
+		t.Errorf("Capabilities %+v", caps)
+	}
+	c.wait("initialized")
+	c.mustCall("launch", map[string]bool{"stopOnEntry": true}, nil)
+	var breaks struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.mustCall("setFunctionBreakpoints", map[string]interface{}{
+		"breakpoints": []functionBreakpoint{{Name: "inc_count", Condition: "X == 1"}, {Name: "nowhere"}, {Name: "start", Condition: "X =="}}}, &breaks)
+	if len(breaks.Breakpoints) != 3 || !breaks.Breakpoints[0].Verified || breaks.Breakpoints[1].Verified || breaks.Breakpoints[2].Verified {
+		t.Errorf("Function breakpoints %+v", breaks.Breakpoints)
+	}
+	c.mustCall("setInstructionBreakpoints", map[string]interface{}{
+		"breakpoints": []instructionBreakpoint{{InstructionReference: "0x8008", Offset: 2}}}, &breaks)
+	if len(breaks.Breakpoints) != 1 || breaks.Breakpoints[0].InstructionReference != "0x800A" {
+		t.Errorf("Instruction breakpoints %+v", breaks.Breakpoints)
+	}
+	c.mustCall("configurationDone", nil, nil)
+	c.stopped("entry", 0x8000)
+
+	// The function breakpoint's condition holds on the second call
+	c.mustCall("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint", 0x800d)
+	if vars := c.variables(); vars["X"] != "$01" || vars["PC"] != "$800D" || vars["Z"] != "0" {
+		t.Errorf("Registers %v", vars)
+	}
+	frames := c.stackTrace()
+	if len(frames) != 2 || frames[0].Name != "inc_count" || frames[1].Name != "? (JSR)" ||
+		frames[1].InstructionPointerReference != "0x8002" {
+		t.Fatalf("Stack %+v", frames)
+	}
+	if frames[0].Source == nil || frames[0].Source.Path != "src/game.s" || frames[0].Line != 9 || frames[1].Line != 3 {
+		t.Errorf("Stack source lines %+v", frames)
+	}
+
+	c.mustCall("stepOut", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8005)
+
+	// Step over the call by instruction, with X changed so the breakpoint
+	// in it doesn't stop
+	var set struct {
+		Value string `json:"value"`
+	}
+	c.mustCall("setVariable", map[string]interface{}{"variablesReference": registersReference, "name": "PC", "value": "loop"}, &set)
+	if set.Value != "$8002" || cpu.PC != 0x8002 {
+		t.Errorf("Set PC to %s", set.Value)
+	}
+	c.mustCall("setVariable", map[string]interface{}{"variablesReference": registersReference, "name": "X", "value": "X + 1"}, &set)
+	if set.Value != "$02" {
+		t.Errorf("Set X to %s", set.Value)
+	}
+	c.mustCall("next", map[string]interface{}{"threadId": 1, "granularity": "instruction"}, nil)
+	c.stopped("step", 0x8005)
+	c.mustCall("stepIn", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8006)
+	if memory[0x10] != 3 {
+		t.Errorf("inc_count was called %d times instead of 3", memory[0x10])
+	}
+
+	var mem struct {
+		Address string `json:"address"`
+		Data    string `json:"data"`
+	}
+	c.mustCall("writeMemory", map[string]interface{}{"memoryReference": "0x0010", "data": base64.StdEncoding.EncodeToString([]byte{0x40, 0x41})}, nil)
+	c.mustCall("readMemory", map[string]interface{}{"memoryReference": "0x0000", "offset": 0x10, "count": 3}, &mem)
+	if data, _ := base64.StdEncoding.DecodeString(mem.Data); mem.Address != "0x0010" || string(data) != "\x40\x41\x00" {
+		t.Errorf("Read %s from %s", data, mem.Address)
+	}
+
+	var result struct {
+		Result string `json:"result"`
+	}
+	c.mustCall("evaluate", map[string]string{"expression": "inc_count + X"}, &result)
+	if result.Result != "$8010 (32784)" {
+		t.Errorf("Evaluated %q", result.Result)
+	}
+	if m := c.call("evaluate", map[string]string{"expression": "nowhere"}, nil); m.Success {
+		t.Error("Evaluated an undefined symbol")
+	}
+
+	var dis struct {
+		Instructions []disassembledInstruction `json:"instructions"`
+	}
+	c.mustCall("disassemble", map[string]interface{}{"memoryReference": "0x8005", "instructionOffset": -2, "instructionCount": 4}, &dis)
+	var got []string
+	for _, ins := range dis.Instructions {
+		got = append(got, ins.Address+" "+ins.Instruction)
+	}
+	want := []string{"0x8000 LDX #$00", "0x8002 JSR inc_count", "0x8005 INX", "0x8006 CPX #$03"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Disassembled\n%s\ninstead of\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(dis.Instructions) == 4 && (dis.Instructions[0].Symbol != "start" || dis.Instructions[1].Line != 3) {
+		t.Errorf("Disassembly symbols and lines %+v", dis.Instructions)
+	}
+
+	c.mustCall("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint", 0x800a)
+	c.mustCall("setInstructionBreakpoints", map[string]interface{}{"breakpoints": []instructionBreakpoint{}}, nil)
+	c.mustCall("continue", map[string]int{"threadId": 1}, nil)
+	c.mustCall("pause", map[string]int{"threadId": 1}, nil)
+	c.stopped("pause", 0x800a)
+	c.disconnect()
+}
+
+func TestServerLines(t *testing.T) {
+	c, _, _ := start6502(t)
+	c.mustCall("initialize", nil, nil)
+	var breaks struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.mustCall("setBreakpoints", map[string]interface{}{
+		"source":      source{Path: "/home/me/game/src/game.s"},
+		"breakpoints": []sourceBreakpoint{{Line: 9}, {Line: 8}}}, &breaks)
+	if len(breaks.Breakpoints) != 2 || !breaks.Breakpoints[0].Verified || breaks.Breakpoints[1].Verified {
+		t.Errorf("Source breakpoints %+v", breaks.Breakpoints)
+	}
+	c.mustCall("launch", nil, nil)
+	c.mustCall("configurationDone", nil, nil)
+	c.stopped("breakpoint", 0x800d)
+	c.mustCall("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x800f)
+	// Stepping past the end of the routine returns to the caller
+	c.mustCall("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8005)
+	c.mustCall("setBreakpoints", map[string]interface{}{"source": source{Path: "/home/me/game/src/game.s"}}, nil)
+	c.mustCall("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8006)
+	// Stepping over the call at line 3 stops at line 4
+	c.mustCall("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8008)
+	c.mustCall("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8002)
+	c.mustCall("next", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0x8005)
+	c.disconnect()
+}
+
+// TestServerReverse debugs a console running through a nes.Rewinder as
+// the nes frontend does.
+func TestServerReverse(t *testing.T) {
+	prog, err := cpu6502.Assemble(`
+		.org $C000
+		LDX #0
+loop:	INX
+		STX $0200
+		TXA
+		AND #$3F
+		BNE loop
+		INC $10		; every 64 iterations
+		JMP loop`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart := &nes.Cart{PRGPages: make([]byte, 0x4000)}
+	copy(cart.PRGPages, prog.Code)
+	cart.PRGPages[0x3ffc], cart.PRGPages[0x3ffd] = 0x00, 0xc0
+	state, err := nes.NewNESState(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := nes.NewRewinder(state)
+	r.Interval = 1000
+	for state.Frame < 2 {
+		if err := r.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := startServer(t, NewServer(NewReversible6502Target(state.CPU, state, r), nil))
+
+	var caps capabilities
+	c.mustCall("initialize", map[string]string{"adapterID": "go-emu"}, &caps)
+	if !caps.SupportsStepBack || !caps.SupportsDataBreakpoints {
+		t.Errorf("Capabilities %+v", caps)
+	}
+	c.wait("initialized")
+	c.mustCall("launch", map[string]bool{"stopOnEntry": true}, nil)
+	c.mustCall("configurationDone", nil, nil)
+	c.stopped("entry", state.CPU.PC)
+
+	// Without data breakpoints reverseContinue goes back a frame
+	c.mustCall("reverseContinue", map[string]int{"threadId": 1}, nil)
+	var stop struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(c.wait("stopped"), &stop)
+	if stop.Reason != "step" || state.Frame != 1 {
+		t.Fatalf("reverseContinue stopped for %q in frame %d", stop.Reason, state.Frame)
+	}
+
+	var info struct {
+		DataID      string   `json:"dataId"`
+		AccessTypes []string `json:"accessTypes"`
+	}
+	c.mustCall("dataBreakpointInfo", map[string]interface{}{"variablesReference": registersReference, "name": "A"}, &info)
+	if info.DataID != "" {
+		t.Errorf("Register A can be watched as %q", info.DataID)
+	}
+	c.mustCall("dataBreakpointInfo", map[string]string{"name": "$10"}, &info)
+	if info.DataID != "0x0010" || len(info.AccessTypes) != 1 || info.AccessTypes[0] != "write" {
+		t.Errorf("Data breakpoint info %+v", info)
+	}
+	var breaks struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.mustCall("setDataBreakpoints", map[string]interface{}{
+		"breakpoints": []dataBreakpoint{{DataID: info.DataID}, {DataID: "0x0011", AccessType: "read"}}}, &breaks)
+	if len(breaks.Breakpoints) != 2 || !breaks.Breakpoints[0].Verified || breaks.Breakpoints[1].Verified {
+		t.Errorf("Data breakpoints %+v", breaks.Breakpoints)
+	}
+
+	// Stop after a write, step back over it and run back to the one before
+	c.mustCall("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint", 0xc00d)
+	count := state.ReadByte(0x10, true)
+	c.mustCall("stepBack", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0xc00b)
+	if n := state.ReadByte(0x10, true); n != count-1 {
+		t.Errorf("$10 is %d after stepping back over INC $10 from %d", n, count)
+	}
+	c.mustCall("stepBack", map[string]int{"threadId": 1}, nil)
+	c.stopped("step", 0xc009)
+	c.mustCall("reverseContinue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint", 0xc00d)
+	if n := state.ReadByte(0x10, true); n != count-1 {
+		t.Errorf("$10 is %d after running back to the write before %d", n, count)
+	}
+	c.mustCall("continue", map[string]int{"threadId": 1}, nil)
+	c.stopped("breakpoint", 0xc00d)
+	if n := state.ReadByte(0x10, true); n != count {
+		t.Errorf("$10 is %d instead of %d after running forward again", n, count)
+	}
+
+	// Nothing writes $0300 so there's nowhere to go
+	c.mustCall("setDataBreakpoints", map[string]interface{}{"breakpoints": []dataBreakpoint{{DataID: "0x0300"}}}, nil)
+	if m := c.call("reverseContinue", map[string]int{"threadId": 1}, nil); m.Success {
+		t.Error("reverseContinue found a write to $0300")
+	}
+	if frames := c.stackTrace(); frames[0].InstructionPointerReference != "0xC00D" {
+		t.Errorf("Failed reverseContinue moved to %s", frames[0].InstructionPointerReference)
+	}
+	c.disconnect()
+}
+
+func TestZ80Target(t *testing.T) {
+	memory := &ram{0x12, 0x34}
+	cpu := z80.New(memory)
+	target := NewZ80Target(cpu, memory)
+	cpu.H, cpu.L = 0x12, 0x34
+	if err := target.SetRegister("a'", 0x56); err != nil || cpu.Ap != 0x56 {
+		t.Errorf("Setting A' gave %v and set it to $%02X", err, cpu.Ap)
+	}
+	if err := target.SetRegister("Q", 1); err == nil {
+		t.Error("Set an unknown register")
+	}
+	if v, err := target.Evaluate("HL + A"); err != nil || v != 0x1234+0xff {
+		t.Errorf("HL + A = %d, %v", v, err)
+	}
+	if text, size := target.Disassemble(1); text != "db $34" || size != 1 {
+		t.Errorf("Disassembled %q, %d", text, size)
+	}
+	if err := target.Step(); !errors.Is(err, ErrStepUnsupported) || cpu.PC != 0 {
+		t.Errorf("Step returned %v and moved PC to $%04X", err, cpu.PC)
+	}
+}
@@ -0,0 +1,920 @@
+// Package dap implements a Debug Adapter Protocol server so 6502 programs
+// can be debugged from editors that speak it (VS Code, Neovim, Emacs, ...).
+// Other CPUs plug in through Target. The Z80 target only examines registers
+// and memory since z80.Z80 doesn't execute instructions yet.
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/samuel/go-emu/cpu6502"
+	"github.com/samuel/go-emu/symbols"
+)
+
+// Instructions run between checks for requests while the target is running
+const runSlice = 10000
+
+// Server debugs a target for one client. Breakpoints are checked by the
+// server before each instruction so they don't interfere with ones set on
+// the CPU directly (which stop the target with reason "breakpoint" too).
+type Server struct {
+	Target Target
+	// Symbols, if set, names routines in the call stack and maps
+	// addresses to source lines for source breakpoints and line stepping.
+	Symbols *symbols.View
+
+	w        io.Writer
+	seq      int
+	writeErr error
+	handlers map[string]func(json.RawMessage) (interface{}, error)
+
+	running bool
+	started bool // configurationDone has been received
+	entry   bool // stop on entry once started
+	stop    func() (string, bool)
+	skipPC  bool // don't stop at the breakpoint at the PC the run started at
+
+	sourceBreaks      map[string][]lineBreakpoint // by source path
+	functionBreaks    []addressBreakpoint
+	instructionBreaks []addressBreakpoint
+	writeWatches      []uint16 // data breakpoints
+	nextBreakID       int
+
+	reversed string // why the last stepBack or reverseContinue stopped
+}
+
+type addressBreakpoint struct {
+	address   uint16
+	condition string
+}
+
+type lineBreakpoint struct {
+	addressBreakpoint
+	line symbols.Line
+}
+
+// NewServer returns a server for target. symbols may be nil.
+func NewServer(target Target, symbols *symbols.View) *Server {
+	s := &Server{Target: target, Symbols: symbols, sourceBreaks: map[string][]lineBreakpoint{}}
+	s.handlers = map[string]func(json.RawMessage) (interface{}, error){
+		"initialize":                s.initialize,
+		"launch":                    s.launch,
+		"attach":                    s.launch,
+		"configurationDone":         s.configurationDone,
+		"setBreakpoints":            s.setBreakpoints,
+		"setFunctionBreakpoints":    s.setFunctionBreakpoints,
+		"setInstructionBreakpoints": s.setInstructionBreakpoints,
+		"setExceptionBreakpoints":   s.ignore,
+		"dataBreakpointInfo":        s.dataBreakpointInfo,
+		"setDataBreakpoints":        s.setDataBreakpoints,
+		"threads":                   s.threads,
+		"stackTrace":                s.stackTrace,
+		"scopes":                    s.scopes,
+		"variables":                 s.variables,
+		"setVariable":               s.setVariable,
+		"continue":                  s.resume,
+		"next":                      s.next,
+		"stepIn":                    s.stepIn,
+		"stepOut":                   s.stepOut,
+		"pause":                     s.pause,
+		"stepBack":                  s.stepBack,
+		"reverseContinue":           s.reverseContinue,
+		"readMemory":                s.readMemory,
+		"writeMemory":               s.writeMemory,
+		"disassemble":               s.disassemble,
+		"evaluate":                  s.evaluate,
+	}
+	return s
+}
+
+// ListenAndServe waits for a client on the TCP address and serves it.
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve handles requests from the client until it disconnects.
+func (s *Server) Serve(rw io.ReadWriter) error {
+	s.w = rw
+	requests := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		r := bufio.NewReader(rw)
+		for {
+			msg, err := readMessage(r)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case requests <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for s.writeErr == nil {
+		var msg []byte
+		if s.running {
+			select {
+			case msg = <-requests:
+			case err := <-readErr:
+				return eofOK(err)
+			default:
+				s.run(runSlice)
+				continue
+			}
+		} else {
+			select {
+			case msg = <-requests:
+			case err := <-readErr:
+				return eofOK(err)
+			}
+		}
+		var req request
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return fmt.Errorf("dap: bad message: %s", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if req.Command == "disconnect" {
+			s.respond(&req, nil)
+			return s.writeErr
+		}
+		s.handle(&req)
+	}
+	return s.writeErr
+}
+
+func eofOK(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) send(v interface{}) {
+	if s.writeErr == nil {
+		s.writeErr = writeMessage(s.w, v)
+	}
+}
+
+func (s *Server) nextSeq() int {
+	s.seq++
+	return s.seq
+}
+
+func (s *Server) respond(req *request, body interface{}) {
+	s.send(&response{Seq: s.nextSeq(), Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (s *Server) fail(req *request, err error) {
+	s.send(&response{Seq: s.nextSeq(), Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: err.Error()})
+}
+
+func (s *Server) event(name string, body interface{}) {
+	s.send(&event{Seq: s.nextSeq(), Type: "event", Event: name, Body: body})
+}
+
+func (s *Server) handle(req *request) {
+	h, ok := s.handlers[req.Command]
+	if !ok {
+		s.fail(req, fmt.Errorf("unsupported request %q", req.Command))
+		return
+	}
+	body, err := h(req.Arguments)
+	if err != nil {
+		s.fail(req, err)
+		return
+	}
+	s.respond(req, body)
+	switch req.Command {
+	case "initialize":
+		s.event("initialized", nil)
+	case "pause":
+		if s.running {
+			s.stopped("pause", "")
+		}
+	case "stepBack", "reverseContinue":
+		s.stopped(s.reversed, "")
+	case "configurationDone":
+		s.started = true
+		if s.entry {
+			s.stopped("entry", "")
+		} else {
+			s.running = true
+			s.skipPC = true
+		}
+	}
+}
+
+func (s *Server) ignore(args json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *Server) initialize(args json.RawMessage) (interface{}, error) {
+	_, watch := s.Target.(Watcher)
+	_, reverse := s.Target.(Reverser)
+	return &capabilities{
+		SupportsConfigurationDoneRequest: true,
+		SupportsFunctionBreakpoints:      true,
+		SupportsConditionalBreakpoints:   true,
+		SupportsInstructionBreakpoints:   true,
+		SupportsSetVariable:              true,
+		SupportsReadMemoryRequest:        true,
+		SupportsWriteMemoryRequest:       true,
+		SupportsDisassembleRequest:       true,
+		SupportsSteppingGranularity:      true,
+		SupportsEvaluateForHovers:        true,
+		SupportsDataBreakpoints:          watch,
+		SupportsStepBack:                 reverse,
+	}, nil
+}
+
+// launch and attach both debug the target the server was given. The
+// target is stopped before its first instruction if stopOnEntry is set.
+func (s *Server) launch(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		StopOnEntry bool `json:"stopOnEntry"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	s.entry = a.StopOnEntry
+	return nil, nil
+}
+
+func (s *Server) configurationDone(args json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+// Breakpoints
+
+// newBreakpoint returns a breakpoint for the response with the next ID. It
+// isn't verified, with the error as its message, if condition doesn't parse.
+// Only the syntax can be checked ahead of time.
+func (s *Server) newBreakpoint(condition string) (breakpoint, bool) {
+	s.nextBreakID++
+	b := breakpoint{ID: s.nextBreakID}
+	if condition != "" {
+		if _, err := cpu6502.Eval(condition, func(string) (int, bool) { return 1, true }); err != nil {
+			b.Message = err.Error()
+			return b, false
+		}
+	}
+	return b, true
+}
+
+func (s *Server) setBreakpoints(args json.RawMessage) (interface{}, error) {
+	var a setBreakpointsArguments
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	var breaks []lineBreakpoint
+	result := []breakpoint{}
+	for _, sb := range a.Breakpoints {
+		b, ok := s.newBreakpoint(sb.Condition)
+		b.Source, b.Line = &a.Source, sb.Line
+		var lines []symbols.Line
+		if ok && s.Symbols != nil {
+			lines = s.Symbols.Table.LineAddresses(a.Source.Path, sb.Line)
+		}
+		if ok && len(lines) == 0 {
+			b.Message = "no code at this line"
+		}
+		for _, l := range lines {
+			breaks = append(breaks, lineBreakpoint{addressBreakpoint{l.Address, sb.Condition}, l})
+			b.Verified = true
+			b.InstructionReference = memoryReference(lines[0].Address)
+		}
+		result = append(result, b)
+	}
+	s.sourceBreaks[a.Source.Path] = breaks
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+func (s *Server) setFunctionBreakpoints(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Breakpoints []functionBreakpoint `json:"breakpoints"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	s.functionBreaks = nil
+	result := []breakpoint{}
+	for _, fb := range a.Breakpoints {
+		b, ok := s.newBreakpoint(fb.Condition)
+		if ok {
+			if addr, err := s.address(fb.Name); err != nil {
+				b.Message = err.Error()
+			} else {
+				b.Verified = true
+				b.InstructionReference = memoryReference(addr)
+				s.functionBreaks = append(s.functionBreaks, addressBreakpoint{addr, fb.Condition})
+			}
+		}
+		result = append(result, b)
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+func (s *Server) setInstructionBreakpoints(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Breakpoints []instructionBreakpoint `json:"breakpoints"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	s.instructionBreaks = nil
+	result := []breakpoint{}
+	for _, ib := range a.Breakpoints {
+		b, ok := s.newBreakpoint(ib.Condition)
+		if ok {
+			if addr, err := parseMemoryReference(ib.InstructionReference); err != nil {
+				b.Message = err.Error()
+			} else {
+				addr += uint16(ib.Offset)
+				b.Verified = true
+				b.InstructionReference = memoryReference(addr)
+				s.instructionBreaks = append(s.instructionBreaks, addressBreakpoint{addr, ib.Condition})
+			}
+		}
+		result = append(result, b)
+	}
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+// dataBreakpointInfo says whether name (an address, symbol or expression)
+// can be watched. Registers can't be.
+func (s *Server) dataBreakpointInfo(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{"dataId": nil}
+	if _, ok := s.Target.(Watcher); !ok {
+		body["description"] = "data breakpoints aren't supported"
+	} else if a.VariablesReference != 0 {
+		body["description"] = "registers can't be watched"
+	} else if addr, err := s.address(a.Name); err != nil {
+		body["description"] = err.Error()
+	} else {
+		body["dataId"] = memoryReference(addr)
+		body["description"] = fmt.Sprintf("writes to $%04X", addr)
+		body["accessTypes"] = []string{"write"}
+	}
+	return body, nil
+}
+
+// setDataBreakpoints watches the addresses of the data breakpoints for
+// writes, which stops the target after the instruction that wrote.
+func (s *Server) setDataBreakpoints(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Breakpoints []dataBreakpoint `json:"breakpoints"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	w, ok := s.Target.(Watcher)
+	if !ok {
+		return nil, errors.New("data breakpoints aren't supported")
+	}
+	var watches []uint16
+	result := []breakpoint{}
+	for _, db := range a.Breakpoints {
+		b, _ := s.newBreakpoint("")
+		if addr, err := parseMemoryReference(db.DataID); err != nil {
+			b.Message = err.Error()
+		} else if db.AccessType != "" && db.AccessType != "write" {
+			b.Message = "only writes can be watched"
+		} else if db.Condition != "" {
+			b.Message = "data breakpoints can't have conditions"
+		} else {
+			b.Verified = true
+			watches = append(watches, addr)
+		}
+		result = append(result, b)
+	}
+	if err := w.WatchWrites(watches); err != nil {
+		return nil, err
+	}
+	s.writeWatches = watches
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+// address returns the address of a symbol or the value of an expression
+func (s *Server) address(name string) (uint16, error) {
+	if s.Symbols != nil {
+		if addr, ok := s.Symbols.Address(name); ok {
+			return addr, nil
+		}
+	}
+	v, err := s.Target.Evaluate(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(v), nil
+}
+
+// breakpointAt reports whether a breakpoint stops execution at pc
+func (s *Server) breakpointAt(pc uint16) bool {
+	hit := func(b addressBreakpoint) bool {
+		if b.address != pc {
+			return false
+		}
+		if b.condition == "" {
+			return true
+		}
+		v, err := s.Target.Evaluate(b.condition)
+		return err == nil && v != 0
+	}
+	for _, b := range s.instructionBreaks {
+		if hit(b) {
+			return true
+		}
+	}
+	for _, b := range s.functionBreaks {
+		if hit(b) {
+			return true
+		}
+	}
+	for _, breaks := range s.sourceBreaks {
+		for _, b := range breaks {
+			// The address can be in another bank
+			if hit(b.addressBreakpoint) && (b.line.Bank < 0 || s.lineAt(pc).Bank == b.line.Bank) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Execution
+
+// run executes up to n instructions while the target is running
+func (s *Server) run(n int) {
+	for i := 0; i < n && s.running; i++ {
+		pc := s.Target.PC()
+		if !s.skipPC && s.breakpointAt(pc) {
+			s.stopped("breakpoint", "")
+			return
+		}
+		s.skipPC = false
+		if err := s.Target.Step(); err != nil {
+			if errors.Is(err, cpu6502.ErrBreakpoint) {
+				s.stopped("breakpoint", err.Error())
+			} else {
+				s.event("output", map[string]string{"category": "stderr", "output": err.Error() + "\n"})
+				s.stopped("exception", err.Error())
+			}
+			return
+		}
+		if s.stop != nil {
+			if reason, ok := s.stop(); ok {
+				s.stopped(reason, "")
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) stopped(reason, text string) {
+	s.running = false
+	s.stop = nil
+	body := map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true}
+	if text != "" {
+		body["text"] = text
+	}
+	s.event("stopped", body)
+}
+
+// start resumes execution until stop returns true (or forever if it's nil)
+func (s *Server) start(stop func() (string, bool)) (interface{}, error) {
+	if !s.started {
+		return nil, errors.New("not configured yet")
+	}
+	s.running = true
+	s.skipPC = true
+	s.stop = stop
+	return map[string]interface{}{"allThreadsContinued": true}, nil
+}
+
+func (s *Server) resume(args json.RawMessage) (interface{}, error) {
+	return s.start(nil)
+}
+
+// pause stops the target once the response has been sent (see handle)
+func (s *Server) pause(args json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+type stepArguments struct {
+	Granularity string `json:"granularity"`
+}
+
+func (s *Server) depth() int {
+	return len(s.Target.CallStack())
+}
+
+// lineAt returns the source line containing pc, or the zero Line
+func (s *Server) lineAt(pc uint16) symbols.Line {
+	if s.Symbols == nil {
+		return symbols.Line{}
+	}
+	l, _ := s.Symbols.Line(pc)
+	return l
+}
+
+// lineStep returns a stop function for stepping by source lines when there
+// is line info for the current instruction. It stops at the start of a
+// different line, or when the start of the current one is reached again,
+// if within returns true there.
+func (s *Server) lineStep(args json.RawMessage, within func() bool) (func() (string, bool), error) {
+	var a stepArguments
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	start := s.lineAt(s.Target.PC())
+	if a.Granularity == "instruction" || start.File == "" {
+		return nil, nil
+	}
+	return func() (string, bool) {
+		pc := s.Target.PC()
+		l := s.lineAt(pc)
+		if l.File == "" || l.Address != pc || !within() {
+			return "", false
+		}
+		return "step", l != start || pc == start.Address
+	}, nil
+}
+
+func (s *Server) stepIn(args json.RawMessage) (interface{}, error) {
+	stop, err := s.lineStep(args, func() bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	if stop == nil {
+		stop = func() (string, bool) { return "step", true }
+	}
+	return s.start(stop)
+}
+
+// next steps over calls and interrupts: it doesn't stop deeper in the call
+// stack than it started.
+func (s *Server) next(args json.RawMessage) (interface{}, error) {
+	d := s.depth()
+	stop, err := s.lineStep(args, func() bool { return s.depth() <= d })
+	if err != nil {
+		return nil, err
+	}
+	if stop == nil {
+		stop = func() (string, bool) { return "step", s.depth() <= d }
+	}
+	return s.start(func() (string, bool) {
+		if s.depth() < d {
+			return "step", true // returned from the routine
+		}
+		return stop()
+	})
+}
+
+// stepOut runs until the current routine returns. In the outermost routine
+// it steps an instruction.
+func (s *Server) stepOut(args json.RawMessage) (interface{}, error) {
+	d := s.depth()
+	if d == 0 {
+		return s.start(func() (string, bool) { return "step", true })
+	}
+	return s.start(func() (string, bool) { return "step", s.depth() < d })
+}
+
+// reverse runs the target backwards with r once it's stopped
+func (s *Server) reverse(reason string, r func(Reverser) error) (interface{}, error) {
+	rt, ok := s.Target.(Reverser)
+	if !ok {
+		return nil, errors.New("the target can't run backwards")
+	}
+	if !s.started {
+		return nil, errors.New("not configured yet")
+	}
+	if s.running {
+		return nil, errors.New("the target is running")
+	}
+	if err := r(rt); err != nil {
+		return nil, err
+	}
+	s.reversed = reason
+	return nil, nil
+}
+
+func (s *Server) stepBack(args json.RawMessage) (interface{}, error) {
+	return s.reverse("step", Reverser.StepBack)
+}
+
+// reverseContinue runs back to the last write to an address with a data
+// breakpoint, or to the start of the previous frame if there are none.
+// Other breakpoints don't stop it.
+func (s *Server) reverseContinue(args json.RawMessage) (interface{}, error) {
+	if len(s.writeWatches) == 0 {
+		return s.reverse("step", Reverser.StepBackFrame)
+	}
+	return s.reverse("breakpoint", func(r Reverser) error {
+		return r.RunBackToWrite(s.writeWatches...)
+	})
+}
+
+// State
+
+func (s *Server) threads(args json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": "CPU"}}}, nil
+}
+
+func (s *Server) stackTrace(args json.RawMessage) (interface{}, error) {
+	calls := s.Target.CallStack()
+	frames := []stackFrame{}
+	pc := s.Target.PC()
+	for i := 0; i <= len(calls); i++ {
+		name := "?"
+		if i < len(calls) {
+			name = s.name(calls[i].Entry)
+		}
+		if i > 0 {
+			name += " (" + calls[i-1].Kind + ")"
+		}
+		f := stackFrame{ID: i + 1, Name: name, InstructionPointerReference: memoryReference(pc)}
+		if l := s.lineAt(pc); l.File != "" {
+			f.Source = &source{Name: baseName(l.File), Path: l.File}
+			f.Line = l.Line
+		}
+		frames = append(frames, f)
+		if i < len(calls) {
+			pc = calls[i].Caller
+		}
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+func (s *Server) name(address uint16) string {
+	if s.Symbols != nil {
+		if name := s.Symbols.Name(address); name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("$%04X", address)
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndexAny(path, `/\`)+1:]
+}
+
+const registersReference = 1
+
+func (s *Server) scopes(args json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{"scopes": []scope{{Name: "Registers", VariablesReference: registersReference}}}, nil
+}
+
+func (s *Server) variables(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	vars := []variable{}
+	if a.VariablesReference == registersReference {
+		for _, r := range s.Target.Registers() {
+			v := variable{Name: r.Name, Value: r.String()}
+			if r.Bits == 16 {
+				v.MemoryReference = memoryReference(uint16(r.Value))
+			}
+			vars = append(vars, v)
+		}
+	}
+	return map[string]interface{}{"variables": vars}, nil
+}
+
+func (s *Server) setVariable(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	if a.VariablesReference != registersReference {
+		return nil, errors.New("unknown variable")
+	}
+	v, err := s.Target.Evaluate(a.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Target.SetRegister(a.Name, v); err != nil {
+		return nil, err
+	}
+	for _, r := range s.Target.Registers() {
+		if r.Name == a.Name {
+			return map[string]interface{}{"value": r.String()}, nil
+		}
+	}
+	return map[string]interface{}{"value": a.Value}, nil
+}
+
+func (s *Server) evaluate(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Expression string `json:"expression"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	v, err := s.Target.Evaluate(a.Expression)
+	if err != nil {
+		return nil, err
+	}
+	result := fmt.Sprint(v)
+	if v >= 0 {
+		result = fmt.Sprintf("$%X (%d)", v, v)
+	}
+	body := map[string]interface{}{"result": result, "variablesReference": 0}
+	if v >= 0 && v <= 0xffff {
+		body["memoryReference"] = memoryReference(uint16(v))
+	}
+	return body, nil
+}
+
+// Memory
+
+// Memory references are addresses as "0x" hex
+func memoryReference(address uint16) string {
+	return fmt.Sprintf("0x%04X", address)
+}
+
+func parseMemoryReference(ref string) (uint16, error) {
+	s := strings.TrimPrefix(ref, "$")
+	base := 0
+	if s != ref {
+		base = 16
+	}
+	v, err := strconv.ParseUint(s, base, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad memory reference %q", ref)
+	}
+	return uint16(v), nil
+}
+
+func (s *Server) readMemory(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	base, err := parseMemoryReference(a.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+	start := int(base) + a.Offset
+	if start < 0 || start > 0xffff {
+		return map[string]interface{}{"address": fmt.Sprintf("0x%X", start), "unreadableBytes": a.Count}, nil
+	}
+	n := a.Count
+	if n > 0x10000-start {
+		n = 0x10000 - start
+	}
+	data := make([]byte, n)
+	s.Target.ReadMemory(uint16(start), data)
+	return map[string]interface{}{
+		"address":         memoryReference(uint16(start)),
+		"data":            base64.StdEncoding.EncodeToString(data),
+		"unreadableBytes": a.Count - n}, nil
+}
+
+func (s *Server) writeMemory(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Data            string `json:"data"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	base, err := parseMemoryReference(a.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(a.Data)
+	if err != nil {
+		return nil, err
+	}
+	start := int(base) + a.Offset
+	if start < 0 || start+len(data) > 0x10000 {
+		return nil, errors.New("write outside the address space")
+	}
+	s.Target.WriteMemory(uint16(start), data)
+	return map[string]interface{}{"bytesWritten": len(data)}, nil
+}
+
+func (s *Server) disassemble(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		MemoryReference   string `json:"memoryReference"`
+		Offset            int    `json:"offset"`
+		InstructionOffset int    `json:"instructionOffset"`
+		InstructionCount  int    `json:"instructionCount"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	base, err := parseMemoryReference(a.MemoryReference)
+	if err != nil {
+		return nil, err
+	}
+	addr := base + uint16(a.Offset)
+	for i := 0; i > a.InstructionOffset; i-- {
+		addr = s.previousInstruction(addr)
+	}
+	for i := 0; i < a.InstructionOffset; i++ {
+		_, size := s.Target.Disassemble(addr)
+		addr += uint16(size)
+	}
+	instructions := []disassembledInstruction{}
+	var last symbols.Line
+	for i := 0; i < a.InstructionCount; i++ {
+		text, size := s.Target.Disassemble(addr)
+		b := make([]byte, size)
+		s.Target.ReadMemory(addr, b)
+		ins := disassembledInstruction{
+			Address:          memoryReference(addr),
+			InstructionBytes: fmt.Sprintf("% X", b),
+			Instruction:      text}
+		if s.Symbols != nil {
+			ins.Symbol = s.Symbols.Name(addr)
+		}
+		// Only the first instruction of a line gets its location
+		if l := s.lineAt(addr); l.File != "" && l != last {
+			ins.Location = &source{Name: baseName(l.File), Path: l.File}
+			ins.Line = l.Line
+			last = l
+		}
+		instructions = append(instructions, ins)
+		addr += uint16(size)
+	}
+	return map[string]interface{}{"instructions": instructions}, nil
+}
+
+// previousInstruction guesses where the instruction before addr starts.
+// The start of the source line is used if it's known, otherwise the
+// longest instruction that ends at addr.
+func (s *Server) previousInstruction(addr uint16) uint16 {
+	if l := s.lineAt(addr - 1); l.File != "" {
+		start := l.Address
+		for a := start; a != addr; {
+			_, size := s.Target.Disassemble(a)
+			if a+uint16(size) == addr {
+				return a
+			}
+			if a+uint16(size)-start > uint16(l.Size) {
+				break
+			}
+			a += uint16(size)
+		}
+	}
+	for n := 3; n > 1; n-- {
+		if _, size := s.Target.Disassemble(addr - uint16(n)); size == n {
+			return addr - uint16(n)
+		}
+	}
+	return addr - 1
+}
+
+func unmarshal(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(args, v)
+}
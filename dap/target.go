@@ -0,0 +1,355 @@
+package dap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samuel/go-emu/cpu6502"
+	"github.com/samuel/go-emu/z80"
+)
+
+// Target is the CPU being debugged along with the system it's in.
+type Target interface {
+	// Step runs the system for one instruction (or interrupt sequence).
+	Step() error
+	PC() uint16
+	Registers() []Register
+	SetRegister(name string, value int) error
+	// ReadMemory and WriteMemory access memory as the CPU sees it. Reads
+	// must not have side effects.
+	ReadMemory(address uint16, b []byte)
+	WriteMemory(address uint16, b []byte)
+	// Disassemble decodes the instruction at address.
+	Disassemble(address uint16) (text string, size int)
+	// CallStack returns the routines being executed, innermost first, or
+	// nil if calls aren't tracked.
+	CallStack() []Frame
+	// Evaluate evaluates an expression (see cpu6502.Eval) with the
+	// registers and any symbols.
+	Evaluate(expression string) (int, error)
+}
+
+// Watcher is implemented by targets that support data breakpoints on
+// writes. Step returns a cpu6502.ErrBreakpoint error once an instruction has
+// written to a watched address.
+type Watcher interface {
+	// WatchWrites replaces the watched addresses.
+	WatchWrites(addresses []uint16) error
+}
+
+// Reverser is implemented by targets that can run backwards. They stop at
+// instruction boundaries, as Step does, and ignore breakpoints on the way.
+type Reverser interface {
+	// StepBack goes back to the start of the previous instruction.
+	StepBack() error
+	// StepBackFrame goes back to the start of the previous video frame.
+	StepBackFrame() error
+	// RunBackToWrite goes back to just after the last write to any of the
+	// addresses.
+	RunBackToWrite(addresses ...uint16) error
+}
+
+// Rewinder runs a system forwards while recording its history so it can
+// also run backwards, e.g. nes.Rewinder.
+type Rewinder interface {
+	Step() error
+	Reverser
+}
+
+// Register is a CPU register or flag (Bits is 1).
+type Register struct {
+	Name  string
+	Value int
+	Bits  int
+}
+
+func (r Register) String() string {
+	switch r.Bits {
+	case 1:
+		return fmt.Sprint(r.Value)
+	case 8:
+		return fmt.Sprintf("$%02X", r.Value)
+	}
+	return fmt.Sprintf("$%04X", r.Value)
+}
+
+// Frame is a routine in the call stack.
+type Frame struct {
+	Kind   string // how it was entered (JSR, NMI, ...)
+	Entry  uint16 // address of the routine
+	Caller uint16 // address of the calling instruction (or the one interrupted)
+}
+
+type target6502 struct {
+	cpu     *cpu6502.CPU6502
+	memory  cpu6502.MemoryAccess
+	step    func() error
+	watches []int // IDs of the CPU breakpoints for WatchWrites
+}
+
+// New6502Target returns a target for a 6502. memory is the CPU's bus and
+// step runs the system for an instruction (e.g. nes.NESState.Step).
+// Breakpoint conditions and expressions use the CPU's Symbols.
+func New6502Target(cpu *cpu6502.CPU6502, memory cpu6502.MemoryAccess, step func() error) Target {
+	return &target6502{cpu: cpu, memory: memory, step: step}
+}
+
+// NewReversible6502Target is New6502Target for a system that runs through
+// r, so the target can also run backwards.
+func NewReversible6502Target(cpu *cpu6502.CPU6502, memory cpu6502.MemoryAccess, r Rewinder) Target {
+	return &reversible6502{&target6502{cpu: cpu, memory: memory, step: r.Step}, r}
+}
+
+type reversible6502 struct {
+	*target6502
+	Reverser
+}
+
+func (t *target6502) Step() error {
+	return t.step()
+}
+
+func (t *target6502) PC() uint16 {
+	return t.cpu.PC
+}
+
+func (t *target6502) Registers() []Register {
+	cpu := t.cpu
+	return []Register{
+		{"A", int(cpu.A), 8},
+		{"X", int(cpu.X), 8},
+		{"Y", int(cpu.Y), 8},
+		{"SP", int(cpu.SP), 8},
+		{"PC", int(cpu.PC), 16},
+		{"P", int(cpu.GetP()), 8},
+		{"N", boolInt(cpu.SignFlag), 1},
+		{"V", boolInt(cpu.OverflowFlag), 1},
+		{"D", boolInt(cpu.DecimalFlag), 1},
+		{"I", boolInt(cpu.InterruptsDisabledFlag), 1},
+		{"Z", boolInt(cpu.ZeroFlag), 1},
+		{"C", boolInt(cpu.CarryFlag), 1},
+	}
+}
+
+func (t *target6502) SetRegister(name string, value int) error {
+	cpu := t.cpu
+	switch strings.ToUpper(name) {
+	case "A":
+		cpu.A = byte(value)
+	case "X":
+		cpu.X = byte(value)
+	case "Y":
+		cpu.Y = byte(value)
+	case "SP", "S":
+		cpu.SP = byte(value)
+	case "PC":
+		cpu.PC = uint16(value)
+	case "P":
+		cpu.SetP(byte(value))
+	case "N":
+		cpu.SignFlag = value != 0
+	case "V":
+		cpu.OverflowFlag = value != 0
+	case "D":
+		cpu.DecimalFlag = value != 0
+	case "I":
+		cpu.InterruptsDisabledFlag = value != 0
+	case "Z":
+		cpu.ZeroFlag = value != 0
+	case "C":
+		cpu.CarryFlag = value != 0
+	default:
+		return fmt.Errorf("unknown register %q", name)
+	}
+	return nil
+}
+
+func (t *target6502) ReadMemory(address uint16, b []byte) {
+	for i := range b {
+		b[i] = t.memory.ReadByte(address+uint16(i), true)
+	}
+}
+
+func (t *target6502) WriteMemory(address uint16, b []byte) {
+	for i, v := range b {
+		t.memory.WriteByte(address+uint16(i), v)
+	}
+}
+
+func (t *target6502) Disassemble(address uint16) (string, int) {
+	ins := cpu6502.DisassembleOne(t.memory, t.cpu.Variant(), address)
+	name := ins.Opcode.Instruction.Name
+	args := ins.Opcode.FormatArgumentsSymbolic(ins.Value, address+uint16(len(ins.Bytes)), t.cpu.Symbols)
+	if args != "" {
+		name += " " + args
+	}
+	return name, len(ins.Bytes)
+}
+
+func (t *target6502) CallStack() []Frame {
+	var frames []Frame
+	for _, f := range t.cpu.Backtrace().Frames {
+		frames = append(frames, Frame{Kind: f.Kind.String(), Entry: f.Entry, Caller: f.Caller})
+	}
+	return frames
+}
+
+func (t *target6502) Evaluate(expression string) (int, error) {
+	return t.cpu.Evaluate(expression)
+}
+
+func (t *target6502) WatchWrites(addresses []uint16) error {
+	for _, id := range t.watches {
+		t.cpu.RemoveBreakpoint(id)
+	}
+	t.watches = nil
+	for _, a := range addresses {
+		b, err := t.cpu.AddBreakpoint(cpu6502.BreakWrite, a, a, "")
+		if err != nil {
+			return err
+		}
+		t.watches = append(t.watches, b.ID)
+	}
+	return nil
+}
+
+// ErrStepUnsupported is returned by targets that can't run instructions.
+var ErrStepUnsupported = errors.New("dap: stepping isn't supported by this target")
+
+type targetZ80 struct {
+	cpu    *z80.Z80
+	memory z80.MemoryAccess
+}
+
+// NewZ80Target returns a target for a Z80 (or the Game Boy's variant of
+// it) limited to examining and changing registers and memory. z80.Z80
+// doesn't execute instructions yet so Step returns ErrStepUnsupported.
+// Calls aren't tracked so the call stack is always just the current
+// routine, and there's no disassembler yet so instructions are shown as
+// bytes.
+func NewZ80Target(cpu *z80.Z80, memory z80.MemoryAccess) Target {
+	return &targetZ80{cpu: cpu, memory: memory}
+}
+
+func (t *targetZ80) Step() error {
+	return ErrStepUnsupported
+}
+
+func (t *targetZ80) PC() uint16 {
+	return t.cpu.PC
+}
+
+// registers returns pointers to the 8-bit registers by name
+func (t *targetZ80) registers() []struct {
+	name string
+	r    *byte
+} {
+	cpu := t.cpu
+	return []struct {
+		name string
+		r    *byte
+	}{
+		{"A", &cpu.A}, {"F", &cpu.F}, {"B", &cpu.B}, {"C", &cpu.C},
+		{"D", &cpu.D}, {"E", &cpu.E}, {"H", &cpu.H}, {"L", &cpu.L},
+		{"I", &cpu.I}, {"R", &cpu.R},
+		{"A'", &cpu.Ap}, {"F'", &cpu.Fp}, {"B'", &cpu.Bp}, {"C'", &cpu.Cp},
+		{"D'", &cpu.Dp}, {"E'", &cpu.Ep}, {"H'", &cpu.Hp}, {"L'", &cpu.Lp},
+		{"IM", &cpu.IM},
+	}
+}
+
+func (t *targetZ80) Registers() []Register {
+	cpu := t.cpu
+	var regs []Register
+	for _, r := range t.registers() {
+		regs = append(regs, Register{r.name, int(*r.r), 8})
+	}
+	return append(regs,
+		Register{"IX", int(cpu.IX), 16},
+		Register{"IY", int(cpu.IY), 16},
+		Register{"SP", int(cpu.SP), 16},
+		Register{"PC", int(cpu.PC), 16},
+		Register{"IFF1", boolInt(cpu.IFF1), 1},
+		Register{"IFF2", boolInt(cpu.IFF2), 1},
+	)
+}
+
+func (t *targetZ80) SetRegister(name string, value int) error {
+	cpu := t.cpu
+	name = strings.ToUpper(name)
+	for _, r := range t.registers() {
+		if r.name == name {
+			*r.r = byte(value)
+			return nil
+		}
+	}
+	switch name {
+	case "IX":
+		cpu.IX = uint16(value)
+	case "IY":
+		cpu.IY = uint16(value)
+	case "SP":
+		cpu.SP = uint16(value)
+	case "PC":
+		cpu.PC = uint16(value)
+	case "IFF1":
+		cpu.IFF1 = value != 0
+	case "IFF2":
+		cpu.IFF2 = value != 0
+	default:
+		return fmt.Errorf("unknown register %q", name)
+	}
+	return nil
+}
+
+func (t *targetZ80) ReadMemory(address uint16, b []byte) {
+	for i := range b {
+		b[i] = t.memory.ReadByte(address+uint16(i), true)
+	}
+}
+
+func (t *targetZ80) WriteMemory(address uint16, b []byte) {
+	for i, v := range b {
+		t.memory.WriteByte(address+uint16(i), v)
+	}
+}
+
+func (t *targetZ80) Disassemble(address uint16) (string, int) {
+	return fmt.Sprintf("db $%02X", t.memory.ReadByte(address, true)), 1
+}
+
+func (t *targetZ80) CallStack() []Frame {
+	return nil
+}
+
+// Evaluate resolves the registers and the register pairs (AF, BC, DE, HL)
+func (t *targetZ80) Evaluate(expression string) (int, error) {
+	cpu := t.cpu
+	return cpu6502.Eval(expression, func(name string) (int, bool) {
+		name = strings.ToUpper(name)
+		switch name {
+		case "AF":
+			return int(cpu.A)<<8 | int(cpu.F), true
+		case "BC":
+			return int(cpu.B)<<8 | int(cpu.C), true
+		case "DE":
+			return int(cpu.D)<<8 | int(cpu.E), true
+		case "HL":
+			return int(cpu.H)<<8 | int(cpu.L), true
+		}
+		for _, r := range t.Registers() {
+			if r.Name == name {
+				return r.Value, true
+			}
+		}
+		return 0, false
+	})
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -3,15 +3,20 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 
 	// "github.com/samuel/go-emu/z80"
+	"github.com/samuel/go-emu/dap"
 	"github.com/samuel/go-emu/gb"
 )
 
 var (
 	f_trace = flag.Bool("t", false, "print trace while running")
 	f_rom   = flag.String("r", "", "ROM file")
+	f_map   = flag.Bool("m", false, "print the memory map and exit")
+	f_dap   = flag.String("dap", "", "debug with the Debug Adapter Protocol over a TCP address (e.g. localhost:4711) or \"stdio\"")
 )
 
 func parseFlags() {
@@ -23,6 +28,11 @@ func parseFlags() {
 
 func main() {
 	parseFlags()
+	stdout := os.Stdout
+	if *f_dap == "stdio" {
+		// stdout is for the protocol, everything else goes to stderr
+		os.Stdout = os.Stderr
+	}
 	cart, err := gb.LoadCartFile(*f_rom)
 	if err != nil {
 		panic(err)
@@ -34,8 +44,29 @@ func main() {
 	}
 
 	fmt.Println(cart)
+	if *f_map {
+		state.Bus.WriteMemoryMap(os.Stdout)
+		return
+	}
 	fmt.Printf("%+v\n", state)
 
+	if *f_dap != "" {
+		// Registers and memory only until the Z80 core runs instructions
+		server := dap.NewServer(dap.NewZ80Target(state.CPU, state.Bus), nil)
+		if *f_dap == "stdio" {
+			err = server.Serve(struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, stdout})
+		} else {
+			err = server.ListenAndServe(*f_dap)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	for i := 0; i < 10000; i++ {
 		state.Step()
 	}
@@ -1,30 +1,102 @@
 package gb
 
 import (
+	"github.com/samuel/go-emu/bus"
 	"github.com/samuel/go-emu/z80"
 )
 
+// Memory map (16bit buswidth, 0-FFFFh)
+//   0000h-7FFFh   Cartridge ROM (banks 0 and 1)
+//   8000h-9FFFh   Video RAM 8K
+//   A000h-BFFFh   Cartridge RAM 8K
+//   C000h-DFFFh   Work RAM 8K (echoed at E000h-FDFFh)
+//   FE00h-FE9Fh   Sprite attribute table (OAM)
+//   FEA0h-FEFFh   Not usable
+//   FF00h-FF7Fh   I/O ports
+//   FF80h-FFFEh   High RAM
+//   FFFFh         Interrupt enable register
+
 type GBState struct {
-	CPU  *z80.Z80
-	cart *Cart
+	CPU *z80.Z80
+	Bus *bus.Bus
+
+	cart    *Cart
+	vram    [0x2000]byte
+	cartRAM [0x2000]byte
+	wram    [0x2000]byte
+	oam     [0xa0]byte
+	io      [0x80]byte
+	hram    [0x80]byte // FF80h-FFFFh including the interrupt enable register
 }
 
 func New(cart *Cart) (*GBState, error) {
 	state := &GBState{cart: cart}
 
-	state.CPU = z80.New(state)
+	if err := state.mapBus(); err != nil {
+		return nil, err
+	}
+	state.CPU = z80.New(state.Bus)
+	state.Reset()
 
 	return state, nil
 }
 
+// Reset resets the CPU into the state the DMG boot ROM leaves it in when it
+// jumps to the cartridge entry point at $0100 (there's no boot ROM).
+func (gb *GBState) Reset() {
+	cpu := gb.CPU
+	cpu.Reset()
+	cpu.A, cpu.F = 0x01, 0xb0
+	cpu.B, cpu.C = 0x00, 0x13
+	cpu.D, cpu.E = 0x00, 0xd8
+	cpu.H, cpu.L = 0x01, 0x4d
+	cpu.SP = 0xfffe
+	cpu.PC = 0x0100
+}
+
 func (gb *GBState) Step() {
 	gb.CPU.Step()
 }
 
+// mapBus maps the memory map onto the bus. There are no MBCs or I/O
+// devices yet so ROM writes are ignored and the I/O ports are plain memory.
+func (gb *GBState) mapBus() error {
+	b := bus.New(0xff)
+	rom := gb.cart.memory
+	if len(rom) > 0x8000 {
+		rom = rom[:0x8000]
+	}
+	if len(rom) > 0 {
+		if _, err := b.MapMemory("ROM", 0x0000, uint16(len(rom)-1), rom, false); err != nil {
+			return err
+		}
+	}
+	for _, r := range []struct {
+		name       string
+		start, end uint16
+		mem        []byte
+	}{
+		{"VRAM", 0x8000, 0x9fff, gb.vram[:]},
+		{"Cart RAM", 0xa000, 0xbfff, gb.cartRAM[:]},
+		{"WRAM", 0xc000, 0xdfff, gb.wram[:]},
+		{"Echo RAM", 0xe000, 0xfdff, gb.wram[:]},
+		{"OAM", 0xfe00, 0xfe9f, gb.oam[:]},
+		{"I/O", 0xff00, 0xff7f, gb.io[:]},
+		{"HRAM", 0xff80, 0xfffe, gb.hram[:0x7f]},
+		{"IE", 0xffff, 0xffff, gb.hram[0x7f:]},
+	} {
+		if _, err := b.MapMemory(r.name, r.start, r.end, r.mem, true); err != nil {
+			return err
+		}
+	}
+	gb.Bus = b
+	return nil
+}
+
 func (gb *GBState) ReadByte(address uint16, peek bool) byte {
-	return gb.cart.memory[address]
+	return gb.Bus.ReadByte(address, peek)
 }
 
 func (gb *GBState) WriteByte(address uint16, value byte) {
-	gb.cart.memory[address] = value
+	gb.Bus.WriteByte(address, value)
 }
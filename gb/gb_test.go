@@ -0,0 +1,31 @@
+package gb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/samuel/go-emu/z80"
+)
+
+func TestPeekHasNoSideEffects(t *testing.T) {
+	memory := make([]byte, 0x8000)
+	for i := range memory {
+		memory[i] = byte(i)
+	}
+	gb, err := New(&Cart{memory: append([]byte(nil), memory...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gb.CPU.PC != 0x0100 || gb.CPU.SP != 0xfffe || gb.CPU.A != 0x01 {
+		t.Errorf("wrong post boot state %+v", *gb.CPU)
+	}
+	cpu := *gb.CPU
+
+	b := z80.PeekRange(gb, 0, 0x10000)
+	if !bytes.Equal(b[:len(memory)], memory) {
+		t.Errorf("peek returned the wrong cart contents")
+	}
+	if !bytes.Equal(gb.cart.memory, memory) || cpu != *gb.CPU {
+		t.Errorf("peeking changed the state")
+	}
+}
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/samuel/go-emu/cpu6502"
+	"github.com/samuel/go-emu/dap"
 	"github.com/samuel/go-emu/nes"
+	"github.com/samuel/go-emu/symbols"
 )
 
 var (
-	f_trace = flag.Bool("t", false, "print trace while running")
-	f_rom   = flag.String("r", "", "ROM file")
+	f_trace    = flag.Bool("t", false, "print trace while running")
+	f_tracefmt = flag.String("tf", "nestest", "trace format (nestest, fceux or mesen)")
+	f_rom      = flag.String("r", "", "ROM file")
+	f_cycle    = flag.Bool("c", false, "cycle-stepped emulation")
+	f_dis      = flag.Bool("d", false, "print ca65 disassembly of PRG ($8000-$FFFF) and exit")
+	f_map      = flag.Bool("m", false, "print the CPU memory map and exit")
+	f_cdl      = flag.String("cdl", "", "record a code/data log to this .cdl file (adding to it if it exists)")
+	f_prof     = flag.String("prof", "", "write a pprof profile of the emulated program to this file")
+	f_break    = flag.String("b", "", "stop before the first instruction where the condition holds (e.g. \"PC == $C000 && X > 3\")")
+	f_sym      = flag.String("sym", "", "comma separated symbol files (.dbg, .nl or label = $addr) naming addresses")
+	f_dap      = flag.String("dap", "", "debug with the Debug Adapter Protocol over a TCP address (e.g. localhost:4711) or \"stdio\"")
+	f_testrom  = flag.Bool("testrom", false, "exit with the result code of a blargg test ROM and print its message")
 )
 
 func parseFlags() {
@@ -23,6 +39,11 @@ func parseFlags() {
 
 func main() {
 	parseFlags()
+	stdout := os.Stdout
+	if *f_dap == "stdio" {
+		// stdout is for the protocol, everything else goes to stderr
+		os.Stdout = os.Stderr
+	}
 	cart, err := nes.LoadCartFile(*f_rom)
 	if err != nil {
 		panic(err)
@@ -35,77 +56,127 @@ func main() {
 		panic(err)
 	}
 
+	if *f_map {
+		state.Bus.WriteMemoryMap(os.Stdout)
+		return
+	}
+
+	var table *symbols.Table
+	var view *symbols.View
+	if *f_sym != "" {
+		table = symbols.New()
+		for _, filename := range strings.Split(*f_sym, ",") {
+			if err := table.LoadFile(filename, nes.SymbolBanks(cart)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		view = state.Symbols(table)
+		state.CPU.Symbols = view
+	}
+
+	if *f_dis {
+		d := cpu6502.Disassemble(state, state.CPU.Variant(), 0x8000, 0xffff)
+		if state.CPU.Symbols != nil {
+			d.UseSymbols(state.CPU.Symbols)
+		}
+		d.WriteTo(os.Stdout)
+		return
+	}
+
+	state.SetCycleStepped(*f_cycle)
+	state.TestROM = *f_testrom
+	if *f_break != "" {
+		if _, err := state.CPU.AddBreakpoint(cpu6502.BreakExec, 0x0000, 0xffff, *f_break); err != nil {
+			log.Fatal(err)
+		}
+	}
 	fmt.Println(state)
 	// state.CPU.PC = 0xc000
 
-	// for i := 0; i < 10000000; i++ {
-	for {
-		if *f_trace {
-			opcode, val := state.CPU.ReadOpcode()
-			fmt.Printf("%.4X  %02X ", state.CPU.PC, opcode.Opcode)
-			switch opcode.Size {
-			case 2:
-				fmt.Printf("%02X    ", val&0xff)
-			case 3:
-				fmt.Printf("%02X %02X ", val&0xff, val>>8)
-			default:
-				fmt.Printf("      ")
-			}
+	if *f_trace {
+		format, err := cpu6502.ParseTraceFormat(*f_tracefmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		state.CPU.Tracer = cpu6502.NewLogTracer(os.Stdout, format, state.PPUPosition)
+	}
 
-			if opcode.Instruction.Num >= 99 || opcode.Opcode == 0x1a || opcode.Opcode == 0x3a || opcode.Opcode == 0x5a || opcode.Opcode == 0xeb {
-				fmt.Printf("*")
-			} else {
-				fmt.Printf(" ")
-			}
+	var cdl *nes.CDL
+	if *f_cdl != "" {
+		cdl, err = nes.LoadCDLFile(*f_cdl, cart)
+		if os.IsNotExist(err) {
+			cdl, err = nes.NewCDL(cart), nil
+		}
+		if err == nil {
+			err = state.SetCDL(cdl)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *f_prof != "" {
+		state.CPU.Profiler = cpu6502.NewProfiler()
+		state.CPU.Profiler.Bank = state.PRGBank
+		if table != nil {
+			state.CPU.Profiler.Symbol = table.Lookup
+		}
+	}
 
-			mem := ""
-			switch opcode.AddressingMode {
-			case cpu6502.AMZeroPage, cpu6502.AMAbsolute:
-				switch opcode.Instruction.Num {
-				default:
-					mem = fmt.Sprintf("= %02X", state.CPU.ReadByte(val, true))
-				case cpu6502.I_JMP.Num, cpu6502.I_JSR.Num:
-				}
-			case cpu6502.AMIndirect:
-				mem = fmt.Sprintf("= %02X%02X", state.CPU.ReadByte(val+1, true), state.CPU.ReadByte(val, true))
-			case cpu6502.AMIndirectX:
-				addr1 := uint16(byte(val) + state.CPU.X)
-				addr2 := (uint16(state.CPU.ReadByte(addr1, true)) |
-					(uint16(state.CPU.ReadByte((addr1+1)&0xff+(addr1&0xff00), true)) << 8))
-				value := state.CPU.ReadByte(addr2, true)
-				mem = fmt.Sprintf("@ %02X = %04X = %02X", addr1, addr2, value)
-			case cpu6502.AMIndirectY:
-				addr1 := (uint16(state.CPU.ReadByte(val, true)) |
-					(uint16(state.CPU.ReadByte((val+1)&0xff+(val&0xff00), true)) << 8))
-				addr2 := uint16(addr1 + uint16(state.CPU.Y))
-				value := state.CPU.ReadByte(addr2, true)
-				mem = fmt.Sprintf("= %04X @ %04X = %02X", addr1, addr2, value)
-			case cpu6502.AMAbsoluteX:
-				addr := val + uint16(state.CPU.X)
-				value := state.CPU.ReadByte(addr, true)
-				mem = fmt.Sprintf("@ %04X = %02X", addr, value)
-			case cpu6502.AMAbsoluteY:
-				addr := val + uint16(state.CPU.Y)
-				value := state.CPU.ReadByte(addr, true)
-				mem = fmt.Sprintf("@ %04X = %02X", addr, value)
-			case cpu6502.AMZeroPageX:
-				addr := (val + uint16(state.CPU.X)) & 0x00ff
-				value := state.CPU.ReadByte(addr, true)
-				mem = fmt.Sprintf("@ %02X = %02X", addr, value)
-			case cpu6502.AMZeroPageY:
-				addr := (val + uint16(state.CPU.Y)) & 0x00ff
-				value := state.CPU.ReadByte(addr, true)
-				mem = fmt.Sprintf("@ %02X = %02X", addr, value)
+	save := func() {
+		if cdl != nil {
+			if err := cdl.SaveFile(*f_cdl); err != nil {
+				log.Print(err)
 			}
+		}
+		if *f_prof != "" {
+			if err := writeProfile(*f_prof, state.CPU.Profiler); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	// Run through a rewinder so recent history can be stepped back through
+	rewinder := nes.NewRewinder(state)
 
-			fmt.Printf("%s %-27s A:%02X X:%02X Y:%02X P:%02X SP:%02X CYC:%4d SL:%d %s\n",
-				opcode.Instruction.Name, opcode.FormatArguments(val, state.CPU.PC+2)+" "+mem,
-				state.CPU.A, state.CPU.X, state.CPU.Y, state.CPU.GetP(), state.CPU.SP,
-				state.PPUCycle, state.Scanline, state.CPU.FlagString())
+	if *f_dap != "" {
+		server := dap.NewServer(dap.NewReversible6502Target(state.CPU, state, rewinder), view)
+		if *f_dap == "stdio" {
+			err = server.Serve(struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, stdout})
+		} else {
+			err = server.ListenAndServe(*f_dap)
 		}
+		save()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-		state.Step()
+	for {
+		if err := rewinder.Step(); err != nil {
+			save()
+			// CPU errors already include the backtrace
+			var hit *cpu6502.BreakpointHit
+			if errors.As(err, &hit) {
+				fmt.Println(state.CPU.Backtrace().Format(state.CPU.Symbols))
+			}
+			log.Fatal(err)
+		}
 	}
+}
 
-	// cpu6502.Disassemble(cart.PRGPages[len(cart.PRGPages)-1][pc-0xc000:])
+func writeProfile(filename string, p *cpu6502.Profiler) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := p.WriteProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
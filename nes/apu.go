@@ -7,6 +7,12 @@ import (
 const (
 	APU_FRAME_CLOCK_DIVIDER = 89490 // frame clock = cpu clock / clock divider = ~240Hz NTSC
 
+	APU_FRAME_4STEP_CYCLES = 29830 // cpu cycles per 4-step frame sequence
+	APU_FRAME_5STEP_CYCLES = 37282 // cpu cycles per 5-step frame sequence
+
+	// Register 4015 (read)
+	BIT_APU_FRAME_IRQ = 0x40 // Frame interrupt flag (cleared on read)
+
 	// Register 4017
 	BIT_APU_FRAME_RATE        = 0x80 // Frame Rate Select  (0=NTSC=60Hz=240Hz/4, 1=PAL=48Hz=240Hz/5)
 	BIT_APU_FRAME_IRQ_DISABLE = 0x40 // Frame IRQ Disable  (0=Enable Frame IRQ, 1=Disable Frame IRQ)
@@ -15,6 +21,9 @@ const (
 type APUState struct {
 	FrameIRQEnabled bool
 	FrameRate       int // NTSC=4, PAL=5
+
+	frameCycle int  // cpu cycles into the current frame sequence
+	frameIRQ   bool // frame interrupt flag
 }
 
 func NewAPUState() (*APUState, error) {
@@ -24,13 +33,47 @@ func NewAPUState() (*APUState, error) {
 	return state, nil
 }
 
+// Reset restarts the frame sequencer and clears the frame interrupt. The
+// last mode written to $4017 is kept.
+func (apu *APUState) Reset() {
+	apu.frameCycle = 0
+	apu.frameIRQ = false
+}
+
 func (apu *APUState) Pulse(cycles int) {
+	apu.frameCycle += cycles
+	if apu.FrameRate == 4 {
+		if apu.frameCycle >= APU_FRAME_4STEP_CYCLES {
+			apu.frameCycle -= APU_FRAME_4STEP_CYCLES
+			if apu.FrameIRQEnabled {
+				apu.frameIRQ = true
+			}
+		}
+	} else if apu.frameCycle >= APU_FRAME_5STEP_CYCLES {
+		// The 5-step sequence never generates an interrupt
+		apu.frameCycle -= APU_FRAME_5STEP_CYCLES
+	}
+}
+
+// IRQ returns the state of the APU's IRQ output
+func (apu *APUState) IRQ() bool {
+	return apu.frameIRQ
 }
 
 func (apu *APUState) ReadByte(address uint16, peek bool) byte {
 	if address < 0x4000 && address > 0x4017 {
 		panic("Invalid APU address")
 	}
+	if address == 0x4015 {
+		var val byte = 0
+		if apu.frameIRQ {
+			val |= BIT_APU_FRAME_IRQ
+		}
+		if !peek {
+			apu.frameIRQ = false
+		}
+		return val
+	}
 	return 0
 }
 
@@ -40,6 +83,10 @@ func (apu *APUState) WriteByte(address uint16, value byte) {
 	}
 	if address == 0x4017 {
 		apu.FrameIRQEnabled = value&BIT_APU_FRAME_IRQ_DISABLE == 0
+		if !apu.FrameIRQEnabled {
+			apu.frameIRQ = false
+		}
+		apu.frameCycle = 0
 		if value&BIT_APU_FRAME_RATE == 0 {
 			apu.FrameRate = 4
 		} else {
@@ -49,5 +96,5 @@ func (apu *APUState) WriteByte(address uint16, value byte) {
 }
 
 func (apu *APUState) String() string {
-	return fmt.Sprintf("{FrameIRQEnabled:%s FrameRate:%d}", apu.FrameIRQEnabled, apu.FrameRate)
+	return fmt.Sprintf("{FrameIRQEnabled:%t FrameRate:%d}", apu.FrameIRQEnabled, apu.FrameRate)
 }
@@ -0,0 +1,176 @@
+package nes
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/samuel/go-emu/cpu6502"
+)
+
+// Code/Data Logger flags in FCEUX's .cdl format. There's a byte for each
+// byte of PRG-ROM followed by a byte for each byte of CHR-ROM.
+const (
+	// PRG-ROM: xPdcAADC
+	CDL_CODE          = 0x01 // executed (opcodes and operands)
+	CDL_DATA          = 0x02 // read as data
+	CDL_BANK_MASK     = 0x0c // (CPU address >> 13) & 3 of the last access
+	CDL_INDIRECT_CODE = 0x10 // executed after an indirect jump
+	CDL_INDIRECT_DATA = 0x20 // read through a pointer
+	CDL_PCM_DATA      = 0x40 // read by the DMC
+
+	// CHR-ROM: xxxxxxRD
+	CDL_CHR_RENDERED = 0x01 // drawn by the PPU
+	CDL_CHR_READ     = 0x02 // read through $2007
+)
+
+// CDL is a code/data log of which bytes of a cart's PRG-ROM and CHR-ROM
+// have been used and how. It's keyed by ROM offset so it's unaffected by
+// bank switching. FCEUX logs opcodes and operands alike as code so the
+// opcodes are kept separately (they aren't saved).
+type CDL struct {
+	PRG []byte
+	CHR []byte
+
+	opcodes []bool
+}
+
+// NewCDL returns an empty log for the cart.
+func NewCDL(cart *Cart) *CDL {
+	return &CDL{
+		PRG:     make([]byte, len(cart.PRGPages)),
+		CHR:     make([]byte, 8192*len(cart.CHRPages)),
+		opcodes: make([]bool, len(cart.PRGPages)),
+	}
+}
+
+// ReadCDL reads a .cdl file for the cart.
+func ReadCDL(r io.Reader, cart *Cart) (*CDL, error) {
+	cdl := NewCDL(cart)
+	if _, err := io.ReadFull(r, cdl.PRG); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, cdl.CHR); err != nil {
+		return nil, err
+	}
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n != 0 {
+		return nil, fmt.Errorf("nes: CDL is longer than the cart's %d bytes of ROM", len(cdl.PRG)+len(cdl.CHR))
+	}
+	return cdl, nil
+}
+
+// LoadCDLFile reads a .cdl file for the cart.
+func LoadCDLFile(filename string, cart *Cart) (*CDL, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadCDL(file, cart)
+}
+
+// WriteTo writes the log in the .cdl format.
+func (cdl *CDL) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(cdl.PRG)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(cdl.CHR)
+	return int64(n + m), err
+}
+
+// SaveFile writes the log to a .cdl file.
+func (cdl *CDL) SaveFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := cdl.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Opcode returns true if the PRG-ROM byte at offset has been executed as the
+// first byte of an instruction since the log was created.
+func (cdl *CDL) Opcode(offset int) bool {
+	return cdl.opcodes[offset]
+}
+
+// LogPRG records an access by the CPU at address to the PRG-ROM byte at
+// offset.
+func (cdl *CDL) LogPRG(offset int, address uint16, kind cpu6502.AccessKind) {
+	flags := byte(address>>13&3) << 2
+	indirect := kind&cpu6502.AccessIndirect != 0
+	if kind&(cpu6502.AccessOpcode|cpu6502.AccessOperand) != 0 {
+		flags |= CDL_CODE
+		if indirect {
+			flags |= CDL_INDIRECT_CODE
+		}
+	}
+	if kind&cpu6502.AccessData != 0 {
+		flags |= CDL_DATA
+		if indirect {
+			flags |= CDL_INDIRECT_DATA
+		}
+	}
+	cdl.PRG[offset] = cdl.PRG[offset]&^CDL_BANK_MASK | flags
+	if kind&cpu6502.AccessOpcode != 0 {
+		cdl.opcodes[offset] = true
+	}
+}
+
+// LogCHR ORs flags (CDL_CHR_*) into the CHR-ROM byte at offset.
+func (cdl *CDL) LogCHR(offset int, flags byte) {
+	cdl.CHR[offset] |= flags
+}
+
+// Coverage returns the number of PRG-ROM bytes logged as code, as data (but
+// not code) and not logged at all.
+func (cdl *CDL) Coverage() (code, data, unknown int) {
+	for _, f := range cdl.PRG {
+		switch {
+		case f&CDL_CODE != 0:
+			code++
+		case f&CDL_DATA != 0:
+			data++
+		default:
+			unknown++
+		}
+	}
+	return code, data, unknown
+}
+
+// cdlLogger records the CPU's accesses to PRG-ROM in a CDL through the
+// mapper's current banking
+type cdlLogger struct {
+	cdl    *CDL
+	mapper PRGMapper
+}
+
+func (l *cdlLogger) LogAccess(address uint16, kind cpu6502.AccessKind) {
+	if offset := l.mapper.PRGOffset(address); offset >= 0 {
+		l.cdl.LogPRG(offset, address, kind)
+	}
+}
+
+// SetCDL starts recording the CPU's use of PRG-ROM into cdl (which must be
+// for this cart). A nil cdl stops recording. Nothing renders CHR yet so the
+// CHR half of the log is only kept, not updated.
+func (nes *NESState) SetCDL(cdl *CDL) error {
+	if cdl == nil {
+		nes.CPU.AccessLogger = nil
+		return nil
+	}
+	m, ok := nes.mapper.(PRGMapper)
+	if !ok {
+		return fmt.Errorf("nes: mapper %s can't translate addresses for a CDL", nes.mapper)
+	}
+	if len(cdl.PRG) != len(nes.cart.PRGPages) || len(cdl.CHR) != 8192*len(nes.cart.CHRPages) {
+		return fmt.Errorf("nes: CDL is for a different size of cart")
+	}
+	nes.CPU.AccessLogger = &cdlLogger{cdl: cdl, mapper: m}
+	return nil
+}
@@ -13,6 +13,39 @@ type Mapper interface {
 	WriteByte(address uint16, value byte)
 }
 
+// IRQMapper is implemented by mappers that can drive the CPU's IRQ line.
+type IRQMapper interface {
+	IRQ() bool
+}
+
+// ScanlineCounter is implemented by mappers that need to be clocked once per
+// rendered scanline (e.g. the MMC3 IRQ counter).
+type ScanlineCounter interface {
+	ClockScanline()
+}
+
+// PageMapper is implemented by mappers whose PRG ROM can be read directly by
+// the CPU. PRGPage returns the 256 bytes currently mapped at the page
+// containing address ($8000-$FFFF).
+type PageMapper interface {
+	PRGPage(address uint16) []byte
+}
+
+// PRGMapper is implemented by mappers that can translate a CPU address to
+// the offset in the cart's PRG-ROM currently mapped there. PRGOffset returns
+// -1 for addresses outside of PRG-ROM.
+type PRGMapper interface {
+	PRGOffset(address uint16) int
+}
+
+// SnapshotMapper is implemented by mappers with registers that need to be
+// saved in a console Snapshot. Snapshot returns a copy of them that Restore
+// accepts. Mappers that don't implement it have no state besides the cart.
+type SnapshotMapper interface {
+	Snapshot() interface{}
+	Restore(snapshot interface{})
+}
+
 func NewMapper(cart *Cart) (Mapper, error) {
 	switch cart.Mapper {
 	case MAPPER_NROM:
@@ -140,6 +140,26 @@ func (m *MapperMMC1) WriteByte(address uint16, value byte) {
 	m.cart.PRGPages[addr] = value
 }
 
+func (m *MapperMMC1) PRGPage(address uint16) []byte {
+	addr := m.translateAddress(address & 0xff00)
+	return m.cart.PRGPages[addr : addr+256]
+}
+
+func (m *MapperMMC1) PRGOffset(address uint16) int {
+	if address < 0x8000 {
+		return -1
+	}
+	return m.translateAddress(address)
+}
+
+func (m *MapperMMC1) Snapshot() interface{} {
+	return append([]int(nil), m.prg_banks...)
+}
+
+func (m *MapperMMC1) Restore(snapshot interface{}) {
+	copy(m.prg_banks, snapshot.([]int))
+}
+
 func (m *MapperMMC1) translateAddress(address uint16) int {
 	if address < 0x8000 {
 		panic("address out of range")
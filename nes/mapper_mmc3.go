@@ -121,6 +121,12 @@ Notes: - Two of the 8K ROM banks in the PRG area are switchable.
 type MapperMMC3 struct {
 	cart      *Cart
 	prg_banks []int
+
+	irqLatch   byte
+	irqCounter byte
+	irqReload  bool
+	irqEnabled bool
+	irq        bool
 }
 
 func (m *MapperMMC3) String() string {
@@ -141,8 +147,64 @@ func (m *MapperMMC3) ReadByte(address uint16, peek bool) byte {
 }
 
 func (m *MapperMMC3) WriteByte(address uint16, value byte) {
-	addr := m.translateAddress(address)
-	m.cart.PRGPages[addr] = value
+	switch address & 0xe001 {
+	case 0xc000: // IRQ latch
+		m.irqLatch = value
+	case 0xc001: // IRQ reload
+		m.irqCounter = 0
+		m.irqReload = true
+	case 0xe000: // IRQ disable (and acknowledge)
+		m.irqEnabled = false
+		m.irq = false
+	case 0xe001: // IRQ enable
+		m.irqEnabled = true
+	default:
+		addr := m.translateAddress(address)
+		m.cart.PRGPages[addr] = value
+	}
+}
+
+// ClockScanline clocks the IRQ counter. On hardware this is driven by
+// PPU A12 rising edges which happen once per rendered scanline.
+func (m *MapperMMC3) ClockScanline() {
+	if m.irqCounter == 0 || m.irqReload {
+		m.irqCounter = m.irqLatch
+		m.irqReload = false
+	} else {
+		m.irqCounter--
+	}
+	if m.irqCounter == 0 && m.irqEnabled {
+		m.irq = true
+	}
+}
+
+func (m *MapperMMC3) IRQ() bool {
+	return m.irq
+}
+
+func (m *MapperMMC3) PRGPage(address uint16) []byte {
+	addr := m.translateAddress(address & 0xff00)
+	return m.cart.PRGPages[addr : addr+256]
+}
+
+func (m *MapperMMC3) PRGOffset(address uint16) int {
+	if address < 0x8000 {
+		return -1
+	}
+	return m.translateAddress(address)
+}
+
+func (m *MapperMMC3) Snapshot() interface{} {
+	s := *m
+	s.prg_banks = append([]int(nil), m.prg_banks...)
+	return &s
+}
+
+func (m *MapperMMC3) Restore(snapshot interface{}) {
+	s := snapshot.(*MapperMMC3)
+	banks := m.prg_banks
+	*m = *s
+	m.prg_banks = append(banks[:0], s.prg_banks...)
 }
 
 func (m *MapperMMC3) translateAddress(address uint16) int {
@@ -26,6 +26,18 @@ func (m *MapperNROM) WriteByte(address uint16, value byte) {
 	m.cart.PRGPages[addr] = value
 }
 
+func (m *MapperNROM) PRGPage(address uint16) []byte {
+	addr := int(m.translateAddress(address & 0xff00))
+	return m.cart.PRGPages[addr : addr+256]
+}
+
+func (m *MapperNROM) PRGOffset(address uint16) int {
+	if address < 0x8000 {
+		return -1
+	}
+	return int(m.translateAddress(address))
+}
+
 func (m *MapperNROM) translateAddress(address uint16) uint16 {
 	if address < 0x8000 {
 		panic("address out of range")
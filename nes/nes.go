@@ -2,8 +2,10 @@ package nes
 
 import (
 	"fmt"
-	"github.com/samuel/go-emu/cpu6502"
 	"os"
+
+	"github.com/samuel/go-emu/bus"
+	"github.com/samuel/go-emu/cpu6502"
 )
 
 const (
@@ -25,8 +27,16 @@ const (
 	BIT_VRAM_ADDR_INC   = 0x04 // (0=Increment by 1, 1=Increment by 32) - Port 2007h VRAM Address Increment
 	BIT_NM_TBL_SCR_ADDR = 0x03 // (0-3=VRAM 2000h,2400h,2800h,2C00h) - Name Table Scroll Address
 
+	// Register 2001h
+	BIT_SHOW_BG      = 0x08 // (0=Hide, 1=Show) - Background
+	BIT_SHOW_SPRITES = 0x10 // (0=Hide, 1=Show) - Sprites
+
 	// Register 2002h
 	BIT_VBLANK = 0x80
+
+	// Sources driving the CPU IRQ line
+	IRQ_APU_FRAME = 1 << 0
+	IRQ_MAPPER    = 1 << 1
 )
 
 // CPU Memory Map (16bit buswidth, 0-FFFFh)
@@ -44,17 +54,27 @@ type NESState struct {
 	workingRam   [2048]byte // 0000h-07FFh   Internal 2K Work RAM (mirrored to 800h-1FFFh)
 	cartSRAM     [8192]byte // 6000h-7FFFh   Cartridge SRAM Area 8K
 	ppuRegisters [8]byte    // 2000h-2007h (mirrored to 2008h-3fffh)
+	oam          [256]byte  // sprite attributes, at the address in 2003h
+	dmaValue     byte       // byte read by OAM DMA for its next write
 	PPUCycle     int
 	Scanline     int
+	Frame        uint64 // frames completed since power on
 	VBlank       bool
 	VBlankReset  bool
+	cart         *Cart
 	mapper       Mapper
+	Bus          *bus.Bus
 	CPU          *cpu6502.CPU6502
 	apu          *APUState
 
 	ppuNMIEnabled bool
 
-	testing bool
+	// TestROM makes writes to $6000 of a result code below $80 exit the
+	// program with it and prints the message written from $6004 on, as
+	// blargg's test ROMs report them.
+	TestROM bool
+
+	replaying bool // re-executing for a Rewinder so don't repeat test output
 }
 
 func NewNESState(cart *Cart) (*NESState, error) {
@@ -69,28 +89,96 @@ func NewNESState(cart *Cart) (*NESState, error) {
 	}
 
 	state := &NESState{
+		cart:   cart,
 		mapper: mapper,
 		apu:    apu}
 
 	// TODO: Set workingRam to 0xFF except 0x0008=0xf7, 0x0009=0xef, 0x000a=0xdf, 0x000f=0xbf
 
-	state.CPU = cpu6502.NewCPU6502(state)
-	state.CPU.PC = uint16(state.ReadByte(cpu6502.IV_RESET, false)) | (uint16(state.ReadByte(cpu6502.IV_RESET+1, false)) << 8)
-
-	// TODO
-	state.testing = true
+	if err := state.mapBus(); err != nil {
+		return nil, err
+	}
+	state.CPU = cpu6502.NewCPU6502Variant(state.Bus, cpu6502.Variant2A03)
+	state.mapPages()
+	state.clock(state.CPU.PowerOn())
 
 	return state, nil
 }
 
-func (nes *NESState) Step() {
-	cycles, _ := nes.CPU.Step()
+func (nes *NESState) Step() error {
+	cycles, err := nes.CPU.Step()
+	if err != nil && cycles == 0 {
+		return err
+	}
+	if nes.CPU.Tick == nil {
+		nes.clock(cycles)
+	}
+	nes.VBlankReset = false
+	return err
+}
+
+// Reset presses the console's reset button. The CPU runs its reset sequence
+// and the PPU control and mask registers and the APU are cleared. RAM and
+// the cartridge are untouched.
+func (nes *NESState) Reset() {
+	nes.ppuRegisters[0] = 0
+	nes.ppuRegisters[1] = 0
+	nes.ppuNMIEnabled = false
+	nes.updateNMI()
+	nes.apu.Reset()
+	cycles := nes.CPU.Reset()
+	if nes.CPU.Tick == nil {
+		nes.clock(cycles)
+	}
+}
+
+// PPUPosition returns the PPU scanline and dot (0-340).
+func (nes *NESState) PPUPosition() (scanline, dot int) {
+	return nes.Scanline, nes.PPUCycle * 341 / PIXELS_PER_SCANLINE
+}
+
+// PRGBank returns the number of the 8K PRG-ROM bank mapped at address or -1
+// if address isn't in PRG-ROM (or the mapper can't tell).
+func (nes *NESState) PRGBank(address uint16) int {
+	if m, ok := nes.mapper.(PRGMapper); ok {
+		if offset := m.PRGOffset(address); offset >= 0 {
+			return offset / 0x2000
+		}
+	}
+	return -1
+}
+
+// SetCycleStepped switches between running the PPU and APU after each CPU
+// instruction (the default) and running them in lock step with every CPU
+// bus cycle. Cycle-stepped mode is slower but lets reads and writes see
+// the exact state of the other chips mid-instruction.
+func (nes *NESState) SetCycleStepped(enabled bool) {
+	if enabled {
+		nes.CPU.Tick = nes.tick
+	} else {
+		nes.CPU.Tick = nil
+	}
+}
+
+func (nes *NESState) tick() {
+	nes.clock(1)
+}
+
+// clock runs everything but the CPU for the given number of CPU cycles
+func (nes *NESState) clock(cycles int) {
+	nes.apu.Pulse(cycles)
 	nes.PPUCycle += CPU_CYCLES_PER_VIDEO_CYCLE * cycles
 	if nes.PPUCycle >= PIXELS_PER_SCANLINE {
 		nes.PPUCycle -= PIXELS_PER_SCANLINE
+		if sc, ok := nes.mapper.(ScanlineCounter); ok && nes.rendering() {
+			if nes.Scanline < SCANLINE_VBLANK || nes.Scanline == SCANLINES-1 {
+				sc.ClockScanline()
+			}
+		}
 		nes.Scanline++
 		if nes.Scanline >= SCANLINES {
 			nes.Scanline -= SCANLINES
+			nes.Frame++
 			nes.VBlank = false
 		} else if nes.Scanline == SCANLINE_VBLANK /*&& nes.PPUCycle != 0*/ {
 			nes.VBlank = true
@@ -98,92 +186,154 @@ func (nes *NESState) Step() {
 			if nes.VBlankReset && nes.PPUCycle == 3 {
 				nes.VBlank = false
 				// println("AAA")
-			} else {
-				if nes.ppuNMIEnabled {
-					nes.CPU.NMICounter = 2
-				}
 			}
 		}
+		nes.updateNMI()
+	}
+
+	nes.CPU.SetIRQ(IRQ_APU_FRAME, nes.apu.IRQ())
+	if m, ok := nes.mapper.(IRQMapper); ok {
+		nes.CPU.SetIRQ(IRQ_MAPPER, m.IRQ())
 	}
-	nes.VBlankReset = false
 }
 
-func (nes *NESState) ReadByte(address uint16, peek bool) byte {
-	if address >= 0x0000 && address <= 0x07ff {
-		return nes.workingRam[address]
-	}
-	if address >= 0x2000 && address <= 0x3fff {
-		trans := (address - 0x2000) & 7
-		if trans == 2 { // PPU Status Register
-			// 7 = VBlank flag (reset on read and end of vblank)
-			// 6 = sprite 0 hit (1=background-to-Sprite0 collision)
-			// 5 = lost sprites (1=more than 8 sprites in 1 scanline)
-			// 4-0 = unused
-			var val byte = 0
-			if nes.VBlank {
-				val |= BIT_VBLANK
-			}
-			if !peek {
-				nes.VBlank = false
-				nes.VBlankReset = true
-			}
-			return val // VBlank
+// updateNMI sets the CPU's NMI line from the PPU's output, which is
+// asserted during vblank while NMI is enabled
+func (nes *NESState) updateNMI() {
+	nes.CPU.SetNMI(nes.VBlank && nes.ppuNMIEnabled)
+}
+
+// rendering returns true if either the background or sprites are enabled
+func (nes *NESState) rendering() bool {
+	return nes.ppuRegisters[1]&(BIT_SHOW_BG|BIT_SHOW_SPRITES) != 0
+}
+
+// mapBus maps the CPU memory map onto the bus
+func (nes *NESState) mapBus() error {
+	b := bus.New(0)
+	for _, r := range []bus.Region{
+		{Name: "RAM", Start: 0x0000, End: 0x1fff, Mask: 0x07ff, Mem: nes.workingRam[:]},
+		{Name: "PPU", Start: 0x2000, End: 0x3fff, Mask: 0x0007, Read: nes.readPPU, Write: nes.writePPU},
+		{Name: "APU", Start: 0x4000, End: 0x4013, Read: nes.apu.ReadByte, Write: nes.apu.WriteByte},
+		{Name: "OAM DMA", Start: 0x4014, End: 0x4014, Write: nes.writeOAMDMA},
+		{Name: "APU", Start: 0x4015, End: 0x4017, Read: nes.apu.ReadByte, Write: nes.apu.WriteByte},
+		{Name: "SRAM", Start: 0x6000, End: 0x7fff, Mem: nes.cartSRAM[:], Write: nes.writeSRAM},
+		{Name: "PRG", Start: 0x8000, End: 0xffff, Read: nes.mapper.ReadByte, Write: nes.writeMapper},
+	} {
+		if _, err := b.Map(r); err != nil {
+			return err
 		}
-		return nes.ppuRegisters[trans]
 	}
-	if address >= 0x4000 && address <= 0x4017 {
-		return nes.apu.ReadByte(address, peek)
+	nes.Bus = b
+	return nil
+}
+
+func (nes *NESState) ReadByte(address uint16, peek bool) byte {
+	return nes.Bus.ReadByte(address, peek)
+}
+
+func (nes *NESState) WriteByte(address uint16, value byte) {
+	nes.Bus.WriteByte(address, value)
+}
+
+func (nes *NESState) readPPU(address uint16, peek bool) byte {
+	trans := address & 7
+	if trans == 2 { // PPU Status Register
+		// 7 = VBlank flag (reset on read and end of vblank)
+		// 6 = sprite 0 hit (1=background-to-Sprite0 collision)
+		// 5 = lost sprites (1=more than 8 sprites in 1 scanline)
+		// 4-0 = unused
+		var val byte = 0
+		if nes.VBlank {
+			val |= BIT_VBLANK
+		}
+		if !peek {
+			nes.VBlank = false
+			nes.VBlankReset = true
+			nes.updateNMI()
+		}
+		return val // VBlank
 	}
-	if address >= 0x4018 && address <= 0x40ff {
-		// Cartridge Expansion Area - never used?
-		return 0
+	if trans == 4 { // SPR-RAM Data Register
+		return nes.oam[nes.ppuRegisters[3]]
 	}
-	if address >= 0x6000 && address <= 0x7fff {
-		return nes.cartSRAM[address-0x6000]
+	return nes.ppuRegisters[trans]
+}
+
+func (nes *NESState) writePPU(address uint16, value byte) {
+	taddr := address & 7
+	if taddr == 0 {
+		// Enabling NMI during vblank causes one immediately
+		nes.ppuNMIEnabled = value&BIT_NMI_ENABLE != 0
+		nes.updateNMI()
 	}
-	if address >= 0x8000 && address <= 0xffff {
-		return nes.mapper.ReadByte(address, peek)
+	if taddr == 4 {
+		nes.oam[nes.ppuRegisters[3]] = value
+		nes.ppuRegisters[3]++
+		return
 	}
-	panic("unknown address")
+	nes.ppuRegisters[taddr] = value
 }
 
-func (nes *NESState) WriteByte(address uint16, value byte) {
-	switch {
-	case address >= 0x8000 && address <= 0xffff:
-		nes.mapper.WriteByte(address, value)
-	case address >= 0x0000 && address <= 0x07ff:
-		nes.workingRam[address] = value
-	case address >= 0x2000 && address <= 0x3fff:
-		taddr := (address - 0x2000) & 7
-		if taddr == 0 {
-			if value&BIT_NMI_ENABLE > 0 && !nes.ppuNMIEnabled {
-				if nes.VBlank {
-					nes.CPU.NMICounter = 2
-				}
-				nes.ppuNMIEnabled = true
+// writeOAMDMA copies the page written to $4014 to OAM through $2004. The
+// CPU is halted for 513 cycles: one while it halts then 256 reads and
+// writes, plus one more if the first read would fall on an odd cycle.
+func (nes *NESState) writeOAMDMA(address uint16, value byte) {
+	n := 513
+	// The halt is the cycle after this write and the reads have to be on
+	// even cycles
+	if (nes.CPU.BusCycle()+2)&1 != 0 {
+		n++
+	}
+	first := n - 512
+	base := uint16(value) << 8
+	nes.CPU.Halt(n, func(cycle int) {
+		if i := cycle - first; i >= 0 {
+			if i&1 == 0 {
+				nes.dmaValue = nes.Bus.ReadByte(base+uint16(i>>1), false)
 			} else {
-				nes.ppuNMIEnabled = false
+				nes.writePPU(0x2004, nes.dmaValue)
 			}
 		}
-		nes.ppuRegisters[taddr] = value
-	case address >= 0x4000 && address <= 0x4017:
-		nes.apu.WriteByte(address, value)
-	case address >= 0x4018 && address <= 0x40ff:
-		// Cartridge Expansion Area - never used?
-	case address >= 0x6000 && address <= 0x7fff:
-		if nes.testing {
-			if address == 0x6000 {
-				// fmt.Printf("%.2x\n", value)
-				if value < 0x80 {
-					os.Exit(int(value))
-				}
-			} else if address >= 0x6004 {
-				fmt.Printf("%c", value)
+	})
+}
+
+func (nes *NESState) writeSRAM(address uint16, value byte) {
+	if nes.TestROM && !nes.replaying {
+		if address == 0x6000 {
+			// fmt.Printf("%.2x\n", value)
+			if value < 0x80 {
+				os.Exit(int(value))
 			}
+		} else if address >= 0x6004 {
+			fmt.Printf("%c", value)
 		}
-		nes.cartSRAM[address-0x6000] = value
-	default:
-		panic("unknown address")
+	}
+	nes.cartSRAM[address-0x6000] = value
+}
+
+func (nes *NESState) writeMapper(address uint16, value byte) {
+	nes.mapper.WriteByte(address, value)
+	nes.mapPRG() // the write may have switched banks
+}
+
+// mapPages maps RAM, SRAM and PRG ROM into the CPU's page table so it can
+// access them without going through ReadByte and WriteByte. SRAM is only
+// mapped for reads since writes to it are watched for test output.
+func (nes *NESState) mapPages() {
+	nes.CPU.MapPages(0x00, 0x1f, nes.workingRam[:], true)
+	nes.CPU.MapPages(0x60, 0x7f, nes.cartSRAM[:], false)
+	nes.mapPRG()
+}
+
+// mapPRG maps the mapper's current PRG banks into the CPU's page table
+func (nes *NESState) mapPRG() {
+	m, ok := nes.mapper.(PageMapper)
+	if !ok {
+		return
+	}
+	for page := 0x80; page <= 0xff; page++ {
+		nes.CPU.MapPages(byte(page), byte(page), m.PRGPage(uint16(page)<<8), false)
 	}
 }
 
@@ -0,0 +1,353 @@
+package nes
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/samuel/go-emu/cpu6502"
+)
+
+// newTestCart returns an NROM cart with the program assembled at $C000 and
+// the reset vector pointing at it.
+func newTestCart(t testing.TB, source string) *Cart {
+	prog, err := cpu6502.Assemble(".org $C000\n" + source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart := &Cart{PRGPages: make([]byte, 0x4000)}
+	copy(cart.PRGPages, prog.Code)
+	cart.PRGPages[0x3ffc] = 0x00
+	cart.PRGPages[0x3ffd] = 0xc0
+	return cart
+}
+
+func TestCycleStepped(t *testing.T) {
+	cart := newTestCart(t, `
+loop:	LDA $00
+		ADC #$03
+		STA $00
+		INX
+		JMP loop`)
+
+	instruction, err := NewNESState(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cycle, err := NewNESState(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cycle.SetCycleStepped(true)
+
+	for i := 0; i < 100000; i++ {
+		if err := instruction.Step(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cycle.Step(); err != nil {
+			t.Fatal(err)
+		}
+		if instruction.CPU.Registers() != cycle.CPU.Registers() {
+			t.Fatalf("CPU state differs after %d steps: %s != %s", i, instruction.CPU.Registers(), cycle.CPU.Registers())
+		}
+		if instruction.PPUCycle != cycle.PPUCycle || instruction.Scanline != cycle.Scanline {
+			t.Fatalf("PPU position differs after %d steps: %d,%d != %d,%d", i,
+				instruction.Scanline, instruction.PPUCycle, cycle.Scanline, cycle.PPUCycle)
+		}
+	}
+}
+
+func TestPeekHasNoSideEffects(t *testing.T) {
+	for _, mapper := range []byte{MAPPER_NROM, MAPPER_MMC1, MAPPER_MMC3} {
+		cart := newTestCart(t, "NOP")
+		cart.PRGPages = append(cart.PRGPages, cart.PRGPages...)
+		cart.Mapper = mapper
+		nes, err := NewNESState(cart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nes.VBlank = true
+		nes.apu.frameIRQ = true
+		if m, ok := nes.mapper.(*MapperMMC3); ok {
+			m.irq = true
+			m.irqReload = true
+		}
+
+		state := *nes
+		cpu := *nes.CPU
+		apu := *nes.apu
+		m := reflect.ValueOf(nes.mapper).Elem().Interface()
+
+		cpu6502.PeekRange(nes, 0, 0x10000)
+		nes.CPU.ReadOpcode()
+		cpu6502.FormatTrace(nes.CPU, cpu6502.TraceNestest, 0, 0)
+
+		if !reflect.DeepEqual(state, *nes) {
+			t.Errorf("mapper %d: peeking changed the NES state", mapper)
+		}
+		if !reflect.DeepEqual(cpu, *nes.CPU) {
+			t.Errorf("mapper %d: peeking changed the CPU state", mapper)
+		}
+		if !reflect.DeepEqual(apu, *nes.apu) {
+			t.Errorf("mapper %d: peeking changed the APU state", mapper)
+		}
+		if !reflect.DeepEqual(m, reflect.ValueOf(nes.mapper).Elem().Interface()) {
+			t.Errorf("mapper %d: peeking changed the mapper state", mapper)
+		}
+
+		// A real read of $2002 does clear VBlank
+		nes.ReadByte(0x2002, false)
+		if nes.VBlank {
+			t.Errorf("reading $2002 didn't clear VBlank")
+		}
+		// Unmapped addresses read as open bus rather than panicking
+		nes.WriteByte(0x5000, 0x12)
+		if v := nes.ReadByte(0x5000, false); v != 0 {
+			t.Errorf("unmapped read returned $%02X", v)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	nes, err := NewNESState(newTestCart(t, `
+loop:	INX
+		JMP loop`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Power on runs the 7 cycle reset sequence (as at the start of nestest.log)
+	if scanline, dot := nes.PPUPosition(); nes.CPU.PC != 0xC000 || nes.CPU.Cycles != 7 || scanline != 0 || dot != 21 {
+		t.Fatalf("power on PC=$%04X CYC:%d PPU:%d,%d", nes.CPU.PC, nes.CPU.Cycles, scanline, dot)
+	}
+	for i := 0; i < 10; i++ {
+		if err := nes.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nes.WriteByte(0x2000, BIT_NMI_ENABLE)
+	nes.Reset()
+	if nes.CPU.PC != 0xC000 || nes.CPU.SP != 0xFA || nes.ppuNMIEnabled {
+		t.Fatalf("reset didn't restart the program %s", nes.CPU)
+	}
+}
+
+func TestOAMDMA(t *testing.T) {
+	for _, cycleStepped := range []bool{false, true} {
+		nes, err := NewNESState(newTestCart(t, `
+		LDX #0
+fill:	TXA
+		EOR #$FF
+		STA $0300,X
+		INX
+		BNE fill
+		LDA #3
+		STA $4014	; $C00D
+		NOP		; so the next DMA has the other alignment
+		STA $4014
+done:	JMP done	; $C014`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nes.SetCycleStepped(cycleStepped)
+		nes.CPU.ValidateCycles = true // halted cycles aren't the instruction's
+		for nes.CPU.PC != 0xC00D {
+			if err := nes.Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start := nes.CPU.Cycles
+		for nes.CPU.PC != 0xC014 {
+			if err := nes.Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The second DMA halts the JMP's opcode fetch
+		if err := nes.Step(); err != nil {
+			t.Fatal(err)
+		}
+		// One DMA takes 513 cycles and the other 514
+		if cycles := nes.CPU.Cycles - start - (4 + 2 + 4 + 3); cycles != 513+514 {
+			t.Errorf("DMAs took %d cycles with cycle stepping %t", cycles, cycleStepped)
+		}
+		for i, b := range nes.oam {
+			if b != ^byte(i) {
+				t.Fatalf("OAM[%d] is $%02X", i, b)
+			}
+		}
+	}
+}
+
+func BenchmarkStep(b *testing.B) {
+	cart := newTestCart(b, `
+loop:	LDX #0
+inner:	LDA $0200,X
+		CLC
+		ADC $C000,X
+		STA $0200,X
+		INC $10
+		DEX
+		BNE inner
+		JSR sub
+		JMP loop
+sub:	RTS`)
+	state, err := NewNESState(cart)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := state.Step(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "instr/s")
+}
+
+func TestCDL(t *testing.T) {
+	cart := newTestCart(t, `
+loop:	LDA $8100
+		JMP loop`)
+	nes, err := NewNESState(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdl := NewCDL(cart)
+	if err := nes.SetCDL(cdl); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := nes.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// $C000 and $8000 are both PRG offset 0 of the mirrored 16K
+	for offset, flags := range map[int]byte{
+		0x0000: CDL_CODE | 0x08, 0x0001: CDL_CODE | 0x08, 0x0005: CDL_CODE | 0x08,
+		0x0100: CDL_DATA | 0x00,
+		0x0006: 0,
+	} {
+		if cdl.PRG[offset] != flags {
+			t.Errorf("PRG $%04X flags $%02X, expected $%02X", offset, cdl.PRG[offset], flags)
+		}
+	}
+	if !cdl.Opcode(0x0003) || cdl.Opcode(0x0004) {
+		t.Errorf("opcodes weren't told apart from operands")
+	}
+	if code, data, _ := cdl.Coverage(); code != 6 || data != 1 {
+		t.Errorf("coverage %d code, %d data", code, data)
+	}
+
+	var buf bytes.Buffer
+	if _, err := cdl.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != len(cart.PRGPages) {
+		t.Fatalf("CDL is %d bytes", buf.Len())
+	}
+	loaded, err := ReadCDL(bytes.NewReader(buf.Bytes()), cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PRG, cdl.PRG) {
+		t.Errorf("CDL didn't round trip")
+	}
+	if _, err := ReadCDL(bytes.NewReader(append(buf.Bytes(), 0)), cart); err == nil {
+		t.Errorf("a CDL for a larger cart was accepted")
+	}
+}
+
+func TestRewind(t *testing.T) {
+	cart := newTestCart(t, `
+		LDA #$80
+		STA $2000	; enable NMI
+		LDX #0
+loop:	INX
+		STX $0200
+		TXA
+		AND #$3F
+		BNE loop
+write:	INC $10		; every 64 iterations
+		JMP loop
+		.org $C100
+nmi:	INC $11
+		RTI`)
+	cart.PRGPages[0x3ffa] = 0x00
+	cart.PRGPages[0x3ffb] = 0xc1
+	const write = 0xc010
+
+	nes, err := NewNESState(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type point struct {
+		regs  cpu6502.Registers
+		frame uint64
+		ram   [3]byte
+	}
+	now := func() point {
+		return point{nes.CPU.Registers(), nes.Frame, [3]byte{nes.workingRam[0x10], nes.workingRam[0x11], nes.workingRam[0x200]}}
+	}
+	r := NewRewinder(nes)
+	r.Interval = 1000
+	var history []point
+	for nes.Frame < 3 {
+		history = append(history, now())
+		if err := r.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history = append(history, now())
+	check := func(what string, want int) {
+		t.Helper()
+		if p := now(); p != history[want] {
+			t.Fatalf("%s: got %+v instead of %+v", what, p, history[want])
+		}
+	}
+
+	pos := len(history) - 1
+	for i := 0; i < 5; i++ {
+		if err := r.StepBack(); err != nil {
+			t.Fatal(err)
+		}
+		pos--
+		check("StepBack", pos)
+	}
+
+	if err := r.RunBackToWrite(0x0010); err != nil {
+		t.Fatal(err)
+	}
+	for pos--; history[pos].regs.PC != write; pos-- {
+	}
+	pos++
+	check("RunBackToWrite", pos)
+
+	if err := r.StepBackFrame(); err != nil {
+		t.Fatal(err)
+	}
+	frame := history[pos].frame - 1
+	for pos = 0; history[pos].frame != frame; pos++ {
+	}
+	check("StepBackFrame", pos)
+
+	// Running forward again retraces the same steps
+	for pos++; pos < len(history); pos++ {
+		if err := r.Step(); err != nil {
+			t.Fatal(err)
+		}
+		check("Step", pos)
+	}
+
+	// A failed search stays where it started
+	if err := r.RunBackToWrite(0x0300); err == nil {
+		t.Error("RunBackToWrite found a write to $0300")
+	}
+	check("failed RunBackToWrite", len(history)-1)
+
+	if err := r.Seek(r.Oldest()); err != nil {
+		t.Fatal(err)
+	}
+	check("Seek", 0)
+	if err := r.StepBack(); err != ErrNoHistory {
+		t.Errorf("StepBack past the start returned %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package nes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samuel/go-emu/cpu6502"
+)
+
+const (
+	// CPU cycles per NTSC frame (262 scanlines of 341 dots, 3 dots per cycle)
+	CPU_CYCLES_PER_FRAME = SCANLINES * 341 / 3
+
+	REWIND_DEFAULT_INTERVAL = CPU_CYCLES_PER_FRAME
+	REWIND_DEFAULT_LIMIT    = 600 // 10 seconds of snapshots a frame apart
+)
+
+// ErrNoHistory is returned when stepping back past the oldest snapshot.
+var ErrNoHistory = errors.New("nes: no history to step back into")
+
+// Rewinder lets execution run backwards. It takes a snapshot of the console
+// every Interval CPU cycles as it runs (through Rewinder.Step) and steps back
+// by restoring the latest snapshot before the target and replaying forward
+// to it. Emulation is deterministic (there's no controller input yet) so
+// the replay reaches exactly the same state.
+//
+// Positions in the history are CPU cycle counts at instruction boundaries.
+// While replaying, the CPU's Tracer, Profiler and AccessLogger are
+// suspended and breakpoints hit along the way are ignored.
+type Rewinder struct {
+	Interval uint64 // CPU cycles between snapshots
+	Limit    int    // snapshots kept, the oldest are dropped
+
+	nes       *NESState
+	snapshots []*Snapshot // oldest first
+}
+
+// NewRewinder returns a rewinder for nes with a snapshot of its current
+// state.
+func NewRewinder(nes *NESState) *Rewinder {
+	r := &Rewinder{
+		Interval: REWIND_DEFAULT_INTERVAL,
+		Limit:    REWIND_DEFAULT_LIMIT,
+		nes:      nes}
+	r.takeSnapshot()
+	return r
+}
+
+// Step takes a snapshot if one is due and then steps the console.
+func (r *Rewinder) Step() error {
+	cycles := r.nes.CPU.Cycles
+	if len(r.snapshots) == 0 || cycles >= r.last().Cycles()+r.Interval {
+		r.takeSnapshot()
+	}
+	return r.nes.Step()
+}
+
+// Oldest returns the CPU cycle count of the oldest point that can be
+// stepped back to.
+func (r *Rewinder) Oldest() uint64 {
+	return r.snapshots[0].Cycles()
+}
+
+func (r *Rewinder) last() *Snapshot {
+	return r.snapshots[len(r.snapshots)-1]
+}
+
+func (r *Rewinder) takeSnapshot() {
+	var prev *Snapshot
+	if len(r.snapshots) != 0 {
+		prev = r.last()
+		if prev.Cycles() == r.nes.CPU.Cycles {
+			return
+		}
+	}
+	r.snapshots = append(r.snapshots, r.nes.snapshot(prev))
+	if r.Limit > 0 && len(r.snapshots) > r.Limit {
+		n := len(r.snapshots) - r.Limit
+		copy(r.snapshots, r.snapshots[n:])
+		r.snapshots = r.snapshots[:r.Limit]
+	}
+}
+
+// StepBack goes back to the start of the previous instruction (or
+// interrupt sequence).
+func (r *Rewinder) StepBack() error {
+	now := r.nes.CPU.Cycles
+	target, err := r.findBack(now, false, func(stepped bool, hit *cpu6502.BreakpointHit) bool {
+		return true
+	})
+	if err != nil {
+		return r.stay(now, err)
+	}
+	return r.Seek(target)
+}
+
+// StepBackFrame goes back to the first instruction of the previous frame
+// (or as close to it as the history goes).
+func (r *Rewinder) StepBackFrame() error {
+	frame, now := r.nes.Frame, r.nes.CPU.Cycles
+	if frame == 0 {
+		return ErrNoHistory
+	}
+	// The previous frame starts in the interval of the latest snapshot
+	// taken before it, or at the following snapshot
+	j := len(r.snapshots) - 1
+	for j >= 0 && (r.snapshots[j].Cycles() >= now || r.snapshots[j].Frame >= frame-1) {
+		j--
+	}
+	if j >= 0 {
+		positions, err := r.scan(j, r.limit(j, now, 0), func(stepped bool, hit *cpu6502.BreakpointHit) bool {
+			return r.nes.Frame == frame-1
+		})
+		if err != nil {
+			return err
+		}
+		if len(positions) > 0 {
+			return r.Seek(positions[0])
+		}
+	}
+	if next := j + 1; next < len(r.snapshots) && r.snapshots[next].Frame == frame-1 && r.snapshots[next].Cycles() < now {
+		return r.Seek(r.snapshots[next].Cycles())
+	}
+	return r.stay(now, ErrNoHistory)
+}
+
+// RunBackToWrite goes back to just after the last instruction that wrote
+// to any of the addresses, where a write breakpoint on it would have
+// stopped.
+func (r *Rewinder) RunBackToWrite(addresses ...uint16) error {
+	cpu := r.nes.CPU
+	watched := map[uint16]bool{}
+	for _, a := range addresses {
+		b, err := cpu.AddBreakpoint(cpu6502.BreakWrite, a, a, "")
+		if err != nil {
+			return err
+		}
+		defer cpu.RemoveBreakpoint(b.ID)
+		watched[a] = true
+	}
+	now := cpu.Cycles
+	// Only the first breakpoint an instruction hits is reported, which may
+	// be someone else's on the same address
+	target, err := r.findBack(now, true, func(stepped bool, hit *cpu6502.BreakpointHit) bool {
+		return hit != nil && hit.Kind == cpu6502.BreakWrite && watched[hit.Address]
+	})
+	if err == ErrNoHistory {
+		var names []string
+		for _, a := range addresses {
+			names = append(names, fmt.Sprintf("$%04X", a))
+		}
+		err = fmt.Errorf("nes: no write to %s in the history", strings.Join(names, ", "))
+	}
+	if err != nil {
+		return r.stay(now, err)
+	}
+	return r.Seek(target)
+}
+
+// stay returns to cycles, where a search that replayed the history started,
+// and returns err.
+func (r *Rewinder) stay(cycles uint64, err error) error {
+	if r.nes.CPU.Cycles != cycles {
+		if serr := r.Seek(cycles); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// Seek restores the console to its state at the given CPU cycle count,
+// which must be an instruction boundary within the history. Snapshots after
+// it are discarded.
+func (r *Rewinder) Seek(cycles uint64) error {
+	i := len(r.snapshots) - 1
+	for i >= 0 && r.snapshots[i].Cycles() > cycles {
+		i--
+	}
+	if i < 0 {
+		return ErrNoHistory
+	}
+	if _, err := r.scan(i, cycles, nil); err != nil {
+		return err
+	}
+	if r.nes.CPU.Cycles != cycles {
+		return fmt.Errorf("nes: replay reached cycle %d instead of %d", r.nes.CPU.Cycles, cycles)
+	}
+	r.snapshots = r.snapshots[:i+1]
+	return nil
+}
+
+// limit returns where scanning from snapshot i should stop: at the next
+// snapshot (plus extra cycles) or before.
+func (r *Rewinder) limit(i int, before, extra uint64) uint64 {
+	if i+1 < len(r.snapshots) {
+		if next := r.snapshots[i+1].Cycles() + extra; next < before {
+			return next
+		}
+	}
+	return before
+}
+
+// findBack returns the latest position before the given one where match is
+// true. afterStep excludes snapshot positions themselves, for matches that
+// depend on the instruction just executed.
+func (r *Rewinder) findBack(before uint64, afterStep bool, match func(stepped bool, hit *cpu6502.BreakpointHit) bool) (uint64, error) {
+	var extra uint64
+	if afterStep {
+		extra = 1 // a match can be at the next snapshot's position
+	}
+	for i := len(r.snapshots) - 1; i >= 0; i-- {
+		if r.snapshots[i].Cycles() >= before {
+			continue
+		}
+		positions, err := r.scan(i, r.limit(i, before, extra), match)
+		if err != nil {
+			return 0, err
+		}
+		if len(positions) > 0 {
+			return positions[len(positions)-1], nil
+		}
+	}
+	return 0, ErrNoHistory
+}
+
+// scan restores snapshot i and replays while the cycle count is below
+// limit. It returns the positions (the snapshot's and after each step)
+// below limit where match is true. match is told whether an instruction
+// was executed to get there and the breakpoint it hit, if any.
+func (r *Rewinder) scan(i int, limit uint64, match func(stepped bool, hit *cpu6502.BreakpointHit) bool) ([]uint64, error) {
+	nes, cpu := r.nes, r.nes.CPU
+	tracer, profiler, logger := cpu.Tracer, cpu.Profiler, cpu.AccessLogger
+	cpu.Tracer, cpu.Profiler, cpu.AccessLogger = nil, nil, nil
+	nes.replaying = true
+	defer func() {
+		cpu.Tracer, cpu.Profiler, cpu.AccessLogger = tracer, profiler, logger
+		nes.replaying = false
+	}()
+
+	nes.Restore(r.snapshots[i])
+	var positions []uint64
+	if match != nil && match(false, nil) {
+		positions = append(positions, cpu.Cycles)
+	}
+	for cpu.Cycles < limit {
+		before := cpu.Cycles
+		err := nes.Step()
+		var hit *cpu6502.BreakpointHit
+		if err != nil && !errors.As(err, &hit) {
+			return nil, err
+		}
+		if cpu.Cycles == before {
+			// An execution breakpoint stopped before the instruction
+			continue
+		}
+		if match != nil && cpu.Cycles < limit && match(true, hit) {
+			positions = append(positions, cpu.Cycles)
+		}
+	}
+	return positions, nil
+}
@@ -0,0 +1,131 @@
+package nes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Harness for blargg's test ROMs, which report through cartridge RAM: $6000
+// is $80 while the test runs, $81 when the console needs to be reset and
+// the result code (0 for success) when it's done. $6001-$6003 hold DE B0 61
+// once $6000 is valid and a message starts at $6004.
+//
+// Put cpu_interrupts_v2's rom_singles in testdata/cpu_interrupts_v2 (or
+// NES_TESTROM_DIR), as the test-roms CI job does from
+// https://github.com/christopherpow/nes-test-roms. Tests for missing ROMs
+// are skipped unless NES_TESTROM_DIR is set.
+
+// maxTestFrames is how long a test ROM may run before giving up.
+const maxTestFrames = 1000
+
+// resetDelayCycles is how long to wait before pressing reset when asked,
+// about 100 ms.
+const resetDelayCycles = 180000
+
+func runTestROM(t *testing.T, name string) {
+	dir := os.Getenv("NES_TESTROM_DIR")
+	required := dir != ""
+	if !required {
+		dir = "testdata"
+	}
+	cart, err := LoadCartFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) && !required {
+		t.Skipf("%s not found in %s", name, dir)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	status, msg, err := runTestCart(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0 {
+		t.Fatalf("failed with code %d: %s", status, msg)
+	}
+}
+
+// runTestCart runs a test ROM until it reports its result and returns the
+// result code and message.
+func runTestCart(cart *Cart) (byte, string, error) {
+	nes, err := NewNESState(cart)
+	if err != nil {
+		return 0, "", err
+	}
+	nes.SetCycleStepped(true)
+	var resetAt uint64
+	for nes.Frame < maxTestFrames {
+		if err := nes.Step(); err != nil {
+			return 0, "", err
+		}
+		if nes.ReadByte(0x6001, true) != 0xde || nes.ReadByte(0x6002, true) != 0xb0 || nes.ReadByte(0x6003, true) != 0x61 {
+			continue
+		}
+		switch status := nes.ReadByte(0x6000, true); status {
+		case 0x80:
+		case 0x81:
+			if resetAt == 0 {
+				resetAt = nes.CPU.Cycles + resetDelayCycles
+			} else if nes.CPU.Cycles >= resetAt {
+				nes.Reset()
+				resetAt = 0
+			}
+		default:
+			return status, testROMMessage(nes), nil
+		}
+	}
+	return 0, "", fmt.Errorf("didn't finish in %d frames: %s", maxTestFrames, testROMMessage(nes))
+}
+
+func testROMMessage(nes *NESState) string {
+	var msg []byte
+	for addr := uint16(0x6004); addr < 0x8000; addr++ {
+		c := nes.ReadByte(addr, true)
+		if c == 0 {
+			break
+		}
+		msg = append(msg, c)
+	}
+	return string(msg)
+}
+
+func TestInterruptROMs(t *testing.T) {
+	for _, name := range []string{
+		"1-cli_latency.nes",
+		"2-nmi_and_brk.nes",
+		"3-nmi_and_irq.nes",
+		"4-irq_and_dma.nes",
+		"5-branch_delays_irq.nes",
+	} {
+		t.Run(name, func(t *testing.T) {
+			runTestROM(t, filepath.Join("cpu_interrupts_v2", name))
+		})
+	}
+}
+
+func TestRunTestCart(t *testing.T) {
+	// Report like a test ROM: running, then failed with code 3
+	cart := newTestCart(t, `
+		LDA #$80
+		STA $6000
+		LDA #$DE
+		STA $6001
+		LDA #$B0
+		STA $6002
+		LDA #$61
+		STA $6003
+		LDX #0
+copy:	LDA message,X
+		STA $6004,X
+		INX
+		CPX #5
+		BNE copy
+		LDA #3
+		STA $6000
+done:	JMP done
+message: .byte "oops", 0`)
+	status, msg, err := runTestCart(cart)
+	if err != nil || status != 3 || msg != "oops" {
+		t.Errorf("runTestCart returned %d, %q, %v", status, msg, err)
+	}
+}
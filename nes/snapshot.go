@@ -0,0 +1,91 @@
+package nes
+
+import (
+	"bytes"
+
+	"github.com/samuel/go-emu/cpu6502"
+)
+
+// Snapshot is a copy of the whole console's state taken between
+// instructions: the CPU, RAM, SRAM, PPU and APU registers, the mapper's
+// registers and PRG-ROM (which the mappers let the CPU write to).
+type Snapshot struct {
+	CPU      cpu6502.Snapshot
+	PPUCycle int
+	Scanline int
+	Frame    uint64
+
+	workingRam    [2048]byte
+	cartSRAM      [8192]byte
+	ppuRegisters  [8]byte
+	oam           [256]byte
+	dmaValue      byte
+	vblank        bool
+	vblankReset   bool
+	ppuNMIEnabled bool
+	apu           APUState
+	mapper        interface{}
+	prg           []byte
+}
+
+// Cycles returns the CPU cycle count when the snapshot was taken.
+func (s *Snapshot) Cycles() uint64 {
+	return s.CPU.Cycles
+}
+
+// Snapshot returns a copy of the console's state.
+func (nes *NESState) Snapshot() *Snapshot {
+	return nes.snapshot(nil)
+}
+
+// snapshot takes a snapshot that shares PRG-ROM with prev (if any) when it
+// hasn't been written since
+func (nes *NESState) snapshot(prev *Snapshot) *Snapshot {
+	s := &Snapshot{
+		CPU:           nes.CPU.Snapshot(),
+		PPUCycle:      nes.PPUCycle,
+		Scanline:      nes.Scanline,
+		Frame:         nes.Frame,
+		workingRam:    nes.workingRam,
+		cartSRAM:      nes.cartSRAM,
+		ppuRegisters:  nes.ppuRegisters,
+		oam:           nes.oam,
+		dmaValue:      nes.dmaValue,
+		vblank:        nes.VBlank,
+		vblankReset:   nes.VBlankReset,
+		ppuNMIEnabled: nes.ppuNMIEnabled,
+		apu:           *nes.apu,
+	}
+	if prev != nil && bytes.Equal(prev.prg, nes.cart.PRGPages) {
+		s.prg = prev.prg
+	} else {
+		s.prg = append([]byte(nil), nes.cart.PRGPages...)
+	}
+	if m, ok := nes.mapper.(SnapshotMapper); ok {
+		s.mapper = m.Snapshot()
+	}
+	return s
+}
+
+// Restore puts the console back in the state s was taken in. s must have
+// been taken from this console.
+func (nes *NESState) Restore(s *Snapshot) {
+	nes.CPU.Restore(s.CPU)
+	nes.PPUCycle = s.PPUCycle
+	nes.Scanline = s.Scanline
+	nes.Frame = s.Frame
+	nes.workingRam = s.workingRam
+	nes.cartSRAM = s.cartSRAM
+	nes.ppuRegisters = s.ppuRegisters
+	nes.oam = s.oam
+	nes.dmaValue = s.dmaValue
+	nes.VBlank = s.vblank
+	nes.VBlankReset = s.vblankReset
+	nes.ppuNMIEnabled = s.ppuNMIEnabled
+	*nes.apu = s.apu
+	copy(nes.cart.PRGPages, s.prg)
+	if m, ok := nes.mapper.(SnapshotMapper); ok {
+		m.Restore(s.mapper)
+	}
+	nes.mapPRG()
+}
@@ -0,0 +1,32 @@
+package nes
+
+import (
+	"github.com/samuel/go-emu/symbols"
+)
+
+// SymbolBanks converts the banks in symbol files for the cart to the 8K
+// PRG-ROM banks returned by PRGBank.
+func SymbolBanks(cart *Cart) symbols.Banks {
+	prgStart := 16 + len(cart.Trainer)
+	return symbols.Banks{
+		FileOffset: func(offset int) int {
+			offset -= prgStart
+			if offset < 0 || offset >= len(cart.PRGPages) {
+				return -1
+			}
+			return offset / 0x2000
+		},
+		// FCEUX numbers 16K banks
+		NL: func(nlBank int, address uint16) int {
+			if address < 0x8000 {
+				return -1
+			}
+			return nlBank*2 + int(address>>13&1)
+		},
+	}
+}
+
+// Symbols returns table as seen through the mapper's current banking.
+func (nes *NESState) Symbols(table *symbols.Table) *symbols.View {
+	return table.View(nes.PRGBank)
+}
@@ -0,0 +1,277 @@
+// Package pprof writes profiles in the protobuf format read by
+// `go tool pprof` (https://github.com/google/pprof/blob/main/proto/profile.proto).
+// It's a small hand-written encoder so emulated programs can be profiled
+// without depending on the protobuf libraries.
+package pprof
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// ValueType describes the values of a sample (e.g. "cycles", "count").
+type ValueType struct {
+	Type string
+	Unit string
+}
+
+// Function is a routine of the profiled program.
+type Function struct {
+	Name       string
+	SystemName string
+	Filename   string
+	StartLine  int64
+}
+
+// Location is an instruction within a function.
+type Location struct {
+	Address  uint64
+	Function *Function
+	Line     int64
+}
+
+// Sample is a call stack (leaf first) and its values, one per sample type.
+type Sample struct {
+	Location []*Location
+	Value    []int64
+}
+
+// Profile is a profile to encode. Functions and locations are identified
+// by pointer so samples should share them.
+type Profile struct {
+	SampleType        []ValueType
+	Sample            []*Sample
+	PeriodType        ValueType
+	Period            int64
+	TimeNanos         int64
+	DurationNanos     int64
+	Comments          []string
+	DefaultSampleType string
+}
+
+// Write writes the gzipped profile like runtime/pprof does.
+func (p *Profile) Write(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if err := p.WriteUncompressed(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// WriteUncompressed writes the profile without gzip compression.
+func (p *Profile) WriteUncompressed(w io.Writer) error {
+	_, err := w.Write(p.encode())
+	return err
+}
+
+// Field numbers from profile.proto
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileMapping           = 3
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileComment           = 13
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	mappingID           = 1
+	mappingMemoryStart  = 2
+	mappingMemoryLimit  = 3
+	mappingHasFunctions = 7
+
+	locationID        = 1
+	locationMappingID = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+func (p *Profile) encode() []byte {
+	strings := map[string]int64{"": 0}
+	stringTable := []string{""}
+	str := func(s string) int64 {
+		if i, ok := strings[s]; ok {
+			return i
+		}
+		i := int64(len(stringTable))
+		strings[s] = i
+		stringTable = append(stringTable, s)
+		return i
+	}
+
+	// IDs are assigned in order of first use so the output is deterministic
+	locationIDs := map[*Location]uint64{}
+	functionIDs := map[*Function]uint64{}
+	var locations []*Location
+	var functions []*Function
+	for _, s := range p.Sample {
+		for _, l := range s.Location {
+			if _, ok := locationIDs[l]; ok {
+				continue
+			}
+			locationIDs[l] = uint64(len(locations) + 1)
+			locations = append(locations, l)
+			if f := l.Function; f != nil {
+				if _, ok := functionIDs[f]; !ok {
+					functionIDs[f] = uint64(len(functions) + 1)
+					functions = append(functions, f)
+				}
+			}
+		}
+	}
+
+	var b buffer
+	valueType := func(tag int, vt ValueType) {
+		b.message(tag, func(b *buffer) {
+			b.int64(valueTypeType, str(vt.Type))
+			b.int64(valueTypeUnit, str(vt.Unit))
+		})
+	}
+	for _, vt := range p.SampleType {
+		valueType(profileSampleType, vt)
+	}
+	for _, s := range p.Sample {
+		b.message(profileSample, func(b *buffer) {
+			ids := make([]uint64, len(s.Location))
+			for i, l := range s.Location {
+				ids[i] = locationIDs[l]
+			}
+			b.packedUint64(sampleLocationID, ids)
+			values := make([]uint64, len(s.Value))
+			for i, v := range s.Value {
+				values[i] = uint64(v)
+			}
+			b.packedUint64(sampleValue, values)
+		})
+	}
+	// A single mapping covering every address. The functions are already
+	// known so pprof won't try to symbolize it.
+	b.message(profileMapping, func(b *buffer) {
+		b.uint64(mappingID, 1)
+		b.uint64(mappingMemoryStart, 0)
+		b.uint64(mappingMemoryLimit, 1<<63)
+		b.bool(mappingHasFunctions, true)
+	})
+	for _, l := range locations {
+		b.message(profileLocation, func(b *buffer) {
+			b.uint64(locationID, locationIDs[l])
+			b.uint64(locationMappingID, 1)
+			b.uint64(locationAddress, l.Address)
+			if l.Function != nil {
+				b.message(locationLine, func(b *buffer) {
+					b.uint64(lineFunctionID, functionIDs[l.Function])
+					b.int64(lineLine, l.Line)
+				})
+			}
+		})
+	}
+	for _, f := range functions {
+		b.message(profileFunction, func(b *buffer) {
+			b.uint64(functionID, functionIDs[f])
+			b.int64(functionName, str(f.Name))
+			b.int64(functionSystemName, str(f.SystemName))
+			b.int64(functionFilename, str(f.Filename))
+			b.int64(functionStartLine, f.StartLine)
+		})
+	}
+	b.int64(profileTimeNanos, p.TimeNanos)
+	b.int64(profileDurationNanos, p.DurationNanos)
+	valueType(profilePeriodType, p.PeriodType)
+	b.int64(profilePeriod, p.Period)
+	for _, c := range p.Comments {
+		b.int64(profileComment, str(c))
+	}
+	if p.DefaultSampleType != "" {
+		b.int64(profileDefaultSampleType, str(p.DefaultSampleType))
+	}
+	// The string table goes last since encoding everything else fills it
+	for _, s := range stringTable {
+		b.string(profileStringTable, s)
+	}
+	return b
+}
+
+// buffer encodes protobuf fields. Zero scalars are omitted as proto3 does.
+type buffer []byte
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *buffer) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *buffer) key(tag, wire int) {
+	b.varint(uint64(tag)<<3 | uint64(wire))
+}
+
+func (b *buffer) uint64(tag int, x uint64) {
+	if x != 0 {
+		b.key(tag, wireVarint)
+		b.varint(x)
+	}
+}
+
+func (b *buffer) int64(tag int, x int64) {
+	b.uint64(tag, uint64(x))
+}
+
+func (b *buffer) bool(tag int, x bool) {
+	if x {
+		b.uint64(tag, 1)
+	}
+}
+
+// string always writes the field since the string table must keep its
+// empty first entry
+func (b *buffer) string(tag int, s string) {
+	b.key(tag, wireBytes)
+	b.varint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *buffer) packedUint64(tag int, x []uint64) {
+	if len(x) == 0 {
+		return
+	}
+	var p buffer
+	for _, v := range x {
+		p.varint(v)
+	}
+	b.key(tag, wireBytes)
+	b.varint(uint64(len(p)))
+	*b = append(*b, p...)
+}
+
+func (b *buffer) message(tag int, encode func(b *buffer)) {
+	var m buffer
+	encode(&m)
+	b.key(tag, wireBytes)
+	b.varint(uint64(len(m)))
+	*b = append(*b, m...)
+}
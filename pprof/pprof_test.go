@@ -0,0 +1,114 @@
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+// field is a decoded protobuf field
+type field struct {
+	tag   int
+	value uint64 // varint fields
+	bytes []byte // length delimited fields
+}
+
+func decode(t *testing.T, b []byte) []field {
+	var fields []field
+	varint := func() uint64 {
+		var x uint64
+		for shift := uint(0); ; shift += 7 {
+			if len(b) == 0 {
+				t.Fatal("truncated varint")
+			}
+			c := b[0]
+			b = b[1:]
+			x |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return x
+			}
+		}
+	}
+	for len(b) > 0 {
+		key := varint()
+		f := field{tag: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.value = varint()
+		case wireBytes:
+			n := varint()
+			f.bytes, b = b[:n], b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestWrite(t *testing.T) {
+	main := &Function{Name: "main"}
+	sub := &Function{Name: "sub"}
+	call := &Location{Address: 0x8000, Function: main, Line: 1}
+	leaf := &Location{Address: 0x9000, Function: sub}
+	p := &Profile{
+		SampleType: []ValueType{{"cycles", "count"}},
+		Sample: []*Sample{
+			{Location: []*Location{leaf, call}, Value: []int64{300}},
+			{Location: []*Location{call}, Value: []int64{2}},
+		},
+		PeriodType:        ValueType{"cycles", "count"},
+		Period:            1,
+		DefaultSampleType: "cycles",
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var strings []string
+	counts := map[int]int{}
+	var samples [][]field
+	for _, f := range decode(t, b) {
+		counts[f.tag]++
+		switch f.tag {
+		case profileStringTable:
+			strings = append(strings, string(f.bytes))
+		case profileSample:
+			samples = append(samples, decode(t, f.bytes))
+		}
+	}
+	if len(strings) == 0 || strings[0] != "" {
+		t.Fatalf("string table %q doesn't start with the empty string", strings)
+	}
+	if counts[profileLocation] != 2 || counts[profileFunction] != 2 || counts[profileMapping] != 1 {
+		t.Errorf("expected 2 locations, 2 functions and 1 mapping: %v", counts)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("%d samples", len(samples))
+	}
+	// Location IDs are packed varints assigned in order of first use
+	s := samples[0]
+	if len(s) != 2 || s[0].tag != sampleLocationID || !bytes.Equal(s[0].bytes, []byte{1, 2}) ||
+		s[1].tag != sampleValue || !bytes.Equal(s[1].bytes, []byte{0xac, 0x02}) {
+		t.Errorf("first sample encoded as %+v", s)
+	}
+	for _, name := range []string{"cycles", "count", "main", "sub"} {
+		found := false
+		for _, s := range strings {
+			found = found || s == name
+		}
+		if !found {
+			t.Errorf("%q missing from the string table", name)
+		}
+	}
+}
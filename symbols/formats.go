@@ -0,0 +1,234 @@
+package symbols
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReadDbg adds the labels and source lines from ca65/ld65 debug info (ld65
+// --dbgfile). The bank of each comes from where its segment was written in
+// the output file. Equates (constants), imports and lines from macro
+// expansions are skipped.
+func (t *Table) ReadDbg(r io.Reader, banks Banks) error {
+	type segment struct {
+		start int64
+		ooffs int64 // -1 if not written to a file
+	}
+	type label struct {
+		name string
+		val  int64
+		seg  string
+	}
+	type span struct {
+		seg         string
+		start, size int64
+	}
+	type line struct {
+		file  string
+		line  int
+		spans []string
+	}
+	segments := map[string]segment{}
+	files := map[string]string{}
+	spans := map[string]span{}
+	var labels []label
+	var lines []line
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		kind, rest, _ := strings.Cut(s.Text(), "\t")
+		switch kind {
+		case "seg", "sym", "file", "span", "line":
+		default:
+			continue
+		}
+		fields, err := dbgFields(rest)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		number := func(key string) (int64, error) {
+			v, err := parseNumber(fields[key])
+			if err != nil {
+				return 0, fmt.Errorf("line %d: bad %s %s %q", n, kind, key, fields[key])
+			}
+			return v, nil
+		}
+		switch kind {
+		case "seg":
+			seg := segment{ooffs: -1}
+			if seg.start, err = number("start"); err != nil {
+				return err
+			}
+			if _, ok := fields["ooffs"]; ok {
+				if seg.ooffs, err = number("ooffs"); err != nil {
+					return err
+				}
+			}
+			segments[fields["id"]] = seg
+		case "sym":
+			if fields["type"] != "lab" {
+				continue
+			}
+			val, err := number("val")
+			if err != nil {
+				return err
+			}
+			labels = append(labels, label{name: fields["name"], val: val, seg: fields["seg"]})
+		case "file":
+			files[fields["id"]] = fields["name"]
+		case "span":
+			sp := span{seg: fields["seg"]}
+			if sp.start, err = number("start"); err != nil {
+				return err
+			}
+			if sp.size, err = number("size"); err != nil {
+				return err
+			}
+			spans[fields["id"]] = sp
+		case "line":
+			if fields["span"] == "" || fields["type"] == "2" {
+				continue
+			}
+			l, err := number("line")
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line{file: fields["file"], line: int(l), spans: strings.Split(fields["span"], "+")})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	// Records can refer to ones that come later so they're resolved once
+	// everything has been read
+	bank := func(seg segment, offset int64) int {
+		if seg.ooffs < 0 || banks.FileOffset == nil {
+			return -1
+		}
+		return banks.FileOffset(int(seg.ooffs + offset))
+	}
+	for _, l := range labels {
+		b := -1
+		if seg, ok := segments[l.seg]; ok {
+			b = bank(seg, l.val-seg.start)
+		}
+		t.Add(l.name, uint16(l.val), b)
+	}
+	for _, l := range lines {
+		for _, id := range l.spans {
+			sp, ok := spans[id]
+			if !ok {
+				continue
+			}
+			seg, ok := segments[sp.seg]
+			if !ok || sp.size == 0 {
+				continue
+			}
+			t.AddLine(Line{
+				File:    files[l.file],
+				Line:    l.line,
+				Address: uint16(seg.start + sp.start),
+				Bank:    bank(seg, sp.start),
+				Size:    int(sp.size)})
+		}
+	}
+	return nil
+}
+
+// dbgFields splits the key=value,... fields of a .dbg line. Values may be
+// quoted.
+func dbgFields(s string) (map[string]string, error) {
+	fields := map[string]string{}
+	for s != "" {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value in %q", s)
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in %q", s)
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		fields[key] = value
+		s = rest
+	}
+	return fields, nil
+}
+
+// ReadNL adds the labels from an FCEUX name list. Lines are
+// "$ADDR#name#comment", or "$ADDR/size#name#comment" for arrays. nlBank is
+// the FCEUX bank the file is for (game.nes.<hex bank>.nl) or -1 for RAM
+// (game.nes.ram.nl).
+func (t *Table) ReadNL(r io.Reader, nlBank int, banks Banks) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(text, "$") {
+			continue
+		}
+		parts := strings.SplitN(text, "#", 3)
+		if len(parts) < 2 || parts[1] == "" {
+			continue
+		}
+		addr, _, _ := strings.Cut(parts[0], "/")
+		a, err := strconv.ParseUint(addr[1:], 16, 16)
+		if err != nil {
+			return fmt.Errorf("line %d: bad address %q", line, parts[0])
+		}
+		bank := -1
+		if nlBank >= 0 && banks.NL != nil {
+			bank = banks.NL(nlBank, uint16(a))
+		}
+		t.Add(parts[1], uint16(a), bank)
+	}
+	return s.Err()
+}
+
+// ReadSym adds labels from "name = $addr" lines. The address may be given
+// as $BB:AAAA to put it in bank $BB, and in hex ($ or 0x) or decimal.
+// Comments start with ';' and blank lines are ignored.
+func (t *Table) ReadSym(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, ';'); i >= 0 {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("line %d: expected name = address", line)
+		}
+		value = strings.TrimSpace(value)
+		bank := int64(-1)
+		if b, a, ok := strings.Cut(value, ":"); ok {
+			var err error
+			if bank, err = parseNumber(b); err != nil || bank < 0 {
+				return fmt.Errorf("line %d: bad bank %q", line, b)
+			}
+			value = a
+			if !strings.HasPrefix(value, "$") && !strings.HasPrefix(value, "0x") {
+				value = "$" + value
+			}
+		}
+		addr, err := parseNumber(value)
+		if err != nil || addr < 0 || addr > 0xffff {
+			return fmt.Errorf("line %d: bad address %q", line, value)
+		}
+		t.Add(name, uint16(addr), int(bank))
+	}
+	return s.Err()
+}
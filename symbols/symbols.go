@@ -0,0 +1,297 @@
+// Package symbols loads debug symbols (labels) for emulated programs from
+// ca65/ld65 debug info (.dbg), FCEUX name lists (.nl) and simple
+// "label = $addr" files.
+//
+// Labels in banked ROM are scoped by bank so the same address can have a
+// different name in each bank. Bank numbers are whatever the system uses
+// (e.g. the NES numbers 8K PRG-ROM banks) and Banks converts the bank
+// information in each file format to them.
+package symbols
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Symbol is a named address. Bank is -1 for addresses that aren't banked
+// (RAM, I/O, fixed ROM) or whose bank isn't known.
+type Symbol struct {
+	Name    string
+	Address uint16
+	Bank    int
+}
+
+func (s Symbol) String() string {
+	if s.Bank >= 0 {
+		return fmt.Sprintf("%s = $%02X:%04X", s.Name, s.Bank, s.Address)
+	}
+	return fmt.Sprintf("%s = $%04X", s.Name, s.Address)
+}
+
+// Line is a source line that assembled to Size bytes at Address.
+type Line struct {
+	File    string
+	Line    int
+	Address uint16
+	Bank    int
+	Size    int
+}
+
+func (l Line) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// Banks converts the bank information in symbol files to bank numbers. A
+// nil function leaves the symbols it would apply to unbanked.
+type Banks struct {
+	// FileOffset returns the bank of an offset into the ROM file or -1 if
+	// it isn't in banked ROM. ca65 debug info records where each segment
+	// was written in the output file.
+	FileOffset func(offset int) int
+	// NL returns the bank of an address listed in the FCEUX .nl file for
+	// the given FCEUX bank number.
+	NL func(nlBank int, address uint16) int
+}
+
+// Table is a set of symbols.
+type Table struct {
+	symbols   []Symbol
+	byName    map[string][]int
+	byAddress map[uint16][]int
+
+	lines  []Line
+	lineAt map[uint16][]int // lines covering each address
+}
+
+// New returns an empty table.
+func New() *Table {
+	return &Table{
+		byName:    make(map[string][]int),
+		byAddress: make(map[uint16][]int),
+		lineAt:    make(map[uint16][]int)}
+}
+
+// Add adds a symbol. The first name added for an address and bank is the
+// one Lookup returns.
+func (t *Table) Add(name string, address uint16, bank int) {
+	if bank < 0 {
+		bank = -1
+	}
+	for _, i := range t.byName[name] {
+		if s := t.symbols[i]; s.Address == address && s.Bank == bank {
+			return
+		}
+	}
+	i := len(t.symbols)
+	t.symbols = append(t.symbols, Symbol{Name: name, Address: address, Bank: bank})
+	t.byName[name] = append(t.byName[name], i)
+	t.byAddress[address] = append(t.byAddress[address], i)
+}
+
+// Len returns the number of symbols.
+func (t *Table) Len() int {
+	return len(t.symbols)
+}
+
+// Symbols returns the symbols ordered by bank and address.
+func (t *Table) Symbols() []Symbol {
+	out := append([]Symbol(nil), t.symbols...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Bank != out[j].Bank {
+			return out[i].Bank < out[j].Bank
+		}
+		return out[i].Address < out[j].Address
+	})
+	return out
+}
+
+// Lookup returns the name of address in bank or "" if it has none. Symbols
+// in the bank are preferred to unbanked ones. If bank is -1 (unknown) a
+// symbol from any bank will do.
+func (t *Table) Lookup(address uint16, bank int) string {
+	unbanked, any := "", ""
+	for _, i := range t.byAddress[address] {
+		s := t.symbols[i]
+		switch {
+		case s.Bank == bank && bank >= 0:
+			return s.Name
+		case s.Bank < 0 && unbanked == "":
+			unbanked = s.Name
+		case any == "":
+			any = s.Name
+		}
+	}
+	if unbanked != "" || bank >= 0 {
+		return unbanked
+	}
+	return any
+}
+
+// Find returns the symbol with the given name. If the name is used in
+// several banks the first one added is returned.
+func (t *Table) Find(name string) (Symbol, bool) {
+	if i, ok := t.byName[name]; ok {
+		return t.symbols[i[0]], true
+	}
+	return Symbol{}, false
+}
+
+// AddLine adds a source line.
+func (t *Table) AddLine(l Line) {
+	if l.Bank < 0 {
+		l.Bank = -1
+	}
+	i := len(t.lines)
+	t.lines = append(t.lines, l)
+	for a := 0; a < l.Size; a++ {
+		addr := l.Address + uint16(a)
+		t.lineAt[addr] = append(t.lineAt[addr], i)
+	}
+}
+
+// HasLines returns true if the table has any source lines.
+func (t *Table) HasLines() bool {
+	return len(t.lines) != 0
+}
+
+// Line returns the source line that assembled to the byte at address in
+// bank, choosing banks like Lookup. If several lines cover it (e.g. a macro
+// call and the line that called it) the one with the fewest bytes wins.
+func (t *Table) Line(address uint16, bank int) (Line, bool) {
+	best := -1
+	rank := func(l Line) int {
+		switch {
+		case l.Bank == bank && bank >= 0:
+			return 0
+		case l.Bank < 0:
+			return 1
+		case bank < 0:
+			return 2
+		}
+		return -1
+	}
+	for _, i := range t.lineAt[address] {
+		r := rank(t.lines[i])
+		if r < 0 {
+			continue
+		}
+		if best < 0 || r < rank(t.lines[best]) || r == rank(t.lines[best]) && t.lines[i].Size < t.lines[best].Size {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Line{}, false
+	}
+	return t.lines[best], true
+}
+
+// LineAddresses returns the code assembled from a line of a source file.
+// file matches the recorded name if either is a path ending in the other,
+// so an absolute path matches the relative one ca65 recorded.
+func (t *Table) LineAddresses(file string, line int) []Line {
+	var out []Line
+	for _, l := range t.lines {
+		if l.Line == line && sameFile(l.File, file) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// sameFile returns true if the paths are the same or one ends with the
+// other
+func sameFile(a, b string) bool {
+	a, b = filepath.ToSlash(filepath.Clean(a)), filepath.ToSlash(filepath.Clean(b))
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	return a == b || strings.HasSuffix(a, "/"+strings.TrimPrefix(b, "./"))
+}
+
+// View returns the table as seen through the CPU's current memory map.
+// bank returns the bank mapped at an address (or -1), nil if nothing is
+// banked.
+func (t *Table) View(bank func(address uint16) int) *View {
+	return &View{Table: t, bank: bank}
+}
+
+// View looks up symbols at CPU addresses using the banks currently mapped.
+// It satisfies cpu6502.Symbols.
+type View struct {
+	Table *Table
+	bank  func(address uint16) int
+}
+
+// Name returns the name of address in the bank mapped there or "".
+func (v *View) Name(address uint16) string {
+	bank := -1
+	if v.bank != nil {
+		bank = v.bank(address)
+	}
+	return v.Table.Lookup(address, bank)
+}
+
+// Address returns the address of a symbol.
+func (v *View) Address(name string) (uint16, bool) {
+	s, ok := v.Table.Find(name)
+	return s.Address, ok
+}
+
+// Line returns the source line that assembled to the byte at address in the
+// bank mapped there.
+func (v *View) Line(address uint16) (Line, bool) {
+	bank := -1
+	if v.bank != nil {
+		bank = v.bank(address)
+	}
+	return v.Table.Line(address, bank)
+}
+
+// LoadFile adds the symbols from a file. The format is chosen by the
+// extension: .dbg for ca65 debug info, .nl for FCEUX name lists (whose
+// bank comes from the file name: game.nes.ram.nl or game.nes.<hex bank>.nl),
+// and anything else is read as "label = $addr" lines.
+func (t *Table) LoadFile(filename string, banks Banks) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".dbg":
+		err = t.ReadDbg(f, banks)
+	case ".nl":
+		bank := -1
+		ext := filepath.Ext(strings.TrimSuffix(filename, filepath.Ext(filename)))
+		if ext != "" && !strings.EqualFold(ext, ".ram") {
+			n, err := strconv.ParseInt(ext[1:], 16, 32)
+			if err != nil {
+				return fmt.Errorf("symbols: can't tell the bank of %s", filename)
+			}
+			bank = int(n)
+		}
+		err = t.ReadNL(f, bank, banks)
+	default:
+		err = t.ReadSym(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	return nil
+}
+
+// parseNumber parses $hex, 0xhex or decimal
+func parseNumber(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "$"):
+		return strconv.ParseInt(s[1:], 16, 64)
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		return strconv.ParseInt(s[2:], 16, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -0,0 +1,193 @@
+package symbols
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 8K banks of a 32K PRG-ROM after a 16 byte iNES header
+var testBanks = Banks{
+	FileOffset: func(offset int) int {
+		if offset < 16 || offset >= 16+0x8000 {
+			return -1
+		}
+		return (offset - 16) / 0x2000
+	},
+	NL: func(nlBank int, address uint16) int {
+		return nlBank*2 + int(address>>13&1)
+	},
+}
+
+func TestLookup(t *testing.T) {
+	table := New()
+	table.Add("bank0_init", 0x8000, 0)
+	table.Add("bank1_init", 0x8000, 1)
+	table.Add("player_x", 0x0010, -1)
+	table.Add("player_x", 0x0010, -1)
+	if table.Len() != 3 {
+		t.Errorf("Len() = %d instead of 3", table.Len())
+	}
+	for _, tc := range []struct {
+		addr uint16
+		bank int
+		want string
+	}{
+		{0x8000, 0, "bank0_init"},
+		{0x8000, 1, "bank1_init"},
+		{0x8000, 2, ""},
+		{0x8000, -1, "bank0_init"},
+		{0x0010, -1, "player_x"},
+		{0x0010, 3, "player_x"},
+		{0x0011, -1, ""},
+	} {
+		if s := table.Lookup(tc.addr, tc.bank); s != tc.want {
+			t.Errorf("Lookup($%04X, %d) = %q instead of %q", tc.addr, tc.bank, s, tc.want)
+		}
+	}
+	if s, ok := table.Find("bank1_init"); !ok || s.Address != 0x8000 || s.Bank != 1 {
+		t.Errorf("Find(bank1_init) = %s, %v", s, ok)
+	}
+
+	bank := 1
+	view := table.View(func(address uint16) int {
+		if address < 0x8000 {
+			return -1
+		}
+		return bank
+	})
+	if s := view.Name(0x8000); s != "bank1_init" {
+		t.Errorf("Name($8000) = %q with bank 1 mapped", s)
+	}
+	bank = 0
+	if s := view.Name(0x8000); s != "bank0_init" {
+		t.Errorf("Name($8000) = %q with bank 0 mapped", s)
+	}
+	if a, ok := view.Address("player_x"); !ok || a != 0x10 {
+		t.Errorf("Address(player_x) = $%04X, %v", a, ok)
+	}
+}
+
+func TestReadDbg(t *testing.T) {
+	dbg := `version	major=2,minor=0
+info	csym=0,file=1,lib=0,line=0,mod=1,scope=1,seg=3,span=0,sym=5,type=0
+file	id=0,name="game.s",size=100,mtime=0x5F000000,mod=0
+sym	id=0,name="reset",addrsize=absolute,scope=0,def=1,val=0xE000,seg=1,type=lab
+sym	id=1,name="update_player",addrsize=absolute,scope=0,def=2,val=0x8123,seg=0,type=lab
+sym	id=2,name="player_x",addrsize=zeropage,scope=0,def=3,val=0x10,seg=2,type=lab
+sym	id=3,name="SPEED",addrsize=zeropage,scope=0,def=4,val=0x3,type=equ
+sym	id=4,name="ext",addrsize=absolute,scope=0,ref=5,type=imp
+seg	id=0,name="CODE",start=0x008000,size=0x2000,addrsize=absolute,type=ro,oname="game.nes",ooffs=16
+seg	id=1,name="FIXED",start=0x00E000,size=0x2000,addrsize=absolute,type=ro,oname="game.nes",ooffs=24592
+seg	id=2,name="ZEROPAGE",start=0x000010,size=0x0010,addrsize=zeropage,type=rw
+file	id=1,name="src/player.s",size=200,mtime=0x5F000000,mod=0
+span	id=0,seg=0,start=291,size=3
+span	id=1,seg=0,start=294,size=2
+span	id=2,seg=0,start=291,size=5
+line	id=0,file=1,line=12,span=0
+line	id=1,file=1,line=13,span=1
+line	id=2,file=1,line=20,type=2,span=2
+line	id=3,file=1,line=11
+`
+	table := New()
+	if err := table.ReadDbg(strings.NewReader(dbg), testBanks); err != nil {
+		t.Fatal(err)
+	}
+	want := []Symbol{
+		{"player_x", 0x0010, -1},
+		{"update_player", 0x8123, 0},
+		{"reset", 0xe000, 3},
+	}
+	checkSymbols(t, table, want)
+
+	if l, ok := table.Line(0x8124, 0); !ok || l != (Line{"src/player.s", 12, 0x8123, 0, 3}) {
+		t.Errorf("Line($8124) = %+v, %v", l, ok)
+	}
+	if l, ok := table.Line(0x8126, 1); ok {
+		t.Errorf("Line($8126) in the wrong bank = %+v", l)
+	}
+	if lines := table.LineAddresses("/home/me/game/src/player.s", 13); len(lines) != 1 || lines[0].Address != 0x8126 {
+		t.Errorf("LineAddresses(player.s, 13) = %v", lines)
+	}
+	if lines := table.LineAddresses("player.s", 11); len(lines) != 0 {
+		t.Errorf("Line without code has addresses %v", lines)
+	}
+}
+
+func TestReadNL(t *testing.T) {
+	table := New()
+	nl := "$8000#bank2_init#Set up bank 2\n$A010/10#table#\n$C000##comment only\n"
+	if err := table.ReadNL(strings.NewReader(nl), 1, testBanks); err != nil {
+		t.Fatal(err)
+	}
+	ram := "$0010#player_x#\n"
+	if err := table.ReadNL(strings.NewReader(ram), -1, testBanks); err != nil {
+		t.Fatal(err)
+	}
+	checkSymbols(t, table, []Symbol{
+		{"player_x", 0x0010, -1},
+		{"bank2_init", 0x8000, 2},
+		{"table", 0xa010, 3},
+	})
+}
+
+func TestReadSym(t *testing.T) {
+	table := New()
+	sym := `; generic symbols
+PPUCTRL = $2000
+player_x=0x10   ; zero page
+nmi = $03:E123
+count = 256
+
+`
+	if err := table.ReadSym(strings.NewReader(sym)); err != nil {
+		t.Fatal(err)
+	}
+	checkSymbols(t, table, []Symbol{
+		{"player_x", 0x0010, -1},
+		{"count", 0x0100, -1},
+		{"PPUCTRL", 0x2000, -1},
+		{"nmi", 0xe123, 3},
+	})
+	if err := table.ReadSym(strings.NewReader("oops $1234\n")); err == nil {
+		t.Error("Expected an error for a line without =")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"game.nes.ram.nl": "$0010#player_x#\n",
+		"game.nes.1.nl":   "$8000#bank2_init#\n",
+		"game.sym":        "PPUCTRL = $2000\n",
+	}
+	table := New()
+	for name, data := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := table.LoadFile(filename, testBanks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSymbols(t, table, []Symbol{
+		{"player_x", 0x0010, -1},
+		{"PPUCTRL", 0x2000, -1},
+		{"bank2_init", 0x8000, 2},
+	})
+}
+
+func checkSymbols(t *testing.T, table *Table, want []Symbol) {
+	t.Helper()
+	got := table.Symbols()
+	if len(got) != len(want) {
+		t.Fatalf("Got symbols %v instead of %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Symbol %d is %s instead of %s", i, got[i], want[i])
+		}
+	}
+}
@@ -25,17 +25,45 @@ type Z80 struct {
 	Hp byte // H'
 	Lp byte // L'
 
+	IFF1 bool // interrupts enabled
+	IFF2 bool // copy of IFF1 saved during an NMI
+	IM   byte // interrupt mode (0-2)
+
 	memory MemoryAccess
 }
 
+// New returns a CPU in its power on state.
 func New(memory MemoryAccess) *Z80 {
 	cpu := &Z80{
 		memory: memory,
-		PC:     0x100,
 	}
+	cpu.PowerOn()
 	return cpu
 }
 
+// PowerOn sets the registers to their power on state (AF and SP are $FFFF,
+// the rest are cleared) and resets the CPU. It returns the number of
+// T-states used.
+func (cpu *Z80) PowerOn() int {
+	*cpu = Z80{memory: cpu.memory}
+	cpu.A, cpu.F = 0xff, 0xff
+	cpu.SP = 0xffff
+	return cpu.Reset()
+}
+
+// Reset clears PC, I and R, disables interrupts and selects interrupt mode
+// 0. The other registers are unchanged. It returns the number of T-states
+// used.
+func (cpu *Z80) Reset() int {
+	cpu.PC = 0
+	cpu.I = 0
+	cpu.R = 0
+	cpu.IFF1 = false
+	cpu.IFF2 = false
+	cpu.IM = 0
+	return 3
+}
+
 func (cpu *Z80) Step() (int, error) {
 	opcode := cpu.memory.ReadByte(cpu.PC, false)
 	cpu.PC += 1
@@ -30,3 +30,17 @@ func TestStack(t *testing.T) {
 	cpu := New(memory)
 	_ = cpu
 }
+
+func TestReset(t *testing.T) {
+	cpu := New(NewTestMemory(nil))
+	if cpu.PC != 0 || cpu.SP != 0xffff || cpu.A != 0xff || cpu.F != 0xff {
+		t.Errorf("wrong power on state %+v", cpu)
+	}
+	cpu.PC = 0x1234
+	cpu.B = 0x12
+	cpu.IFF1, cpu.IM = true, 2
+	cpu.Reset()
+	if cpu.PC != 0 || cpu.B != 0x12 || cpu.IFF1 || cpu.IM != 0 {
+		t.Errorf("wrong state after reset %+v", cpu)
+	}
+}